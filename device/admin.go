@@ -0,0 +1,282 @@
+package device
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/pkg/errors"
+)
+
+// Page-sizes for listing Devices using the admin API.
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 500
+)
+
+// adminFilterFields are the Device fields Devices can be listed by.
+var adminFilterFields = []string{"status", "sku", "lot", "itemID", "tenantID"}
+
+// PageReader reads Devices in pages ordered by _id.
+type PageReader interface {
+	// FindPage returns up to limit Devices matching filter, with _ids
+	// greater than after, or from the first Device if after is NilObjectID.
+	FindPage(
+		filter map[string]interface{}, after objectid.ObjectID, limit int,
+	) ([]*Device, error)
+}
+
+// pageFilter adds the condition for _ids greater than after to a copy of filter.
+func pageFilter(
+	filter map[string]interface{}, after objectid.ObjectID,
+) map[string]interface{} {
+	paged := map[string]interface{}{}
+	for k, v := range filter {
+		paged[k] = v
+	}
+	if after != objectid.NilObjectID {
+		paged["_id"] = map[string]interface{}{"$gt": after}
+	}
+	return paged
+}
+
+// devicePage is the response for listed Devices.
+type devicePage struct {
+	Devices []json.RawMessage `json:"devices"`
+	// NextCursor continues listing after this page,
+	// and is blank on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// adminHandler serves the read-only admin API.
+type adminHandler struct {
+	reader  PageReader
+	fetcher EventFetcher
+	token   []byte
+}
+
+// NewAdminHandler creates the read-only admin HTTP API for inspecting Devices.
+// Requests must have the header "Authorization: Bearer <token>".
+//
+//	GET /devices/{deviceID}
+//	GET /devices?status=&sku=&lot=&itemID=&tenantID=&limit=&cursor=
+//	GET /devices/{deviceID}/state?version=&at=
+//
+// The first two accept "fields", a comma-separated list of Device fields to
+// return. Lists are ordered by _id, and continued using the "nextCursor" of the
+// previous page as "cursor".
+// The last returns the DeviceState as of an event-version and/or an RFC3339
+// time, replaying events from fetcher. It is not served if fetcher is nil.
+func NewAdminHandler(
+	reader PageReader, fetcher EventFetcher, token string,
+) (http.Handler, error) {
+	if reader == nil {
+		return nil, errors.New("reader cannot be nil")
+	}
+	if token == "" {
+		return nil, errors.New("token cannot be blank")
+	}
+	return &adminHandler{
+		reader:  reader,
+		fetcher: fetcher,
+		token:   []byte(token),
+	}, nil
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !checkBearer(w, r, h.token) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeHTTPError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "devices":
+		h.listDevices(w, r)
+	case strings.HasPrefix(path, "devices/") && !strings.Contains(path[8:], "/"):
+		h.getDevice(w, r, path[8:])
+	case strings.HasPrefix(path, "devices/") && strings.HasSuffix(path, "/state") &&
+		h.fetcher != nil:
+		h.getDeviceState(w, r, strings.TrimSuffix(path[8:], "/state"))
+	default:
+		writeHTTPError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (h *adminHandler) getDevice(w http.ResponseWriter, r *http.Request, id string) {
+	deviceID, err := uuuid.FromString(id)
+	if err != nil {
+		err = errors.Wrap(err, "Error parsing deviceID")
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+	fields := parseFields(r.URL.Query().Get("fields"))
+
+	devices, err := h.reader.FindPage(
+		map[string]interface{}{"deviceID": deviceID.String()}, objectid.NilObjectID, 1,
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Error finding Device")
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(devices) == 0 {
+		err = errors.Errorf("device %s not found", deviceID)
+		writeHTTPError(w, http.StatusNotFound, err)
+		return
+	}
+
+	device, err := projectDevice(devices[0], fields)
+	if err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, device)
+}
+
+func (h *adminHandler) getDeviceState(
+	w http.ResponseWriter, r *http.Request, id string,
+) {
+	deviceID, err := uuuid.FromString(id)
+	if err != nil {
+		err = errors.Wrap(err, "Error parsing deviceID")
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+	at, err := ParsePointInTime(r.URL.Query().Get("version"), r.URL.Query().Get("at"))
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	state, err := StateAt(h.fetcher, deviceID, at)
+	if err != nil {
+		err = errors.Wrap(err, "Error reconstructing Device")
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if state == nil {
+		err = errors.Errorf("device %s not found", deviceID)
+		writeHTTPError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, state)
+}
+
+// ParsePointInTime parses an event-version and an RFC3339 time,
+// either of which can be blank.
+func ParsePointInTime(version string, at string) (PointInTime, error) {
+	p := PointInTime{}
+	if version != "" {
+		v, err := strconv.ParseInt(version, 10, 64)
+		if err != nil || v < 1 {
+			return p, errors.New("version must be a positive integer")
+		}
+		p.Version = v
+	}
+	if at != "" {
+		t, err := time.Parse(time.RFC3339Nano, at)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing time")
+			return p, err
+		}
+		p.Time = t
+	}
+	return p, nil
+}
+
+func (h *adminHandler) listDevices(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := map[string]interface{}{}
+	for _, field := range adminFilterFields {
+		if value := query.Get(field); value != "" {
+			filter[field] = value
+		}
+	}
+
+	limit := DefaultPageLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > MaxPageLimit {
+			err = errors.Errorf("limit must be between 1 and %d", MaxPageLimit)
+			writeHTTPError(w, http.StatusBadRequest, err)
+			return
+		}
+		limit = n
+	}
+	after := objectid.NilObjectID
+	if c := query.Get("cursor"); c != "" {
+		var err error
+		after, err = objectid.FromHex(c)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing cursor")
+			writeHTTPError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	fields := parseFields(query.Get("fields"))
+
+	devices, err := h.reader.FindPage(filter, after, limit)
+	if err != nil {
+		err = errors.Wrap(err, "Error finding Devices")
+		writeHTTPError(w, http.StatusInternalServerError, err)
+		return
+	}
+	page := devicePage{
+		Devices: make([]json.RawMessage, len(devices)),
+	}
+	for i, d := range devices {
+		page.Devices[i], err = projectDevice(d, fields)
+		if err != nil {
+			writeHTTPError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if len(devices) == limit {
+		page.NextCursor = devices[len(devices)-1].ID.Hex()
+	}
+	writeJSON(w, page)
+}
+
+// parseFields splits the comma-separated "fields" query-value.
+func parseFields(fields string) []string {
+	if fields == "" {
+		return nil
+	}
+	return strings.Split(fields, ",")
+}
+
+// projectDevice returns the JSON-marshalled Device with only the fields,
+// or all fields if fields is empty.
+func projectDevice(device *Device, fields []string) (json.RawMessage, error) {
+	marshalled, err := json.Marshal(device)
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling Device")
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return marshalled, nil
+	}
+
+	m := map[string]json.RawMessage{}
+	err = json.Unmarshal(marshalled, &m)
+	if err != nil {
+		err = errors.Wrap(err, "Error unmarshalling Device")
+		return nil, err
+	}
+	projected := map[string]json.RawMessage{}
+	for _, field := range fields {
+		if value, exists := m[strings.TrimSpace(field)]; exists {
+			projected[strings.TrimSpace(field)] = value
+		}
+	}
+	return json.Marshal(projected)
+}
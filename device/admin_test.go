@@ -0,0 +1,129 @@
+package device
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// slicePageReader pages through Devices ordered by _id.
+type slicePageReader struct {
+	devices []*Device
+}
+
+func (s *slicePageReader) FindPage(
+	filter map[string]interface{}, after objectid.ObjectID, limit int,
+) ([]*Device, error) {
+	page := []*Device{}
+	for _, d := range s.devices {
+		fields := d.fieldMap()
+		fields["_id"] = d.ID
+		matches, err := matchFilter(fields, pageFilter(filter, after), false)
+		if err != nil {
+			return nil, err
+		}
+		if matches && len(page) < limit {
+			page = append(page, d)
+		}
+	}
+	return page, nil
+}
+
+var _ = Describe("AdminHandler", func() {
+	var (
+		devices []*Device
+		handler http.Handler
+	)
+
+	get := func(
+		path string, token string,
+	) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		body := map[string]interface{}{}
+		err := json.Unmarshal(rec.Body.Bytes(), &body)
+		Expect(err).ToNot(HaveOccurred())
+		return rec, body
+	}
+
+	BeforeEach(func() {
+		devices = []*Device{}
+		for i, status := range []string{"active", "retired", "active", "active"} {
+			deviceID, err := uuuid.NewV4()
+			Expect(err).ToNot(HaveOccurred())
+			id := objectid.ObjectID{}
+			id[11] = byte(i + 1)
+			devices = append(devices, &Device{
+				ID:       id,
+				DeviceID: deviceID,
+				Lot:      "lot-a",
+				Name:     "sensor",
+				Status:   status,
+				SKU:      "sku-1",
+			})
+		}
+
+		var err error
+		handler, err = NewAdminHandler(&slicePageReader{devices}, nil, "secret")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should reject requests without the bearer token", func() {
+		rec, _ := get("/devices", "")
+		Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+		rec, _ = get("/devices", "wrong")
+		Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should get a Device with projected fields", func() {
+		path := "/devices/" + devices[1].DeviceID.String() + "?fields=deviceID,status"
+		rec, body := get(path, "secret")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(body).To(Equal(map[string]interface{}{
+			"deviceID": devices[1].DeviceID.String(),
+			"status":   "retired",
+		}))
+
+		deviceID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		rec, _ = get("/devices/"+deviceID.String(), "secret")
+		Expect(rec.Code).To(Equal(http.StatusNotFound))
+		rec, _ = get("/devices/not-a-uuid", "secret")
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should list filtered Devices in pages", func() {
+		rec, body := get("/devices?status=active&limit=2&fields=_id", "secret")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(body["devices"]).To(Equal([]interface{}{
+			map[string]interface{}{"_id": devices[0].ID.Hex()},
+			map[string]interface{}{"_id": devices[2].ID.Hex()},
+		}))
+		Expect(body["nextCursor"]).To(Equal(devices[2].ID.Hex()))
+
+		path := "/devices?status=active&limit=2&fields=_id&cursor=" + devices[2].ID.Hex()
+		rec, body = get(path, "secret")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(body["devices"]).To(Equal([]interface{}{
+			map[string]interface{}{"_id": devices[3].ID.Hex()},
+		}))
+		Expect(body).ToNot(HaveKey("nextCursor"))
+	})
+
+	It("should reject invalid limits and cursors", func() {
+		rec, _ := get("/devices?limit=0", "secret")
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		rec, _ = get("/devices?cursor=xyz", "secret")
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+	})
+})
@@ -0,0 +1,171 @@
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/pkg/errors"
+)
+
+// Archive formats for exporting and importing Devices.
+const (
+	// NDJSONArchive has a JSON-marshalled Device on each line.
+	NDJSONArchive = "ndjson"
+	// BSONArchive has consecutive BSON-marshalled Devices, as in mongodump files.
+	BSONArchive = "bson"
+)
+
+// validateArchiveFormat checks that format is a known archive format.
+func validateArchiveFormat(format string) error {
+	if format != NDJSONArchive && format != BSONArchive {
+		return errors.Errorf(
+			"archive format must be %q or %q", NDJSONArchive, BSONArchive,
+		)
+	}
+	return nil
+}
+
+// ArchiveWriter writes Devices to an archive, along with their _ids,
+// and computes the archive's SHA-256 checksum.
+type ArchiveWriter struct {
+	w      io.Writer
+	format string
+	hash   hash.Hash
+	count  int64
+}
+
+// NewArchiveWriter creates an ArchiveWriter writing to w in the format.
+func NewArchiveWriter(w io.Writer, format string) (*ArchiveWriter, error) {
+	err := validateArchiveFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	return &ArchiveWriter{
+		w:      io.MultiWriter(w, h),
+		format: format,
+		hash:   h,
+	}, nil
+}
+
+// Write writes the Device to the archive.
+func (a *ArchiveWriter) Write(device *Device) error {
+	var out []byte
+	var err error
+	if a.format == BSONArchive {
+		out, err = device.MarshalBSON()
+	} else {
+		out, err = json.Marshal(device)
+		out = append(out, '\n')
+	}
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling Device")
+		return err
+	}
+
+	_, err = a.w.Write(out)
+	if err != nil {
+		err = errors.Wrap(err, "Error writing Device to archive")
+		return err
+	}
+	a.count++
+	return nil
+}
+
+// Count returns the number of Devices written.
+func (a *ArchiveWriter) Count() int64 {
+	return a.count
+}
+
+// Checksum returns the hex-encoded SHA-256 checksum of the archive written.
+func (a *ArchiveWriter) Checksum() string {
+	return hex.EncodeToString(a.hash.Sum(nil))
+}
+
+// ArchiveReader reads Devices from an archive.
+type ArchiveReader struct {
+	r      *bufio.Reader
+	format string
+	offset int64
+}
+
+// NewArchiveReader creates an ArchiveReader reading from r in the format.
+// offset is the position of r in the archive, such as when resuming
+// reading an archive, and is advanced as Devices are read.
+func NewArchiveReader(r io.Reader, format string, offset int64) (*ArchiveReader, error) {
+	err := validateArchiveFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	return &ArchiveReader{
+		r:      bufio.NewReader(r),
+		format: format,
+		offset: offset,
+	}, nil
+}
+
+// Read returns the next Device in the archive, or io.EOF
+// if there are no more Devices.
+func (a *ArchiveReader) Read() (*Device, error) {
+	device := &Device{}
+	if a.format == BSONArchive {
+		doc, err := bson.NewFromIOReader(a.r)
+		if err == io.EOF {
+			return nil, err
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "Error reading BSON archive at offset %d", a.offset)
+			return nil, err
+		}
+		err = device.UnmarshalBSON(doc)
+		if err != nil {
+			err = errors.Wrapf(err, "Error unmarshalling Device at offset %d", a.offset)
+			return nil, err
+		}
+		a.offset += int64(len(doc))
+		return device, nil
+	}
+
+	// Blank lines are skipped
+	var line []byte
+	for len(line) == 0 {
+		readLine, err := a.r.ReadBytes('\n')
+		if err == io.EOF && len(readLine) == 0 {
+			return nil, err
+		}
+		if err != nil && err != io.EOF {
+			err = errors.Wrapf(err, "Error reading NDJSON archive at offset %d", a.offset)
+			return nil, err
+		}
+		a.offset += int64(len(readLine))
+		line = bytes.TrimSpace(readLine)
+	}
+	err := json.Unmarshal(line, device)
+	if err != nil {
+		err = errors.Wrapf(err, "Error unmarshalling Device before offset %d", a.offset)
+		return nil, err
+	}
+	return device, nil
+}
+
+// Offset returns the position in the archive after the last Device read.
+func (a *ArchiveReader) Offset() int64 {
+	return a.offset
+}
+
+// ArchiveChecksum returns the hex-encoded SHA-256 checksum of the archive in r.
+func ArchiveChecksum(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		err = errors.Wrap(err, "Error reading archive")
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
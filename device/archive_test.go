@@ -0,0 +1,72 @@
+package device
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Archive", func() {
+	var devices []*Device
+
+	BeforeEach(func() {
+		devices = []*Device{}
+		for i := 0; i < 3; i++ {
+			deviceID, err := uuuid.NewV4()
+			Expect(err).ToNot(HaveOccurred())
+			devices = append(devices, &Device{
+				ID:       objectid.New(),
+				DeviceID: deviceID,
+				Lot:      "lot",
+				Status:   "ok",
+			})
+		}
+	})
+
+	for _, format := range []string{NDJSONArchive, BSONArchive} {
+		format := format
+
+		It("should read Devices written in "+format+" format", func() {
+			buf := &bytes.Buffer{}
+			writer, err := NewArchiveWriter(buf, format)
+			Expect(err).ToNot(HaveOccurred())
+			for _, d := range devices {
+				Expect(writer.Write(d)).To(Succeed())
+			}
+			Expect(writer.Count()).To(Equal(int64(3)))
+
+			checksum, err := ArchiveChecksum(bytes.NewReader(buf.Bytes()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(checksum).To(Equal(writer.Checksum()))
+
+			archive := buf.Bytes()
+			reader, err := NewArchiveReader(bytes.NewReader(archive), format, 0)
+			Expect(err).ToNot(HaveOccurred())
+			first, err := reader.Read()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(first).To(Equal(devices[0]))
+
+			// Reading is resumed from the offset after the first Device
+			offset := reader.Offset()
+			reader, err = NewArchiveReader(bytes.NewReader(archive[offset:]), format, offset)
+			Expect(err).ToNot(HaveOccurred())
+			for _, d := range devices[1:] {
+				read, err := reader.Read()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(read).To(Equal(d))
+			}
+			_, err = reader.Read()
+			Expect(err).To(Equal(io.EOF))
+			Expect(reader.Offset()).To(Equal(int64(len(archive))))
+		})
+	}
+
+	It("should return error for unknown format", func() {
+		_, err := NewArchiveWriter(&bytes.Buffer{}, "csv")
+		Expect(err).To(HaveOccurred())
+	})
+})
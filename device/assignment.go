@@ -0,0 +1,242 @@
+package device
+
+import (
+	"encoding/json"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/pkg/errors"
+)
+
+// AssignServiceAction is the ServiceAction for "update" events
+// that assign a Device to an Inventory Item.
+const AssignServiceAction = "assign"
+
+// UnassignServiceAction is the ServiceAction for "update" events
+// that unassign a Device from its Inventory Item.
+const UnassignServiceAction = "unassign"
+
+// Assignment records a Device being assigned to, or unassigned from, an Item.
+type Assignment struct {
+	Action    string     `json:"action"`
+	DeviceID  uuuid.UUID `json:"deviceID"`
+	ItemID    uuuid.UUID `json:"itemID"`
+	EventUUID uuuid.UUID `json:"eventUUID"`
+	UserUUID  uuuid.UUID `json:"userUUID"`
+	Timestamp int64      `json:"timestamp"`
+	TenantID  string     `json:"tenantID,omitempty"`
+}
+
+// MarshalBSON returns bytes of BSON-type.
+func (a Assignment) MarshalBSON() ([]byte, error) {
+	in := map[string]interface{}{
+		"action":    a.Action,
+		"deviceID":  a.DeviceID.String(),
+		"itemID":    a.ItemID.String(),
+		"eventUUID": a.EventUUID.String(),
+		"userUUID":  a.UserUUID.String(),
+		"timestamp": a.Timestamp,
+	}
+	if a.TenantID != "" {
+		in["tenantID"] = a.TenantID
+	}
+	return bson.Marshal(in)
+}
+
+type assignArgs struct {
+	dryRunOption
+	DeviceID uuuid.UUID `json:"deviceID"`
+	ItemID   uuuid.UUID `json:"itemID"`
+}
+
+// Assign returns the command for "update" events with "assign" ServiceAction.
+// The Device is only assigned if the Item exists, as per items,
+// and the Device is not already assigned to another Item.
+func Assign(items ItemLookup) CommandFunc {
+	return func(store Storage, event *model.Event) (interface{}, error) {
+		args, err := parseAssignment(event)
+		if err != nil {
+			return nil, err
+		}
+
+		itemExists, err := items.ItemExists(args.ItemID)
+		if err != nil {
+			err = errors.Wrap(err, "Assign: Error looking up Item")
+			return nil, NewError(DatabaseError, err)
+		}
+		if !itemExists {
+			err = errors.Errorf("item %s does not exist", args.ItemID)
+			err = errors.Wrap(err, "Assign")
+			return nil, NewError(UserError, err)
+		}
+
+		assignment := &Assignment{
+			Action:    AssignServiceAction,
+			DeviceID:  args.DeviceID,
+			ItemID:    args.ItemID,
+			EventUUID: event.UUID,
+			UserUUID:  event.UserUUID,
+			Timestamp: event.NanoTime,
+		}
+		// Device is only updated if currently unassigned, so it
+		// cannot be assigned to two Items by concurrent events.
+		filter := map[string]interface{}{
+			"deviceID": args.DeviceID.String(),
+			"itemID":   (uuuid.UUID{}).String(),
+		}
+		update := map[string]interface{}{
+			"itemID": args.ItemID.String(),
+		}
+		preview, err := changeAssignment(
+			store, event, assignment, filter, update, isDryRun(event, args.DryRun),
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "Assign")
+		}
+		if preview != nil {
+			return preview, preview.rejection
+		}
+		return assignment, nil
+	}
+}
+
+// Unassign handles "update" events with "unassign" ServiceAction.
+func Unassign(store Storage, event *model.Event) (interface{}, error) {
+	args, err := parseAssignment(event)
+	if err != nil {
+		return nil, err
+	}
+
+	assignment := &Assignment{
+		Action:    UnassignServiceAction,
+		DeviceID:  args.DeviceID,
+		EventUUID: event.UUID,
+		UserUUID:  event.UserUUID,
+		Timestamp: event.NanoTime,
+	}
+	filter := map[string]interface{}{
+		"deviceID": args.DeviceID.String(),
+	}
+	update := map[string]interface{}{
+		"itemID": (uuuid.UUID{}).String(),
+	}
+	preview, err := changeAssignment(
+		store, event, assignment, filter, update, isDryRun(event, args.DryRun),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unassign")
+	}
+	if preview != nil {
+		return preview, preview.rejection
+	}
+	return assignment, nil
+}
+
+// parseAssignment returns the arguments of "assign" and "unassign" events.
+func parseAssignment(event *model.Event) (*assignArgs, error) {
+	name := "Assign"
+	if event.ServiceAction == UnassignServiceAction {
+		name = "Unassign"
+	}
+
+	args := &assignArgs{}
+	err := json.Unmarshal(event.Data, args)
+	if err != nil {
+		err = errors.Wrapf(err, "%s: Error while unmarshalling Event-data", name)
+		return nil, NewError(InternalError, err)
+	}
+
+	if event.ServiceAction == UnassignServiceAction {
+		if args.DeviceID == (uuuid.UUID{}) {
+			err = errors.New("missing DeviceID")
+			err = errors.Wrap(err, name)
+			return nil, NewError(UserError, err)
+		}
+	} else if args.DeviceID == (uuuid.UUID{}) || args.ItemID == (uuuid.UUID{}) {
+		err = errors.New("missing DeviceID or ItemID")
+		err = errors.Wrap(err, name)
+		return nil, NewError(UserError, err)
+	}
+	return args, nil
+}
+
+// changeAssignment applies the assignment-event to its Device, using update
+// on the Device matching filter, and records the assignment in the same
+// transaction. For unassignment, the Item the Device was assigned to is set
+// on assignment.
+// For dry-runs, nothing is changed, and the changes are returned instead,
+// along with the rejection if the event would be rejected.
+func changeAssignment(
+	store Storage,
+	event *model.Event,
+	assignment *Assignment,
+	filter map[string]interface{},
+	update map[string]interface{},
+	dryRun bool,
+) (*dryRunResult, error) {
+	var preview *dryRunResult
+
+	err := store.Transaction(func(tx Storage) error {
+		devices, err := tx.Find(map[string]interface{}{
+			"deviceID": assignment.DeviceID.String(),
+		})
+		if err != nil {
+			return errors.Wrap(err, "Error finding Device")
+		}
+		if len(devices) == 0 {
+			err = errors.Errorf("device %s does not exist", assignment.DeviceID)
+			err = NewError(UserError, err)
+			if dryRun {
+				preview = newDryRunResult([]*Device{}, []*Device{})
+				preview.rejection = err
+				return nil
+			}
+			return err
+		}
+
+		device := devices[0]
+		after, err := Apply(device, event)
+		if err != nil {
+			// Rejected dry-runs list the Device as is
+			if dryRun && isRejection(err) {
+				preview = newDryRunResult([]*Device{device}, []*Device{device})
+				preview.rejection = err
+				return nil
+			}
+			return err
+		}
+		if assignment.Action == UnassignServiceAction {
+			assignment.ItemID = device.ItemID
+			filter["itemID"] = device.ItemID.String()
+		}
+
+		if dryRun {
+			preview = newDryRunResult([]*Device{device}, []*Device{after})
+			preview.rejection = tx.CheckUnique([]*Device{after}, update)
+			if preview.rejection != nil && !isRejection(preview.rejection) {
+				return preview.rejection
+			}
+			return nil
+		}
+
+		matchedCount, _, err := tx.UpdateMany(filter, update)
+		if err != nil {
+			return errors.Wrap(err, "Error updating Device")
+		}
+		if matchedCount == 0 {
+			err = errors.New("device assignment was changed by another event")
+			return NewError(UserError, err)
+		}
+
+		err = tx.InsertAssignment(assignment)
+		if err != nil {
+			return errors.Wrap(err, "Error recording Assignment")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, NewError(errorCode(err, DatabaseError), err)
+	}
+	return preview, nil
+}
@@ -0,0 +1,218 @@
+package device
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// itemSet is an ItemLookup of a fixed set of Items.
+type itemSet struct {
+	items map[uuuid.UUID]bool
+	err   error
+}
+
+func (s *itemSet) ItemExists(itemID uuuid.UUID) (bool, error) {
+	return s.items[itemID], s.err
+}
+
+var _ = Describe("Assignment", func() {
+	var (
+		dbFile string
+		db     *bolt.DB
+		store  *BoltStorage
+		items  *itemSet
+		device *Device
+		itemID uuuid.UUID
+	)
+
+	newUUID := func() uuuid.UUID {
+		id, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		return id
+	}
+
+	newEvent := func(serviceAction string, itemID uuuid.UUID) *model.Event {
+		data, err := json.Marshal(map[string]interface{}{
+			"deviceID": device.DeviceID,
+			"itemID":   itemID,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return &model.Event{
+			EventAction:   "update",
+			ServiceAction: serviceAction,
+			Data:          data,
+			NanoTime:      1539211234,
+			UserUUID:      newUUID(),
+			UUID:          newUUID(),
+		}
+	}
+
+	// stored returns the Device as currently stored
+	stored := func() *Device {
+		devices, err := store.Find(map[string]interface{}{
+			"deviceID": device.DeviceID.String(),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(devices).To(HaveLen(1))
+		return devices[0]
+	}
+
+	// history returns the recorded Assignments
+	history := func() []map[string]interface{} {
+		assignments := []map[string]interface{}{}
+		err := db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(assignmentsBucket).ForEach(func(k, v []byte) error {
+				m := map[string]interface{}{}
+				err := bson.Unmarshal(v, m)
+				assignments = append(assignments, m)
+				return err
+			})
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return assignments
+	}
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "agg_device_assignment")
+		Expect(err).ToNot(HaveOccurred())
+		dbFile = f.Name()
+		f.Close()
+
+		db, err = bolt.Open(dbFile, 0600, nil)
+		Expect(err).ToNot(HaveOccurred())
+		store, err = NewBoltStorage(BoltStorageConfig{DB: db})
+		Expect(err).ToNot(HaveOccurred())
+
+		itemID = newUUID()
+		items = &itemSet{
+			items: map[uuuid.UUID]bool{itemID: true},
+		}
+		device = &Device{
+			DeviceID: newUUID(),
+			Name:     "sensor",
+			Status:   "active",
+		}
+		_, err = store.InsertOne(device)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.Remove(dbFile)
+	})
+
+	It("should assign and unassign Devices, recording their history", func() {
+		event := newEvent(AssignServiceAction, itemID)
+		result, err := Assign(items)(store, event)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal(&Assignment{
+			Action:    AssignServiceAction,
+			DeviceID:  device.DeviceID,
+			ItemID:    itemID,
+			EventUUID: event.UUID,
+			UserUUID:  event.UserUUID,
+			Timestamp: event.NanoTime,
+		}))
+		Expect(stored().ItemID).To(Equal(itemID))
+
+		unassignEvent := newEvent(UnassignServiceAction, uuuid.UUID{})
+		result, err = Unassign(store, unassignEvent)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.(*Assignment).ItemID).To(Equal(itemID))
+		Expect(stored().ItemID).To(Equal(uuuid.UUID{}))
+
+		Expect(history()).To(Equal([]map[string]interface{}{
+			map[string]interface{}{
+				"action":    AssignServiceAction,
+				"deviceID":  device.DeviceID.String(),
+				"itemID":    itemID.String(),
+				"eventUUID": event.UUID.String(),
+				"userUUID":  event.UserUUID.String(),
+				"timestamp": event.NanoTime,
+			},
+			map[string]interface{}{
+				"action":    UnassignServiceAction,
+				"deviceID":  device.DeviceID.String(),
+				"itemID":    itemID.String(),
+				"eventUUID": unassignEvent.UUID.String(),
+				"userUUID":  unassignEvent.UserUUID.String(),
+				"timestamp": unassignEvent.NanoTime,
+			},
+		}))
+	})
+
+	It("should reject assigning to Items that do not exist", func() {
+		_, err := Assign(items)(store, newEvent(AssignServiceAction, newUUID()))
+		Expect(err).To(HaveOccurred())
+		Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+
+		items.err = errors.New("lookup failed")
+		_, err = Assign(items)(store, newEvent(AssignServiceAction, itemID))
+		Expect(err).To(HaveOccurred())
+		Expect(errorCode(err, 0)).To(Equal(int16(DatabaseError)))
+
+		Expect(stored().ItemID).To(Equal(uuuid.UUID{}))
+		Expect(history()).To(BeEmpty())
+	})
+
+	It("should reject assigning Devices already assigned to an Item", func() {
+		_, err := Assign(items)(store, newEvent(AssignServiceAction, itemID))
+		Expect(err).ToNot(HaveOccurred())
+
+		otherItemID := newUUID()
+		items.items[otherItemID] = true
+		_, err = Assign(items)(store, newEvent(AssignServiceAction, otherItemID))
+		Expect(err).To(HaveOccurred())
+		Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+		Expect(err.Error()).To(ContainSubstring("already assigned"))
+
+		Expect(stored().ItemID).To(Equal(itemID))
+		Expect(history()).To(HaveLen(1))
+	})
+
+	It("should reject unassigning unassigned or missing Devices", func() {
+		_, err := Unassign(store, newEvent(UnassignServiceAction, uuuid.UUID{}))
+		Expect(err).To(HaveOccurred())
+		Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+
+		device.DeviceID = newUUID()
+		_, err = Assign(items)(store, newEvent(AssignServiceAction, itemID))
+		Expect(err).To(HaveOccurred())
+		Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+		Expect(history()).To(BeEmpty())
+	})
+
+	It("should preview rejected assignments on dry-run", func() {
+		_, err := Assign(items)(store, newEvent(AssignServiceAction, itemID))
+		Expect(err).ToNot(HaveOccurred())
+
+		otherItemID := newUUID()
+		items.items[otherItemID] = true
+		dryRun, err := DryRunEvent(newEvent(AssignServiceAction, otherItemID))
+		Expect(err).ToNot(HaveOccurred())
+		result, err := Assign(items)(store, dryRun)
+		Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+		Expect(err.Error()).To(ContainSubstring("already assigned"))
+		preview := result.(*dryRunResult)
+		Expect(preview.DeviceIDs).To(Equal([]string{device.DeviceID.String()}))
+		Expect(preview.Diffs[0].Fields).To(BeEmpty())
+
+		device.DeviceID = newUUID()
+		dryRun, err = DryRunEvent(newEvent(UnassignServiceAction, uuuid.UUID{}))
+		Expect(err).ToNot(HaveOccurred())
+		result, err = Unassign(store, dryRun)
+		Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+		Expect(result.(*dryRunResult).DeviceIDs).To(BeEmpty())
+
+		Expect(history()).To(HaveLen(1))
+	})
+})
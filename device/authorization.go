@@ -0,0 +1,210 @@
+package device
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/pkg/errors"
+)
+
+// Roles with default policies, as configured in the service.
+const (
+	ViewerRole     = "viewer"
+	TechnicianRole = "technician"
+	AdminRole      = "admin"
+)
+
+// AllowAll allows all actions or fields in a Policy.
+const AllowAll = "*"
+
+// Policy defines the commands a role is allowed to run.
+type Policy struct {
+	// Actions are either "<EventAction>", to allow the EventAction with any
+	// ServiceAction, or "<EventAction>.<ServiceAction>". "dryRun" allows
+	// dry-runs of any command.
+	Actions []string `json:"actions"`
+	// Fields are the Device fields that can be set using insert,
+	// update, assign and unassign commands.
+	Fields []string `json:"fields"`
+}
+
+// allows checks if the policy allows the action on the fields.
+// eventAction is the EventAction of action.
+func (p Policy) allows(eventAction string, action string, fields []string) bool {
+	if !contains(p.Actions, action) && !contains(p.Actions, eventAction) {
+		return false
+	}
+	for _, field := range fields {
+		if !contains(p.Fields, field) {
+			return false
+		}
+	}
+	return true
+}
+
+// contains checks if values contains value, or AllowAll.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value || v == AllowAll {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleLookup resolves the roles of users.
+type RoleLookup interface {
+	Roles(userUUID uuuid.UUID) ([]string, error)
+}
+
+// StaticRoles are the roles of users, keyed by UserUUID,
+// such as when read from a file.
+type StaticRoles map[uuuid.UUID][]string
+
+// Roles returns the user's roles.
+func (s StaticRoles) Roles(userUUID uuuid.UUID) ([]string, error) {
+	return s[userUUID], nil
+}
+
+// UserRoles are the roles of a user, as stored by MongoRoleLookup.
+type UserRoles struct {
+	ID       objectid.ObjectID `bson:"_id,omitempty"`
+	UserUUID string            `bson:"userUUID,omitempty"`
+	Roles    []string          `bson:"roles,omitempty"`
+}
+
+// MongoRoleLookup looks up the roles of users in a MongoDB collection.
+type MongoRoleLookup struct {
+	collection *mongo.Collection
+}
+
+// NewMongoRoleLookup creates a RoleLookup backed by the provided collection.
+// The collection's SchemaStruct must be *UserRoles.
+func NewMongoRoleLookup(collection *mongo.Collection) (*MongoRoleLookup, error) {
+	if collection == nil {
+		return nil, errors.New("collection cannot be nil")
+	}
+	return &MongoRoleLookup{collection}, nil
+}
+
+// Roles returns the user's roles, or none if the user is not found.
+func (l *MongoRoleLookup) Roles(userUUID uuuid.UUID) ([]string, error) {
+	filter := map[string]interface{}{
+		"userUUID": userUUID.String(),
+	}
+	findResults, err := l.collection.Find(filter, findopt.Limit(1))
+	if err != nil {
+		err = errors.Wrap(err, "Error finding UserRoles")
+		return nil, err
+	}
+	if len(findResults) == 0 {
+		return nil, nil
+	}
+	userRoles, assertOK := findResults[0].(*UserRoles)
+	if !assertOK {
+		return nil, errors.New("error asserting FindResult to UserRoles")
+	}
+	return userRoles.Roles, nil
+}
+
+// RoleAuthorizer authorizes events by the roles of their UserUUID.
+// An event is allowed if any of the user's roles has a Policy
+// allowing the command and all fields it sets.
+type RoleAuthorizer struct {
+	roles    RoleLookup
+	policies map[string]Policy
+}
+
+// NewRoleAuthorizer creates a RoleAuthorizer with policies keyed by role.
+func NewRoleAuthorizer(
+	roles RoleLookup, policies map[string]Policy,
+) (*RoleAuthorizer, error) {
+	if roles == nil {
+		return nil, errors.New("roles cannot be nil")
+	}
+	return &RoleAuthorizer{
+		roles:    roles,
+		policies: policies,
+	}, nil
+}
+
+// Authorize returns UnauthorizedError if the event's user is not allowed
+// to run the command.
+func (a *RoleAuthorizer) Authorize(event *model.Event) error {
+	if event.UserUUID == (uuuid.UUID{}) {
+		err := errors.New("event has blank UserUUID")
+		return NewError(UnauthorizedError, err)
+	}
+	action, fields, err := commandScope(event)
+	if err != nil {
+		return NewError(UserError, err)
+	}
+	roles, err := a.roles.Roles(event.UserUUID)
+	if err != nil {
+		err = errors.Wrap(err, "Error looking up user-roles")
+		return NewError(DatabaseError, err)
+	}
+
+	for _, role := range roles {
+		policy, exists := a.policies[role]
+		if exists && policy.allows(event.EventAction, action, fields) {
+			return nil
+		}
+	}
+	err = errors.Errorf(
+		"user %s with roles [%s] is not allowed to %s fields [%s]",
+		event.UserUUID, strings.Join(roles, ", "), action, strings.Join(fields, ", "),
+	)
+	return NewError(UnauthorizedError, err)
+}
+
+// commandScope returns the action the event runs, and the Device fields it sets.
+// The action is "dryRun" for dry-runs, which set no fields.
+func commandScope(event *model.Event) (string, []string, error) {
+	opts := &dryRunOption{}
+	err := json.Unmarshal(event.Data, opts)
+	if err != nil {
+		err = errors.Wrap(err, "Error while unmarshalling Event-data")
+		return "", nil, err
+	}
+	if isDryRun(event, opts.DryRun) {
+		return DryRunServiceAction, nil, nil
+	}
+
+	action := event.EventAction
+	if event.ServiceAction != "" {
+		action += "." + event.ServiceAction
+	}
+
+	var set map[string]interface{}
+	switch {
+	case event.ServiceAction == AssignServiceAction ||
+		event.ServiceAction == UnassignServiceAction:
+		return action, []string{"itemID"}, nil
+	case event.EventAction == "insert":
+		err = json.Unmarshal(event.Data, &set)
+	case event.EventAction == "update":
+		update := &deviceUpdate{}
+		err = json.Unmarshal(event.Data, update)
+		set = update.Update
+	}
+	if err != nil {
+		err = errors.Wrap(err, "Error while unmarshalling Event-data")
+		return "", nil, err
+	}
+
+	fields := []string{}
+	for field := range set {
+		if field != "dryRun" {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return action, fields, nil
+}
@@ -0,0 +1,120 @@
+package device
+
+import (
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Authorization", func() {
+	var (
+		auth       *RoleAuthorizer
+		technician uuuid.UUID
+		viewer     uuuid.UUID
+	)
+
+	BeforeEach(func() {
+		var err error
+		technician, err = uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		viewer, err = uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+
+		auth, err = NewRoleAuthorizer(
+			StaticRoles{
+				technician: []string{TechnicianRole},
+				viewer:     []string{ViewerRole},
+			},
+			map[string]Policy{
+				ViewerRole: Policy{
+					Actions: []string{DryRunServiceAction},
+				},
+				TechnicianRole: Policy{
+					Actions: []string{"update"},
+					Fields:  []string{"itemID", "status"},
+				},
+			},
+		)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should allow actions and fields allowed by user's role", func() {
+		err := auth.Authorize(&model.Event{
+			EventAction: "update",
+			UserUUID:    technician,
+			Data:        []byte(`{"filter":{"lot":"a"},"update":{"status":"ok"}}`),
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		err = auth.Authorize(&model.Event{
+			EventAction:   "update",
+			ServiceAction: AssignServiceAction,
+			UserUUID:      technician,
+			Data:          []byte(`{}`),
+		})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should reject fields not allowed by user's role", func() {
+		err := auth.Authorize(&model.Event{
+			EventAction: "update",
+			UserUUID:    technician,
+			Data:        []byte(`{"filter":{"lot":"a"},"update":{"sku":"b"}}`),
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(errorCode(err, 0)).To(Equal(int16(UnauthorizedError)))
+	})
+
+	It("should reject actions not allowed by user's role", func() {
+		err := auth.Authorize(&model.Event{
+			EventAction: "delete",
+			UserUUID:    technician,
+			Data:        []byte(`{"lot":"a"}`),
+		})
+		Expect(errorCode(err, 0)).To(Equal(int16(UnauthorizedError)))
+
+		err = auth.Authorize(&model.Event{
+			EventAction: "delete",
+			UserUUID:    viewer,
+			Data:        []byte(`{"lot":"a"}`),
+		})
+		Expect(errorCode(err, 0)).To(Equal(int16(UnauthorizedError)))
+	})
+
+	It("should allow dry-runs if allowed by user's role", func() {
+		err := auth.Authorize(&model.Event{
+			EventAction: "delete",
+			UserUUID:    viewer,
+			Data:        []byte(`{"lot":"a","dryRun":true}`),
+		})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should reject unknown users and events without UserUUID", func() {
+		unknown, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		err = auth.Authorize(&model.Event{
+			EventAction: "delete",
+			UserUUID:    unknown,
+			Data:        []byte(`{"dryRun":true}`),
+		})
+		Expect(errorCode(err, 0)).To(Equal(int16(UnauthorizedError)))
+
+		err = auth.Authorize(&model.Event{
+			EventAction: "delete",
+			Data:        []byte(`{"dryRun":true}`),
+		})
+		Expect(errorCode(err, 0)).To(Equal(int16(UnauthorizedError)))
+	})
+
+	It("should respond with UnauthorizedError from middleware", func() {
+		handled := false
+		kr := Authorization(auth)(func(Storage, *model.Event) *model.KafkaResponse {
+			handled = true
+			return nil
+		})(nil, &model.Event{EventAction: "delete", UserUUID: viewer, Data: []byte("{}")})
+		Expect(handled).To(BeFalse())
+		Expect(kr.ErrorCode).To(Equal(int16(UnauthorizedError)))
+	})
+})
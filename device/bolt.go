@@ -0,0 +1,981 @@
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DeviceIDIndex is the unique-index on Devices' deviceID.
+const DeviceIDIndex = "deviceID_index"
+
+// Buckets of the BoltDB database.
+var (
+	// devicesBucket stores BSON-marshalled Devices, keyed by their _id.
+	devicesBucket = []byte("devices")
+	// deviceIDsBucket maps deviceIDs to the _id of their Device,
+	// keeping deviceIDs unique.
+	deviceIDsBucket = []byte("deviceIDs")
+	// assignmentsBucket stores BSON-marshalled Assignments in insertion-order.
+	assignmentsBucket = []byte("assignments")
+	// processedBucket stores JSON-marshalled responses, keyed by event-UUID.
+	processedBucket = []byte("processed")
+	// metaBucket stores the schema-version Devices were migrated to,
+	// and the Version of the last applied event.
+	metaBucket = []byte("meta")
+	// snapshotsBucket stores JSON-marshalled Snapshots, keyed by Version.
+	snapshotsBucket = []byte("snapshots")
+	// uniqueBucket has a bucket for each UniqueConstraint, indexing the Devices
+	// subject to it by their constraint-key and deviceID, mapped to their _id.
+	uniqueBucket = []byte("unique")
+)
+
+// errStopScan stops scanning Devices without an error.
+var errStopScan = errors.New("stop scan")
+
+// BoltStorageConfig defines the database and options for BoltStorage.
+type BoltStorageConfig struct {
+	DB *bolt.DB
+	// UniqueConstraints are checked before inserting and updating Devices.
+	UniqueConstraints []UniqueConstraint
+}
+
+// BoltStorage is the embedded BoltDB Storage for Device Aggregates, for
+// deployments without MongoDB. Filters are matched like MongoDB would, but only
+// support the operators listed for matchFilter. Each write is a BoltDB
+// transaction, so writes of multiple Devices are always either all or none
+// applied.
+type BoltStorage struct {
+	db          *bolt.DB
+	constraints []UniqueConstraint
+	// tx is only set on Storage passed to Transaction functions.
+	tx *bolt.Tx
+}
+
+// NewBoltStorage creates a Storage backed by a BoltDB database,
+// creating its buckets if required.
+// The indexes of UniqueConstraints are rebuilt, since constraints can change
+// between runs, and migrations change Devices without updating them.
+func NewBoltStorage(config BoltStorageConfig) (*BoltStorage, error) {
+	if config.DB == nil {
+		return nil, errors.New("DB cannot be nil")
+	}
+	err := createBuckets(config.DB, devicesBucket, deviceIDsBucket, assignmentsBucket)
+	if err != nil {
+		return nil, err
+	}
+	b := &BoltStorage{
+		db:          config.DB,
+		constraints: config.UniqueConstraints,
+	}
+	err = b.db.Update(b.rebuildUniqueIndexes)
+	if err != nil {
+		err = errors.Wrap(err, "Error rebuilding unique-indexes")
+		return nil, err
+	}
+	return b, nil
+}
+
+// rebuildUniqueIndexes recreates the indexes of the UniqueConstraints
+// from the stored Devices.
+func (b *BoltStorage) rebuildUniqueIndexes(tx *bolt.Tx) error {
+	if tx.Bucket(uniqueBucket) != nil {
+		err := tx.DeleteBucket(uniqueBucket)
+		if err != nil {
+			return err
+		}
+	}
+	indexes, err := tx.CreateBucket(uniqueBucket)
+	if err != nil {
+		return err
+	}
+	for _, constraint := range b.constraints {
+		_, err = indexes.CreateBucket([]byte(constraint.Name))
+		if err != nil {
+			err = errors.Wrapf(err, "Error creating bucket for %s", constraint.Name)
+			return err
+		}
+	}
+	return scanDevices(tx, map[string]interface{}{}, false, func(device *Device) error {
+		return b.indexUnique(tx, device)
+	})
+}
+
+func createBuckets(db *bolt.DB, buckets ...[]byte) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range buckets {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				err = errors.Wrapf(err, "Error creating bucket %s", bucket)
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Find returns all Devices matching filter.
+func (b *BoltStorage) Find(filter map[string]interface{}) ([]*Device, error) {
+	return b.find(filter, false, 0)
+}
+
+// find returns up to limit Devices matching filter, or all if limit is 0.
+func (b *BoltStorage) find(
+	filter map[string]interface{}, caseInsensitive bool, limit int,
+) ([]*Device, error) {
+	devices := []*Device{}
+	err := b.view(func(tx *bolt.Tx) error {
+		return scanDevices(tx, filter, caseInsensitive, func(device *Device) error {
+			devices = append(devices, device)
+			if limit > 0 && len(devices) >= limit {
+				return errStopScan
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// FindPage returns up to limit Devices matching filter, ordered by _id,
+// with _ids greater than after.
+func (b *BoltStorage) FindPage(
+	filter map[string]interface{}, after objectid.ObjectID, limit int,
+) ([]*Device, error) {
+	return b.find(pageFilter(filter, after), false, limit)
+}
+
+// Count returns the number of Devices matching filter.
+func (b *BoltStorage) Count(filter map[string]interface{}) (int64, error) {
+	devices, err := b.Find(filter)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(devices)), nil
+}
+
+// InsertOne inserts the Device and returns its ObjectID,
+// which is generated if the Device has none.
+func (b *BoltStorage) InsertOne(device *Device) (objectid.ObjectID, error) {
+	id := device.ID
+	if id == objectid.NilObjectID {
+		id = objectid.New()
+	}
+	inserted := *device
+	inserted.ID = id
+
+	err := b.update(func(tx *bolt.Tx) error {
+		err := b.withTx(tx).CheckUnique([]*Device{&inserted}, nil)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(devicesBucket).Get(id[:]) != nil {
+			return errors.Errorf("device with _id %s already exists", id.Hex())
+		}
+		return b.putDevice(tx, nil, &inserted)
+	})
+	if err != nil {
+		return objectid.NilObjectID, err
+	}
+	return id, nil
+}
+
+// UpdateMany sets the fields in update on all Devices matching filter.
+// Only fields of Device are stored.
+func (b *BoltStorage) UpdateMany(
+	filter map[string]interface{},
+	update map[string]interface{},
+) (int64, int64, error) {
+	var matchedCount, modifiedCount int64
+	err := b.update(func(tx *bolt.Tx) error {
+		txStore := b.withTx(tx)
+		matched, err := txStore.Find(filter)
+		if err != nil {
+			return err
+		}
+		updated := make([]*Device, len(matched))
+		for i, d := range matched {
+			updated[i], err = d.applyUpdate(update)
+			if err != nil {
+				return err
+			}
+		}
+		if len(b.constraints) > 0 {
+			err = txStore.CheckUnique(updated, update)
+			if err != nil {
+				return err
+			}
+		}
+
+		matchedCount = int64(len(matched))
+		for i := range matched {
+			if *matched[i] == *updated[i] {
+				continue
+			}
+			err = b.putDevice(tx, matched[i], updated[i])
+			if err != nil {
+				return err
+			}
+			modifiedCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return matchedCount, modifiedCount, nil
+}
+
+// DeleteMany deletes all Devices matching filter.
+func (b *BoltStorage) DeleteMany(filter map[string]interface{}) (int64, error) {
+	var deletedCount int64
+	err := b.update(func(tx *bolt.Tx) error {
+		matched, err := b.withTx(tx).Find(filter)
+		if err != nil {
+			return err
+		}
+		for _, d := range matched {
+			err = tx.Bucket(devicesBucket).Delete(d.ID[:])
+			if err != nil {
+				return err
+			}
+			err = tx.Bucket(deviceIDsBucket).Delete([]byte(d.DeviceID.String()))
+			if err != nil {
+				return err
+			}
+			err = b.unindexUnique(tx, d)
+			if err != nil {
+				return err
+			}
+			deletedCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deletedCount, nil
+}
+
+// Each calls fn with each Device matching filter, ordered by _id.
+// Iteration stops at the first error returned by fn.
+func (b *BoltStorage) Each(
+	filter map[string]interface{}, fn func(device *Device) error,
+) error {
+	return b.view(func(tx *bolt.Tx) error {
+		return scanDevices(tx, filter, false, fn)
+	})
+}
+
+// Restore stores the Devices with their _ids, replacing any Device with the same
+// _id, so restoring the same Devices again has no further effect.
+// Unique constraints, other than the unique deviceID, are not checked.
+func (b *BoltStorage) Restore(devices []*Device) error {
+	return b.update(func(tx *bolt.Tx) error {
+		for _, device := range devices {
+			if device.ID == objectid.NilObjectID {
+				return errors.Errorf("device %s has no _id", device.DeviceID)
+			}
+			existing, err := getDevice(tx, device.ID)
+			if err != nil {
+				return err
+			}
+			err = b.putDevice(tx, existing, device)
+			if err != nil {
+				err = errors.Wrapf(err, "Error restoring Device %s", device.DeviceID)
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// InsertAssignment records an Assignment in the Device's assignment-history.
+func (b *BoltStorage) InsertAssignment(assignment *Assignment) error {
+	value, err := assignment.MarshalBSON()
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling Assignment")
+		return err
+	}
+	return b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(assignmentsBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return bucket.Put(key, value)
+	})
+}
+
+// Transaction runs fn inside a BoltDB read-write transaction, which is committed
+// if fn returns no error, and rolled back otherwise. If this Storage is already
+// part of a transaction, fn is run using this Storage.
+// BoltDB allows a single read-write transaction at a time, so concurrent
+// transactions wait for each other.
+func (b *BoltStorage) Transaction(fn func(tx Storage) error) error {
+	if b.tx != nil {
+		return fn(b)
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(b.withTx(tx))
+	})
+}
+
+// CheckUnique returns a *UniqueConflictError if the Devices, as they would
+// be stored, violate a UniqueConstraint. If update is set, only constraints
+// affected by the update are checked.
+func (b *BoltStorage) CheckUnique(
+	devices []*Device, update map[string]interface{},
+) error {
+	return b.view(func(tx *bolt.Tx) error {
+		return checkUnique(b.constraints, devices, update, b.withTx(tx).findClashes)
+	})
+}
+
+// findClashes finds a Device with the same constraint-key as filter,
+// other than excludeIDs, using the constraint's index.
+func (b *BoltStorage) findClashes(
+	constraint *UniqueConstraint,
+	filter map[string]interface{},
+	excludeIDs []string,
+) ([]*Device, error) {
+	excluded := map[string]bool{}
+	for _, id := range excludeIDs {
+		excluded[id] = true
+	}
+	prefix := []byte(constraint.key(filter) + "\x00")
+
+	clashes := []*Device{}
+	err := b.view(func(tx *bolt.Tx) error {
+		index := tx.Bucket(uniqueBucket).Bucket([]byte(constraint.Name))
+		if index == nil {
+			return errors.Errorf("no index for unique constraint %s", constraint.Name)
+		}
+		cursor := index.Cursor()
+		for k, v := cursor.Seek(prefix); bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			// Keys of other constraint-values can only have this prefix
+			// if their values contain the separator
+			deviceID := k[len(prefix):]
+			if bytes.IndexByte(deviceID, 0) != -1 || excluded[string(deviceID)] {
+				continue
+			}
+			device, err := getDevice(tx, objectIDFromBytes(v))
+			if err != nil || device == nil {
+				return err
+			}
+			clashes = append(clashes, device)
+			return nil
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return clashes, nil
+}
+
+// uniqueIndexKey returns the key of the Device in the constraint's index,
+// or nil if the Device is not subject to the constraint.
+func uniqueIndexKey(constraint *UniqueConstraint, device *Device) []byte {
+	fields := device.fieldMap()
+	if !constraint.inScope(fields) || constraint.hasBlank(fields) {
+		return nil
+	}
+	return []byte(constraint.key(fields) + "\x00" + device.DeviceID.String())
+}
+
+// indexUnique adds the Device to the indexes of the constraints it is subject to.
+func (b *BoltStorage) indexUnique(tx *bolt.Tx, device *Device) error {
+	for i := range b.constraints {
+		key := uniqueIndexKey(&b.constraints[i], device)
+		if key == nil {
+			continue
+		}
+		index := tx.Bucket(uniqueBucket).Bucket([]byte(b.constraints[i].Name))
+		err := index.Put(key, device.ID[:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexUnique removes the Device from the indexes of the constraints.
+func (b *BoltStorage) unindexUnique(tx *bolt.Tx, device *Device) error {
+	for i := range b.constraints {
+		key := uniqueIndexKey(&b.constraints[i], device)
+		if key == nil {
+			continue
+		}
+		index := tx.Bucket(uniqueBucket).Bucket([]byte(b.constraints[i].Name))
+		err := index.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BoltStorage) withTx(tx *bolt.Tx) *BoltStorage {
+	return &BoltStorage{
+		db:          b.db,
+		constraints: b.constraints,
+		tx:          tx,
+	}
+}
+
+// view runs fn in this Storage's transaction, or a new read-only transaction.
+func (b *BoltStorage) view(fn func(tx *bolt.Tx) error) error {
+	if b.tx != nil {
+		return fn(b.tx)
+	}
+	return b.db.View(fn)
+}
+
+// update runs fn in this Storage's transaction, or a new read-write transaction.
+func (b *BoltStorage) update(fn func(tx *bolt.Tx) error) error {
+	if b.tx != nil {
+		return fn(b.tx)
+	}
+	return b.db.Update(fn)
+}
+
+// scanDevices calls fn with each Device matching filter, ordered by _id.
+// Devices selected by _id or deviceID are looked up, and only Devices after
+// the _id in "$gt" are scanned, instead of scanning all Devices.
+func scanDevices(
+	tx *bolt.Tx,
+	filter map[string]interface{},
+	caseInsensitive bool,
+	fn func(device *Device) error,
+) error {
+	visit := func(v []byte) error {
+		device := &Device{}
+		err := device.UnmarshalBSON(v)
+		if err != nil {
+			err = errors.Wrap(err, "Error unmarshalling Device")
+			return err
+		}
+		fields := device.fieldMap()
+		fields["_id"] = device.ID
+		matches, err := matchFilter(fields, filter, caseInsensitive)
+		if err != nil || !matches {
+			return err
+		}
+		return fn(device)
+	}
+
+	var err error
+	devices := tx.Bucket(devicesBucket)
+	ids, isIndexed := indexedIDs(tx, filter, caseInsensitive)
+	if isIndexed {
+		for _, id := range ids {
+			if v := devices.Get(id); v != nil {
+				err = visit(v)
+				if err != nil {
+					break
+				}
+			}
+		}
+	} else {
+		cursor := devices.Cursor()
+		k, v := cursor.First()
+		if after, isAfter := afterID(filter); isAfter {
+			k, v = cursor.Seek(after[:])
+		}
+		for ; k != nil; k, v = cursor.Next() {
+			err = visit(v)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err == errStopScan {
+		return nil
+	}
+	return err
+}
+
+// indexedIDs returns the sorted _ids of Devices the filter can match, if it
+// selects Devices by _id using equality or "$in", or by deviceID using
+// equality, "$eq" or "$in". deviceIDs are not looked up for case-insensitive
+// filters.
+func indexedIDs(
+	tx *bolt.Tx, filter map[string]interface{}, caseInsensitive bool,
+) ([][]byte, bool) {
+	if id, isID := filter["_id"].(objectid.ObjectID); isID {
+		return [][]byte{id[:]}, true
+	}
+	if in, isList := objectIDList(filter["_id"]); isList {
+		ids := make([][]byte, len(in))
+		for i := range in {
+			ids[i] = in[i][:]
+		}
+		return uniqueIDs(ids), true
+	}
+	if caseInsensitive {
+		return nil, false
+	}
+
+	deviceIDs := []string{}
+	switch value := filter["deviceID"].(type) {
+	case string:
+		deviceIDs = append(deviceIDs, value)
+	case map[string]interface{}:
+		if len(value) != 1 {
+			return nil, false
+		}
+		if eq, isString := value["$eq"].(string); isString {
+			deviceIDs = append(deviceIDs, eq)
+			break
+		}
+		in, isList := stringList(value["$in"])
+		if !isList {
+			return nil, false
+		}
+		deviceIDs = append(deviceIDs, in...)
+	default:
+		return nil, false
+	}
+
+	ids := [][]byte{}
+	index := tx.Bucket(deviceIDsBucket)
+	for _, deviceID := range deviceIDs {
+		if id := index.Get([]byte(deviceID)); id != nil {
+			ids = append(ids, id)
+		}
+	}
+	return uniqueIDs(ids), true
+}
+
+// uniqueIDs sorts the _ids, removing duplicates.
+func uniqueIDs(ids [][]byte) [][]byte {
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i], ids[j]) < 0
+	})
+	unique := ids[:0]
+	for i, id := range ids {
+		if i == 0 || !bytes.Equal(id, ids[i-1]) {
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// objectIDList returns the ObjectIDs of a filter-value {"$in": [...]},
+// and false if it is not a list of ObjectIDs.
+func objectIDList(value interface{}) ([]objectid.ObjectID, bool) {
+	ops, isMap := value.(map[string]interface{})
+	if !isMap || len(ops) != 1 {
+		return nil, false
+	}
+	list, isList := ops["$in"].([]interface{})
+	if !isList {
+		return nil, false
+	}
+	ids := make([]objectid.ObjectID, len(list))
+	for i, v := range list {
+		id, isID := v.(objectid.ObjectID)
+		if !isID {
+			return nil, false
+		}
+		ids[i] = id
+	}
+	return ids, true
+}
+
+// stringList returns the strings of a "$in" list,
+// and false if it is not a list of strings.
+func stringList(value interface{}) ([]string, bool) {
+	switch list := value.(type) {
+	case []string:
+		return list, true
+	case []interface{}:
+		strs := make([]string, len(list))
+		for i, v := range list {
+			str, isString := v.(string)
+			if !isString {
+				return nil, false
+			}
+			strs[i] = str
+		}
+		return strs, true
+	}
+	return nil, false
+}
+
+// afterID returns the _id in filter's "$gt" on _id, as set by pageFilter.
+func afterID(filter map[string]interface{}) (objectid.ObjectID, bool) {
+	idFilter, isMap := filter["_id"].(map[string]interface{})
+	if !isMap {
+		return objectid.NilObjectID, false
+	}
+	after, isID := idFilter["$gt"].(objectid.ObjectID)
+	return after, isID
+}
+
+// objectIDFromBytes returns the ObjectID stored as bytes in a bucket.
+func objectIDFromBytes(b []byte) objectid.ObjectID {
+	var id objectid.ObjectID
+	copy(id[:], b)
+	return id
+}
+
+// getDevice returns the Device with the _id, or nil if it does not exist.
+func getDevice(tx *bolt.Tx, id objectid.ObjectID) (*Device, error) {
+	value := tx.Bucket(devicesBucket).Get(id[:])
+	if value == nil {
+		return nil, nil
+	}
+	device := &Device{}
+	err := device.UnmarshalBSON(value)
+	if err != nil {
+		err = errors.Wrap(err, "Error unmarshalling Device")
+		return nil, err
+	}
+	return device, nil
+}
+
+// putDevice stores the Device, replacing existing, which is nil for new Devices,
+// and updates the indexes of UniqueConstraints.
+func (b *BoltStorage) putDevice(tx *bolt.Tx, existing *Device, device *Device) error {
+	if existing != nil {
+		err := b.unindexUnique(tx, existing)
+		if err != nil {
+			return err
+		}
+	}
+	value, err := device.MarshalBSON()
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling Device")
+		return err
+	}
+	existingDeviceID := ""
+	if existing != nil {
+		existingDeviceID = existing.DeviceID.String()
+	}
+	err = putDeviceValue(tx, device.ID, existingDeviceID, device.DeviceID.String(), value)
+	if err != nil {
+		return err
+	}
+	return b.indexUnique(tx, device)
+}
+
+// putDeviceValue stores the marshalled Device with the _id, replacing the Device
+// with existingDeviceID, which is blank for new Devices, and maps its deviceID
+// to its _id. A *UniqueConflictError is returned if another Device has the same
+// deviceID.
+func putDeviceValue(
+	tx *bolt.Tx,
+	id objectid.ObjectID,
+	existingDeviceID string,
+	deviceID string,
+	value []byte,
+) error {
+	deviceIDs := tx.Bucket(deviceIDsBucket)
+	if mappedID := deviceIDs.Get([]byte(deviceID)); mappedID != nil &&
+		!bytes.Equal(mappedID, id[:]) {
+		uuid, _ := uuuid.FromString(deviceID)
+		return &UniqueConflictError{
+			Constraint: DeviceIDIndex,
+			DeviceID:   uuid,
+		}
+	}
+	if existingDeviceID != "" && existingDeviceID != deviceID {
+		err := deviceIDs.Delete([]byte(existingDeviceID))
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tx.Bucket(devicesBucket).Put(id[:], value)
+	if err != nil {
+		return err
+	}
+	return deviceIDs.Put([]byte(deviceID), id[:])
+}
+
+// BoltProcessedEvents records processed events in a BoltDB database.
+type BoltProcessedEvents struct {
+	db *bolt.DB
+}
+
+// NewBoltProcessedEvents creates ProcessedEvents backed by a BoltDB database,
+// creating its bucket if required.
+func NewBoltProcessedEvents(db *bolt.DB) (*BoltProcessedEvents, error) {
+	if db == nil {
+		return nil, errors.New("db cannot be nil")
+	}
+	err := createBuckets(db, processedBucket)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltProcessedEvents{db}, nil
+}
+
+// Response returns the recorded response for the event,
+// or nil if the event was not processed yet.
+func (p *BoltProcessedEvents) Response(
+	eventUUID uuuid.UUID,
+) (*model.KafkaResponse, error) {
+	var kr *model.KafkaResponse
+	err := p.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(processedBucket).Get([]byte(eventUUID.String()))
+		if value == nil {
+			return nil
+		}
+		kr = &model.KafkaResponse{}
+		return json.Unmarshal(value, kr)
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error reading ProcessedEvent")
+		return nil, err
+	}
+	return kr, nil
+}
+
+// Record records the response of a handled event.
+func (p *BoltProcessedEvents) Record(response *model.KafkaResponse) error {
+	responseMarshal, err := json.Marshal(response)
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling response")
+		return err
+	}
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(processedBucket).Put(
+			[]byte(response.UUID.String()), responseMarshal,
+		)
+	})
+}
+
+// BoltMigrationStore is the MigrationStore for Devices in a BoltDB database.
+type BoltMigrationStore struct {
+	db *bolt.DB
+}
+
+// NewBoltMigrationStore creates a MigrationStore for the Devices
+// of a BoltStorage, creating its buckets if required.
+func NewBoltMigrationStore(db *bolt.DB) (*BoltMigrationStore, error) {
+	if db == nil {
+		return nil, errors.New("db cannot be nil")
+	}
+	err := createBuckets(db, devicesBucket, metaBucket)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltMigrationStore{db}, nil
+}
+
+// Version returns the schema-version Devices were migrated to.
+func (s *BoltMigrationStore) Version() (int64, error) {
+	var version int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(metaBucket).Get([]byte("schemaVersion"))
+		if value != nil {
+			version = int64(binary.BigEndian.Uint64(value))
+		}
+		return nil
+	})
+	return version, err
+}
+
+// SetVersion records the schema-version Devices were migrated to.
+func (s *BoltMigrationStore) SetVersion(version int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(version))
+		bucket := tx.Bucket(metaBucket)
+		err := bucket.Put([]byte("schemaVersion"), value)
+		if err != nil {
+			return err
+		}
+		timestamp := make([]byte, 8)
+		binary.BigEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()))
+		return bucket.Put([]byte("timestamp"), timestamp)
+	})
+}
+
+// EachDocument calls fn with each Device document matching filter.
+func (s *BoltMigrationStore) EachDocument(
+	filter map[string]interface{}, fn func(doc map[string]interface{}) error,
+) error {
+	// Documents are read before calling fn, since fn can replace documents,
+	// which requires a read-write transaction.
+	docs := []map[string]interface{}{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(devicesBucket).ForEach(func(k, v []byte) error {
+			doc := map[string]interface{}{}
+			err := bson.Unmarshal(v, doc)
+			if err != nil {
+				err = errors.Wrap(err, "Error unmarshalling document")
+				return err
+			}
+			matches, err := matchFilter(doc, filter, false)
+			if matches {
+				docs = append(docs, doc)
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		err = fn(doc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplaceDocument replaces the Device document with the same _id, and maps its
+// deviceID to it. Indexes of UniqueConstraints are rebuilt by NewBoltStorage.
+func (s *BoltMigrationStore) ReplaceDocument(doc map[string]interface{}) error {
+	id, isObjectID := doc["_id"].(objectid.ObjectID)
+	if !isObjectID {
+		return errors.New("error asserting document _id to ObjectID")
+	}
+	deviceID, isString := doc["deviceID"].(string)
+	if !isString {
+		return errors.New("error asserting document deviceID to string")
+	}
+	value, err := bson.Marshal(doc)
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling document")
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		existingValue := tx.Bucket(devicesBucket).Get(id[:])
+		if existingValue == nil {
+			return nil
+		}
+		existing := map[string]interface{}{}
+		err := bson.Unmarshal(existingValue, existing)
+		if err != nil {
+			err = errors.Wrap(err, "Error unmarshalling document")
+			return err
+		}
+		existingDeviceID, _ := existing["deviceID"].(string)
+		return putDeviceValue(tx, id, existingDeviceID, deviceID, value)
+	})
+}
+
+// BoltVersionStore records the applied event-version in a BoltDB database.
+type BoltVersionStore struct {
+	db  *bolt.DB
+	key []byte
+}
+
+// NewBoltVersionStore creates a VersionStore for the Devices of a BoltStorage,
+// creating its bucket if required.
+func NewBoltVersionStore(db *bolt.DB) (*BoltVersionStore, error) {
+	return newBoltVersionStore(db, "appliedVersion")
+}
+
+// NewBoltPollVersionStore creates a VersionStore recording the Version of the
+// last event polled from the EventStore, rather than the last applied event.
+func NewBoltPollVersionStore(db *bolt.DB) (*BoltVersionStore, error) {
+	return newBoltVersionStore(db, "polledVersion")
+}
+
+func newBoltVersionStore(db *bolt.DB, key string) (*BoltVersionStore, error) {
+	if db == nil {
+		return nil, errors.New("db cannot be nil")
+	}
+	err := createBuckets(db, metaBucket)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltVersionStore{db, []byte(key)}, nil
+}
+
+// AppliedVersion returns the Version of the last applied event.
+func (s *BoltVersionStore) AppliedVersion() (int64, error) {
+	var version int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(metaBucket).Get(s.key)
+		if value != nil {
+			version = int64(binary.BigEndian.Uint64(value))
+		}
+		return nil
+	})
+	return version, err
+}
+
+// SetAppliedVersion records the Version of the last applied event.
+func (s *BoltVersionStore) SetAppliedVersion(version int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(version))
+		return tx.Bucket(metaBucket).Put(s.key, value)
+	})
+}
+
+// BoltSnapshotStore stores Snapshots in a BoltDB database.
+type BoltSnapshotStore struct {
+	db *bolt.DB
+}
+
+// NewBoltSnapshotStore creates a SnapshotStore backed by a BoltDB database,
+// creating its bucket if required.
+func NewBoltSnapshotStore(db *bolt.DB) (*BoltSnapshotStore, error) {
+	if db == nil {
+		return nil, errors.New("db cannot be nil")
+	}
+	err := createBuckets(db, snapshotsBucket)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltSnapshotStore{db}, nil
+}
+
+// Latest returns the Snapshot with the highest Version.
+func (s *BoltSnapshotStore) Latest() (*Snapshot, error) {
+	var snapshot *Snapshot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		_, value := tx.Bucket(snapshotsBucket).Cursor().Last()
+		if value == nil {
+			return nil
+		}
+		snapshot = &Snapshot{}
+		err := json.Unmarshal(value, snapshot)
+		if err != nil {
+			err = errors.Wrap(err, "Error unmarshalling Snapshot")
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Save saves the Snapshot, keyed by its Version.
+func (s *BoltSnapshotStore) Save(snapshot *Snapshot) error {
+	value, err := json.Marshal(snapshot)
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling Snapshot")
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(snapshot.Version))
+		return tx.Bucket(snapshotsBucket).Put(key, value)
+	})
+}
@@ -0,0 +1,304 @@
+package device
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var _ = Describe("BoltStorage", func() {
+	var (
+		dbFile string
+		db     *bolt.DB
+		store  *BoltStorage
+	)
+
+	newDevice := func(name string, lot string) *Device {
+		deviceID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		return &Device{
+			DeviceID:      deviceID,
+			DateInstalled: 1539211234,
+			Lot:           lot,
+			Name:          name,
+			Status:        "active",
+			SKU:           "sku-1",
+		}
+	}
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "agg_device_bolt")
+		Expect(err).ToNot(HaveOccurred())
+		dbFile = f.Name()
+		f.Close()
+
+		db, err = bolt.Open(dbFile, 0600, nil)
+		Expect(err).ToNot(HaveOccurred())
+		store, err = NewBoltStorage(BoltStorageConfig{
+			DB: db,
+			UniqueConstraints: []UniqueConstraint{
+				UniqueConstraint{
+					Name:            "lot_name_unique",
+					Fields:          []string{"lot", "name"},
+					CaseInsensitive: true,
+				},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.Remove(dbFile)
+	})
+
+	It("should insert, find, update and delete Devices", func() {
+		d := newDevice("sensor", "lot-a")
+		id, err := store.InsertOne(d)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(id).ToNot(Equal(objectid.NilObjectID))
+		_, err = store.InsertOne(newDevice("probe", "lot-b"))
+		Expect(err).ToNot(HaveOccurred())
+
+		found, err := store.Find(map[string]interface{}{
+			"deviceID": d.DeviceID.String(),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(HaveLen(1))
+		d.ID = id
+		Expect(found[0]).To(Equal(d))
+
+		matched, modified, err := store.UpdateMany(
+			map[string]interface{}{"lot": map[string]interface{}{"$in": []string{"lot-a"}}},
+			map[string]interface{}{"status": "retired", "dateInstalled": float64(1)},
+		)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(matched).To(Equal(int64(1)))
+		Expect(modified).To(Equal(int64(1)))
+
+		count, err := store.Count(map[string]interface{}{
+			"status":        "retired",
+			"dateInstalled": map[string]interface{}{"$lt": 2},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(int64(1)))
+
+		deleted, err := store.DeleteMany(map[string]interface{}{
+			"$or": []interface{}{
+				map[string]interface{}{"name": "sensor"},
+				map[string]interface{}{"name": "probe"},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(deleted).To(Equal(int64(2)))
+		count, err = store.Count(map[string]interface{}{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(BeZero())
+	})
+
+	It("should not count unchanged Devices as modified", func() {
+		_, err := store.InsertOne(newDevice("sensor", "lot-a"))
+		Expect(err).ToNot(HaveOccurred())
+
+		matched, modified, err := store.UpdateMany(
+			map[string]interface{}{"name": "sensor"},
+			map[string]interface{}{"status": "active"},
+		)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(matched).To(Equal(int64(1)))
+		Expect(modified).To(BeZero())
+	})
+
+	It("should keep deviceIDs unique", func() {
+		d := newDevice("sensor", "lot-a")
+		_, err := store.InsertOne(d)
+		Expect(err).ToNot(HaveOccurred())
+
+		clash := newDevice("probe", "lot-b")
+		clash.DeviceID = d.DeviceID
+		_, err = store.InsertOne(clash)
+		conflict, isConflict := errors.Cause(err).(*UniqueConflictError)
+		Expect(isConflict).To(BeTrue())
+		Expect(conflict.Constraint).To(Equal(DeviceIDIndex))
+	})
+
+	It("should check UniqueConstraints ignoring case", func() {
+		_, err := store.InsertOne(newDevice("sensor", "lot-a"))
+		Expect(err).ToNot(HaveOccurred())
+		other := newDevice("probe", "lot-a")
+		_, err = store.InsertOne(other)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = store.InsertOne(newDevice("SENSOR", "LOT-A"))
+		_, isConflict := errors.Cause(err).(*UniqueConflictError)
+		Expect(isConflict).To(BeTrue())
+
+		_, _, err = store.UpdateMany(
+			map[string]interface{}{"deviceID": other.DeviceID.String()},
+			map[string]interface{}{"name": "Sensor"},
+		)
+		_, isConflict = errors.Cause(err).(*UniqueConflictError)
+		Expect(isConflict).To(BeTrue())
+	})
+
+	It("should discard writes of failed Transactions", func() {
+		err := store.Transaction(func(tx Storage) error {
+			_, err := tx.InsertOne(newDevice("sensor", "lot-a"))
+			Expect(err).ToNot(HaveOccurred())
+			err = tx.InsertAssignment(&Assignment{Action: AssignServiceAction})
+			Expect(err).ToNot(HaveOccurred())
+			return errors.New("some error")
+		})
+		Expect(err).To(HaveOccurred())
+
+		count, err := store.Count(map[string]interface{}{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(BeZero())
+	})
+
+	It("should restore Devices with their _ids", func() {
+		d := newDevice("sensor", "lot-a")
+		d.ID = objectid.New()
+		err := store.Restore([]*Device{d})
+		Expect(err).ToNot(HaveOccurred())
+		err = store.Restore([]*Device{d})
+		Expect(err).ToNot(HaveOccurred())
+
+		devices := []*Device{}
+		err = store.Each(map[string]interface{}{}, func(device *Device) error {
+			devices = append(devices, device)
+			return nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(devices).To(Equal([]*Device{d}))
+	})
+
+	It("should look up Devices by _id and deviceID", func() {
+		devices := []*Device{}
+		for _, name := range []string{"a", "b", "c"} {
+			d := newDevice(name, "lot-"+name)
+			id, err := store.InsertOne(d)
+			Expect(err).ToNot(HaveOccurred())
+			d.ID = id
+			devices = append(devices, d)
+		}
+
+		found, err := store.Find(map[string]interface{}{
+			"deviceID": map[string]interface{}{"$in": []interface{}{
+				devices[2].DeviceID.String(), devices[0].DeviceID.String(), "unknown",
+			}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(Equal([]*Device{devices[0], devices[2]}))
+
+		found, err = store.Find(map[string]interface{}{
+			"deviceID": devices[1].DeviceID.String(),
+			"name":     "c",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(BeEmpty())
+
+		found, err = store.FindPage(map[string]interface{}{}, devices[0].ID, 5)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(Equal(devices[1:]))
+		found, err = store.Find(map[string]interface{}{"_id": devices[1].ID})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(Equal([]*Device{devices[1]}))
+		found, err = store.Find(idsFilter([]*Device{devices[2], devices[0]}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(Equal([]*Device{devices[0], devices[2]}))
+	})
+
+	It("should check UniqueConstraints on all Devices an update matches", func() {
+		for _, name := range []string{"a", "b"} {
+			_, err := store.InsertOne(newDevice(name, "lot-a"))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"filter":        map[string]interface{}{"lot": "lot-a"},
+			"update":        map[string]interface{}{"name": "sensor"},
+			"allowMultiple": true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = Update(FilterLimits{})(store, &model.Event{
+			EventAction: "update",
+			Data:        data,
+		})
+		Expect(errorCode(err, 0)).To(Equal(int16(ConflictError)))
+
+		count, err := store.Count(map[string]interface{}{"name": "sensor"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(BeZero())
+	})
+
+	It("should rebuild indexes of UniqueConstraints", func() {
+		_, err := store.InsertOne(newDevice("sensor", "lot-a"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = store.InsertOne(newDevice("sensor", "lot-b"))
+		Expect(err).ToNot(HaveOccurred())
+
+		store, err = NewBoltStorage(BoltStorageConfig{
+			DB: db,
+			UniqueConstraints: []UniqueConstraint{
+				UniqueConstraint{Name: "name_unique", Fields: []string{"name"}},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = store.InsertOne(newDevice("sensor", "lot-c"))
+		_, isConflict := errors.Cause(err).(*UniqueConflictError)
+		Expect(isConflict).To(BeTrue())
+
+		// Deleted Devices are removed from indexes
+		_, err = store.DeleteMany(map[string]interface{}{"name": "sensor"})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = store.InsertOne(newDevice("sensor", "lot-c"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should map deviceIDs of migrated Devices", func() {
+		d := newDevice("sensor", "lot-a")
+		id, err := store.InsertOne(d)
+		Expect(err).ToNot(HaveOccurred())
+		migrations, err := NewBoltMigrationStore(db)
+		Expect(err).ToNot(HaveOccurred())
+
+		deviceID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		err = migrations.ReplaceDocument(map[string]interface{}{
+			"_id":      id,
+			"deviceID": deviceID.String(),
+			"name":     "sensor",
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		found, err := store.Find(map[string]interface{}{"deviceID": deviceID.String()})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(HaveLen(1))
+		Expect(found[0].ID).To(Equal(id))
+		found, err = store.Find(map[string]interface{}{"deviceID": d.DeviceID.String()})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(BeEmpty())
+
+		// The previous deviceID can be used again
+		_, err = store.InsertOne(d)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should reject unsupported filter operators", func() {
+		_, err := store.InsertOne(newDevice("sensor", "lot-a"))
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = store.Find(map[string]interface{}{
+			"name": map[string]interface{}{"$regex": "^s"},
+		})
+		Expect(err).To(HaveOccurred())
+	})
+})
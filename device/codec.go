@@ -0,0 +1,482 @@
+package device
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/pkg/errors"
+)
+
+// Devices are encoded and decoded field by field, without intermediate maps
+// or logging, since the codec dominates CPU when replaying events and scanning
+// BoltDB. The wire format is unchanged: UUIDs are strings, _id is an ObjectID
+// in BSON and a hex-string in JSON, and tenantID and _id are only set if
+// non-empty. Its output is checked against the map-based encoding in tests.
+
+// BSON element-types, as per the BSON specification.
+const (
+	bsonDouble    byte = 0x01
+	bsonString    byte = 0x02
+	bsonDocument  byte = 0x03
+	bsonArray     byte = 0x04
+	bsonBinary    byte = 0x05
+	bsonUndefined byte = 0x06
+	bsonObjectID  byte = 0x07
+	bsonBoolean   byte = 0x08
+	bsonDateTime  byte = 0x09
+	bsonNull      byte = 0x0A
+	bsonRegex     byte = 0x0B
+	bsonDBPointer byte = 0x0C
+	bsonCode      byte = 0x0D
+	bsonSymbol    byte = 0x0E
+	bsonCodeScope byte = 0x0F
+	bsonInt32     byte = 0x10
+	bsonTimestamp byte = 0x11
+	bsonInt64     byte = 0x12
+	bsonDecimal   byte = 0x13
+	bsonMinKey    byte = 0xFF
+	bsonMaxKey    byte = 0x7F
+)
+
+// deviceBSONSize is the initial capacity of marshalled Devices,
+// fitting most Devices without growing.
+const deviceBSONSize = 320
+
+// MarshalBSON returns bytes of BSON-type.
+func (d Device) MarshalBSON() ([]byte, error) {
+	b := make([]byte, 4, deviceBSONSize)
+	if d.ID != objectid.NilObjectID {
+		b = appendBSONKey(b, bsonObjectID, "_id")
+		b = append(b, d.ID[:]...)
+	}
+	b = appendBSONString(b, "itemID", d.ItemID.String())
+	b = appendBSONString(b, "deviceID", d.DeviceID.String())
+	b = appendBSONInt64(b, "dateInstalled", d.DateInstalled)
+	b = appendBSONString(b, "lot", d.Lot)
+	b = appendBSONInt64(b, "lastMaintenance", d.LastMaintenance)
+	b = appendBSONString(b, "name", d.Name)
+	b = appendBSONString(b, "status", d.Status)
+	b = appendBSONString(b, "sku", d.SKU)
+	b = appendBSONInt64(b, "schemaVersion", SchemaVersion)
+	// TenantID is only stored if set, so Devices stored without
+	// tenancy are unchanged
+	if d.TenantID != "" {
+		b = appendBSONString(b, "tenantID", d.TenantID)
+	}
+	b = append(b, 0)
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+	return b, nil
+}
+
+func appendBSONKey(b []byte, elemType byte, key string) []byte {
+	b = append(b, elemType)
+	b = append(b, key...)
+	return append(b, 0)
+}
+
+func appendBSONString(b []byte, key string, value string) []byte {
+	b = appendBSONKey(b, bsonString, key)
+	b = appendUint32(b, uint32(len(value)+1))
+	b = append(b, value...)
+	return append(b, 0)
+}
+
+func appendBSONInt64(b []byte, key string, value int64) []byte {
+	b = appendBSONKey(b, bsonInt64, key)
+	u := uint64(value)
+	return append(
+		b,
+		byte(u), byte(u>>8), byte(u>>16), byte(u>>24),
+		byte(u>>32), byte(u>>40), byte(u>>48), byte(u>>56),
+	)
+}
+
+func appendUint32(b []byte, u uint32) []byte {
+	return append(b, byte(u), byte(u>>8), byte(u>>16), byte(u>>24))
+}
+
+// UnmarshalBSON returns BSON-type from bytes.
+// Fields not of Device are skipped, as are null fields.
+func (d *Device) UnmarshalBSON(in []byte) error {
+	if len(in) < 5 || int(binary.LittleEndian.Uint32(in)) != len(in) ||
+		in[len(in)-1] != 0 {
+		return errors.New("Unmarshal Error: invalid BSON document")
+	}
+
+	pos := 4
+	for pos < len(in)-1 {
+		elemType := in[pos]
+		keyEnd := pos + 1
+		for keyEnd < len(in) && in[keyEnd] != 0 {
+			keyEnd++
+		}
+		if keyEnd >= len(in)-1 {
+			return errors.New("Unmarshal Error: invalid BSON element-key")
+		}
+		key := in[pos+1 : keyEnd]
+		value := in[keyEnd+1 : len(in)-1]
+
+		size, err := bsonValueSize(elemType, value)
+		if err != nil {
+			err = errors.Wrapf(err, "Unmarshal Error: invalid BSON element %q", key)
+			return err
+		}
+		if elemType != bsonNull && elemType != bsonUndefined {
+			err = d.setBSONField(key, elemType, value[:size])
+			if err != nil {
+				return err
+			}
+		}
+		pos = keyEnd + 1 + size
+	}
+	return nil
+}
+
+// setBSONField sets the Device field stored as key to the BSON-value.
+// Go does not allocate for string(key) in switch statements.
+func (d *Device) setBSONField(key []byte, elemType byte, value []byte) error {
+	var err error
+	switch string(key) {
+	case "_id":
+		err = setBSONObjectID(&d.ID, elemType, value)
+	case "itemID":
+		err = setBSONUUID(&d.ItemID, elemType, value)
+	case "deviceID":
+		err = setBSONUUID(&d.DeviceID, elemType, value)
+	case "dateInstalled":
+		err = setBSONInt64(&d.DateInstalled, elemType, value)
+	case "lastMaintenance":
+		err = setBSONInt64(&d.LastMaintenance, elemType, value)
+	case "lot":
+		err = setBSONString(&d.Lot, elemType, value)
+	case "name":
+		err = setBSONString(&d.Name, elemType, value)
+	case "status":
+		err = setBSONString(&d.Status, elemType, value)
+	case "sku":
+		err = setBSONString(&d.SKU, elemType, value)
+	case "tenantID":
+		err = setBSONString(&d.TenantID, elemType, value)
+	default:
+		return nil
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "Error while asserting %s", key)
+		return err
+	}
+	return nil
+}
+
+func setBSONObjectID(id *objectid.ObjectID, elemType byte, value []byte) error {
+	if elemType == bsonObjectID {
+		copy(id[:], value)
+		return nil
+	}
+	if elemType != bsonString {
+		return errors.New("error asserting to ObjectID")
+	}
+	parsed, err := objectid.FromHex(bsonStringValue(value))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+func setBSONUUID(u *uuuid.UUID, elemType byte, value []byte) error {
+	if elemType != bsonString {
+		return errors.New("error asserting to string")
+	}
+	parsed, err := uuuid.FromString(bsonStringValue(value))
+	if err != nil {
+		return err
+	}
+	*u = parsed
+	return nil
+}
+
+func setBSONInt64(n *int64, elemType byte, value []byte) error {
+	switch elemType {
+	case bsonInt64:
+		*n = int64(binary.LittleEndian.Uint64(value))
+	case bsonInt32:
+		*n = int64(int32(binary.LittleEndian.Uint32(value)))
+	case bsonDouble:
+		*n = int64(math.Float64frombits(binary.LittleEndian.Uint64(value)))
+	default:
+		return errors.New("not int")
+	}
+	return nil
+}
+
+func setBSONString(s *string, elemType byte, value []byte) error {
+	if elemType != bsonString {
+		return errors.New("error asserting to string")
+	}
+	*s = bsonStringValue(value)
+	return nil
+}
+
+// bsonStringValue returns the string of a BSON string-value,
+// whose size was checked by bsonValueSize.
+func bsonStringValue(value []byte) string {
+	return string(value[4 : len(value)-1])
+}
+
+// bsonValueSize returns the size of the BSON-value of elemType
+// at the start of b.
+func bsonValueSize(elemType byte, b []byte) (int, error) {
+	size := 0
+	switch elemType {
+	case bsonUndefined, bsonNull, bsonMinKey, bsonMaxKey:
+		return 0, nil
+	case bsonBoolean:
+		size = 1
+	case bsonInt32:
+		size = 4
+	case bsonDouble, bsonDateTime, bsonTimestamp, bsonInt64:
+		size = 8
+	case bsonObjectID:
+		size = 12
+	case bsonDecimal:
+		size = 16
+	case bsonString, bsonCode, bsonSymbol:
+		n, err := bsonLength(b, 1)
+		if err != nil {
+			return 0, err
+		}
+		size = 4 + n
+		if size > len(b) || b[size-1] != 0 {
+			return 0, errors.New("string is not null-terminated")
+		}
+	case bsonDocument, bsonArray, bsonCodeScope:
+		n, err := bsonLength(b, 5)
+		if err != nil {
+			return 0, err
+		}
+		size = n
+	case bsonBinary:
+		n, err := bsonLength(b, 0)
+		if err != nil {
+			return 0, err
+		}
+		size = 5 + n
+	case bsonDBPointer:
+		n, err := bsonLength(b, 1)
+		if err != nil {
+			return 0, err
+		}
+		size = 4 + n + 12
+	case bsonRegex:
+		terminators := 0
+		for size < len(b) && terminators < 2 {
+			if b[size] == 0 {
+				terminators++
+			}
+			size++
+		}
+		if terminators < 2 {
+			return 0, errors.New("regex is not null-terminated")
+		}
+	default:
+		return 0, errors.Errorf("unknown element-type 0x%02x", elemType)
+	}
+	if size > len(b) {
+		return 0, errors.New("value exceeds document")
+	}
+	return size, nil
+}
+
+// bsonLength reads the int32 length-prefix of a BSON-value,
+// which must be at least min.
+func bsonLength(b []byte, min int) (int, error) {
+	if len(b) < 4 {
+		return 0, errors.New("value exceeds document")
+	}
+	n := int(int32(binary.LittleEndian.Uint32(b)))
+	if n < min || n > len(b) {
+		return 0, errors.New("invalid value-length")
+	}
+	return n, nil
+}
+
+// deviceJSONSize is the initial capacity of marshalled Devices,
+// fitting most Devices without growing.
+const deviceJSONSize = 320
+
+// MarshalJSON returns bytes of JSON-type.
+// Fields are in alphabetical order.
+func (d *Device) MarshalJSON() ([]byte, error) {
+	b := make([]byte, 0, deviceJSONSize)
+	b = append(b, '{')
+	if d.ID != objectid.NilObjectID {
+		b = append(b, `"_id":"`...)
+		b = append(b, hex.EncodeToString(d.ID[:])...)
+		b = append(b, `",`...)
+	}
+	b = append(b, `"dateInstalled":`...)
+	b = strconv.AppendInt(b, d.DateInstalled, 10)
+	b = append(b, `,"deviceID":`...)
+	b = appendJSONString(b, d.DeviceID.String())
+	b = append(b, `,"itemID":`...)
+	b = appendJSONString(b, d.ItemID.String())
+	b = append(b, `,"lastMaintenance":`...)
+	b = strconv.AppendInt(b, d.LastMaintenance, 10)
+	b = append(b, `,"lot":`...)
+	b = appendJSONString(b, d.Lot)
+	b = append(b, `,"name":`...)
+	b = appendJSONString(b, d.Name)
+	b = append(b, `,"sku":`...)
+	b = appendJSONString(b, d.SKU)
+	b = append(b, `,"status":`...)
+	b = appendJSONString(b, d.Status)
+	if d.TenantID != "" {
+		b = append(b, `,"tenantID":`...)
+		b = appendJSONString(b, d.TenantID)
+	}
+	return append(b, '}'), nil
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s as a JSON-string, escaped as by encoding/json:
+// HTML-characters, U+2028 and U+2029 are escaped, and invalid UTF-8 is
+// replaced with U+FFFD.
+func appendJSONString(b []byte, s string) []byte {
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
+
+// deviceJSON is decoded by UnmarshalJSON. Fields are pointers, so fields that
+// are missing or null are not set on the Device.
+type deviceJSON struct {
+	ID              *string    `json:"_id"`
+	ItemID          *string    `json:"itemID"`
+	DeviceID        *string    `json:"deviceID"`
+	DateInstalled   *jsonInt64 `json:"dateInstalled"`
+	Lot             *string    `json:"lot"`
+	LastMaintenance *jsonInt64 `json:"lastMaintenance"`
+	Name            *string    `json:"name"`
+	Status          *string    `json:"status"`
+	SKU             *string    `json:"sku"`
+	TenantID        *string    `json:"tenantID"`
+}
+
+// UnmarshalJSON returns JSON-type from bytes.
+func (d *Device) UnmarshalJSON(in []byte) error {
+	v := &deviceJSON{}
+	err := json.Unmarshal(in, v)
+	if err != nil {
+		err = errors.Wrap(err, "Unmarshal Error")
+		return err
+	}
+
+	if v.ID != nil {
+		d.ID, err = objectid.FromHex(*v.ID)
+		if err != nil {
+			err = errors.Wrap(err, "Error while asserting ObjectID")
+			return err
+		}
+	}
+	if v.ItemID != nil {
+		d.ItemID, err = uuuid.FromString(*v.ItemID)
+		if err != nil {
+			err = errors.Wrap(err, "Error while parsing ItemID")
+			return err
+		}
+	}
+	if v.DeviceID != nil {
+		d.DeviceID, err = uuuid.FromString(*v.DeviceID)
+		if err != nil {
+			err = errors.Wrap(err, "Error while parsing DeviceID")
+			return err
+		}
+	}
+	if v.DateInstalled != nil {
+		d.DateInstalled = int64(*v.DateInstalled)
+	}
+	if v.LastMaintenance != nil {
+		d.LastMaintenance = int64(*v.LastMaintenance)
+	}
+	if v.Lot != nil {
+		d.Lot = *v.Lot
+	}
+	if v.Name != nil {
+		d.Name = *v.Name
+	}
+	if v.Status != nil {
+		d.Status = *v.Status
+	}
+	if v.SKU != nil {
+		d.SKU = *v.SKU
+	}
+	if v.TenantID != nil {
+		d.TenantID = *v.TenantID
+	}
+	return nil
+}
+
+// jsonInt64 is an int64 decoded from a JSON-number,
+// truncating fractions as when decoding to float64.
+type jsonInt64 int64
+
+func (n *jsonInt64) UnmarshalJSON(in []byte) error {
+	i, err := strconv.ParseInt(string(in), 10, 64)
+	if err != nil {
+		f, err := strconv.ParseFloat(string(in), 64)
+		if err != nil {
+			return errors.Errorf("not int: %s", in)
+		}
+		i = int64(f)
+	}
+	*n = jsonInt64(i)
+	return nil
+}
@@ -0,0 +1,311 @@
+package device
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// The map-based codec that the Device codec replaced. It is kept to check
+// that the wire format is unchanged, and to benchmark against. Maps were
+// logged on every call, which is done here to a discarding logger.
+var legacyLogger = log.New(ioutil.Discard, "", log.LstdFlags)
+
+func legacyMap(d *Device) map[string]interface{} {
+	m := map[string]interface{}{
+		"itemID":          d.ItemID.String(),
+		"deviceID":        d.DeviceID.String(),
+		"dateInstalled":   d.DateInstalled,
+		"lot":             d.Lot,
+		"lastMaintenance": d.LastMaintenance,
+		"name":            d.Name,
+		"status":          d.Status,
+		"sku":             d.SKU,
+	}
+	if d.TenantID != "" {
+		m["tenantID"] = d.TenantID
+	}
+	return m
+}
+
+func legacyMarshalBSON(d *Device) ([]byte, error) {
+	m := legacyMap(d)
+	m["schemaVersion"] = SchemaVersion
+	legacyLogger.Printf("%+v", m)
+	if d.ID != objectid.NilObjectID {
+		m["_id"] = d.ID
+	}
+	return bson.Marshal(m)
+}
+
+func legacyMarshalJSON(d *Device) ([]byte, error) {
+	m := legacyMap(d)
+	legacyLogger.Printf("%+v", m)
+	if d.ID != objectid.NilObjectID {
+		m["_id"] = d.ID.Hex()
+	}
+	return json.Marshal(m)
+}
+
+func legacyUnmarshalBSON(d *Device, in []byte) error {
+	m := make(map[string]interface{})
+	err := bson.Unmarshal(in, m)
+	if err != nil {
+		return err
+	}
+	legacyLogger.Printf("%+v", m)
+	return d.unmarshalFromMap(m)
+}
+
+func legacyUnmarshalJSON(d *Device, in []byte) error {
+	m := make(map[string]interface{})
+	err := json.Unmarshal(in, &m)
+	if err != nil {
+		return err
+	}
+	legacyLogger.Printf("%+v", m)
+	return d.unmarshalFromMap(m)
+}
+
+func newCodecDevice() *Device {
+	itemID, err := uuuid.NewV4()
+	if err != nil {
+		panic(err)
+	}
+	deviceID, err := uuuid.NewV4()
+	if err != nil {
+		panic(err)
+	}
+	return &Device{
+		ID:              objectid.New(),
+		ItemID:          itemID,
+		DeviceID:        deviceID,
+		DateInstalled:   1538000000,
+		Lot:             "lot-a",
+		LastMaintenance: -1538000000,
+		Name:            "sensor",
+		Status:          "active",
+		SKU:             "sku-1",
+		TenantID:        "acme",
+	}
+}
+
+var _ = Describe("Device codec", func() {
+	var devices []*Device
+
+	BeforeEach(func() {
+		escaped := newCodecDevice()
+		escaped.Name = "<a href=\"x\">&\\ \n\r\t\x01 \u00e9 \u4e16 \u2028\u2029"
+		escaped.Lot = "\x7f"
+
+		blank := newCodecDevice()
+		blank.ID = objectid.NilObjectID
+		blank.ItemID = uuuid.UUID{}
+		blank.TenantID = ""
+		blank.Lot = ""
+
+		devices = []*Device{newCodecDevice(), escaped, blank, &Device{}}
+	})
+
+	It("should marshal JSON as the map-based codec did", func() {
+		for _, d := range devices {
+			marshalled, err := json.Marshal(d)
+			Expect(err).ToNot(HaveOccurred())
+			legacy, err := legacyMarshalJSON(d)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(marshalled)).To(Equal(string(legacy)))
+
+			unmarshalled := &Device{}
+			err = json.Unmarshal(marshalled, unmarshalled)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmarshalled).To(Equal(d))
+		}
+
+		// Invalid UTF-8 is replaced, which newer Go-versions do without escaping
+		marshalled, err := json.Marshal(&Device{Name: "a\xffb"})
+		Expect(err).ToNot(HaveOccurred())
+		unmarshalled := &Device{}
+		err = json.Unmarshal(marshalled, unmarshalled)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(unmarshalled.Name).To(Equal("a\ufffdb"))
+	})
+
+	It("should escape control characters as encoding/json does", func() {
+		for c := 0; c < 0x20; c++ {
+			s := "a" + string(rune(c)) + "b"
+			golden, err := json.Marshal(s)
+			Expect(err).ToNot(HaveOccurred())
+			// The service is built with Go 1.11, escaping \b and \f as
+			// \u0008 and \u000c, which Go 1.22 shortened to \b and \f
+			golden = bytes.Replace(golden, []byte(`\b`), []byte(`\u0008`), 1)
+			golden = bytes.Replace(golden, []byte(`\f`), []byte(`\u000c`), 1)
+			Expect(string(appendJSONString(nil, s))).To(Equal(string(golden)))
+		}
+	})
+
+	It("should marshal BSON as the map-based codec did", func() {
+		for _, d := range devices {
+			marshalled, err := d.MarshalBSON()
+			Expect(err).ToNot(HaveOccurred())
+			legacy, err := legacyMarshalBSON(d)
+			Expect(err).ToNot(HaveOccurred())
+
+			// Map-keys were marshalled in random order,
+			// so documents are compared as maps
+			m := map[string]interface{}{}
+			err = bson.Unmarshal(marshalled, m)
+			Expect(err).ToNot(HaveOccurred())
+			legacyM := map[string]interface{}{}
+			err = bson.Unmarshal(legacy, legacyM)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m).To(Equal(legacyM))
+
+			unmarshalled := &Device{}
+			err = unmarshalled.UnmarshalBSON(marshalled)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmarshalled).To(Equal(d))
+		}
+	})
+
+	It("should unmarshal BSON and JSON as the map-based codec did", func() {
+		id := objectid.New()
+		deviceID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		in := map[string]interface{}{
+			"_id":             id,
+			"deviceID":        deviceID.String(),
+			"dateInstalled":   int32(-12),
+			"lastMaintenance": 12.7,
+			"name":            "sensor",
+			"extra": map[string]interface{}{
+				"list": []interface{}{true, "x", int64(1)},
+			},
+		}
+		inBSON, err := bson.Marshal(in)
+		Expect(err).ToNot(HaveOccurred())
+		in["_id"] = id.Hex()
+		inJSON, err := json.Marshal(in)
+		Expect(err).ToNot(HaveOccurred())
+
+		d := &Device{Lot: "kept"}
+		err = d.UnmarshalBSON(inBSON)
+		Expect(err).ToNot(HaveOccurred())
+		legacy := &Device{Lot: "kept"}
+		err = legacyUnmarshalBSON(legacy, inBSON)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d).To(Equal(legacy))
+		Expect(d.DateInstalled).To(Equal(int64(-12)))
+
+		// Null fields are not set
+		in["lot"] = nil
+		inJSON, err = json.Marshal(in)
+		Expect(err).ToNot(HaveOccurred())
+		d = &Device{Lot: "kept"}
+		err = d.UnmarshalJSON(inJSON)
+		Expect(err).ToNot(HaveOccurred())
+		legacy = &Device{Lot: "kept"}
+		err = legacyUnmarshalJSON(legacy, inJSON)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d).To(Equal(legacy))
+	})
+
+	It("should reject invalid fields and documents", func() {
+		invalid := []map[string]interface{}{
+			{"deviceID": "not-a-uuid"},
+			{"itemID": int64(1)},
+			{"status": int64(1)},
+			{"dateInstalled": "1"},
+			{"_id": "not-hex"},
+		}
+		for _, in := range invalid {
+			inBSON, err := bson.Marshal(in)
+			Expect(err).ToNot(HaveOccurred())
+			Expect((&Device{}).UnmarshalBSON(inBSON)).To(HaveOccurred())
+			inJSON, err := json.Marshal(in)
+			Expect(err).ToNot(HaveOccurred())
+			Expect((&Device{}).UnmarshalJSON(inJSON)).To(HaveOccurred())
+		}
+
+		marshalled, err := newCodecDevice().MarshalBSON()
+		Expect(err).ToNot(HaveOccurred())
+		for _, truncated := range [][]byte{
+			marshalled[:len(marshalled)-1],
+			marshalled[:3],
+			append(marshalled[:4:4], 0x02, 'a', 0, 0xFF, 0xFF, 0xFF, 0x7F, 0),
+		} {
+			Expect((&Device{}).UnmarshalBSON(truncated)).To(HaveOccurred())
+		}
+	})
+})
+
+func BenchmarkDeviceMarshalBSON(b *testing.B) {
+	d := newCodecDevice()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		d.MarshalBSON()
+	}
+}
+
+func BenchmarkLegacyDeviceMarshalBSON(b *testing.B) {
+	d := newCodecDevice()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		legacyMarshalBSON(d)
+	}
+}
+
+func BenchmarkDeviceUnmarshalBSON(b *testing.B) {
+	in, _ := newCodecDevice().MarshalBSON()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		(&Device{}).UnmarshalBSON(in)
+	}
+}
+
+func BenchmarkLegacyDeviceUnmarshalBSON(b *testing.B) {
+	in, _ := newCodecDevice().MarshalBSON()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		legacyUnmarshalBSON(&Device{}, in)
+	}
+}
+
+func BenchmarkDeviceMarshalJSON(b *testing.B) {
+	d := newCodecDevice()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		d.MarshalJSON()
+	}
+}
+
+func BenchmarkLegacyDeviceMarshalJSON(b *testing.B) {
+	d := newCodecDevice()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		legacyMarshalJSON(d)
+	}
+}
+
+func BenchmarkDeviceUnmarshalJSON(b *testing.B) {
+	in, _ := newCodecDevice().MarshalJSON()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		(&Device{}).UnmarshalJSON(in)
+	}
+}
+
+func BenchmarkLegacyDeviceUnmarshalJSON(b *testing.B) {
+	in, _ := newCodecDevice().MarshalJSON()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		legacyUnmarshalJSON(&Device{}, in)
+	}
+}
@@ -0,0 +1,59 @@
+package device
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/pkg/errors"
+)
+
+// CommandFunc handles an event, and returns the result to respond with.
+// Errors are responded with the error-code set using NewError,
+// or InternalError if none is set. The result is responded even if
+// there is an error, such as for rejected dry-runs.
+type CommandFunc func(store Storage, event *model.Event) (interface{}, error)
+
+// Respond adapts the command to a HandlerFunc, creating the KafkaResponse
+// from the command's result and error.
+func Respond(command CommandFunc) HandlerFunc {
+	return func(store Storage, event *model.Event) *model.KafkaResponse {
+		result, err := command(store, event)
+
+		kr := &model.KafkaResponse{
+			AggregateID:   event.AggregateID,
+			CorrelationID: event.CorrelationID,
+			EventAction:   event.EventAction,
+			ServiceAction: event.ServiceAction,
+			UUID:          event.UUID,
+		}
+		if result != nil {
+			resultMarshal, marshalErr := json.Marshal(result)
+			if marshalErr != nil {
+				marshalErr = errors.Wrap(marshalErr, "Error marshalling result")
+				log.Println(marshalErr)
+				return errorResponse(event, marshalErr, InternalError)
+			}
+			kr.Result = resultMarshal
+		}
+		if err != nil {
+			log.Println(err)
+			kr.Error = err.Error()
+			kr.ErrorCode = errorCode(err, InternalError)
+		}
+		return kr
+	}
+}
+
+// errorResponse creates the KafkaResponse for an event that failed with err.
+func errorResponse(event *model.Event, err error, errCode int16) *model.KafkaResponse {
+	return &model.KafkaResponse{
+		AggregateID:   event.AggregateID,
+		CorrelationID: event.CorrelationID,
+		Error:         err.Error(),
+		ErrorCode:     errCode,
+		EventAction:   event.EventAction,
+		ServiceAction: event.ServiceAction,
+		UUID:          event.UUID,
+	}
+}
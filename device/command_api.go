@@ -0,0 +1,271 @@
+package device
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// ErrResponseTimeout is returned by EventPublishers when the response
+// to a published event is not received in time.
+var ErrResponseTimeout = errors.New("timed out waiting for event-response")
+
+// EventPublisher publishes events to the EventStore, and waits for
+// the response produced once the event is handled.
+type EventPublisher interface {
+	Publish(event *model.Event) (*model.KafkaResponse, error)
+}
+
+// CommandAPIConfig defines the dependencies of the command API.
+type CommandAPIConfig struct {
+	// Registry and Storage validate commands before they are published,
+	// by handling them as dry-runs.
+	Registry *Registry
+	Storage  Storage
+	// Publisher publishes validated commands as events.
+	Publisher EventPublisher
+	// Tokens maps the bearer-tokens accepted by requests to the UserUUID of
+	// their user. Events are published with the UserUUID of the request's token.
+	Tokens map[string]uuuid.UUID
+}
+
+// commandRequest is the body of command API requests.
+// UserUUID is optional, and must match the UserUUID of the bearer-token.
+type commandRequest struct {
+	EventAction   string          `json:"eventAction"`
+	ServiceAction string          `json:"serviceAction"`
+	UserUUID      uuuid.UUID      `json:"userUUID"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// commandResponse is the body of command API responses.
+type commandResponse struct {
+	UUID          uuuid.UUID      `json:"uuid"`
+	CorrelationID uuuid.UUID      `json:"correlationID"`
+	Result        json.RawMessage `json:"result,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	ErrorCode     int16           `json:"errorCode,omitempty"`
+	// Published is false if the command was rejected before being published.
+	Published bool `json:"published"`
+}
+
+// commandHandler serves the command API.
+type commandHandler struct {
+	config CommandAPIConfig
+	tokens []commandToken
+}
+
+// commandToken is a bearer-token accepted by the command API.
+type commandToken struct {
+	token    []byte
+	userUUID uuuid.UUID
+}
+
+// NewCommandHandler creates the HTTP API for running commands synchronously.
+// Commands are posted to "/commands" as:
+//
+//	{"eventAction": "update", "serviceAction": "", "userUUID": "", "data": {}}
+//
+// Each command is first handled as a dry-run, and rejected if that fails.
+// Otherwise it is published as an event, and the response produced once the
+// event is handled is returned.
+// Requests must have the header "Authorization: Bearer <token>", with one of
+// the configured Tokens. The command's UserUUID is that of the token, and
+// commands with any other "userUUID" are rejected.
+func NewCommandHandler(config CommandAPIConfig) (http.Handler, error) {
+	if config.Registry == nil {
+		return nil, errors.New("Registry cannot be nil")
+	}
+	if config.Storage == nil {
+		return nil, errors.New("Storage cannot be nil")
+	}
+	if config.Publisher == nil {
+		return nil, errors.New("Publisher cannot be nil")
+	}
+	if len(config.Tokens) == 0 {
+		return nil, errors.New("Tokens cannot be empty")
+	}
+	tokens := []commandToken{}
+	for token, userUUID := range config.Tokens {
+		if token == "" {
+			return nil, errors.New("Tokens cannot contain blank tokens")
+		}
+		if userUUID == (uuuid.UUID{}) {
+			return nil, errors.New("Tokens cannot map to blank UserUUIDs")
+		}
+		tokens = append(tokens, commandToken{
+			token:    []byte(token),
+			userUUID: userUUID,
+		})
+	}
+	return &commandHandler{
+		config: config,
+		tokens: tokens,
+	}, nil
+}
+
+// tokenUser returns the UserUUID of the request's bearer-token.
+// If the token is invalid, false is returned after writing the error.
+func (h *commandHandler) tokenUser(
+	w http.ResponseWriter, r *http.Request,
+) (uuuid.UUID, bool) {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		reqToken := []byte(strings.TrimPrefix(auth, "Bearer "))
+		// All tokens are compared, so timing does not reveal which matched
+		var userUUID uuuid.UUID
+		found := false
+		for _, t := range h.tokens {
+			if subtle.ConstantTimeCompare(reqToken, t.token) == 1 {
+				userUUID = t.userUUID
+				found = true
+			}
+		}
+		if found {
+			return userUUID, true
+		}
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeHTTPError(w, http.StatusUnauthorized, errors.New("invalid bearer token"))
+	return uuuid.UUID{}, false
+}
+
+func (h *commandHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userUUID, ok := h.tokenUser(w, r)
+	if !ok {
+		return
+	}
+	if r.URL.Path != "/commands" {
+		writeHTTPError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeHTTPError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	req := &commandRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		err = errors.Wrap(err, "Error decoding command")
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.UserUUID != (uuuid.UUID{}) && req.UserUUID != userUUID {
+		err = errors.New("userUUID does not match the bearer token's user")
+		writeHTTPError(w, http.StatusForbidden, err)
+		return
+	}
+	req.UserUUID = userUUID
+	event, err := newCommandEvent(req)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	rejection := ValidateCommand(h.config.Registry, h.config.Storage, event)
+	if rejection != nil {
+		writeCommandResponse(w, event, rejection, false)
+		return
+	}
+
+	kr, err := h.config.Publisher.Publish(event)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Cause(err) == ErrResponseTimeout {
+			status = http.StatusGatewayTimeout
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(&commandResponse{
+			UUID:          event.UUID,
+			CorrelationID: event.CorrelationID,
+			Error:         err.Error(),
+			Published:     true,
+		})
+		return
+	}
+	writeCommandResponse(w, event, kr, true)
+}
+
+// newCommandEvent creates the event for the command,
+// with new UUID and CorrelationID.
+func newCommandEvent(req *commandRequest) (*model.Event, error) {
+	if req.EventAction == "" {
+		return nil, errors.New("eventAction is required")
+	}
+	if len(req.Data) == 0 {
+		return nil, errors.New("data is required")
+	}
+
+	eventUUID, err := uuuid.NewV4()
+	if err != nil {
+		err = errors.Wrap(err, "Error generating event UUID")
+		return nil, err
+	}
+	correlationID, err := uuuid.NewV4()
+	if err != nil {
+		err = errors.Wrap(err, "Error generating event CorrelationID")
+		return nil, err
+	}
+	now := time.Now()
+	return &model.Event{
+		AggregateID:   AggregateID,
+		EventAction:   req.EventAction,
+		ServiceAction: req.ServiceAction,
+		CorrelationID: correlationID,
+		Data:          req.Data,
+		NanoTime:      now.UnixNano(),
+		UserUUID:      req.UserUUID,
+		UUID:          eventUUID,
+		YearBucket:    int16(now.Year()),
+	}, nil
+}
+
+// writeCommandResponse writes the KafkaResponse for the event, with the
+// HTTP-status for its error-code.
+func writeCommandResponse(
+	w http.ResponseWriter, event *model.Event, kr *model.KafkaResponse, published bool,
+) {
+	resp := &commandResponse{
+		UUID:          event.UUID,
+		CorrelationID: event.CorrelationID,
+		Published:     published,
+	}
+	status := http.StatusOK
+	if kr != nil {
+		if len(kr.Result) > 0 {
+			resp.Result = kr.Result
+		}
+		resp.Error = kr.Error
+		resp.ErrorCode = kr.ErrorCode
+		if kr.Error != "" {
+			status = commandStatus(kr.ErrorCode)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// commandStatus returns the HTTP-status for a command's error-code.
+func commandStatus(errorCode int16) int {
+	switch errorCode {
+	case ConflictError:
+		return http.StatusConflict
+	case UnauthorizedError:
+		return http.StatusForbidden
+	case DatabaseError:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
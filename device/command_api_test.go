@@ -0,0 +1,185 @@
+package device
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	bolt "go.etcd.io/bbolt"
+)
+
+// publisherFunc is an EventPublisher calling itself.
+type publisherFunc func(event *model.Event) (*model.KafkaResponse, error)
+
+func (f publisherFunc) Publish(event *model.Event) (*model.KafkaResponse, error) {
+	return f(event)
+}
+
+var _ = Describe("CommandHandler", func() {
+	var (
+		dbFile    string
+		db        *bolt.DB
+		store     *BoltStorage
+		published []*model.Event
+		publisher publisherFunc
+		handler   http.Handler
+		userUUID  uuuid.UUID
+		token     string
+	)
+
+	post := func(body interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+		reqBody, err := json.Marshal(body)
+		Expect(err).ToNot(HaveOccurred())
+		req := httptest.NewRequest(http.MethodPost, "/commands", bytes.NewReader(reqBody))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		resp := map[string]interface{}{}
+		err = json.Unmarshal(rec.Body.Bytes(), &resp)
+		Expect(err).ToNot(HaveOccurred())
+		return rec, resp
+	}
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "agg_device_command_api")
+		Expect(err).ToNot(HaveOccurred())
+		dbFile = f.Name()
+		f.Close()
+		db, err = bolt.Open(dbFile, 0600, nil)
+		Expect(err).ToNot(HaveOccurred())
+		store, err = NewBoltStorage(BoltStorageConfig{DB: db})
+		Expect(err).ToNot(HaveOccurred())
+
+		registry := NewRegistry()
+		err = RegisterCommands(registry, CommandsConfig{})
+		Expect(err).ToNot(HaveOccurred())
+
+		userUUID, err = uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		otherUUID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		token = "secret"
+
+		published = []*model.Event{}
+		publisher = func(event *model.Event) (*model.KafkaResponse, error) {
+			published = append(published, event)
+			return &model.KafkaResponse{
+				AggregateID:   event.AggregateID,
+				CorrelationID: event.CorrelationID,
+				EventAction:   event.EventAction,
+				Result:        []byte(`{"deviceID":"published"}`),
+				UUID:          event.UUID,
+			}, nil
+		}
+		handler, err = NewCommandHandler(CommandAPIConfig{
+			Registry: registry,
+			Storage:  store,
+			Publisher: publisherFunc(func(e *model.Event) (*model.KafkaResponse, error) {
+				return publisher(e)
+			}),
+			Tokens: map[string]uuuid.UUID{
+				"secret":       userUUID,
+				"other-secret": otherUUID,
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.Remove(dbFile)
+	})
+
+	It("should publish valid commands and return their response", func() {
+		deviceID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		rec, resp := post(map[string]interface{}{
+			"eventAction": "insert",
+			"data": map[string]interface{}{
+				"deviceID": deviceID.String(),
+				"name":     "sensor",
+			},
+		})
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(resp["published"]).To(BeTrue())
+		Expect(resp["result"]).To(Equal(map[string]interface{}{"deviceID": "published"}))
+
+		Expect(published).To(HaveLen(1))
+		event := published[0]
+		Expect(resp["uuid"]).To(Equal(event.UUID.String()))
+		Expect(event.AggregateID).To(Equal(AggregateID))
+		Expect(event.UserUUID).To(Equal(userUUID))
+		Expect(event.CorrelationID).ToNot(Equal(uuuid.UUID{}))
+		Expect(event.Data).ToNot(ContainSubstring("dryRun"))
+
+		// Dry-run does not change Devices
+		count, err := store.Count(map[string]interface{}{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(BeZero())
+	})
+
+	It("should reject invalid commands without publishing them", func() {
+		rec, resp := post(map[string]interface{}{
+			"eventAction": "delete",
+			"data":        map[string]interface{}{},
+		})
+		Expect(rec.Code).To(Equal(http.StatusUnprocessableEntity))
+		Expect(resp["published"]).To(BeFalse())
+		Expect(resp["error"]).ToNot(BeEmpty())
+		Expect(published).To(BeEmpty())
+
+		rec, _ = post(map[string]interface{}{"eventAction": "insert"})
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(published).To(BeEmpty())
+	})
+
+	It("should publish commands as the user of the bearer-token", func() {
+		deviceID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		command := map[string]interface{}{
+			"eventAction": "insert",
+			"userUUID":    userUUID.String(),
+			"data":        map[string]interface{}{"deviceID": deviceID.String()},
+		}
+
+		token = "other-secret"
+		rec, resp := post(command)
+		Expect(rec.Code).To(Equal(http.StatusForbidden))
+		Expect(resp["error"]).To(ContainSubstring("userUUID"))
+		Expect(published).To(BeEmpty())
+
+		token = "unknown"
+		rec, _ = post(command)
+		Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+		Expect(published).To(BeEmpty())
+
+		token = "secret"
+		rec, _ = post(command)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(published).To(HaveLen(1))
+		Expect(published[0].UserUUID).To(Equal(userUUID))
+	})
+
+	It("should return 504 if the response times out", func() {
+		publisher = func(event *model.Event) (*model.KafkaResponse, error) {
+			return nil, ErrResponseTimeout
+		}
+		deviceID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		rec, resp := post(map[string]interface{}{
+			"eventAction": "insert",
+			"data":        map[string]interface{}{"deviceID": deviceID.String()},
+		})
+		Expect(rec.Code).To(Equal(http.StatusGatewayTimeout))
+		Expect(resp["published"]).To(BeTrue())
+		Expect(resp["uuid"]).ToNot(BeEmpty())
+	})
+})
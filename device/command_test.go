@@ -0,0 +1,123 @@
+package device
+
+import (
+	"errors"
+	"expvar"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// quarantineFunc adapts a function to a Quarantine
+type quarantineFunc func(event *QuarantinedEvent) error
+
+func (f quarantineFunc) Quarantine(event *QuarantinedEvent) error {
+	return f(event)
+}
+
+var _ = Describe("Command", func() {
+	var event *model.Event
+
+	BeforeEach(func() {
+		event = &model.Event{
+			AggregateID: AggregateID,
+			EventAction: "update",
+		}
+	})
+
+	Context("Respond", func() {
+		It("should respond with the marshalled result", func() {
+			kr := Respond(func(Storage, *model.Event) (interface{}, error) {
+				return map[string]int{"count": 1}, nil
+			})(nil, event)
+			Expect(kr.Error).To(BeEmpty())
+			Expect(string(kr.Result)).To(Equal(`{"count":1}`))
+			Expect(kr.AggregateID).To(Equal(event.AggregateID))
+			Expect(kr.EventAction).To(Equal(event.EventAction))
+		})
+
+		It("should respond with the error-code set on the error", func() {
+			kr := Respond(func(Storage, *model.Event) (interface{}, error) {
+				return nil, NewError(UserError, errors.New("some error"))
+			})(nil, event)
+			Expect(kr.Error).To(Equal("some error"))
+			Expect(kr.ErrorCode).To(Equal(int16(UserError)))
+			Expect(kr.Result).To(BeNil())
+		})
+
+		It("should respond with InternalError if no error-code is set", func() {
+			kr := Respond(func(Storage, *model.Event) (interface{}, error) {
+				return nil, errors.New("some error")
+			})(nil, event)
+			Expect(kr.ErrorCode).To(Equal(int16(InternalError)))
+		})
+
+		It("should respond with both result and error", func() {
+			kr := Respond(func(Storage, *model.Event) (interface{}, error) {
+				return "preview", &UniqueConflictError{Constraint: "name"}
+			})(nil, event)
+			Expect(string(kr.Result)).To(Equal(`"preview"`))
+			Expect(kr.ErrorCode).To(Equal(int16(ConflictError)))
+		})
+	})
+
+	Context("Recovery", func() {
+		var quarantined []*QuarantinedEvent
+		var recovery Middleware
+		var metrics *expvar.Map
+
+		panicHandler := func(Storage, *model.Event) *model.KafkaResponse {
+			panic("some panic")
+		}
+
+		BeforeEach(func() {
+			quarantined = nil
+			metrics = new(expvar.Map).Init()
+			recovery = Recovery(metrics, quarantineFunc(func(e *QuarantinedEvent) error {
+				quarantined = append(quarantined, e)
+				return nil
+			}))
+		})
+
+		It("should respond with InternalError on panic", func() {
+			kr := recovery(panicHandler)(nil, event)
+			Expect(kr.Error).To(ContainSubstring("some panic"))
+			Expect(kr.ErrorCode).To(Equal(int16(InternalError)))
+		})
+
+		It("should count panics and quarantine the event", func() {
+			recovery(panicHandler)(nil, event)
+			Expect(metrics.Get("panics").String()).To(Equal("1"))
+			Expect(metrics.Get("update..panics").String()).To(Equal("1"))
+
+			Expect(quarantined).To(HaveLen(1))
+			Expect(quarantined[0].Event).To(Equal(*event))
+			Expect(quarantined[0].Error).To(ContainSubstring("some panic"))
+			Expect(quarantined[0].Stack).ToNot(BeEmpty())
+		})
+
+		It("should not quarantine events handled without panic", func() {
+			recovery(func(Storage, *model.Event) *model.KafkaResponse {
+				return &model.KafkaResponse{}
+			})(nil, event)
+			Expect(quarantined).To(BeEmpty())
+			Expect(metrics.Get("panics")).To(BeNil())
+		})
+	})
+
+	Context("Authorization", func() {
+		It("should reject events that are not allowed", func() {
+			handled := false
+			auth := AuthorizerFunc(func(*model.Event) error {
+				return errors.New("not allowed")
+			})
+			kr := Authorization(auth)(func(Storage, *model.Event) *model.KafkaResponse {
+				handled = true
+				return nil
+			})(nil, event)
+			Expect(handled).To(BeFalse())
+			Expect(kr.ErrorCode).To(Equal(int16(UserError)))
+		})
+	})
+})
@@ -0,0 +1,34 @@
+package device
+
+import "github.com/pkg/errors"
+
+// CommandsConfig provides the dependencies of Device commands.
+type CommandsConfig struct {
+	Limits FilterLimits
+	Items  ItemLookup
+}
+
+// RegisterCommands registers all Device commands on the Registry.
+// New commands are added here.
+func RegisterCommands(r *Registry, config CommandsConfig) error {
+	commands := []struct {
+		eventAction   string
+		serviceAction string
+		command       CommandFunc
+	}{
+		{"insert", "", Insert},
+		{"update", "", Update(config.Limits)},
+		{"update", AssignServiceAction, Assign(config.Items)},
+		{"update", UnassignServiceAction, Unassign},
+		{"delete", "", Delete(config.Limits)},
+	}
+
+	for _, c := range commands {
+		err := r.Register(c.eventAction, c.serviceAction, Respond(c.command))
+		if err != nil {
+			err = errors.Wrapf(err, "Error registering %s command", c.eventAction)
+			return err
+		}
+	}
+	return nil
+}
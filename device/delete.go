@@ -2,10 +2,8 @@ package device
 
 import (
 	"encoding/json"
-	"log"
 
 	"github.com/TerrexTech/go-eventstore-models/model"
-	"github.com/TerrexTech/go-mongoutils/mongo"
 	"github.com/pkg/errors"
 )
 
@@ -13,77 +11,70 @@ type deleteResult struct {
 	DeletedCount int64 `json:"deletedCount,omitempty"`
 }
 
-// Delete handles "delete" events.
-func Delete(collection *mongo.Collection, event *model.Event) *model.KafkaResponse {
-	filter := map[string]interface{}{}
+// Delete returns the command for "delete" events.
+// The number of Devices the filter can match is restricted by limits.
+func Delete(limits FilterLimits) CommandFunc {
+	return func(store Storage, event *model.Event) (interface{}, error) {
+		filter, opts, err := parseDelete(event)
+		if err != nil {
+			return nil, err
+		}
 
-	err := json.Unmarshal(event.Data, &filter)
-	if err != nil {
-		err = errors.Wrap(err, "Delete: Error while unmarshalling Event-data")
-		log.Println(err)
-		return &model.KafkaResponse{
-			AggregateID:   event.AggregateID,
-			CorrelationID: event.CorrelationID,
-			Error:         err.Error(),
-			ErrorCode:     InternalError,
-			EventAction:   event.EventAction,
-			ServiceAction: event.ServiceAction,
-			UUID:          event.UUID,
+		dryRun := isDryRun(event, opts.DryRun)
+		result := &deleteResult{}
+		var preview *dryRunResult
+		// Transaction ensures either all or none of the matched Devices are deleted
+		err = store.Transaction(func(tx Storage) error {
+			err := checkFilter(tx, filter, limits, opts)
+			if dryRun {
+				preview, err = dryRunDelete(tx, filter, event, err)
+				return err
+			}
+			if err != nil {
+				return err
+			}
+
+			// Devices are deleted as Apply deletes them, so filters match
+			// the same Devices when handling and when replaying the event
+			matched, _, err := applyMatching(tx, filter, event)
+			if err != nil || len(matched) == 0 {
+				return err
+			}
+			result.DeletedCount, err = tx.DeleteMany(idsFilter(matched))
+			return err
+		})
+		if err != nil {
+			err = errors.Wrap(err, "Delete: Error in DeleteMany")
+			return nil, NewError(errorCode(err, DatabaseError), err)
 		}
-	}
 
-	if len(filter) == 0 {
-		err = errors.New("blank filter provided")
-		err = errors.Wrap(err, "Delete")
-		log.Println(err)
-		return &model.KafkaResponse{
-			AggregateID:   event.AggregateID,
-			CorrelationID: event.CorrelationID,
-			Error:         err.Error(),
-			ErrorCode:     InternalError,
-			EventAction:   event.EventAction,
-			ServiceAction: event.ServiceAction,
-			UUID:          event.UUID,
+		if dryRun {
+			return preview, preview.rejection
 		}
+		return result, nil
 	}
+}
 
-	deleteStats, err := collection.DeleteMany(filter)
+// parseDelete returns the filter of the "delete" event, and its filterOptions.
+func parseDelete(event *model.Event) (map[string]interface{}, filterOptions, error) {
+	filter := map[string]interface{}{}
+
+	err := json.Unmarshal(event.Data, &filter)
 	if err != nil {
-		err = errors.Wrap(err, "Delete: Error in DeleteMany")
-		log.Println(err)
-		return &model.KafkaResponse{
-			AggregateID:   event.AggregateID,
-			CorrelationID: event.CorrelationID,
-			Error:         err.Error(),
-			ErrorCode:     DatabaseError,
-			EventAction:   event.EventAction,
-			ServiceAction: event.ServiceAction,
-			UUID:          event.UUID,
-		}
+		err = errors.Wrap(err, "Delete: Error while unmarshalling Event-data")
+		return nil, filterOptions{}, NewError(InternalError, err)
 	}
 
-	result := &deleteResult{deleteStats.DeletedCount}
-	resultMarshal, err := json.Marshal(result)
+	opts, err := extractFilterOptions(filter)
 	if err != nil {
-		err = errors.Wrap(err, "Delete: Error marshalling Device Delete-result")
-		log.Println(err)
-		return &model.KafkaResponse{
-			AggregateID:   event.AggregateID,
-			CorrelationID: event.CorrelationID,
-			Error:         err.Error(),
-			ErrorCode:     InternalError,
-			EventAction:   event.EventAction,
-			ServiceAction: event.ServiceAction,
-			UUID:          event.UUID,
-		}
+		err = errors.Wrap(err, "Delete")
+		return nil, opts, NewError(UserError, err)
 	}
 
-	return &model.KafkaResponse{
-		AggregateID:   event.AggregateID,
-		CorrelationID: event.CorrelationID,
-		EventAction:   event.EventAction,
-		Result:        resultMarshal,
-		ServiceAction: event.ServiceAction,
-		UUID:          event.UUID,
+	if len(filter) == 0 {
+		err = errors.New("blank filter provided")
+		err = errors.Wrap(err, "Delete")
+		return nil, opts, NewError(InternalError, err)
 	}
+	return filter, opts, nil
 }
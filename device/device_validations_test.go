@@ -38,7 +38,7 @@ var _ = Describe("DeviceAggregate", func() {
 				Version:       3,
 				YearBucket:    2018,
 			}
-			kr := Delete(nil, mockEvent)
+			kr := Respond(Delete(FilterLimits{}))(nil, mockEvent)
 			Expect(kr.AggregateID).To(Equal(mockEvent.AggregateID))
 			Expect(kr.CorrelationID).To(Equal(mockEvent.CorrelationID))
 			Expect(kr.Error).ToNot(BeEmpty())
@@ -67,7 +67,7 @@ var _ = Describe("DeviceAggregate", func() {
 				Version:       3,
 				YearBucket:    2018,
 			}
-			kr := Insert(nil, mockEvent)
+			kr := Respond(Insert)(nil, mockEvent)
 			Expect(kr.AggregateID).To(Equal(mockEvent.AggregateID))
 			Expect(kr.CorrelationID).To(Equal(mockEvent.CorrelationID))
 			Expect(kr.Error).ToNot(BeEmpty())
@@ -102,7 +102,7 @@ var _ = Describe("DeviceAggregate", func() {
 				Version:       3,
 				YearBucket:    2018,
 			}
-			kr := Update(nil, mockEvent)
+			kr := Respond(Update(FilterLimits{}))(nil, mockEvent)
 			Expect(kr.AggregateID).To(Equal(mockEvent.AggregateID))
 			Expect(kr.CorrelationID).To(Equal(mockEvent.CorrelationID))
 			Expect(kr.Error).ToNot(BeEmpty())
@@ -137,7 +137,7 @@ var _ = Describe("DeviceAggregate", func() {
 				Version:       3,
 				YearBucket:    2018,
 			}
-			kr := Update(nil, mockEvent)
+			kr := Respond(Update(FilterLimits{}))(nil, mockEvent)
 			Expect(kr.AggregateID).To(Equal(mockEvent.AggregateID))
 			Expect(kr.CorrelationID).To(Equal(mockEvent.CorrelationID))
 			Expect(kr.Error).ToNot(BeEmpty())
@@ -174,7 +174,7 @@ var _ = Describe("DeviceAggregate", func() {
 				Version:       3,
 				YearBucket:    2018,
 			}
-			kr := Update(nil, mockEvent)
+			kr := Respond(Update(FilterLimits{}))(nil, mockEvent)
 			Expect(kr.AggregateID).To(Equal(mockEvent.AggregateID))
 			Expect(kr.CorrelationID).To(Equal(mockEvent.CorrelationID))
 			Expect(kr.Error).ToNot(BeEmpty())
@@ -0,0 +1,238 @@
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// DryRunServiceAction is the ServiceAction for events that should only be
+// validated, returning the changes they would make without making them.
+// Alternatively, "dryRun" can be set in Event-data.
+const DryRunServiceAction = "dryRun"
+
+// dryRunOption is set in Event-data to only validate the event.
+type dryRunOption struct {
+	DryRun bool `json:"dryRun"`
+}
+
+// dryRunResult describes the changes an event would make.
+type dryRunResult struct {
+	MatchedCount int64    `json:"matchedCount"`
+	DeviceIDs    []string `json:"deviceIDs"`
+	// Devices are the resulting Devices, as they would be stored.
+	Devices []*Device    `json:"devices"`
+	Diffs   []deviceDiff `json:"diffs"`
+
+	// rejection is set if the event would be rejected due to current Devices.
+	rejection error
+}
+
+// deviceDiff lists the fields of a Device that would change.
+type deviceDiff struct {
+	DeviceID string               `json:"deviceID"`
+	Fields   map[string]fieldDiff `json:"fields"`
+}
+
+// fieldDiff is the value of a field before and after a change.
+// Before is nil for inserted Devices, and After is nil for deleted Devices.
+type fieldDiff struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// isDryRun checks if the event is a dry-run, either by its ServiceAction,
+// or by dryRun set in its data.
+func isDryRun(event *model.Event, dryRun bool) bool {
+	return dryRun || event.ServiceAction == DryRunServiceAction
+}
+
+// newDryRunResult describes the changes from the before-Devices to the
+// after-Devices, which are paired by index. Inserted Devices have a nil
+// before-Device, and deleted Devices have a nil after-Device.
+func newDryRunResult(before []*Device, after []*Device) *dryRunResult {
+	result := &dryRunResult{
+		DeviceIDs: []string{},
+		Devices:   []*Device{},
+		Diffs:     []deviceDiff{},
+	}
+	for i := range before {
+		var beforeFields, afterFields map[string]interface{}
+		deviceID := ""
+		if before[i] != nil {
+			result.MatchedCount++
+			beforeFields = before[i].fieldMap()
+			deviceID = before[i].DeviceID.String()
+		}
+		if after[i] != nil {
+			result.Devices = append(result.Devices, after[i])
+			afterFields = after[i].fieldMap()
+			deviceID = after[i].DeviceID.String()
+		}
+		result.DeviceIDs = append(result.DeviceIDs, deviceID)
+
+		diff := deviceDiff{
+			DeviceID: deviceID,
+			Fields:   map[string]fieldDiff{},
+		}
+		fields := map[string]bool{}
+		for field := range beforeFields {
+			fields[field] = true
+		}
+		for field := range afterFields {
+			fields[field] = true
+		}
+		for field := range fields {
+			beforeValue := beforeFields[field]
+			afterValue := afterFields[field]
+			if before[i] != nil && after[i] != nil &&
+				fmt.Sprint(beforeValue) == fmt.Sprint(afterValue) {
+				continue
+			}
+			diff.Fields[field] = fieldDiff{
+				Before: beforeValue,
+				After:  afterValue,
+			}
+		}
+		result.Diffs = append(result.Diffs, diff)
+	}
+	return result
+}
+
+// isRejection checks if err is a rejection of the event due to the current
+// Devices, such as a unique-constraint conflict, rather than a failure.
+func isRejection(err error) bool {
+	code := errorCode(err, 0)
+	return code == UserError || code == ConflictError
+}
+
+// dryRunInsert describes inserting the Device.
+func dryRunInsert(store Storage, device *Device) (*dryRunResult, error) {
+	existing, err := store.Find(map[string]interface{}{
+		"deviceID": device.DeviceID.String(),
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error finding Device")
+		return nil, err
+	}
+
+	var rejection error
+	if len(existing) > 0 {
+		rejection = &UniqueConflictError{
+			Constraint: "deviceID",
+			DeviceID:   existing[0].DeviceID,
+		}
+	} else {
+		rejection = store.CheckUnique([]*Device{device}, nil)
+		if rejection != nil && !isRejection(rejection) {
+			return nil, rejection
+		}
+	}
+	result := newDryRunResult([]*Device{nil}, []*Device{device})
+	result.rejection = rejection
+	return result, nil
+}
+
+// dryRunMatching returns the Devices the event changes, and the Devices
+// after the event, matching them as the command does using applyMatching.
+// If Apply rejects the event, a result without Devices is returned, which is
+// rejected with limitErr if set, since the command checks that first.
+func dryRunMatching(
+	store Storage,
+	filter map[string]interface{},
+	event *model.Event,
+	limitErr error,
+) ([]*Device, []*Device, *dryRunResult, error) {
+	before, after, err := applyMatching(store, filter, event)
+	if err == nil {
+		return before, after, nil, nil
+	}
+	if !isRejection(err) {
+		err = errors.Wrap(err, "Error finding Devices matching filter")
+		return nil, nil, nil, err
+	}
+	result := newDryRunResult([]*Device{}, []*Device{})
+	result.rejection = err
+	if limitErr != nil {
+		result.rejection = limitErr
+	}
+	return nil, nil, result, nil
+}
+
+// dryRunUpdate describes applying the update-event to the Devices it matches.
+// limitErr is the result of checking the filter, and is the rejection if set.
+func dryRunUpdate(
+	store Storage,
+	deviceUpdate *deviceUpdate,
+	event *model.Event,
+	limitErr error,
+) (*dryRunResult, error) {
+	if limitErr != nil && !isRejection(limitErr) {
+		return nil, limitErr
+	}
+	before, after, rejected, err := dryRunMatching(
+		store, deviceUpdate.Filter, event, limitErr,
+	)
+	if rejected != nil || err != nil {
+		return rejected, err
+	}
+
+	rejection := limitErr
+	if rejection == nil {
+		rejection = store.CheckUnique(after, deviceUpdate.Update)
+		if rejection != nil && !isRejection(rejection) {
+			return nil, rejection
+		}
+	}
+	result := newDryRunResult(before, after)
+	result.rejection = rejection
+	return result, nil
+}
+
+// dryRunDelete describes deleting the Devices the delete-event matches.
+// limitErr is the result of checking filter, and is the rejection if set.
+func dryRunDelete(
+	store Storage,
+	filter map[string]interface{},
+	event *model.Event,
+	limitErr error,
+) (*dryRunResult, error) {
+	if limitErr != nil && !isRejection(limitErr) {
+		return nil, limitErr
+	}
+	before, _, rejected, err := dryRunMatching(store, filter, event, limitErr)
+	if rejected != nil || err != nil {
+		return rejected, err
+	}
+	result := newDryRunResult(before, make([]*Device, len(before)))
+	result.rejection = limitErr
+	return result, nil
+}
+
+// DryRunEvent returns a copy of the event with "dryRun" set in its data, and
+// a new UUID, so handling it only validates the event against current Devices.
+func DryRunEvent(event *model.Event) (*model.Event, error) {
+	data := map[string]json.RawMessage{}
+	err := json.Unmarshal(event.Data, &data)
+	if err != nil {
+		err = errors.Wrap(err, "Error unmarshalling Event-data")
+		return nil, err
+	}
+	data["dryRun"] = json.RawMessage("true")
+
+	dryRun := *event
+	dryRun.Data, err = json.Marshal(data)
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling Event-data")
+		return nil, err
+	}
+	dryRun.UUID, err = uuuid.NewV4()
+	if err != nil {
+		err = errors.Wrap(err, "Error generating UUID for dry-run")
+		return nil, err
+	}
+	return &dryRun, nil
+}
@@ -1,5 +1,10 @@
 package device
 
+import (
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/pkg/errors"
+)
+
 // InternalError represents an error when something goes wrong, and its our fault.
 const InternalError = 2
 
@@ -10,3 +15,53 @@ const DatabaseError = 3
 // UserError occurs when there's an error because of user's action.
 // An example would be providing devicealid input.
 const UserError = 4
+
+// ConflictError occurs when a Device would clash with an existing Device,
+// such as by violating a unique constraint.
+const ConflictError = 5
+
+// UnauthorizedError occurs when the event's user is not allowed to run
+// the command, as per the user's roles.
+const UnauthorizedError = 6
+
+// Error is an error along with the error-code it is responded with.
+// Error is not unwrapped by errors.Cause, so its code is kept if it
+// is wrapped using errors.Wrap.
+type Error struct {
+	Code int16
+	Err  error
+}
+
+// NewError returns err along with the error-code it is responded with.
+func NewError(code int16, err error) error {
+	return &Error{
+		Code: code,
+		Err:  err,
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// isRetryable checks if the event with the KafkaResponse failed with an error
+// that handling the event again may not repeat, which is only DatabaseError.
+// Other errors, such as InternalError for invalid data, are repeated every time.
+func isRetryable(kr *model.KafkaResponse) bool {
+	return kr != nil && kr.ErrorCode == DatabaseError
+}
+
+// errorCode returns the error-code for errors caused by the user, such as
+// UniqueConflictError, the code set using NewError, and defaultCode
+// for other errors.
+func errorCode(err error, defaultCode int16) int16 {
+	switch e := errors.Cause(err).(type) {
+	case *Error:
+		return e.Code
+	case *UniqueConflictError:
+		return ConflictError
+	case *FilterLimitError:
+		return UserError
+	}
+	return defaultCode
+}
@@ -0,0 +1,44 @@
+package device
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// checkBearer checks that the request has the header
+// "Authorization: Bearer <token>", and responds with 401 otherwise.
+func checkBearer(w http.ResponseWriter, r *http.Request, token []byte) bool {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		reqToken := []byte(strings.TrimPrefix(auth, "Bearer "))
+		if subtle.ConstantTimeCompare(reqToken, token) == 1 {
+			return true
+		}
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeHTTPError(w, http.StatusUnauthorized, errors.New("invalid bearer token"))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		err = errors.Wrap(err, "Error writing HTTP-response")
+		log.Println(err)
+	}
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, err error) {
+	if status == http.StatusInternalServerError {
+		log.Println(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
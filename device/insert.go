@@ -2,100 +2,58 @@ package device
 
 import (
 	"encoding/json"
-	"log"
 
 	"github.com/TerrexTech/go-eventstore-models/model"
-	"github.com/TerrexTech/go-mongoutils/mongo"
 	"github.com/TerrexTech/uuuid"
-	"github.com/mongodb/mongo-go-driver/bson/objectid"
 	"github.com/pkg/errors"
 )
 
 // Insert handles "insert" events.
-func Insert(collection *mongo.Collection, event *model.Event) *model.KafkaResponse {
-	device := &Device{}
-	err := json.Unmarshal(event.Data, device)
+func Insert(store Storage, event *model.Event) (interface{}, error) {
+	device, err := Apply(nil, event)
 	if err != nil {
-		err = errors.Wrap(err, "Insert: Error while unmarshalling Event-data")
-		log.Println(err)
-		return &model.KafkaResponse{
-			AggregateID:   event.AggregateID,
-			CorrelationID: event.CorrelationID,
-			Error:         err.Error(),
-			ErrorCode:     InternalError,
-			EventAction:   event.EventAction,
-			ServiceAction: event.ServiceAction,
-			UUID:          event.UUID,
-		}
+		return nil, err
 	}
 
-	if device.DeviceID == (uuuid.UUID{}) {
-		err = errors.New("missing DeviceID")
-		err = errors.Wrap(err, "Insert")
-		log.Println(err)
-		return &model.KafkaResponse{
-			AggregateID:   event.AggregateID,
-			CorrelationID: event.CorrelationID,
-			Error:         err.Error(),
-			ErrorCode:     InternalError,
-			EventAction:   event.EventAction,
-			ServiceAction: event.ServiceAction,
-			UUID:          event.UUID,
+	opts := &dryRunOption{}
+	err = json.Unmarshal(event.Data, opts)
+	if err != nil {
+		err = errors.Wrap(err, "Insert: Error while unmarshalling dryRun")
+		return nil, NewError(UserError, err)
+	}
+
+	if isDryRun(event, opts.DryRun) {
+		preview, err := dryRunInsert(store, device)
+		if err != nil {
+			err = errors.Wrap(err, "Insert: Error in dry-run")
+			return nil, NewError(DatabaseError, err)
 		}
+		return preview, preview.rejection
 	}
 
-	insertResult, err := collection.InsertOne(device)
+	insertedID, err := store.InsertOne(device)
 	if err != nil {
 		err = errors.Wrap(err, "Insert: Error Inserting Device into Mongo")
-		log.Println(err)
-		return &model.KafkaResponse{
-			AggregateID:   event.AggregateID,
-			CorrelationID: event.CorrelationID,
-			Error:         err.Error(),
-			ErrorCode:     DatabaseError,
-			EventAction:   event.EventAction,
-			ServiceAction: event.ServiceAction,
-			UUID:          event.UUID,
-		}
-	}
-	insertedID, assertOK := insertResult.InsertedID.(objectid.ObjectID)
-	if !assertOK {
-		err = errors.New("error asserting InsertedID from InsertResult to ObjectID")
-		err = errors.Wrap(err, "Insert")
-		log.Println(err)
-		return &model.KafkaResponse{
-			AggregateID:   event.AggregateID,
-			CorrelationID: event.CorrelationID,
-			Error:         err.Error(),
-			ErrorCode:     InternalError,
-			EventAction:   event.EventAction,
-			ServiceAction: event.ServiceAction,
-			UUID:          event.UUID,
-		}
+		return nil, NewError(errorCode(err, DatabaseError), err)
 	}
 
 	device.ID = insertedID
-	result, err := json.Marshal(device)
+	return device, nil
+}
+
+// parseInsert returns the Device inserted by the "insert" event.
+func parseInsert(event *model.Event) (*Device, error) {
+	device := &Device{}
+	err := json.Unmarshal(event.Data, device)
 	if err != nil {
-		err = errors.Wrap(err, "Insert: Error marshalling Device Insert-result")
-		log.Println(err)
-		return &model.KafkaResponse{
-			AggregateID:   event.AggregateID,
-			CorrelationID: event.CorrelationID,
-			Error:         err.Error(),
-			ErrorCode:     InternalError,
-			EventAction:   event.EventAction,
-			ServiceAction: event.ServiceAction,
-			UUID:          event.UUID,
-		}
+		err = errors.Wrap(err, "Insert: Error while unmarshalling Event-data")
+		return nil, NewError(InternalError, err)
 	}
 
-	return &model.KafkaResponse{
-		AggregateID:   event.AggregateID,
-		CorrelationID: event.CorrelationID,
-		Result:        result,
-		EventAction:   event.EventAction,
-		ServiceAction: event.ServiceAction,
-		UUID:          event.UUID,
+	if device.DeviceID == (uuuid.UUID{}) {
+		err = errors.New("missing DeviceID")
+		err = errors.Wrap(err, "Insert")
+		return nil, NewError(InternalError, err)
 	}
+	return device, nil
 }
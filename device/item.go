@@ -0,0 +1,50 @@
+package device
+
+import (
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/pkg/errors"
+)
+
+// ItemLookup checks if Inventory Items exist, so Devices
+// are only assigned to existing Items.
+type ItemLookup interface {
+	ItemExists(itemID uuuid.UUID) (bool, error)
+}
+
+// InventoryItem is the minimal representation of an Inventory Item
+// required for looking up Items.
+type InventoryItem struct {
+	ID     objectid.ObjectID `bson:"_id,omitempty"`
+	ItemID string            `bson:"itemID,omitempty"`
+}
+
+// MongoItemLookup looks up Items in a local MongoDB collection,
+// such as the Inventory Aggregate's projection.
+type MongoItemLookup struct {
+	collection *mongo.Collection
+}
+
+// NewMongoItemLookup creates an ItemLookup backed by the provided collection.
+// The collection's SchemaStruct must be *InventoryItem.
+func NewMongoItemLookup(collection *mongo.Collection) (*MongoItemLookup, error) {
+	if collection == nil {
+		return nil, errors.New("collection cannot be nil")
+	}
+	return &MongoItemLookup{collection}, nil
+}
+
+// ItemExists checks if an Item with specified ItemID exists in the collection.
+func (l *MongoItemLookup) ItemExists(itemID uuuid.UUID) (bool, error) {
+	filter := map[string]interface{}{
+		"itemID": itemID.String(),
+	}
+	findResults, err := l.collection.Find(filter, findopt.Limit(1))
+	if err != nil {
+		err = errors.Wrap(err, "Error finding Item")
+		return false, err
+	}
+	return len(findResults) > 0, nil
+}
@@ -0,0 +1,94 @@
+package device
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// FilterLimits restricts how many Devices can be affected by a single
+// "update" or "delete" event.
+type FilterLimits struct {
+	// MaxAffected is the maximum number of Devices an event can affect,
+	// even with allowMultiple set. Zero means no limit.
+	MaxAffected int64
+}
+
+// FilterLimitError is returned when an event's filter matches
+// more Devices than allowed.
+type FilterLimitError struct {
+	MatchedCount int64
+	MaxAffected  int64
+}
+
+func (e *FilterLimitError) Error() string {
+	if e.MaxAffected > 0 {
+		return fmt.Sprintf(
+			"filter matches %d devices, exceeding the limit of %d",
+			e.MatchedCount, e.MaxAffected,
+		)
+	}
+	return fmt.Sprintf(
+		"filter matches %d devices, set allowMultiple to affect multiple devices",
+		e.MatchedCount,
+	)
+}
+
+// filterOptions are set in Event-data for events affecting Devices
+// matching a filter.
+type filterOptions struct {
+	// AllowMultiple is required for affecting more than one Device.
+	AllowMultiple bool `json:"allowMultiple"`
+	// DryRun only returns the changes to Devices the filter matches,
+	// without making them.
+	DryRun bool `json:"dryRun"`
+}
+
+// extractFilterOptions removes the filterOptions from filter and returns them.
+// This is for events whose data is the filter itself, such as "delete".
+func extractFilterOptions(filter map[string]interface{}) (filterOptions, error) {
+	opts := filterOptions{}
+	var isBool bool
+	if v, exists := filter["allowMultiple"]; exists {
+		opts.AllowMultiple, isBool = v.(bool)
+		if !isBool {
+			return opts, errors.New("allowMultiple must be a boolean")
+		}
+		delete(filter, "allowMultiple")
+	}
+	if v, exists := filter["dryRun"]; exists {
+		opts.DryRun, isBool = v.(bool)
+		if !isBool {
+			return opts, errors.New("dryRun must be a boolean")
+		}
+		delete(filter, "dryRun")
+	}
+	return opts, nil
+}
+
+// checkFilter counts the Devices matching filter, and checks the count
+// against limits and opts. A *FilterLimitError is returned if the limits
+// are exceeded.
+func checkFilter(
+	store Storage,
+	filter map[string]interface{},
+	limits FilterLimits,
+	opts filterOptions,
+) error {
+	matchedCount, err := store.Count(filter)
+	if err != nil {
+		err = errors.Wrap(err, "Error counting Devices matching filter")
+		return err
+	}
+
+	if limits.MaxAffected > 0 && matchedCount > limits.MaxAffected {
+		return &FilterLimitError{
+			MatchedCount: matchedCount,
+			MaxAffected:  limits.MaxAffected,
+		}
+	}
+	if matchedCount > 1 && !opts.AllowMultiple {
+		return &FilterLimitError{MatchedCount: matchedCount}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package device
+
+import (
+	"encoding/json"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// countStorage is a Storage whose filters always match devices.
+// Write operations are not implemented.
+type countStorage struct {
+	Storage
+	devices []*Device
+}
+
+func (s *countStorage) Count(filter map[string]interface{}) (int64, error) {
+	return int64(len(s.devices)), nil
+}
+
+func (s *countStorage) Find(filter map[string]interface{}) ([]*Device, error) {
+	return s.devices, nil
+}
+
+func (s *countStorage) CheckUnique([]*Device, map[string]interface{}) error {
+	return nil
+}
+
+var _ = Describe("FilterLimits", func() {
+	var store *countStorage
+
+	newEvent := func(eventAction string, data interface{}) *model.Event {
+		marshalled, err := json.Marshal(data)
+		Expect(err).ToNot(HaveOccurred())
+		return &model.Event{
+			EventAction: eventAction,
+			Data:        marshalled,
+		}
+	}
+
+	BeforeEach(func() {
+		store = &countStorage{}
+		for i := 0; i < 3; i++ {
+			deviceID, err := uuuid.NewV4()
+			Expect(err).ToNot(HaveOccurred())
+			store.devices = append(store.devices, &Device{DeviceID: deviceID})
+		}
+	})
+
+	It("should require allowMultiple if filter matches multiple devices", func() {
+		err := checkFilter(store, nil, FilterLimits{}, filterOptions{})
+		Expect(err).To(HaveOccurred())
+		Expect(errorCode(err, DatabaseError)).To(Equal(int16(UserError)))
+
+		opts := filterOptions{AllowMultiple: true}
+		err = checkFilter(store, nil, FilterLimits{}, opts)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should return error if filter matches more than MaxAffected", func() {
+		opts := filterOptions{AllowMultiple: true}
+		err := checkFilter(store, nil, FilterLimits{MaxAffected: 2}, opts)
+		Expect(err).To(HaveOccurred())
+
+		limitErr, isLimitErr := err.(*FilterLimitError)
+		Expect(isLimitErr).To(BeTrue())
+		Expect(limitErr.MatchedCount).To(Equal(int64(3)))
+	})
+
+	It("should return matched deviceIDs on dry-run", func() {
+		limitErr := checkFilter(store, nil, FilterLimits{}, filterOptions{})
+		filter := map[string]interface{}{
+			"deviceID": map[string]interface{}{"$exists": true},
+		}
+		preview, err := dryRunDelete(store, filter, newEvent("delete", filter), limitErr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(preview.MatchedCount).To(Equal(int64(3)))
+		Expect(preview.DeviceIDs).To(ConsistOf(
+			store.devices[0].DeviceID.String(),
+			store.devices[1].DeviceID.String(),
+			store.devices[2].DeviceID.String(),
+		))
+		Expect(preview.Devices).To(BeEmpty())
+		Expect(preview.rejection).To(Equal(limitErr))
+	})
+
+	It("should return updated devices and diffs on dry-run", func() {
+		store.devices[0].Status = "active"
+		store.devices[0].Lot = "lot-1"
+		store.devices = store.devices[:1]
+		deviceUpdate := &deviceUpdate{
+			Filter: map[string]interface{}{"status": "active"},
+			Update: map[string]interface{}{"status": "retired", "lot": "lot-1"},
+		}
+
+		event := newEvent("update", deviceUpdate)
+		preview, err := dryRunUpdate(store, deviceUpdate, event, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(preview.rejection).ToNot(HaveOccurred())
+		Expect(preview.Devices).To(HaveLen(1))
+		Expect(preview.Devices[0].Status).To(Equal("retired"))
+		Expect(preview.Diffs).To(HaveLen(1))
+		Expect(preview.Diffs[0].Fields).To(Equal(map[string]fieldDiff{
+			"status": fieldDiff{Before: "active", After: "retired"},
+		}))
+	})
+
+	It("should extract options from filter", func() {
+		filter := map[string]interface{}{
+			"status":        "active",
+			"allowMultiple": true,
+			"dryRun":        true,
+		}
+		opts, err := extractFilterOptions(filter)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(opts).To(Equal(filterOptions{AllowMultiple: true, DryRun: true}))
+		Expect(filter).To(Equal(map[string]interface{}{"status": "active"}))
+	})
+})
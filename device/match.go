@@ -0,0 +1,236 @@
+package device
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/pkg/errors"
+)
+
+// matchFilter checks if the document-fields match filter, as MongoDB would for
+// Device documents. Filters can use field-equality, the "$and" and "$or"
+// operators, and the field-operators "$eq", "$ne", "$in", "$nin", "$gt",
+// "$gte", "$lt", "$lte", "$exists" and "$not". Other operators, such as
+// "$regex", are rejected, rather than matched differently from MongoDB.
+// If caseInsensitive is set, strings are compared ignoring their case.
+func matchFilter(
+	fields map[string]interface{},
+	filter map[string]interface{},
+	caseInsensitive bool,
+) (bool, error) {
+	for key, cond := range filter {
+		var matches bool
+		var err error
+		switch key {
+		case "$and", "$or":
+			matches, err = matchLogical(fields, key, cond, caseInsensitive)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, errors.Errorf("unsupported filter operator %s", key)
+			}
+			matches, err = matchCondition(fields[key], cond, caseInsensitive)
+		}
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// MatchFilter checks if the document-fields match filter, as filters of
+// Device events are matched by Apply, so documents of other aggregates, such
+// as Inventory Items, can be matched alike.
+func MatchFilter(
+	fields map[string]interface{}, filter map[string]interface{},
+) (bool, error) {
+	return matchFilter(fields, filter, false)
+}
+
+// matchLogical matches the filters of "$and" and "$or" operators.
+func matchLogical(
+	fields map[string]interface{},
+	op string,
+	cond interface{},
+	caseInsensitive bool,
+) (bool, error) {
+	filters, err := toSlice(cond)
+	if err != nil {
+		err = errors.Wrapf(err, "Error reading %s filters", op)
+		return false, err
+	}
+	for _, f := range filters {
+		filter, isMap := f.(map[string]interface{})
+		if !isMap {
+			return false, errors.Errorf("%s requires a list of filters", op)
+		}
+		matches, err := matchFilter(fields, filter, caseInsensitive)
+		if err != nil {
+			return false, err
+		}
+		if op == "$or" && matches {
+			return true, nil
+		}
+		if op == "$and" && !matches {
+			return false, nil
+		}
+	}
+	return op == "$and", nil
+}
+
+// matchCondition checks a field-value against a filter-value,
+// which is either the value to equal, or a map of field-operators.
+func matchCondition(
+	value interface{}, cond interface{}, caseInsensitive bool,
+) (bool, error) {
+	ops, isMap := cond.(map[string]interface{})
+	if !isMap || !hasOperators(ops) {
+		return equalValues(value, cond, caseInsensitive), nil
+	}
+
+	for op, arg := range ops {
+		var matches bool
+		switch op {
+		case "$eq":
+			matches = equalValues(value, arg, caseInsensitive)
+		case "$ne":
+			matches = !equalValues(value, arg, caseInsensitive)
+		case "$in", "$nin":
+			args, err := toSlice(arg)
+			if err != nil {
+				err = errors.Wrapf(err, "Error reading %s values", op)
+				return false, err
+			}
+			for _, a := range args {
+				if equalValues(value, a, caseInsensitive) {
+					matches = true
+					break
+				}
+			}
+			if op == "$nin" {
+				matches = !matches
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			cmp, comparable := compareValues(value, arg, caseInsensitive)
+			matches = comparable &&
+				(op == "$gt" && cmp > 0 || op == "$gte" && cmp >= 0 ||
+					op == "$lt" && cmp < 0 || op == "$lte" && cmp <= 0)
+		case "$exists":
+			exists, isBool := arg.(bool)
+			if !isBool {
+				return false, errors.New("$exists requires a boolean")
+			}
+			matches = exists == (value != nil)
+		case "$not":
+			var err error
+			matches, err = matchCondition(value, arg, caseInsensitive)
+			if err != nil {
+				return false, err
+			}
+			matches = !matches
+		default:
+			return false, errors.Errorf("unsupported filter operator %s", op)
+		}
+		if !matches {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// hasOperators checks if the filter-value is a map of field-operators.
+func hasOperators(cond map[string]interface{}) bool {
+	for k := range cond {
+		if strings.HasPrefix(k, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+func equalValues(a interface{}, b interface{}, caseInsensitive bool) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	cmp, comparable := compareValues(a, b, caseInsensitive)
+	if comparable {
+		return cmp == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValues orders numbers, strings and ObjectIDs. The returned bool is
+// false if the values are not of the same comparable type.
+func compareValues(a interface{}, b interface{}, caseInsensitive bool) (int, bool) {
+	a = normalizeValue(a)
+	b = normalizeValue(b)
+
+	switch av := a.(type) {
+	case float64:
+		bv, isFloat := b.(float64)
+		if !isFloat {
+			return 0, false
+		}
+		if av < bv {
+			return -1, true
+		}
+		if av > bv {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		bv, isString := b.(string)
+		if !isString {
+			return 0, false
+		}
+		if caseInsensitive {
+			av = strings.ToLower(av)
+			bv = strings.ToLower(bv)
+		}
+		return strings.Compare(av, bv), true
+	case objectid.ObjectID:
+		bv, isObjectID := b.(objectid.ObjectID)
+		if !isObjectID {
+			return 0, false
+		}
+		return bytes.Compare(av[:], bv[:]), true
+	}
+	return 0, false
+}
+
+// normalizeValue converts numbers to float64 and UUIDs to strings,
+// as they are compared.
+func normalizeValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case int:
+		return float64(value)
+	case int8:
+		return float64(value)
+	case int16:
+		return float64(value)
+	case int32:
+		return float64(value)
+	case int64:
+		return float64(value)
+	case float32:
+		return float64(value)
+	case uuuid.UUID:
+		return value.String()
+	}
+	return v
+}
+
+// toSlice converts slices of any type to []interface{}.
+func toSlice(v interface{}) ([]interface{}, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, errors.Errorf("expected a list, got %T", v)
+	}
+	s := make([]interface{}, rv.Len())
+	for i := range s {
+		s[i] = rv.Index(i).Interface()
+	}
+	return s, nil
+}
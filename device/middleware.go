@@ -0,0 +1,199 @@
+package device
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// Logging logs each handled event, and the error it failed with, if any.
+func Logging() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(store Storage, event *model.Event) *model.KafkaResponse {
+			log.Printf(
+				"Handling %s/%s event %s",
+				event.EventAction, event.ServiceAction, event.UUID,
+			)
+			kr := next(store, event)
+			if kr != nil && kr.Error != "" {
+				log.Printf(
+					"Event %s failed with error-code %d: %s",
+					event.UUID, kr.ErrorCode, kr.Error,
+				)
+			}
+			return kr
+		}
+	}
+}
+
+// Metrics counts handled and failed events on metrics, keyed by
+// "<EventAction>.<ServiceAction>" and suffixed with ".count" or ".errors".
+func Metrics(metrics *expvar.Map) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(store Storage, event *model.Event) *model.KafkaResponse {
+			key := event.EventAction + "." + event.ServiceAction
+			metrics.Add(key+".count", 1)
+			kr := next(store, event)
+			if kr != nil && kr.Error != "" {
+				metrics.Add(key+".errors", 1)
+			}
+			return kr
+		}
+	}
+}
+
+// Timing logs how long each event took to handle, and adds the duration in
+// nanoseconds to metrics, keyed by "<EventAction>.<ServiceAction>.durationNs".
+func Timing(metrics *expvar.Map) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(store Storage, event *model.Event) *model.KafkaResponse {
+			start := time.Now()
+			kr := next(store, event)
+			duration := time.Since(start)
+
+			key := event.EventAction + "." + event.ServiceAction
+			metrics.Add(key+".durationNs", int64(duration))
+			log.Printf("Handled event %s in %s", event.UUID, duration)
+			return kr
+		}
+	}
+}
+
+// Recovery recovers from panics while handling events, responding
+// with InternalError instead. The panic is logged with its stack-trace,
+// counted on metrics as "panics" and "<EventAction>.<ServiceAction>.panics",
+// and the event is quarantined, unless quarantine is nil.
+func Recovery(metrics *expvar.Map, quarantine Quarantine) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(store Storage, event *model.Event) (kr *model.KafkaResponse) {
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+				err := errors.Errorf("Recovery: Panic handling event: %v", recovered)
+				stack := debug.Stack()
+				log.Printf("%s\n%s", err, stack)
+
+				key := event.EventAction + "." + event.ServiceAction
+				metrics.Add("panics", 1)
+				metrics.Add(key+".panics", 1)
+
+				if quarantine != nil {
+					qErr := quarantine.Quarantine(&QuarantinedEvent{
+						Event:     *event,
+						Error:     err.Error(),
+						Stack:     string(stack),
+						Timestamp: time.Now().UnixNano(),
+					})
+					if qErr != nil {
+						qErr = errors.Wrap(qErr, "Recovery: Error quarantining event")
+						log.Println(qErr)
+					}
+				}
+				kr = errorResponse(event, err, InternalError)
+			}()
+			return next(store, event)
+		}
+	}
+}
+
+// Authorizer checks if events are allowed, such as by their UserUUID.
+type Authorizer interface {
+	// Authorize returns an error if the event is not allowed.
+	Authorize(event *model.Event) error
+}
+
+// AuthorizerFunc adapts a function to an Authorizer.
+type AuthorizerFunc func(event *model.Event) error
+
+// Authorize calls f(event).
+func (f AuthorizerFunc) Authorize(event *model.Event) error {
+	return f(event)
+}
+
+// Authorization rejects events not allowed by auth, before they are handled.
+// Errors are responded with the error-code set using NewError,
+// or UserError if none is set.
+func Authorization(auth Authorizer) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(store Storage, event *model.Event) *model.KafkaResponse {
+			err := auth.Authorize(event)
+			if err != nil {
+				err = errors.Wrap(err, "Authorization")
+				return errorResponse(event, err, errorCode(err, UserError))
+			}
+			return next(store, event)
+		}
+	}
+}
+
+// Validation rejects events that are not valid Device Aggregate events,
+// before they are handled.
+func Validation() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(store Storage, event *model.Event) *model.KafkaResponse {
+			var err error
+			if event.AggregateID != AggregateID {
+				err = errors.Errorf(
+					"event has AggregateID %d, expected %d", event.AggregateID, AggregateID,
+				)
+			} else if event.UUID == (uuuid.UUID{}) {
+				err = errors.New("event has blank UUID")
+			} else if len(event.Data) == 0 {
+				err = errors.New("event has blank data")
+			}
+			if err != nil {
+				err = errors.Wrap(err, "Validation")
+				return errorResponse(event, err, UserError)
+			}
+			return next(store, event)
+		}
+	}
+}
+
+// Idempotency answers redelivered events with the response recorded for them,
+// instead of handling them again. Responses are only recorded if handling the
+// event again would give the same result, so events that failed due to
+// database errors are retried, as checked by isRetryable. Dry-runs, such as
+// commands validated before being persisted, change no Devices and are always
+// handled again, without being recorded.
+func Idempotency(processed ProcessedEvents) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(store Storage, event *model.Event) *model.KafkaResponse {
+			opts := &dryRunOption{}
+			// Events with invalid data are rejected by the handlers
+			json.Unmarshal(event.Data, opts)
+			if isDryRun(event, opts.DryRun) {
+				return next(store, event)
+			}
+
+			kr, err := processed.Response(event.UUID)
+			if err != nil {
+				err = errors.Wrap(err, "Idempotency: Error finding processed event")
+				log.Println(err)
+			}
+			if kr != nil {
+				log.Printf("Event %s was already processed, reusing response", event.UUID)
+				return kr
+			}
+
+			kr = next(store, event)
+			if kr == nil || isRetryable(kr) {
+				return kr
+			}
+			err = processed.Record(kr)
+			if err != nil {
+				err = errors.Wrap(err, "Idempotency: Error recording processed event")
+				log.Println(err)
+			}
+			return kr
+		}
+	}
+}
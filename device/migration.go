@@ -0,0 +1,329 @@
+package device
+
+import (
+	"context"
+	"time"
+
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/mongodb/mongo-go-driver/bson"
+	mgo "github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/replaceopt"
+	"github.com/mongodb/mongo-go-driver/mongo/updateopt"
+	"github.com/pkg/errors"
+)
+
+// Migration changes stored Device documents from the previous schema-version
+// to Version, and back. Up and Down change the document in place, and
+// its "schemaVersion" is set by the Migrator.
+type Migration struct {
+	Version     int64
+	Description string
+	Up          func(doc map[string]interface{}) error
+	Down        func(doc map[string]interface{}) error
+}
+
+// MigrationStore provides the stored Device documents, and the
+// schema-version they were migrated to.
+type MigrationStore interface {
+	// Version returns the schema-version Devices were migrated to.
+	Version() (int64, error)
+	// SetVersion records the schema-version Devices were migrated to.
+	SetVersion(version int64) error
+	// EachDocument calls fn with each Device document matching filter.
+	EachDocument(
+		filter map[string]interface{}, fn func(doc map[string]interface{}) error,
+	) error
+	// ReplaceDocument replaces the Device document with the same _id.
+	ReplaceDocument(doc map[string]interface{}) error
+}
+
+// MigrationReport describes the migrations run, or that would be run
+// for dry-runs.
+type MigrationReport struct {
+	FromVersion int64           `json:"fromVersion" yaml:"fromVersion"`
+	ToVersion   int64           `json:"toVersion" yaml:"toVersion"`
+	DryRun      bool            `json:"dryRun" yaml:"dryRun"`
+	Steps       []MigrationStep `json:"steps" yaml:"steps"`
+}
+
+// MigrationStep describes a migration run in a direction.
+type MigrationStep struct {
+	Version     int64  `json:"version" yaml:"version"`
+	Description string `json:"description" yaml:"description"`
+	// Direction is either "up" or "down".
+	Direction string `json:"direction" yaml:"direction"`
+	// Documents is the number of documents changed by the migration.
+	Documents int64 `json:"documents" yaml:"documents"`
+}
+
+// Migrator migrates stored Device documents between schema-versions.
+type Migrator struct {
+	store      MigrationStore
+	migrations []Migration
+}
+
+// NewMigrator creates a Migrator for the migrations, whose Versions must
+// start at 1 and increase by 1.
+func NewMigrator(store MigrationStore, migrations []Migration) (*Migrator, error) {
+	if store == nil {
+		return nil, errors.New("store cannot be nil")
+	}
+	for i, m := range migrations {
+		if m.Version != int64(i+1) {
+			return nil, errors.Errorf(
+				"migration %d has version %d, expected %d", i, m.Version, i+1,
+			)
+		}
+		if m.Up == nil || m.Down == nil {
+			return nil, errors.Errorf("migration %d must have Up and Down", m.Version)
+		}
+	}
+	return &Migrator{
+		store:      store,
+		migrations: migrations,
+	}, nil
+}
+
+// Latest returns the schema-version after all migrations.
+func (m *Migrator) Latest() int64 {
+	return int64(len(m.migrations))
+}
+
+// Migrate runs the migrations up or down to the target schema-version.
+// Dry-runs only report the documents each migration would change. Since dry-runs
+// do not change documents, a document is reported by every migration it needs.
+func (m *Migrator) Migrate(target int64, dryRun bool) (*MigrationReport, error) {
+	if target < 0 || target > m.Latest() {
+		return nil, errors.Errorf(
+			"target version must be between 0 and %d", m.Latest(),
+		)
+	}
+	current, err := m.store.Version()
+	if err != nil {
+		err = errors.Wrap(err, "Error reading schema-version")
+		return nil, err
+	}
+	if current > m.Latest() {
+		return nil, errors.Errorf(
+			"stored schema-version %d is newer than latest known version %d",
+			current, m.Latest(),
+		)
+	}
+
+	report := &MigrationReport{
+		FromVersion: current,
+		ToVersion:   target,
+		DryRun:      dryRun,
+		Steps:       []MigrationStep{},
+	}
+	for v := current + 1; v <= target; v++ {
+		step, err := m.run(m.migrations[v-1], true, dryRun)
+		if err != nil {
+			return report, err
+		}
+		report.Steps = append(report.Steps, *step)
+	}
+	for v := current; v > target; v-- {
+		step, err := m.run(m.migrations[v-1], false, dryRun)
+		if err != nil {
+			return report, err
+		}
+		report.Steps = append(report.Steps, *step)
+	}
+	return report, nil
+}
+
+// run runs the migration up or down on all documents it applies to, and
+// records the resulting schema-version.
+func (m *Migrator) run(
+	migration Migration, up bool, dryRun bool,
+) (*MigrationStep, error) {
+	step := &MigrationStep{
+		Version:     migration.Version,
+		Description: migration.Description,
+		Direction:   "up",
+	}
+	// Documents stored before schema-versions were added have no schemaVersion
+	filter := map[string]interface{}{
+		"schemaVersion": map[string]interface{}{
+			"$not": map[string]interface{}{"$gte": migration.Version},
+		},
+	}
+	fn := migration.Up
+	version := migration.Version
+	if !up {
+		step.Direction = "down"
+		filter = map[string]interface{}{
+			"schemaVersion": migration.Version,
+		}
+		fn = migration.Down
+		version = migration.Version - 1
+	}
+
+	err := m.store.EachDocument(filter, func(doc map[string]interface{}) error {
+		err := fn(doc)
+		if err != nil {
+			return errors.Wrapf(err, "Error migrating document %v", doc["_id"])
+		}
+		doc["schemaVersion"] = version
+		if version == 0 {
+			delete(doc, "schemaVersion")
+		}
+		step.Documents++
+		if dryRun {
+			return nil
+		}
+		return m.store.ReplaceDocument(doc)
+	})
+	if err != nil {
+		err = errors.Wrapf(
+			err, "Error running migration %d %s", migration.Version, step.Direction,
+		)
+		return nil, err
+	}
+
+	if !dryRun {
+		err = m.store.SetVersion(version)
+		if err != nil {
+			err = errors.Wrap(err, "Error recording schema-version")
+			return nil, err
+		}
+	}
+	return step, nil
+}
+
+// MongoMigrationStore migrates the Device documents in a MongoDB collection, and
+// records their schema-version in the Aggregate-meta collection.
+type MongoMigrationStore struct {
+	collection     *mongo.Collection
+	metaCollection *mgo.Collection
+}
+
+// NewMongoMigrationStore creates a MigrationStore for Devices in collection.
+// The schema-version is recorded in the metaCollection of same database.
+func NewMongoMigrationStore(
+	collection *mongo.Collection, metaCollection string,
+) (*MongoMigrationStore, error) {
+	if collection == nil {
+		return nil, errors.New("collection cannot be nil")
+	}
+	if metaCollection == "" {
+		return nil, errors.New("metaCollection cannot be blank")
+	}
+	meta := collection.Connection.Client.DriverClient().
+		Database(collection.Database).
+		Collection(metaCollection)
+	return &MongoMigrationStore{
+		collection:     collection,
+		metaCollection: meta,
+	}, nil
+}
+
+// metaFilter matches the schema-version document in the meta-collection.
+// It has no aggregateID, so it is not mistaken for the Aggregate's meta-data.
+func (s *MongoMigrationStore) metaFilter() map[string]interface{} {
+	return map[string]interface{}{
+		"schemaMigrations": s.collection.Name,
+	}
+}
+
+// Version returns the schema-version Devices were migrated to,
+// which is 0 if they were never migrated.
+func (s *MongoMigrationStore) Version() (int64, error) {
+	ctx, cancel := s.timeoutContext()
+	defer cancel()
+	doc := bson.NewDocument()
+	err := s.metaCollection.FindOne(ctx, s.metaFilter()).Decode(doc)
+	if err == mgo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := doc.LookupErr("version")
+	if err != nil {
+		err = errors.Wrap(err, "Error reading version")
+		return 0, err
+	}
+	v, isInt := version.Int64OK()
+	if !isInt {
+		return 0, errors.New("error asserting version to int64")
+	}
+	return v, nil
+}
+
+// SetVersion records the schema-version Devices were migrated to.
+func (s *MongoMigrationStore) SetVersion(version int64) error {
+	ctx, cancel := s.timeoutContext()
+	defer cancel()
+	_, err := s.metaCollection.UpdateOne(
+		ctx,
+		s.metaFilter(),
+		map[string]interface{}{
+			"$set": map[string]interface{}{
+				"version":   version,
+				"timestamp": time.Now().UnixNano(),
+			},
+		},
+		updateopt.Upsert(true),
+	)
+	return err
+}
+
+// EachDocument calls fn with each Device document matching filter.
+func (s *MongoMigrationStore) EachDocument(
+	filter map[string]interface{}, fn func(doc map[string]interface{}) error,
+) error {
+	ctx := context.Background()
+	cursor, err := s.driverCollection().Find(ctx, filter)
+	if err != nil {
+		err = errors.Wrap(err, "Error finding documents")
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		raw, err := cursor.DecodeBytes()
+		if err != nil {
+			err = errors.Wrap(err, "Error reading document from cursor")
+			return err
+		}
+		doc := map[string]interface{}{}
+		err = bson.Unmarshal(raw, doc)
+		if err != nil {
+			err = errors.Wrap(err, "Error unmarshalling document")
+			return err
+		}
+		err = fn(doc)
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// ReplaceDocument replaces the Device document with the same _id.
+func (s *MongoMigrationStore) ReplaceDocument(doc map[string]interface{}) error {
+	ctx, cancel := s.timeoutContext()
+	defer cancel()
+	_, err := s.driverCollection().ReplaceOne(
+		ctx,
+		map[string]interface{}{"_id": doc["_id"]},
+		doc,
+		replaceopt.Upsert(false),
+	)
+	return err
+}
+
+func (s *MongoMigrationStore) driverCollection() *mgo.Collection {
+	return s.collection.Connection.Client.DriverClient().
+		Database(s.collection.Database).
+		Collection(s.collection.Name)
+}
+
+func (s *MongoMigrationStore) timeoutContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(
+		context.Background(),
+		time.Duration(s.collection.Connection.Timeout)*time.Millisecond,
+	)
+}
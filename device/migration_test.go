@@ -0,0 +1,164 @@
+package device
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+// memoryMigrationStore keeps documents in memory, keyed by _id.
+// Filters only match on schemaVersion, as used by Migrator.
+type memoryMigrationStore struct {
+	version int64
+	docs    map[string]map[string]interface{}
+}
+
+func (s *memoryMigrationStore) Version() (int64, error) {
+	return s.version, nil
+}
+
+func (s *memoryMigrationStore) SetVersion(version int64) error {
+	s.version = version
+	return nil
+}
+
+func (s *memoryMigrationStore) EachDocument(
+	filter map[string]interface{}, fn func(doc map[string]interface{}) error,
+) error {
+	for _, doc := range s.docs {
+		version, _ := doc["schemaVersion"].(int64)
+		var matches bool
+		switch f := filter["schemaVersion"].(type) {
+		case int64:
+			matches = version == f
+		case map[string]interface{}:
+			below := f["$not"].(map[string]interface{})["$gte"].(int64)
+			matches = version < below
+		}
+		if !matches {
+			continue
+		}
+		docCopy := map[string]interface{}{}
+		for k, v := range doc {
+			docCopy[k] = v
+		}
+		err := fn(docCopy)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryMigrationStore) ReplaceDocument(doc map[string]interface{}) error {
+	s.docs[doc["_id"].(string)] = doc
+	return nil
+}
+
+var _ = Describe("Migrator", func() {
+	var (
+		store      *memoryMigrationStore
+		migrations []Migration
+	)
+
+	BeforeEach(func() {
+		store = &memoryMigrationStore{
+			docs: map[string]map[string]interface{}{
+				"a": {"_id": "a", "status": "OK"},
+				"b": {"_id": "b", "status": "ok"},
+			},
+		}
+		noop := func(doc map[string]interface{}) error { return nil }
+		migrations = []Migration{
+			{Version: 1, Description: "version", Up: noop, Down: noop},
+			{
+				Version:     2,
+				Description: "rename status to state",
+				Up: func(doc map[string]interface{}) error {
+					doc["state"] = doc["status"]
+					delete(doc, "status")
+					return nil
+				},
+				Down: func(doc map[string]interface{}) error {
+					doc["status"] = doc["state"]
+					delete(doc, "state")
+					return nil
+				},
+			},
+		}
+	})
+
+	It("should migrate documents up and down", func() {
+		migrator, err := NewMigrator(store, migrations)
+		Expect(err).ToNot(HaveOccurred())
+
+		report, err := migrator.Migrate(2, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.FromVersion).To(Equal(int64(0)))
+		Expect(report.Steps).To(HaveLen(2))
+		Expect(report.Steps[1].Direction).To(Equal("up"))
+		Expect(report.Steps[1].Documents).To(Equal(int64(2)))
+		Expect(store.version).To(Equal(int64(2)))
+		Expect(store.docs["a"]).To(Equal(map[string]interface{}{
+			"_id": "a", "state": "OK", "schemaVersion": int64(2),
+		}))
+
+		report, err = migrator.Migrate(0, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Steps).To(HaveLen(2))
+		Expect(report.Steps[0].Version).To(Equal(int64(2)))
+		Expect(report.Steps[0].Direction).To(Equal("down"))
+		Expect(store.version).To(Equal(int64(0)))
+		Expect(store.docs["a"]).To(Equal(map[string]interface{}{
+			"_id": "a", "status": "OK",
+		}))
+	})
+
+	It("should only report changes for dry-runs", func() {
+		migrator, err := NewMigrator(store, migrations)
+		Expect(err).ToNot(HaveOccurred())
+
+		report, err := migrator.Migrate(2, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.DryRun).To(BeTrue())
+		Expect(report.Steps).To(HaveLen(2))
+		Expect(report.Steps[0].Documents).To(Equal(int64(2)))
+		Expect(store.version).To(Equal(int64(0)))
+		Expect(store.docs["a"]).To(Equal(map[string]interface{}{
+			"_id": "a", "status": "OK",
+		}))
+	})
+
+	It("should stop at failing migration", func() {
+		migrations[1].Up = func(doc map[string]interface{}) error {
+			return errors.New("some error")
+		}
+		migrator, err := NewMigrator(store, migrations)
+		Expect(err).ToNot(HaveOccurred())
+
+		report, err := migrator.Migrate(2, false)
+		Expect(err).To(HaveOccurred())
+		Expect(report.Steps).To(HaveLen(1))
+		Expect(store.version).To(Equal(int64(1)))
+	})
+
+	It("should reject unordered migrations and unknown versions", func() {
+		_, err := NewMigrator(store, migrations[1:])
+		Expect(err).To(HaveOccurred())
+
+		migrator, err := NewMigrator(store, migrations)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = migrator.Migrate(3, false)
+		Expect(err).To(HaveOccurred())
+
+		store.version = 3
+		_, err = migrator.Migrate(2, false)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should have SchemaVersion as latest migration", func() {
+		migrator, err := NewMigrator(store, Migrations)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(migrator.Latest()).To(Equal(SchemaVersion))
+	})
+})
@@ -0,0 +1,18 @@
+package device
+
+// SchemaVersion is the schema-version of Device documents stored by the
+// service, and is the Version of the latest migration in Migrations.
+const SchemaVersion int64 = 1
+
+// Migrations lists the schema migrations of Device documents, ordered by Version.
+// New migrations are added here, along with incrementing SchemaVersion.
+var Migrations = []Migration{
+	{
+		// Documents are versioned as they are, since
+		// the Device schema is otherwise unchanged
+		Version:     1,
+		Description: "Add schemaVersion to Devices",
+		Up:          func(doc map[string]interface{}) error { return nil },
+		Down:        func(doc map[string]interface{}) error { return nil },
+	},
+}
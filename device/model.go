@@ -1,13 +1,9 @@
 package device
 
 import (
-	"encoding/json"
-	"log"
-
 	util "github.com/TerrexTech/go-commonutils/commonutil"
 
 	"github.com/TerrexTech/uuuid"
-	"github.com/mongodb/mongo-go-driver/bson"
 	"github.com/mongodb/mongo-go-driver/bson/objectid"
 	"github.com/pkg/errors"
 )
@@ -26,74 +22,7 @@ type Device struct {
 	Name            string            `bson:"name,omitempty" json:"name,omitempty"`
 	Status          string            `bson:"status,omitempty" json:"status,omitempty"`
 	SKU             string            `bson:"sku,omitempty" json:"sku,omitempty"`
-}
-
-// MarshalBSON returns bytes of BSON-type.
-func (d Device) MarshalBSON() ([]byte, error) {
-	in := map[string]interface{}{
-		"itemID":          d.ItemID.String(),
-		"deviceID":        d.DeviceID.String(),
-		"dateInstalled":   d.DateInstalled,
-		"lot":             d.Lot,
-		"lastMaintenance": d.LastMaintenance,
-		"name":            d.Name,
-		"status":          d.Status,
-		"sku":             d.SKU,
-	}
-
-	log.Printf("%+v", in)
-	if d.ID != objectid.NilObjectID {
-		in["_id"] = d.ID
-	}
-	return bson.Marshal(in)
-}
-
-// MarshalJSON returns bytes of JSON-type.
-func (d *Device) MarshalJSON() ([]byte, error) {
-	in := map[string]interface{}{
-		"itemID":          d.ItemID.String(),
-		"deviceID":        d.DeviceID.String(),
-		"dateInstalled":   d.DateInstalled,
-		"lot":             d.Lot,
-		"lastMaintenance": d.LastMaintenance,
-		"name":            d.Name,
-		"status":          d.Status,
-		"sku":             d.SKU,
-	}
-
-	log.Printf("%+v", in)
-	if d.ID != objectid.NilObjectID {
-		in["_id"] = d.ID.Hex()
-	}
-	return json.Marshal(in)
-}
-
-// UnmarshalBSON returns BSON-type from bytes.
-func (d *Device) UnmarshalBSON(in []byte) error {
-	m := make(map[string]interface{})
-	err := bson.Unmarshal(in, m)
-	if err != nil {
-		err = errors.Wrap(err, "Unmarshal Error")
-		return err
-	}
-
-	log.Printf("%+v", m)
-	err = d.unmarshalFromMap(m)
-	return err
-}
-
-// UnmarshalJSON returns JSON-type from bytes.
-func (d *Device) UnmarshalJSON(in []byte) error {
-	m := make(map[string]interface{})
-	err := json.Unmarshal(in, &m)
-	if err != nil {
-		err = errors.Wrap(err, "Unmarshal Error")
-		return err
-	}
-
-	log.Printf("%+v", m)
-	err = d.unmarshalFromMap(m)
-	return err
+	TenantID        string            `bson:"tenantID,omitempty" json:"tenantID,omitempty"`
 }
 
 // unmarshalFromMap unmarshals Map into Device.
@@ -105,7 +34,13 @@ func (d *Device) unmarshalFromMap(m map[string]interface{}) error {
 	if m["_id"] != nil {
 		d.ID, assertOK = m["_id"].(objectid.ObjectID)
 		if !assertOK {
-			d.ID, err = objectid.FromHex(m["_id"].(string))
+			idStr, assertOK := m["_id"].(string)
+			if !assertOK {
+				err = errors.New("error asserting to ObjectID or string")
+				err = errors.Wrap(err, "Error while asserting ObjectID")
+				return err
+			}
+			d.ID, err = objectid.FromHex(idStr)
 			if err != nil {
 				err = errors.Wrap(err, "Error while asserting ObjectID")
 				return err
@@ -186,5 +121,48 @@ func (d *Device) unmarshalFromMap(m map[string]interface{}) error {
 			return err
 		}
 	}
+	if m["tenantID"] != nil {
+		d.TenantID, assertOK = m["tenantID"].(string)
+		if !assertOK {
+			err = errors.New("error asserting to string")
+			err = errors.Wrap(err, "Error while asserting TenantID")
+			return err
+		}
+	}
 	return nil
 }
+
+// fieldMap returns the Device's fields keyed by their stored names,
+// with UUIDs as strings, as they are stored.
+func (d *Device) fieldMap() map[string]interface{} {
+	m := map[string]interface{}{
+		"itemID":          d.ItemID.String(),
+		"deviceID":        d.DeviceID.String(),
+		"dateInstalled":   d.DateInstalled,
+		"lot":             d.Lot,
+		"lastMaintenance": d.LastMaintenance,
+		"name":            d.Name,
+		"status":          d.Status,
+		"sku":             d.SKU,
+	}
+	if d.TenantID != "" {
+		m["tenantID"] = d.TenantID
+	}
+	return m
+}
+
+// applyUpdate returns a copy of the Device with the fields in update set.
+func (d *Device) applyUpdate(update map[string]interface{}) (*Device, error) {
+	m := d.fieldMap()
+	for k, v := range update {
+		m[k] = v
+	}
+
+	updated := &Device{ID: d.ID}
+	err := updated.unmarshalFromMap(m)
+	if err != nil {
+		err = errors.Wrap(err, "Error applying update to Device")
+		return nil, err
+	}
+	return updated, nil
+}
@@ -0,0 +1,93 @@
+package device
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/pkg/errors"
+)
+
+// ProcessedEvents records the responses of handled events,
+// so redelivered events are not handled again.
+type ProcessedEvents interface {
+	// Response returns the recorded response for the event,
+	// or nil if the event was not processed yet.
+	Response(eventUUID uuuid.UUID) (*model.KafkaResponse, error)
+	// Record records the response of a handled event.
+	Record(response *model.KafkaResponse) error
+}
+
+// ProcessedEvent is a recorded response of a handled event.
+type ProcessedEvent struct {
+	ID        objectid.ObjectID `bson:"_id,omitempty"`
+	EventUUID string            `bson:"eventUUID,omitempty"`
+	// Response is the JSON-marshalled KafkaResponse.
+	Response  string `bson:"response,omitempty"`
+	Timestamp int64  `bson:"timestamp,omitempty"`
+}
+
+// MongoProcessedEvents records processed events in a MongoDB collection.
+type MongoProcessedEvents struct {
+	collection *mongo.Collection
+}
+
+// NewMongoProcessedEvents creates ProcessedEvents backed by the provided
+// collection. The collection's SchemaStruct must be *ProcessedEvent.
+func NewMongoProcessedEvents(
+	collection *mongo.Collection,
+) (*MongoProcessedEvents, error) {
+	if collection == nil {
+		return nil, errors.New("collection cannot be nil")
+	}
+	return &MongoProcessedEvents{collection}, nil
+}
+
+// Response returns the recorded response for the event,
+// or nil if the event was not processed yet.
+func (p *MongoProcessedEvents) Response(
+	eventUUID uuuid.UUID,
+) (*model.KafkaResponse, error) {
+	filter := map[string]interface{}{
+		"eventUUID": eventUUID.String(),
+	}
+	findResults, err := p.collection.Find(filter, findopt.Limit(1))
+	if err != nil {
+		err = errors.Wrap(err, "Error finding ProcessedEvent")
+		return nil, err
+	}
+	if len(findResults) == 0 {
+		return nil, nil
+	}
+
+	processed, assertOK := findResults[0].(*ProcessedEvent)
+	if !assertOK {
+		return nil, errors.New("error asserting FindResult to ProcessedEvent")
+	}
+	kr := &model.KafkaResponse{}
+	err = json.Unmarshal([]byte(processed.Response), kr)
+	if err != nil {
+		err = errors.Wrap(err, "Error unmarshalling ProcessedEvent response")
+		return nil, err
+	}
+	return kr, nil
+}
+
+// Record records the response of a handled event.
+func (p *MongoProcessedEvents) Record(response *model.KafkaResponse) error {
+	responseMarshal, err := json.Marshal(response)
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling response")
+		return err
+	}
+	_, err = p.collection.InsertOne(&ProcessedEvent{
+		EventUUID: response.UUID.String(),
+		Response:  string(responseMarshal),
+		Timestamp: time.Now().UnixNano(),
+	})
+	return err
+}
@@ -0,0 +1,19 @@
+package device
+
+import "github.com/TerrexTech/go-eventstore-models/model"
+
+// Quarantine stores events that could not be handled, such as events that
+// caused a panic, so they can be inspected and replayed later.
+type Quarantine interface {
+	Quarantine(event *QuarantinedEvent) error
+}
+
+// QuarantinedEvent is an event that could not be handled,
+// along with why it could not be handled.
+type QuarantinedEvent struct {
+	Event model.Event `json:"event"`
+	Error string      `json:"error"`
+	// Stack is the stack-trace of the panic caused by the event, if any.
+	Stack     string `json:"stack,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
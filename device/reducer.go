@@ -0,0 +1,245 @@
+package device
+
+import (
+	"encoding/json"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// Apply returns the Device resulting from applying the event to state, where
+// state is nil if the Device does not exist. Nil is returned if the event
+// deletes the Device, and state is returned as is if the event does not
+// affect it. Apply has no side-effects and does not change state, so the same
+// business-rules apply when handling events and when replaying them.
+// Errors reject the event, and have their error-codes set using NewError.
+//
+// Rules spanning multiple Devices, such as unique constraints and
+// FilterLimits, and Item lookups, are checked by the commands instead.
+func Apply(state *Device, event *model.Event) (*Device, error) {
+	switch event.EventAction {
+	case "insert":
+		return applyInsert(state, event)
+	case "update":
+		switch event.ServiceAction {
+		case AssignServiceAction, UnassignServiceAction:
+			return applyAssignment(state, event)
+		}
+		return applyUpdate(state, event)
+	case "delete":
+		return applyDelete(state, event)
+	}
+	err := errors.Errorf("unknown event-action %q", event.EventAction)
+	return state, NewError(UserError, err)
+}
+
+// applyInsert returns the inserted Device if state is nil. Inserting an
+// existing Device is rejected with UniqueConflictError. DeviceIDs are unique
+// to each tenant, so Devices of other tenants are not existing Devices.
+func applyInsert(state *Device, event *model.Event) (*Device, error) {
+	device, err := parseInsert(event)
+	if err != nil {
+		return state, err
+	}
+	if state == nil {
+		return device, nil
+	}
+	if state.DeviceID == device.DeviceID && state.TenantID == device.TenantID {
+		return state, &UniqueConflictError{
+			Constraint: "deviceID",
+			DeviceID:   state.DeviceID,
+		}
+	}
+	return state, nil
+}
+
+// applyUpdate updates state if it matches the update's filter.
+func applyUpdate(state *Device, event *model.Event) (*Device, error) {
+	deviceUpdate, err := parseUpdate(event)
+	if err != nil {
+		return state, err
+	}
+	if otherTenant(state, event) {
+		return state, nil
+	}
+	matches, err := state.matches(deviceUpdate.Filter)
+	if err != nil || !matches {
+		return state, err
+	}
+	updated, err := state.applyUpdate(deviceUpdate.Update)
+	if err != nil {
+		err = errors.Wrap(err, "Update")
+		return state, NewError(UserError, err)
+	}
+	return updated, nil
+}
+
+// applyDelete deletes state if it matches the filter.
+func applyDelete(state *Device, event *model.Event) (*Device, error) {
+	filter, _, err := parseDelete(event)
+	if err != nil {
+		return state, err
+	}
+	matches, err := state.matches(filter)
+	if err != nil || !matches {
+		return state, err
+	}
+	return nil, nil
+}
+
+// applyAssignment assigns state to, or unassigns it from, an Item.
+// A Device can only be assigned if it is unassigned, and vice-versa.
+func applyAssignment(state *Device, event *model.Event) (*Device, error) {
+	args, err := parseAssignment(event)
+	if err != nil {
+		return state, err
+	}
+	if state == nil || state.DeviceID != args.DeviceID || otherTenant(state, event) {
+		return state, nil
+	}
+
+	updated := *state
+	if event.ServiceAction == AssignServiceAction {
+		if state.ItemID != (uuuid.UUID{}) {
+			err = errors.Errorf("device is already assigned to item %s", state.ItemID)
+			return state, NewError(UserError, err)
+		}
+		updated.ItemID = args.ItemID
+	} else {
+		if state.ItemID == (uuuid.UUID{}) {
+			err = errors.New("device is not assigned to any item")
+			return state, NewError(UserError, err)
+		}
+		updated.ItemID = uuuid.UUID{}
+	}
+	return &updated, nil
+}
+
+// otherTenant checks if state is a Device of another tenant than the event's,
+// if the event-data sets "tenantID". Filters of delete events are the
+// event-data, so these already include the tenantID.
+func otherTenant(state *Device, event *model.Event) bool {
+	data := struct {
+		TenantID string `json:"tenantID"`
+	}{}
+	// Events with invalid data are rejected by their parse-functions
+	json.Unmarshal(event.Data, &data)
+	return state != nil && data.TenantID != "" && state.TenantID != data.TenantID
+}
+
+// applyMatching applies the event to the Devices in store matching filter,
+// using Apply, so they change as they would when the event is replayed.
+// The Devices the event applies to are returned, with their resulting state
+// at the same index, which is nil for deleted Devices. Devices found using
+// the filter, but not matching it as Apply does, are left out.
+func applyMatching(
+	store Storage, filter map[string]interface{}, event *model.Event,
+) ([]*Device, []*Device, error) {
+	found, err := store.Find(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	matched := []*Device{}
+	applied := []*Device{}
+	for _, d := range found {
+		next, err := Apply(d, event)
+		if err != nil {
+			return nil, nil, err
+		}
+		if next == d {
+			continue
+		}
+		matched = append(matched, d)
+		applied = append(applied, next)
+	}
+	return matched, applied, nil
+}
+
+// idsFilter returns a filter matching the Devices by their _id, so they are
+// written using a single UpdateMany or DeleteMany.
+func idsFilter(devices []*Device) map[string]interface{} {
+	ids := make([]interface{}, len(devices))
+	for i, d := range devices {
+		ids[i] = d.ID
+	}
+	return map[string]interface{}{
+		"_id": map[string]interface{}{"$in": ids},
+	}
+}
+
+// matches checks if the Device exists and matches filter.
+func (d *Device) matches(filter map[string]interface{}) (bool, error) {
+	if d == nil {
+		return false, nil
+	}
+	fields := d.fieldMap()
+	fields["_id"] = d.ID
+	matches, err := matchFilter(fields, filter, false)
+	if err != nil {
+		err = errors.Wrap(err, "Error matching filter")
+		return false, NewError(UserError, err)
+	}
+	return matches, nil
+}
+
+// Replay returns the Devices resulting from applying the events in order to
+// devices. Events rejected by Apply are skipped, as are events referenced by
+// CommandRejectedAction events, since those were rejected when handled.
+// Devices are returned in order of insertion.
+func Replay(devices []*Device, events []model.Event) []*Device {
+	rejected := rejectedEvents(events)
+	state := append([]*Device{}, devices...)
+	for i := range events {
+		event := &events[i]
+		if event.EventAction == CommandRejectedAction || rejected[event.UUID] {
+			continue
+		}
+		next, err := replayEvent(state, event)
+		if err == nil {
+			state = next
+		}
+	}
+	return state
+}
+
+// rejectedEvents returns the UUIDs of events referenced by
+// CommandRejectedAction events.
+func rejectedEvents(events []model.Event) map[uuuid.UUID]bool {
+	rejected := map[uuuid.UUID]bool{}
+	for _, event := range events {
+		if event.EventAction != CommandRejectedAction {
+			continue
+		}
+		rejection := &RejectedCommand{}
+		if json.Unmarshal(event.Data, rejection) == nil {
+			rejected[rejection.EventUUID] = true
+		}
+	}
+	return rejected
+}
+
+// replayEvent applies the event to each Device, or inserts the Device if the
+// event is an insert not matching any Device. Either all Devices are changed,
+// or none are if the event is rejected for any Device.
+func replayEvent(devices []*Device, event *model.Event) ([]*Device, error) {
+	next := make([]*Device, 0, len(devices)+1)
+	for _, d := range devices {
+		applied, err := Apply(d, event)
+		if err != nil {
+			return nil, err
+		}
+		if applied != nil {
+			next = append(next, applied)
+		}
+	}
+
+	if event.EventAction == "insert" {
+		inserted, err := Apply(nil, event)
+		if err != nil {
+			return nil, err
+		}
+		next = append(next, inserted)
+	}
+	return next, nil
+}
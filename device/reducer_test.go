@@ -0,0 +1,323 @@
+package device
+
+import (
+	"encoding/json"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// writeStorage is a Storage finding all its Devices regardless of filter, as
+// a Storage with other filter-semantics could, and recording the filters of
+// its writes.
+type writeStorage struct {
+	countStorage
+	written []map[string]interface{}
+}
+
+func (s *writeStorage) Transaction(fn func(tx Storage) error) error {
+	return fn(s)
+}
+
+func (s *writeStorage) UpdateMany(
+	filter map[string]interface{}, update map[string]interface{},
+) (int64, int64, error) {
+	s.written = append(s.written, filter)
+	return 1, 1, nil
+}
+
+func (s *writeStorage) DeleteMany(filter map[string]interface{}) (int64, error) {
+	s.written = append(s.written, filter)
+	return 1, nil
+}
+
+var _ = Describe("Apply", func() {
+	var deviceID, itemID uuuid.UUID
+
+	newEvent := func(eventAction, serviceAction string, data interface{}) *model.Event {
+		marshalled, err := json.Marshal(data)
+		Expect(err).ToNot(HaveOccurred())
+		eventUUID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		return &model.Event{
+			AggregateID:   AggregateID,
+			EventAction:   eventAction,
+			ServiceAction: serviceAction,
+			Data:          marshalled,
+			UUID:          eventUUID,
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		deviceID, err = uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		itemID, err = uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should apply every event-action without changing state", func() {
+		insert := newEvent("insert", "", map[string]interface{}{
+			"deviceID": deviceID.String(),
+			"status":   "new",
+		})
+		device, err := Apply(nil, insert)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(device.DeviceID).To(Equal(deviceID))
+		Expect(device.Status).To(Equal("new"))
+
+		withItem, err := Apply(nil, newEvent("insert", "", map[string]interface{}{
+			"deviceID": deviceID.String(),
+			"itemID":   itemID.String(),
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(withItem.ItemID).To(Equal(itemID))
+
+		update := newEvent("update", "", map[string]interface{}{
+			"filter": map[string]interface{}{"deviceID": deviceID.String()},
+			"update": map[string]interface{}{"status": "active"},
+		})
+		updated, err := Apply(device, update)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(updated.Status).To(Equal("active"))
+		Expect(device.Status).To(Equal("new"))
+
+		assign := newEvent("update", AssignServiceAction, map[string]interface{}{
+			"deviceID": deviceID.String(),
+			"itemID":   itemID.String(),
+		})
+		assigned, err := Apply(updated, assign)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(assigned.ItemID).To(Equal(itemID))
+		Expect(updated.ItemID).To(Equal(uuuid.UUID{}))
+
+		unassign := newEvent("update", UnassignServiceAction, map[string]interface{}{
+			"deviceID": deviceID.String(),
+		})
+		unassigned, err := Apply(assigned, unassign)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(unassigned.ItemID).To(Equal(uuuid.UUID{}))
+
+		del := newEvent("delete", "", map[string]interface{}{
+			"deviceID": deviceID.String(),
+		})
+		deleted, err := Apply(unassigned, del)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(deleted).To(BeNil())
+	})
+
+	It("should return state for events not affecting it", func() {
+		otherID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		device := &Device{DeviceID: deviceID, Status: "new"}
+
+		events := []*model.Event{
+			newEvent("update", "", map[string]interface{}{
+				"filter": map[string]interface{}{"deviceID": otherID.String()},
+				"update": map[string]interface{}{"status": "active"},
+			}),
+			newEvent("delete", "", map[string]interface{}{"deviceID": otherID.String()}),
+			newEvent("update", UnassignServiceAction, map[string]interface{}{
+				"deviceID": otherID.String(),
+			}),
+			newEvent("insert", "", map[string]interface{}{"deviceID": otherID.String()}),
+		}
+		for _, event := range events {
+			applied, err := Apply(device, event)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(applied).To(Equal(device))
+		}
+
+		applied, err := Apply(nil, events[0])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(applied).To(BeNil())
+	})
+
+	It("should reject events breaking business-rules", func() {
+		device := &Device{DeviceID: deviceID, ItemID: itemID}
+
+		_, err := Apply(device, newEvent("insert", "", map[string]interface{}{
+			"deviceID": deviceID.String(),
+		}))
+		Expect(errorCode(err, 0)).To(Equal(int16(ConflictError)))
+
+		_, err = Apply(device, newEvent("update", AssignServiceAction, map[string]interface{}{
+			"deviceID": deviceID.String(),
+			"itemID":   itemID.String(),
+		}))
+		Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+
+		_, err = Apply(device, newEvent("update", "", map[string]interface{}{
+			"filter": map[string]interface{}{"deviceID": deviceID.String()},
+			"update": map[string]interface{}{"itemID": itemID.String()},
+		}))
+		Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+
+		_, err = Apply(device, newEvent("update", "", map[string]interface{}{
+			"filter": map[string]interface{}{"deviceID": deviceID.String()},
+			"update": map[string]interface{}{"_id": 5},
+		}))
+		Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+
+		_, err = Apply(device, newEvent("delete", "", map[string]interface{}{}))
+		Expect(err).To(HaveOccurred())
+
+		_, err = Apply(device, newEvent("archive", "", map[string]interface{}{}))
+		Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+	})
+
+	It("should replay events, skipping rejected events", func() {
+		insert := newEvent("insert", "", map[string]interface{}{
+			"deviceID": deviceID.String(),
+		})
+		duplicate := newEvent("insert", "", map[string]interface{}{
+			"deviceID": deviceID.String(),
+			"status":   "duplicate",
+		})
+		update := newEvent("update", "", map[string]interface{}{
+			"filter": map[string]interface{}{"deviceID": deviceID.String()},
+			"update": map[string]interface{}{"status": "rejected"},
+		})
+		rejection, err := NewRejectionEvent(update, &model.KafkaResponse{
+			Error:     "rejected",
+			ErrorCode: UserError,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		devices := Replay(nil, []model.Event{*insert, *duplicate, *update, *rejection})
+		Expect(devices).To(HaveLen(1))
+		Expect(devices[0].DeviceID).To(Equal(deviceID))
+		Expect(devices[0].Status).To(BeEmpty())
+	})
+
+	It("should replay inserts of a deviceID by each tenant", func() {
+		events := []model.Event{}
+		for _, tenantID := range []string{"acme", "globex", "acme"} {
+			events = append(events, *newEvent("insert", "", map[string]interface{}{
+				"deviceID": deviceID.String(),
+				"tenantID": tenantID,
+			}))
+		}
+
+		// Updates and assignments only apply to the Device of their tenant
+		events = append(events, *newEvent("update", "", map[string]interface{}{
+			"tenantID": "globex",
+			"filter":   map[string]interface{}{"deviceID": deviceID.String()},
+			"update":   map[string]interface{}{"status": "active"},
+		}))
+		events = append(events, *newEvent("update", AssignServiceAction, map[string]interface{}{
+			"tenantID": "acme",
+			"deviceID": deviceID.String(),
+			"itemID":   itemID.String(),
+		}))
+
+		devices := Replay(nil, events)
+		Expect(devices).To(HaveLen(2))
+		Expect(devices[0].TenantID).To(Equal("acme"))
+		Expect(devices[0].Status).To(BeEmpty())
+		Expect(devices[0].ItemID).To(Equal(itemID))
+		Expect(devices[1].TenantID).To(Equal("globex"))
+		Expect(devices[1].Status).To(Equal("active"))
+		Expect(devices[1].ItemID).To(Equal(uuuid.UUID{}))
+		for _, d := range devices {
+			Expect(d.DeviceID).To(Equal(deviceID))
+		}
+	})
+
+	It("should only write Devices matching filters as Apply does", func() {
+		active := &Device{ID: objectid.New(), DeviceID: deviceID, Status: "active"}
+		broken := &Device{ID: objectid.New(), DeviceID: itemID, Status: "broken"}
+		store := &writeStorage{}
+		store.devices = []*Device{active, broken}
+
+		update := newEvent("update", "", map[string]interface{}{
+			"filter":        map[string]interface{}{"status": "active"},
+			"update":        map[string]interface{}{"lot": "lot-a"},
+			"allowMultiple": true,
+		})
+		result, err := Update(FilterLimits{})(store, update)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal(&updateResult{MatchedCount: 1, ModifiedCount: 1}))
+		Expect(store.written).To(Equal([]map[string]interface{}{
+			idsFilter([]*Device{active}),
+		}))
+
+		store.written = nil
+		del := newEvent("delete", "", map[string]interface{}{
+			"status":        map[string]interface{}{"$in": []string{"broken", "lost"}},
+			"allowMultiple": true,
+		})
+		result, err = Delete(FilterLimits{})(store, del)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result).To(Equal(&deleteResult{DeletedCount: 1}))
+		Expect(store.written).To(Equal([]map[string]interface{}{
+			idsFilter([]*Device{broken}),
+		}))
+
+		// Operators Apply does not support are rejected before writing
+		store.written = nil
+		regex := newEvent("delete", "", map[string]interface{}{
+			"status":        map[string]interface{}{"$regex": "^b"},
+			"allowMultiple": true,
+		})
+		_, err = Delete(FilterLimits{})(store, regex)
+		Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+		Expect(store.written).To(BeEmpty())
+	})
+
+	It("should preview the Devices the command matches on dry-run", func() {
+		active := &Device{ID: objectid.New(), DeviceID: deviceID, Status: "active"}
+		broken := &Device{ID: objectid.New(), DeviceID: itemID, Status: "broken"}
+		store := &writeStorage{}
+		store.devices = []*Device{active, broken}
+
+		update := newEvent("update", DryRunServiceAction, map[string]interface{}{
+			"filter":        map[string]interface{}{"status": "active"},
+			"update":        map[string]interface{}{"lot": "lot-a"},
+			"allowMultiple": true,
+		})
+		result, err := Update(FilterLimits{})(store, update)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.(*dryRunResult).DeviceIDs).To(Equal([]string{deviceID.String()}))
+
+		del := newEvent("delete", DryRunServiceAction, map[string]interface{}{
+			"status":        "broken",
+			"allowMultiple": true,
+		})
+		result, err = Delete(FilterLimits{})(store, del)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(result.(*dryRunResult).DeviceIDs).To(Equal([]string{itemID.String()}))
+
+		regex := newEvent("delete", DryRunServiceAction, map[string]interface{}{
+			"status":        map[string]interface{}{"$regex": "^b"},
+			"allowMultiple": true,
+		})
+		result, err = Delete(FilterLimits{})(store, regex)
+		Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+		Expect(result.(*dryRunResult).DeviceIDs).To(BeEmpty())
+		Expect(store.written).To(BeEmpty())
+	})
+
+	It("should reject filter operators it does not match", func() {
+		state := &Device{DeviceID: deviceID, Status: "active"}
+		for _, filter := range []map[string]interface{}{
+			{"status": map[string]interface{}{"$regex": "^a"}},
+			{"status": map[string]interface{}{"$size": 1}},
+			{"status": map[string]interface{}{"$elemMatch": map[string]interface{}{}}},
+			{"$where": "this.status == 'active'"},
+			{"$nor": []interface{}{map[string]interface{}{"status": "broken"}}},
+		} {
+			event := newEvent("update", "", map[string]interface{}{
+				"filter": filter,
+				"update": map[string]interface{}{"lot": "lot-a"},
+			})
+			next, err := Apply(state, event)
+			Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+			Expect(err.Error()).To(ContainSubstring("unsupported filter operator"))
+			Expect(next).To(Equal(state))
+		}
+	})
+})
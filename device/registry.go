@@ -0,0 +1,105 @@
+package device
+
+import (
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/pkg/errors"
+)
+
+// HandlerFunc handles an event, and returns the KafkaResponse to produce.
+// No response is produced if the returned KafkaResponse is nil.
+type HandlerFunc func(store Storage, event *model.Event) *model.KafkaResponse
+
+// Middleware wraps a HandlerFunc to add behavior, such as logging.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+type handlerKey struct {
+	eventAction   string
+	serviceAction string
+}
+
+type registeredHandler struct {
+	handler    HandlerFunc
+	middleware []Middleware
+}
+
+// Registry maps events, by their EventAction and ServiceAction, to handlers.
+// Handlers should be registered before events are handled.
+type Registry struct {
+	handlers   map[handlerKey]registeredHandler
+	middleware []Middleware
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		handlers: map[handlerKey]registeredHandler{},
+	}
+}
+
+// Register registers the handler for events with eventAction and serviceAction.
+// Handlers registered with blank serviceAction handle events whose ServiceAction
+// has no handler of its own. The middleware is only applied to this handler,
+// inside the middleware added using Use.
+func (r *Registry) Register(
+	eventAction string,
+	serviceAction string,
+	handler HandlerFunc,
+	middleware ...Middleware,
+) error {
+	if eventAction == "" {
+		return errors.New("eventAction cannot be blank")
+	}
+	if handler == nil {
+		return errors.New("handler cannot be nil")
+	}
+	key := handlerKey{eventAction, serviceAction}
+	if _, exists := r.handlers[key]; exists {
+		return errors.Errorf(
+			"handler already registered for event-action %q and service-action %q",
+			eventAction, serviceAction,
+		)
+	}
+	r.handlers[key] = registeredHandler{handler, middleware}
+	return nil
+}
+
+// Use adds middleware applied to all handlers. Middleware added first
+// is the outermost, so it runs before, and finishes after, the others.
+func (r *Registry) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Handles checks if any handler is registered for eventAction.
+func (r *Registry) Handles(eventAction string) bool {
+	for key := range r.handlers {
+		if key.eventAction == eventAction {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle handles the event using its registered handler and middleware.
+// Events without a registered handler are rejected with UserError.
+func (r *Registry) Handle(store Storage, event *model.Event) *model.KafkaResponse {
+	registered, exists := r.handlers[handlerKey{event.EventAction, event.ServiceAction}]
+	if !exists {
+		registered, exists = r.handlers[handlerKey{event.EventAction, ""}]
+	}
+	if !exists {
+		err := errors.Errorf(
+			"no handler for event-action %q and service-action %q",
+			event.EventAction, event.ServiceAction,
+		)
+		return errorResponse(event, err, UserError)
+	}
+
+	handler := registered.handler
+	for i := len(registered.middleware) - 1; i >= 0; i-- {
+		handler = registered.middleware[i](handler)
+	}
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.middleware[i](handler)
+	}
+	return handler(store, event)
+}
@@ -0,0 +1,81 @@
+package device
+
+import (
+	"github.com/TerrexTech/go-eventstore-models/model"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry", func() {
+	var registry *Registry
+
+	// resultHandler responds with result
+	resultHandler := func(result string) HandlerFunc {
+		return func(store Storage, event *model.Event) *model.KafkaResponse {
+			return &model.KafkaResponse{Result: []byte(result)}
+		}
+	}
+
+	// recordingMiddleware appends name to calls when run
+	recordingMiddleware := func(name string, calls *[]string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(store Storage, event *model.Event) *model.KafkaResponse {
+				*calls = append(*calls, name)
+				return next(store, event)
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		registry = NewRegistry()
+		err := registry.Register("update", "", resultHandler("update"))
+		Expect(err).ToNot(HaveOccurred())
+		err = registry.Register("update", "assign", resultHandler("assign"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should dispatch events by EventAction and ServiceAction", func() {
+		kr := registry.Handle(nil, &model.Event{
+			EventAction:   "update",
+			ServiceAction: "assign",
+		})
+		Expect(string(kr.Result)).To(Equal("assign"))
+	})
+
+	It("should fallback to handler with blank ServiceAction", func() {
+		kr := registry.Handle(nil, &model.Event{
+			EventAction:   "update",
+			ServiceAction: "other",
+		})
+		Expect(string(kr.Result)).To(Equal("update"))
+	})
+
+	It("should return error for events without handler", func() {
+		kr := registry.Handle(nil, &model.Event{EventAction: "insert"})
+		Expect(kr.Error).ToNot(BeEmpty())
+		Expect(kr.ErrorCode).To(Equal(int16(UserError)))
+		Expect(registry.Handles("insert")).To(BeFalse())
+		Expect(registry.Handles("update")).To(BeTrue())
+	})
+
+	It("should return error on duplicate registration", func() {
+		err := registry.Register("update", "assign", resultHandler("assign"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should apply registry-middleware before handler-middleware", func() {
+		calls := []string{}
+		err := registry.Register(
+			"delete", "", resultHandler("delete"),
+			recordingMiddleware("handler", &calls),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		registry.Use(
+			recordingMiddleware("first", &calls),
+			recordingMiddleware("second", &calls),
+		)
+
+		registry.Handle(nil, &model.Event{EventAction: "delete"})
+		Expect(calls).To(Equal([]string{"first", "second", "handler"}))
+	})
+})
@@ -0,0 +1,100 @@
+package device
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// CommandRejectedAction is the EventAction of events recording that
+// a persisted event was rejected, and so did not change any Device.
+const CommandRejectedAction = "deviceCommandRejected"
+
+// RejectedCommand is the data of CommandRejectedAction events.
+type RejectedCommand struct {
+	// EventUUID is the UUID of the rejected event.
+	EventUUID     uuuid.UUID `json:"eventUUID"`
+	EventAction   string     `json:"eventAction"`
+	ServiceAction string     `json:"serviceAction,omitempty"`
+	Reason        string     `json:"reason"`
+	ErrorCode     int16      `json:"errorCode"`
+}
+
+// EventEmitter emits events to the EventStore.
+type EventEmitter interface {
+	Emit(event *model.Event) error
+}
+
+// NewRejectionEvent creates the CommandRejectedAction event for the event
+// rejected with the KafkaResponse. It has the CorrelationID and UserUUID
+// of the rejected event, and a new UUID.
+func NewRejectionEvent(
+	event *model.Event, kr *model.KafkaResponse,
+) (*model.Event, error) {
+	data, err := json.Marshal(&RejectedCommand{
+		EventUUID:     event.UUID,
+		EventAction:   event.EventAction,
+		ServiceAction: event.ServiceAction,
+		Reason:        kr.Error,
+		ErrorCode:     kr.ErrorCode,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling RejectedCommand")
+		return nil, err
+	}
+	eventUUID, err := uuuid.NewV4()
+	if err != nil {
+		err = errors.Wrap(err, "Error generating UUID for rejection-event")
+		return nil, err
+	}
+
+	now := time.Now()
+	return &model.Event{
+		AggregateID:   AggregateID,
+		EventAction:   CommandRejectedAction,
+		CorrelationID: event.CorrelationID,
+		Data:          data,
+		NanoTime:      now.UnixNano(),
+		UserUUID:      event.UserUUID,
+		UUID:          eventUUID,
+		YearBucket:    int16(now.Year()),
+	}, nil
+}
+
+// Compensation emits a CommandRejectedAction event for each rejected event,
+// so the EventStore records that the event did not change any Device.
+// Dry-runs are not compensated, nor are events failing with DatabaseError,
+// since those are retried, as checked by isRetryable. Compensation should be
+// used after Idempotency, so redelivered events are not compensated again,
+// and before any middleware rejecting events, so their rejections are
+// compensated too.
+func Compensation(emitter EventEmitter) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(store Storage, event *model.Event) *model.KafkaResponse {
+			kr := next(store, event)
+			if kr == nil || kr.Error == "" || isRetryable(kr) {
+				return kr
+			}
+			opts := &dryRunOption{}
+			// Events with invalid data are still compensated
+			json.Unmarshal(event.Data, opts)
+			if isDryRun(event, opts.DryRun) {
+				return kr
+			}
+
+			rejection, err := NewRejectionEvent(event, kr)
+			if err == nil {
+				err = emitter.Emit(rejection)
+			}
+			if err != nil {
+				err = errors.Wrap(err, "Compensation: Error emitting rejection-event")
+				log.Println(err)
+			}
+			return kr
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package device
+
+import (
+	"encoding/json"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+// emitterFunc is an EventEmitter calling itself.
+type emitterFunc func(event *model.Event) error
+
+func (f emitterFunc) Emit(event *model.Event) error {
+	return f(event)
+}
+
+var _ = Describe("Compensation", func() {
+	var emitted []*model.Event
+
+	// handle runs the event through Compensation, responding with errCode
+	handle := func(event *model.Event, errCode int16) *model.KafkaResponse {
+		next := func(store Storage, event *model.Event) *model.KafkaResponse {
+			if errCode == 0 {
+				return &model.KafkaResponse{UUID: event.UUID}
+			}
+			return errorResponse(event, errors.New("rejected"), errCode)
+		}
+		handler := Compensation(emitterFunc(func(event *model.Event) error {
+			emitted = append(emitted, event)
+			return nil
+		}))(next)
+		return handler(nil, event)
+	}
+
+	newEvent := func(data string) *model.Event {
+		eventUUID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		correlationID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		return &model.Event{
+			AggregateID:   AggregateID,
+			EventAction:   "update",
+			CorrelationID: correlationID,
+			Data:          []byte(data),
+			UUID:          eventUUID,
+		}
+	}
+
+	BeforeEach(func() {
+		emitted = []*model.Event{}
+	})
+
+	It("should emit a rejection-event for rejected events", func() {
+		event := newEvent(`{}`)
+		kr := handle(event, ConflictError)
+		Expect(kr.ErrorCode).To(Equal(int16(ConflictError)))
+
+		Expect(emitted).To(HaveLen(1))
+		rejection := emitted[0]
+		Expect(rejection.EventAction).To(Equal(CommandRejectedAction))
+		Expect(rejection.AggregateID).To(Equal(AggregateID))
+		Expect(rejection.CorrelationID).To(Equal(event.CorrelationID))
+		Expect(rejection.UUID).ToNot(Equal(event.UUID))
+
+		data := &RejectedCommand{}
+		err := json.Unmarshal(rejection.Data, data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data.EventUUID).To(Equal(event.UUID))
+		Expect(data.EventAction).To(Equal("update"))
+		Expect(data.Reason).To(Equal(kr.Error))
+		Expect(data.ErrorCode).To(Equal(int16(ConflictError)))
+	})
+
+	It("should not emit for accepted events, dry-runs and database errors", func() {
+		handle(newEvent(`{}`), 0)
+		handle(newEvent(`{"dryRun":true}`), UserError)
+		handle(newEvent(`{}`), DatabaseError)
+		Expect(emitted).To(BeEmpty())
+	})
+})
@@ -0,0 +1,238 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+	mgo "github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/updateopt"
+	"github.com/pkg/errors"
+)
+
+// VersionStore records the Version of the last event applied to Devices.
+type VersionStore interface {
+	// AppliedVersion returns the Version of the last applied event,
+	// which is 0 if no event was applied yet.
+	AppliedVersion() (int64, error)
+	SetAppliedVersion(version int64) error
+}
+
+// EventFetcher fetches Device events from the EventStore.
+type EventFetcher interface {
+	// Events returns the events with Version greater than fromVersion,
+	// sorted by Version.
+	Events(fromVersion int64) ([]model.Event, error)
+}
+
+// Sequencing applies events in order of their Version. Events are handled one
+// at a time, and if an event's Version is more than one past the last applied
+// Version, the missing events are first fetched and handled in order using
+// dispatch, which should be the Registry's Handle, so each missing event is
+// handled by the handler and middleware of its own EventAction. Missing
+// CommandRejectedAction events are skipped, since they only record rejections.
+// Events without a Version, and dry-runs, are handled as is. The applied
+// Version is not tracked until the first versioned event is handled.
+// Events failing with DatabaseError are not recorded as applied, so they are
+// fetched again before the next event. Events failing with other errors are
+// recorded as applied, since they would fail the same way again.
+func Sequencing(
+	versions VersionStore, fetcher EventFetcher, dispatch HandlerFunc,
+) Middleware {
+	lock := sync.Mutex{}
+
+	// dispatching is the UUID of the missing event being dispatched, which
+	// reaches this middleware again while lock is held
+	dispatchingLock := sync.Mutex{}
+	dispatching := uuuid.UUID{}
+	isDispatching := func(event *model.Event) bool {
+		dispatchingLock.Lock()
+		defer dispatchingLock.Unlock()
+		return dispatching != uuuid.UUID{} && dispatching == event.UUID
+	}
+	setDispatching := func(eventUUID uuuid.UUID) {
+		dispatchingLock.Lock()
+		dispatching = eventUUID
+		dispatchingLock.Unlock()
+	}
+	dispatchMissing := func(store Storage, event *model.Event) *model.KafkaResponse {
+		setDispatching(event.UUID)
+		defer setDispatching(uuuid.UUID{})
+		return dispatch(store, event)
+	}
+
+	// backfill dispatches the events with Versions after applied and before
+	// version in order, recording each as applied.
+	backfill := func(store Storage, applied int64, version int64) error {
+		events, err := fetcher.Events(applied)
+		if err != nil {
+			err = errors.Wrap(err, "Error fetching missing events")
+			return err
+		}
+		for i := range events {
+			event := &events[i]
+			if event.Version <= applied || event.Version >= version {
+				continue
+			}
+			if event.EventAction != CommandRejectedAction {
+				kr := dispatchMissing(store, event)
+				if isRetryable(kr) {
+					return errors.Errorf(
+						"Error handling missing event %s: %s", event.UUID, kr.Error,
+					)
+				}
+				log.Printf(
+					"Sequencing: Applied missing event %s, version %d",
+					event.UUID, event.Version,
+				)
+			}
+			err = versions.SetAppliedVersion(event.Version)
+			if err != nil {
+				err = errors.Wrap(err, "Error recording applied event-version")
+				return err
+			}
+		}
+		return nil
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(store Storage, event *model.Event) *model.KafkaResponse {
+			dryRun := event.ServiceAction == DryRunServiceAction
+			opts := &dryRunOption{}
+			err := json.Unmarshal(event.Data, opts)
+			// Events with invalid data are sequenced, and rejected by their handlers
+			if err == nil {
+				dryRun = isDryRun(event, opts.DryRun)
+			}
+			if event.Version == 0 || dryRun || isDispatching(event) {
+				return next(store, event)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			applied, err := versions.AppliedVersion()
+			if err != nil {
+				err = errors.Wrap(err, "Sequencing: Error reading applied event-version")
+				return errorResponse(event, err, DatabaseError)
+			}
+			// Older events are handled as redelivered events
+			if event.Version <= applied {
+				return next(store, event)
+			}
+
+			if applied > 0 && event.Version > applied+1 {
+				log.Printf(
+					"Sequencing: Event %s has version %d, but last applied version is %d, "+
+						"fetching missing events",
+					event.UUID, event.Version, applied,
+				)
+				err = backfill(store, applied, event.Version)
+				if err != nil {
+					err = errors.Wrap(err, "Sequencing")
+					return errorResponse(event, err, DatabaseError)
+				}
+			}
+
+			kr := next(store, event)
+			if !isRetryable(kr) {
+				err = versions.SetAppliedVersion(event.Version)
+				if err != nil {
+					err = errors.Wrap(err, "Sequencing: Error recording applied event-version")
+					log.Println(err)
+				}
+			}
+			return kr
+		}
+	}
+}
+
+// MongoVersionStore records the applied event-version
+// in the Aggregate-meta collection.
+type MongoVersionStore struct {
+	collection     *mongo.Collection
+	metaCollection *mgo.Collection
+}
+
+// NewMongoVersionStore creates a VersionStore for Devices in collection.
+// The applied event-version is recorded in the metaCollection of same database.
+func NewMongoVersionStore(
+	collection *mongo.Collection, metaCollection string,
+) (*MongoVersionStore, error) {
+	if collection == nil {
+		return nil, errors.New("collection cannot be nil")
+	}
+	if metaCollection == "" {
+		return nil, errors.New("metaCollection cannot be blank")
+	}
+	meta := collection.Connection.Client.DriverClient().
+		Database(collection.Database).
+		Collection(metaCollection)
+	return &MongoVersionStore{
+		collection:     collection,
+		metaCollection: meta,
+	}, nil
+}
+
+// metaFilter matches the applied-version document in the meta-collection.
+// It has no aggregateID, so it is not mistaken for the Aggregate's meta-data.
+func (s *MongoVersionStore) metaFilter() map[string]interface{} {
+	return map[string]interface{}{
+		"appliedEvents": s.collection.Name,
+	}
+}
+
+// AppliedVersion returns the Version of the last applied event.
+func (s *MongoVersionStore) AppliedVersion() (int64, error) {
+	ctx, cancel := s.timeoutContext()
+	defer cancel()
+	doc := bson.NewDocument()
+	err := s.metaCollection.FindOne(ctx, s.metaFilter()).Decode(doc)
+	if err == mgo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := doc.LookupErr("version")
+	if err != nil {
+		err = errors.Wrap(err, "Error reading version")
+		return 0, err
+	}
+	v, isInt := version.Int64OK()
+	if !isInt {
+		return 0, errors.New("error asserting version to int64")
+	}
+	return v, nil
+}
+
+// SetAppliedVersion records the Version of the last applied event.
+func (s *MongoVersionStore) SetAppliedVersion(version int64) error {
+	ctx, cancel := s.timeoutContext()
+	defer cancel()
+	_, err := s.metaCollection.UpdateOne(
+		ctx,
+		s.metaFilter(),
+		map[string]interface{}{
+			"$set": map[string]interface{}{
+				"version":   version,
+				"timestamp": time.Now().UnixNano(),
+			},
+		},
+		updateopt.Upsert(true),
+	)
+	return err
+}
+
+func (s *MongoVersionStore) timeoutContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(
+		context.Background(),
+		time.Duration(s.collection.Connection.Timeout)*time.Millisecond,
+	)
+}
@@ -0,0 +1,213 @@
+package device
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	bolt "go.etcd.io/bbolt"
+)
+
+// fetcherFunc is an EventFetcher calling itself.
+type fetcherFunc func(fromVersion int64) ([]model.Event, error)
+
+func (f fetcherFunc) Events(fromVersion int64) ([]model.Event, error) {
+	return f(fromVersion)
+}
+
+var _ = Describe("Sequencing", func() {
+	var (
+		dbFile   string
+		db       *bolt.DB
+		versions *BoltVersionStore
+		stored   []model.Event
+		handled  []int64
+		actions  []string
+		errCode  int16
+		handler  HandlerFunc
+	)
+
+	newEvent := func(version int64, data string) model.Event {
+		eventUUID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		return model.Event{
+			AggregateID: AggregateID,
+			EventAction: "update",
+			Data:        []byte(data),
+			UUID:        eventUUID,
+			Version:     version,
+		}
+	}
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "agg_device_sequencing")
+		Expect(err).ToNot(HaveOccurred())
+		dbFile = f.Name()
+		f.Close()
+		db, err = bolt.Open(dbFile, 0600, nil)
+		Expect(err).ToNot(HaveOccurred())
+		versions, err = NewBoltVersionStore(db)
+		Expect(err).ToNot(HaveOccurred())
+
+		stored = []model.Event{}
+		for v := int64(1); v <= 5; v++ {
+			stored = append(stored, newEvent(v, `{}`))
+		}
+		handled = []int64{}
+		actions = []string{}
+		errCode = 0
+
+		fetcher := fetcherFunc(func(fromVersion int64) ([]model.Event, error) {
+			events := []model.Event{}
+			for _, e := range stored {
+				if e.Version > fromVersion {
+					events = append(events, e)
+				}
+			}
+			return events, nil
+		})
+		registry := NewRegistry()
+		registry.Use(Sequencing(versions, fetcher, registry.Handle))
+		for _, eventAction := range []string{"insert", "update", "delete"} {
+			err = registry.Register(
+				eventAction, "",
+				func(store Storage, event *model.Event) *model.KafkaResponse {
+					handled = append(handled, event.Version)
+					actions = append(actions, event.EventAction)
+					if errCode != 0 {
+						return &model.KafkaResponse{Error: "failed", ErrorCode: errCode}
+					}
+					return &model.KafkaResponse{UUID: event.UUID}
+				},
+			)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		handler = registry.Handle
+	})
+
+	appliedVersion := func() int64 {
+		applied, err := versions.AppliedVersion()
+		Expect(err).ToNot(HaveOccurred())
+		return applied
+	}
+
+	AfterEach(func() {
+		db.Close()
+		os.Remove(dbFile)
+	})
+
+	It("should fetch and apply missing events in order first", func() {
+		handler(nil, &stored[0])
+		handler(nil, &stored[3])
+		Expect(handled).To(Equal([]int64{1, 2, 3, 4}))
+
+		applied, err := versions.AppliedVersion()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(applied).To(Equal(int64(4)))
+
+		// Older events are passed through without changing applied version
+		handler(nil, &stored[2])
+		Expect(handled).To(Equal([]int64{1, 2, 3, 4, 3}))
+		applied, err = versions.AppliedVersion()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(applied).To(Equal(int64(4)))
+	})
+
+	It("should not backfill before the first versioned event", func() {
+		handler(nil, &stored[2])
+		Expect(handled).To(Equal([]int64{3}))
+	})
+
+	It("should not track unversioned events and dry-runs", func() {
+		unversioned := newEvent(0, `{}`)
+		dryRun := newEvent(9, `{"dryRun":true}`)
+		handler(nil, &unversioned)
+		handler(nil, &dryRun)
+		Expect(handled).To(Equal([]int64{0, 9}))
+
+		applied, err := versions.AppliedVersion()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(applied).To(BeZero())
+	})
+
+	It("should refetch only events that failed with DatabaseError", func() {
+		handler(nil, &stored[0])
+		errCode = DatabaseError
+		handler(nil, &stored[1])
+		Expect(appliedVersion()).To(Equal(int64(1)))
+
+		// Events failing with other errors are not fetched again
+		errCode = InternalError
+		handler(nil, &stored[2])
+		Expect(appliedVersion()).To(Equal(int64(3)))
+
+		errCode = 0
+		handler(nil, &stored[3])
+		Expect(handled).To(Equal([]int64{1, 2, 2, 3, 4}))
+		Expect(appliedVersion()).To(Equal(int64(4)))
+	})
+
+	It("should handle missing events by their own EventAction", func() {
+		stored[0].EventAction = "insert"
+		stored[1].EventAction = "delete"
+		rejection, err := NewRejectionEvent(&stored[1], &model.KafkaResponse{
+			Error:     "rejected",
+			ErrorCode: UserError,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		rejection.Version = 3
+		stored[2] = *rejection
+
+		handler(nil, &stored[0])
+		handler(nil, &stored[4])
+		Expect(handled).To(Equal([]int64{1, 2, 4, 5}))
+		Expect(actions).To(Equal([]string{"insert", "delete", "update", "update"}))
+		Expect(appliedVersion()).To(Equal(int64(5)))
+	})
+
+	It("should sequence events with invalid data", func() {
+		handler(nil, &stored[0])
+		invalid := newEvent(2, `not-json`)
+		handler(nil, &invalid)
+		Expect(handled).To(Equal([]int64{1, 2}))
+		Expect(appliedVersion()).To(Equal(int64(2)))
+	})
+
+	It("should apply events after malformed events with the Device commands", func() {
+		store, err := NewBoltStorage(BoltStorageConfig{DB: db})
+		Expect(err).ToNot(HaveOccurred())
+		registry := NewRegistry()
+		registry.Use(Sequencing(versions, fetcherFunc(
+			func(fromVersion int64) ([]model.Event, error) {
+				return stored[fromVersion:], nil
+			},
+		), registry.Handle))
+		err = RegisterCommands(registry, CommandsConfig{})
+		Expect(err).ToNot(HaveOccurred())
+
+		stored[0] = newEvent(1, `{"deviceID":"b4b4e5c2-1a4f-4b4e-9f8e-4b4e5c21a4f4"}`)
+		stored[0].EventAction = "insert"
+		stored[1] = newEvent(2, `{"filter":{"name":"x"}}`)
+		stored[2] = newEvent(3, `not-json`)
+		stored[3] = newEvent(4, `{}`)
+		stored[3].EventAction = "delete"
+		stored[4] = newEvent(5, `{
+			"filter": {"deviceID": "b4b4e5c2-1a4f-4b4e-9f8e-4b4e5c21a4f4"},
+			"update": {"name": "sensor"}
+		}`)
+
+		kr := registry.Handle(store, &stored[0])
+		Expect(kr.Error).To(BeEmpty())
+		kr = registry.Handle(store, &stored[4])
+		Expect(kr.Error).To(BeEmpty())
+		Expect(appliedVersion()).To(Equal(int64(5)))
+
+		devices, err := store.Find(map[string]interface{}{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(devices).To(HaveLen(1))
+		Expect(devices[0].Name).To(Equal("sensor"))
+	})
+})
@@ -0,0 +1,296 @@
+package device
+
+import (
+	"encoding/json"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/pkg/errors"
+)
+
+// snapshotChunkSize is the number of Devices stored per SnapshotChunk,
+// keeping documents well under MongoDB's document-size limit.
+const snapshotChunkSize = 1000
+
+// Snapshot is the state of all Devices after replaying the events
+// up to and including Version.
+type Snapshot struct {
+	Version   int64     `json:"version"`
+	Timestamp int64     `json:"timestamp"`
+	Devices   []*Device `json:"devices"`
+}
+
+// SnapshotStore stores Snapshots.
+type SnapshotStore interface {
+	// Latest returns the Snapshot with the highest Version,
+	// or nil if there is no Snapshot.
+	Latest() (*Snapshot, error)
+	Save(snapshot *Snapshot) error
+}
+
+// Rebuild returns the current state of all Devices, by replaying the events
+// after the latest Snapshot onto it, or all events if there is no Snapshot.
+func Rebuild(snapshots SnapshotStore, fetcher EventFetcher) (*Snapshot, error) {
+	latest, err := snapshots.Latest()
+	if err != nil {
+		err = errors.Wrap(err, "Error reading latest Snapshot")
+		return nil, err
+	}
+	return rebuildFrom(latest, fetcher)
+}
+
+// rebuildFrom replays the events after the Snapshot onto it,
+// or all events if the Snapshot is nil.
+func rebuildFrom(latest *Snapshot, fetcher EventFetcher) (*Snapshot, error) {
+	if latest == nil {
+		latest = &Snapshot{Devices: []*Device{}}
+	}
+	events, err := fetcher.Events(latest.Version)
+	if err != nil {
+		err = errors.Wrap(err, "Error fetching events after Snapshot")
+		return nil, err
+	}
+
+	rebuilt := &Snapshot{
+		Version:   latest.Version,
+		Timestamp: time.Now().UnixNano(),
+		Devices:   Replay(latest.Devices, events),
+	}
+	for _, event := range events {
+		if event.Version > rebuilt.Version {
+			rebuilt.Version = event.Version
+		}
+	}
+	return rebuilt, nil
+}
+
+// TakeSnapshot rebuilds the state of all Devices, and saves it as a Snapshot
+// if there are events after the latest Snapshot.
+func TakeSnapshot(snapshots SnapshotStore, fetcher EventFetcher) (*Snapshot, error) {
+	latest, err := snapshots.Latest()
+	if err != nil {
+		err = errors.Wrap(err, "Error reading latest Snapshot")
+		return nil, err
+	}
+	snapshot, err := rebuildFrom(latest, fetcher)
+	if err != nil {
+		return nil, err
+	}
+	if latest != nil && snapshot.Version <= latest.Version {
+		return latest, nil
+	}
+	err = snapshots.Save(snapshot)
+	if err != nil {
+		err = errors.Wrap(err, "Error saving Snapshot")
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// SnapshotPolicy defines when Snapshots are taken.
+type SnapshotPolicy struct {
+	// EveryEvents takes a Snapshot once this many events were handled since
+	// the last Snapshot. Zero disables this.
+	EveryEvents int64
+	// Interval takes a Snapshot when an event is handled this long after
+	// the last Snapshot. Zero disables this.
+	Interval time.Duration
+}
+
+// Snapshotting takes Snapshots in the background as per policy, counting
+// handled events with a Version. Only one Snapshot is taken at a time.
+func Snapshotting(
+	snapshots SnapshotStore, fetcher EventFetcher, policy SnapshotPolicy,
+) Middleware {
+	lock := sync.Mutex{}
+	var count int64
+	last := time.Now()
+	isTaking := false
+
+	// take runs in its own goroutine, so panics are recovered here
+	take := func() {
+		defer func() {
+			recovered := recover()
+			if recovered != nil {
+				log.Printf(
+					"Snapshotting: Panic taking Snapshot: %v\n%s", recovered, debug.Stack(),
+				)
+			}
+			lock.Lock()
+			isTaking = false
+			lock.Unlock()
+		}()
+
+		snapshot, err := TakeSnapshot(snapshots, fetcher)
+		if err != nil {
+			err = errors.Wrap(err, "Snapshotting: Error taking Snapshot")
+			log.Println(err)
+		} else {
+			log.Printf(
+				"Snapshotting: Snapshot of %d Devices at version %d",
+				len(snapshot.Devices), snapshot.Version,
+			)
+		}
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(store Storage, event *model.Event) *model.KafkaResponse {
+			kr := next(store, event)
+			opts := &dryRunOption{}
+			// Events with invalid data are rejected by their handlers
+			json.Unmarshal(event.Data, opts)
+			if event.Version == 0 || isDryRun(event, opts.DryRun) {
+				return kr
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			count++
+			isDue := (policy.EveryEvents > 0 && count >= policy.EveryEvents) ||
+				(policy.Interval > 0 && time.Since(last) >= policy.Interval)
+			if isDue && !isTaking {
+				count = 0
+				last = time.Now()
+				isTaking = true
+				go take()
+			}
+			return kr
+		}
+	}
+}
+
+// SnapshotChunk stores up to snapshotChunkSize Devices of a Snapshot.
+type SnapshotChunk struct {
+	ID      objectid.ObjectID `bson:"_id,omitempty"`
+	Version int64             `bson:"version"`
+	// Chunk is the index of this chunk, and Chunks is the Snapshot's
+	// number of chunks.
+	Chunk  int64 `bson:"chunk"`
+	Chunks int64 `bson:"chunks"`
+	// Devices are the JSON-marshalled Devices.
+	Devices   string `bson:"devices"`
+	Timestamp int64  `bson:"timestamp"`
+}
+
+// MongoSnapshotStore stores Snapshots in a MongoDB collection,
+// in chunks of Devices.
+type MongoSnapshotStore struct {
+	collection *mongo.Collection
+}
+
+// NewMongoSnapshotStore creates a SnapshotStore backed by the provided
+// collection. The collection's SchemaStruct must be *SnapshotChunk.
+func NewMongoSnapshotStore(collection *mongo.Collection) (*MongoSnapshotStore, error) {
+	if collection == nil {
+		return nil, errors.New("collection cannot be nil")
+	}
+	return &MongoSnapshotStore{collection}, nil
+}
+
+// Latest returns the Snapshot with the highest Version.
+// The first chunk of a Snapshot is saved last, so only completely saved
+// Snapshots are found.
+func (s *MongoSnapshotStore) Latest() (*Snapshot, error) {
+	firstChunks, err := s.collection.Find(
+		map[string]interface{}{"chunk": 0},
+		findopt.Sort(map[string]interface{}{"version": -1}),
+		findopt.Limit(1),
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Error finding latest SnapshotChunk")
+		return nil, err
+	}
+	if len(firstChunks) == 0 {
+		return nil, nil
+	}
+	first, assertOK := firstChunks[0].(*SnapshotChunk)
+	if !assertOK {
+		return nil, errors.New("error asserting FindResult to SnapshotChunk")
+	}
+
+	chunks, err := s.collection.Find(
+		map[string]interface{}{"version": first.Version},
+		findopt.Sort(map[string]interface{}{"chunk": 1}),
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Error finding SnapshotChunks")
+		return nil, err
+	}
+	if int64(len(chunks)) != first.Chunks {
+		return nil, errors.Errorf(
+			"snapshot %d has %d of %d chunks", first.Version, len(chunks), first.Chunks,
+		)
+	}
+
+	snapshot := &Snapshot{
+		Version:   first.Version,
+		Timestamp: first.Timestamp,
+		Devices:   []*Device{},
+	}
+	for _, c := range chunks {
+		chunk, assertOK := c.(*SnapshotChunk)
+		if !assertOK {
+			return nil, errors.New("error asserting FindResult to SnapshotChunk")
+		}
+		devices := []*Device{}
+		err = json.Unmarshal([]byte(chunk.Devices), &devices)
+		if err != nil {
+			err = errors.Wrap(err, "Error unmarshalling SnapshotChunk Devices")
+			return nil, err
+		}
+		snapshot.Devices = append(snapshot.Devices, devices...)
+	}
+	return snapshot, nil
+}
+
+// Save saves the Snapshot in chunks, saving its first chunk last.
+func (s *MongoSnapshotStore) Save(snapshot *Snapshot) error {
+	chunks, err := splitSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	for i := len(chunks) - 1; i >= 0; i-- {
+		_, err := s.collection.InsertOne(chunks[i])
+		if err != nil {
+			err = errors.Wrapf(err, "Error inserting SnapshotChunk %d", i)
+			return err
+		}
+	}
+	return nil
+}
+
+// splitSnapshot splits the Snapshot's Devices into SnapshotChunks.
+// A Snapshot without Devices has a single empty chunk.
+func splitSnapshot(snapshot *Snapshot) ([]*SnapshotChunk, error) {
+	count := (len(snapshot.Devices) + snapshotChunkSize - 1) / snapshotChunkSize
+	if count == 0 {
+		count = 1
+	}
+	chunks := make([]*SnapshotChunk, count)
+	for i := range chunks {
+		start := i * snapshotChunkSize
+		end := start + snapshotChunkSize
+		if end > len(snapshot.Devices) {
+			end = len(snapshot.Devices)
+		}
+		devices, err := json.Marshal(snapshot.Devices[start:end])
+		if err != nil {
+			err = errors.Wrap(err, "Error marshalling Snapshot Devices")
+			return nil, err
+		}
+		chunks[i] = &SnapshotChunk{
+			Version:   snapshot.Version,
+			Chunk:     int64(i),
+			Chunks:    int64(count),
+			Devices:   string(devices),
+			Timestamp: snapshot.Timestamp,
+		}
+	}
+	return chunks, nil
+}
@@ -0,0 +1,160 @@
+package device
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	bolt "go.etcd.io/bbolt"
+)
+
+var _ = Describe("Snapshot", func() {
+	var (
+		dbFile    string
+		db        *bolt.DB
+		snapshots *BoltSnapshotStore
+		events    []model.Event
+		fetchedAt []int64
+		fetcher   fetcherFunc
+	)
+
+	// addInsert appends an insert-event for a new Device
+	addInsert := func() {
+		deviceID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		eventUUID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		data, err := json.Marshal(map[string]interface{}{"deviceID": deviceID.String()})
+		Expect(err).ToNot(HaveOccurred())
+		events = append(events, model.Event{
+			AggregateID: AggregateID,
+			EventAction: "insert",
+			Data:        data,
+			UUID:        eventUUID,
+			Version:     int64(len(events) + 1),
+		})
+	}
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "agg_device_snapshot")
+		Expect(err).ToNot(HaveOccurred())
+		dbFile = f.Name()
+		f.Close()
+		db, err = bolt.Open(dbFile, 0600, nil)
+		Expect(err).ToNot(HaveOccurred())
+		snapshots, err = NewBoltSnapshotStore(db)
+		Expect(err).ToNot(HaveOccurred())
+
+		events = []model.Event{}
+		fetchedAt = []int64{}
+		fetcher = func(fromVersion int64) ([]model.Event, error) {
+			fetchedAt = append(fetchedAt, fromVersion)
+			fetched := []model.Event{}
+			for _, e := range events {
+				if e.Version > fromVersion {
+					fetched = append(fetched, e)
+				}
+			}
+			return fetched, nil
+		}
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.Remove(dbFile)
+	})
+
+	It("should replay from the latest Snapshot", func() {
+		addInsert()
+		addInsert()
+		snapshot, err := TakeSnapshot(snapshots, fetcher)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(snapshot.Version).To(Equal(int64(2)))
+		Expect(snapshot.Devices).To(HaveLen(2))
+
+		addInsert()
+		rebuilt, err := Rebuild(snapshots, fetcher)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rebuilt.Version).To(Equal(int64(3)))
+		Expect(rebuilt.Devices).To(HaveLen(3))
+		Expect(fetchedAt).To(Equal([]int64{0, 2}))
+
+		// Snapshots are not saved without new events
+		_, err = TakeSnapshot(snapshots, fetcher)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = TakeSnapshot(snapshots, fetcher)
+		Expect(err).ToNot(HaveOccurred())
+		latest, err := snapshots.Latest()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(latest.Version).To(Equal(int64(3)))
+	})
+
+	It("should take Snapshots every configured number of events", func() {
+		handler := Snapshotting(snapshots, fetcher, SnapshotPolicy{EveryEvents: 2})(
+			func(store Storage, event *model.Event) *model.KafkaResponse {
+				return &model.KafkaResponse{UUID: event.UUID}
+			},
+		)
+		addInsert()
+		handler(nil, &events[0])
+		latest, err := snapshots.Latest()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(latest).To(BeNil())
+
+		addInsert()
+		handler(nil, &events[1])
+		Eventually(func() *Snapshot {
+			latest, err := snapshots.Latest()
+			Expect(err).ToNot(HaveOccurred())
+			return latest
+		}).ShouldNot(BeNil())
+	})
+
+	It("should recover from panics taking Snapshots", func() {
+		inner := fetcher
+		panicked := int32(0)
+		panicking := fetcherFunc(func(fromVersion int64) ([]model.Event, error) {
+			if atomic.CompareAndSwapInt32(&panicked, 0, 1) {
+				panic("fetch failed")
+			}
+			return inner(fromVersion)
+		})
+		handler := Snapshotting(snapshots, panicking, SnapshotPolicy{EveryEvents: 1})(
+			func(store Storage, event *model.Event) *model.KafkaResponse {
+				return &model.KafkaResponse{UUID: event.UUID}
+			},
+		)
+		addInsert()
+		handler(nil, &events[0])
+
+		// Snapshots are taken again once the panicking Snapshot is done
+		Eventually(func() *Snapshot {
+			handler(nil, &events[0])
+			latest, err := snapshots.Latest()
+			Expect(err).ToNot(HaveOccurred())
+			return latest
+		}).ShouldNot(BeNil())
+		Expect(atomic.LoadInt32(&panicked)).To(Equal(int32(1)))
+	})
+
+	It("should split Snapshots into chunks", func() {
+		snapshot := &Snapshot{Version: 1, Devices: []*Device{}}
+		chunks, err := splitSnapshot(snapshot)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(chunks).To(HaveLen(1))
+
+		for i := 0; i < snapshotChunkSize+1; i++ {
+			snapshot.Devices = append(snapshot.Devices, &Device{Name: "sensor"})
+		}
+		chunks, err = splitSnapshot(snapshot)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(chunks).To(HaveLen(2))
+		Expect(chunks[1].Chunk).To(Equal(int64(1)))
+		Expect(chunks[1].Chunks).To(Equal(int64(2)))
+	})
+})
@@ -0,0 +1,164 @@
+package device
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// PointInTime selects the events replayed to reconstruct a past state.
+// Zero values do not limit the events.
+type PointInTime struct {
+	// Version replays events up to and including this event-version.
+	Version int64
+	// Time replays events with a NanoTime up to and including this time.
+	Time time.Time
+}
+
+// includes checks if the event happened at or before the PointInTime.
+func (p PointInTime) includes(event *model.Event) bool {
+	return (p.Version == 0 || event.Version <= p.Version) &&
+		(p.Time.IsZero() || event.NanoTime <= p.Time.UnixNano())
+}
+
+// DeviceState is the state of a Device as of a PointInTime.
+type DeviceState struct {
+	// Device is nil if the Device was deleted by Event.
+	Device *Device
+	// Event is the last event that changed the Device.
+	Event *model.Event
+}
+
+// stateEvent is the JSON-representation of a DeviceState's Event,
+// with its data as JSON instead of bytes.
+type stateEvent struct {
+	UUID          uuuid.UUID      `json:"uuid"`
+	CorrelationID uuuid.UUID      `json:"correlationID"`
+	UserUUID      uuuid.UUID      `json:"userUUID"`
+	EventAction   string          `json:"eventAction"`
+	ServiceAction string          `json:"serviceAction"`
+	Version       int64           `json:"version"`
+	NanoTime      int64           `json:"nanoTime"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// MarshalJSON returns bytes of JSON-type.
+func (s *DeviceState) MarshalJSON() ([]byte, error) {
+	event := &stateEvent{
+		UUID:          s.Event.UUID,
+		CorrelationID: s.Event.CorrelationID,
+		UserUUID:      s.Event.UserUUID,
+		EventAction:   s.Event.EventAction,
+		ServiceAction: s.Event.ServiceAction,
+		Version:       s.Event.Version,
+		NanoTime:      s.Event.NanoTime,
+		Data:          s.Event.Data,
+	}
+	if !json.Valid(event.Data) {
+		event.Data = nil
+	}
+	return json.Marshal(map[string]interface{}{
+		"device": s.Device,
+		"event":  event,
+	})
+}
+
+// StateAt reconstructs the Device with the deviceID as of the PointInTime,
+// by replaying all events up to it, skipping rejected events as Replay does.
+// Nil is returned if the Device was not inserted as of the PointInTime.
+func StateAt(
+	fetcher EventFetcher, deviceID uuuid.UUID, at PointInTime,
+) (*DeviceState, error) {
+	events, err := fetcher.Events(0)
+	if err != nil {
+		err = errors.Wrap(err, "Error fetching events")
+		return nil, err
+	}
+
+	rejected := rejectedEvents(events)
+	devices := []*Device{}
+	var state *DeviceState
+	for i := range events {
+		event := &events[i]
+		if !at.includes(event) ||
+			event.EventAction == CommandRejectedAction || rejected[event.UUID] {
+			continue
+		}
+		next, err := replayEvent(devices, event)
+		if err != nil {
+			continue
+		}
+		// Apply returns Devices not affected by the event as is
+		before := findDevice(devices, deviceID)
+		after := findDevice(next, deviceID)
+		if before != after {
+			state = &DeviceState{Device: after, Event: event}
+		}
+		devices = next
+	}
+	return state, nil
+}
+
+// EventCache is an EventFetcher keeping all fetched events in memory, so
+// only events newer than the cached events are fetched again. This suits
+// reconstructing past states, which replays all events on every request.
+type EventCache struct {
+	fetcher EventFetcher
+
+	lock   sync.Mutex
+	events []model.Event
+}
+
+// NewEventCache creates an EventCache fetching new events using fetcher.
+func NewEventCache(fetcher EventFetcher) (*EventCache, error) {
+	if fetcher == nil {
+		return nil, errors.New("fetcher cannot be nil")
+	}
+	return &EventCache{
+		fetcher: fetcher,
+		events:  []model.Event{},
+	}, nil
+}
+
+// Events fetches the events newer than the cached events, and returns
+// the events with Version greater than fromVersion, sorted by Version.
+func (c *EventCache) Events(fromVersion int64) ([]model.Event, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var cached int64
+	if len(c.events) > 0 {
+		cached = c.events[len(c.events)-1].Version
+	}
+	fetched, err := c.fetcher.Events(cached)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range fetched {
+		if event.Version > cached {
+			c.events = append(c.events, event)
+			cached = event.Version
+		}
+	}
+
+	// Events are sorted, so the first event after fromVersion is searched
+	i := sort.Search(len(c.events), func(i int) bool {
+		return c.events[i].Version > fromVersion
+	})
+	return append([]model.Event{}, c.events[i:]...), nil
+}
+
+// findDevice returns the Device with the deviceID, or nil if there is none.
+func findDevice(devices []*Device, deviceID uuuid.UUID) *Device {
+	for _, d := range devices {
+		if d.DeviceID == deviceID {
+			return d
+		}
+	}
+	return nil
+}
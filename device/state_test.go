@@ -0,0 +1,168 @@
+package device
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("StateAt", func() {
+	var (
+		deviceID uuuid.UUID
+		events   []model.Event
+		fetcher  fetcherFunc
+		start    time.Time
+	)
+
+	// addEvent appends an event, happening a minute after the previous event
+	addEvent := func(eventAction string, data interface{}) {
+		marshalled, err := json.Marshal(data)
+		Expect(err).ToNot(HaveOccurred())
+		eventUUID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		events = append(events, model.Event{
+			AggregateID: AggregateID,
+			EventAction: eventAction,
+			Data:        marshalled,
+			NanoTime:    start.Add(time.Duration(len(events)) * time.Minute).UnixNano(),
+			UUID:        eventUUID,
+			Version:     int64(len(events) + 1),
+		})
+	}
+
+	addUpdate := func(status string) {
+		addEvent("update", map[string]interface{}{
+			"filter": map[string]interface{}{"deviceID": deviceID.String()},
+			"update": map[string]interface{}{"status": status},
+		})
+	}
+
+	BeforeEach(func() {
+		var err error
+		deviceID, err = uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		start = time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+
+		events = []model.Event{}
+		fetcher = func(fromVersion int64) ([]model.Event, error) {
+			return events, nil
+		}
+		addEvent("insert", map[string]interface{}{
+			"deviceID": deviceID.String(),
+			"status":   "new",
+		})
+		addUpdate("active")
+		addUpdate("broken")
+	})
+
+	It("should reconstruct the Device as of a version or time", func() {
+		state, err := StateAt(fetcher, deviceID, PointInTime{Version: 2})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state.Device.Status).To(Equal("active"))
+		Expect(state.Event.Version).To(Equal(int64(2)))
+
+		state, err = StateAt(fetcher, deviceID, PointInTime{
+			Time: start.Add(30 * time.Second),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state.Device.Status).To(Equal("new"))
+		Expect(state.Event.Version).To(Equal(int64(1)))
+
+		state, err = StateAt(fetcher, deviceID, PointInTime{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state.Device.Status).To(Equal("broken"))
+
+		state, err = StateAt(fetcher, deviceID, PointInTime{
+			Time: start.Add(-time.Second),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state).To(BeNil())
+	})
+
+	It("should skip rejected events", func() {
+		rejection, err := NewRejectionEvent(&events[2], &model.KafkaResponse{
+			Error:     "rejected",
+			ErrorCode: UserError,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		events = append(events, *rejection)
+
+		state, err := StateAt(fetcher, deviceID, PointInTime{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state.Device.Status).To(Equal("active"))
+		Expect(state.Event.Version).To(Equal(int64(2)))
+	})
+
+	It("should serve past states on the admin API", func() {
+		addEvent("delete", map[string]interface{}{"deviceID": deviceID.String()})
+		handler, err := NewAdminHandler(&slicePageReader{}, fetcher, "secret")
+		Expect(err).ToNot(HaveOccurred())
+
+		get := func(query string) (*httptest.ResponseRecorder, map[string]interface{}) {
+			path := "/devices/" + deviceID.String() + "/state" + query
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			body := map[string]interface{}{}
+			err := json.Unmarshal(rec.Body.Bytes(), &body)
+			Expect(err).ToNot(HaveOccurred())
+			return rec, body
+		}
+
+		rec, body := get("?at=2018-06-01T00:01:30Z")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(body["device"]).To(HaveKeyWithValue("status", "active"))
+		Expect(body["event"]).To(HaveKeyWithValue("version", BeNumerically("==", 2)))
+		Expect(body["event"]).To(HaveKeyWithValue("data", HaveKey("update")))
+
+		rec, body = get("")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(body["device"]).To(BeNil())
+		Expect(body["event"]).To(HaveKeyWithValue("eventAction", "delete"))
+
+		rec, _ = get("?version=x")
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should fetch only events newer than the cached events", func() {
+		fromVersions := []int64{}
+		cache, err := NewEventCache(fetcherFunc(
+			func(fromVersion int64) ([]model.Event, error) {
+				fromVersions = append(fromVersions, fromVersion)
+				newer := []model.Event{}
+				for _, event := range events {
+					if event.Version > fromVersion {
+						newer = append(newer, event)
+					}
+				}
+				return newer, nil
+			},
+		))
+		Expect(err).ToNot(HaveOccurred())
+
+		state, err := StateAt(cache, deviceID, PointInTime{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state.Device.Status).To(Equal("broken"))
+
+		addUpdate("fixed")
+		state, err = StateAt(cache, deviceID, PointInTime{Version: 2})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state.Device.Status).To(Equal("active"))
+		state, err = StateAt(cache, deviceID, PointInTime{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state.Device.Status).To(Equal("fixed"))
+		Expect(fromVersions).To(Equal([]int64{0, 3, 4}))
+
+		cached, err := cache.Events(2)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cached).To(Equal(events[2:]))
+	})
+})
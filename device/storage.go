@@ -0,0 +1,457 @@
+package device
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	mgo "github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/countopt"
+	"github.com/mongodb/mongo-go-driver/mongo/deleteopt"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/mongodb/mongo-go-driver/mongo/insertopt"
+	"github.com/mongodb/mongo-go-driver/mongo/mongoopt"
+	"github.com/mongodb/mongo-go-driver/mongo/replaceopt"
+	"github.com/mongodb/mongo-go-driver/mongo/updateopt"
+	"github.com/pkg/errors"
+)
+
+// duplicateKey is the MongoDB error-code for unique-index violations.
+const duplicateKey = 11000
+
+// CaseInsensitiveCollation compares strings ignoring their case. This is used
+// by case-insensitive UniqueConstraints, and their unique-indexes.
+var CaseInsensitiveCollation = &mongoopt.Collation{
+	Locale:   "en",
+	Strength: 2,
+}
+
+// Storage persists Device Aggregates.
+// Handlers only interact with persisted Devices through Storage.
+type Storage interface {
+	// Find returns all Devices matching filter.
+	Find(filter map[string]interface{}) ([]*Device, error)
+	// Count returns the number of Devices matching filter.
+	Count(filter map[string]interface{}) (int64, error)
+	// InsertOne inserts the Device and returns its generated ObjectID.
+	// A *UniqueConflictError is returned if the Device violates
+	// a UniqueConstraint.
+	InsertOne(device *Device) (objectid.ObjectID, error)
+	// UpdateMany sets the fields in update on all Devices matching filter.
+	// A *UniqueConflictError is returned if any updated Device would violate
+	// a UniqueConstraint.
+	UpdateMany(
+		filter map[string]interface{},
+		update map[string]interface{},
+	) (matchedCount int64, modifiedCount int64, err error)
+	// DeleteMany deletes all Devices matching filter.
+	DeleteMany(filter map[string]interface{}) (deletedCount int64, err error)
+	// CheckUnique returns a *UniqueConflictError if the Devices, as they would
+	// be stored, violate a UniqueConstraint. If update is set, only constraints
+	// affected by the update are checked.
+	CheckUnique(devices []*Device, update map[string]interface{}) error
+	// InsertAssignment records an Assignment in the Device's assignment-history.
+	InsertAssignment(assignment *Assignment) error
+	// Transaction runs fn with a Storage whose operations are either all
+	// committed, or all discarded if fn returns an error.
+	Transaction(fn func(tx Storage) error) error
+}
+
+// MongoStorageConfig defines the collections and options for MongoStorage.
+type MongoStorageConfig struct {
+	// AggCollection stores the Devices.
+	AggCollection *mongo.Collection
+	// AssignmentCollection stores the Device-to-Item assignment-history.
+	AssignmentCollection *mongo.Collection
+	// UniqueConstraints are checked before inserting and updating Devices.
+	// These should be backed by unique-indexes, which guard against concurrent
+	// writes when transactions are disabled.
+	UniqueConstraints []UniqueConstraint
+	// EnableTransactions runs operations using Storage.Transaction in MongoDB
+	// multi-document transactions. Transactions require a replica-set, so on
+	// standalone servers this falls back to non-transactional operations.
+	EnableTransactions bool
+}
+
+// MongoStorage is the MongoDB Storage for Device Aggregates.
+type MongoStorage struct {
+	collection           *mongo.Collection
+	assignmentCollection *mongo.Collection
+	constraints          []UniqueConstraint
+	transactions         bool
+	// session is only set on Storage passed to Transaction functions.
+	session *mgo.Session
+}
+
+// NewMongoStorage creates a Storage backed by MongoDB collections.
+func NewMongoStorage(config MongoStorageConfig) (*MongoStorage, error) {
+	if config.AggCollection == nil {
+		return nil, errors.New("AggCollection cannot be nil")
+	}
+	if config.AssignmentCollection == nil {
+		return nil, errors.New("AssignmentCollection cannot be nil")
+	}
+
+	storage := &MongoStorage{
+		collection:           config.AggCollection,
+		assignmentCollection: config.AssignmentCollection,
+		constraints:          config.UniqueConstraints,
+	}
+	if !config.EnableTransactions {
+		return storage, nil
+	}
+
+	isReplSet, err := storage.isReplicaSet()
+	if err != nil {
+		err = errors.Wrap(err, "Error checking MongoDB server-type")
+		return nil, err
+	}
+	if !isReplSet {
+		log.Println(
+			"WARNING: MongoDB server is not a replica-set member, " +
+				"transactions are not supported and will be disabled",
+		)
+		return storage, nil
+	}
+	storage.transactions = true
+	return storage, nil
+}
+
+// isReplicaSet checks if the MongoDB server is a replica-set member.
+func (m *MongoStorage) isReplicaSet() (bool, error) {
+	ctx, cancel := m.timeoutContext()
+	defer cancel()
+
+	cmd := bson.NewDocument(bson.EC.Int32("isMaster", 1))
+	result, err := m.driverClient().Database("admin").RunCommand(ctx, cmd)
+	if err != nil {
+		return false, err
+	}
+	_, err = result.Lookup("setName")
+	return err == nil, nil
+}
+
+// Find returns all Devices matching filter.
+func (m *MongoStorage) Find(filter map[string]interface{}) ([]*Device, error) {
+	opts := []findopt.Find{}
+	if m.session != nil {
+		opts = append(opts, m.session)
+	}
+
+	return m.find(filter, opts...)
+}
+
+func (m *MongoStorage) find(
+	filter map[string]interface{}, opts ...findopt.Find,
+) ([]*Device, error) {
+	findResults, err := m.collection.Find(filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]*Device, len(findResults))
+	for i, result := range findResults {
+		device, assertOK := result.(*Device)
+		if !assertOK {
+			err = errors.New("error asserting FindResult to Device")
+			return nil, err
+		}
+		devices[i] = device
+	}
+	return devices, nil
+}
+
+// FindPage returns up to limit Devices matching filter, ordered by _id,
+// with _ids greater than after.
+func (m *MongoStorage) FindPage(
+	filter map[string]interface{}, after objectid.ObjectID, limit int,
+) ([]*Device, error) {
+	return m.find(
+		pageFilter(filter, after),
+		findopt.Sort(map[string]interface{}{"_id": 1}),
+		findopt.Limit(int64(limit)),
+	)
+}
+
+// Count returns the number of Devices matching filter.
+func (m *MongoStorage) Count(filter map[string]interface{}) (int64, error) {
+	opts := []countopt.Count{}
+	if m.session != nil {
+		opts = append(opts, m.session)
+	}
+
+	ctx, cancel := m.timeoutContext()
+	defer cancel()
+	return m.driverCollection().CountDocuments(ctx, filter, opts...)
+}
+
+// InsertOne inserts the Device and returns its generated ObjectID.
+func (m *MongoStorage) InsertOne(device *Device) (objectid.ObjectID, error) {
+	opts := []insertopt.One{}
+	if m.session != nil {
+		opts = append(opts, m.session)
+	}
+
+	err := m.CheckUnique([]*Device{device}, nil)
+	if err != nil {
+		return objectid.NilObjectID, err
+	}
+	insertResult, err := m.collection.InsertOne(device, opts...)
+	if err != nil {
+		return objectid.NilObjectID, m.uniqueIndexError(err)
+	}
+	insertedID, assertOK := insertResult.InsertedID.(objectid.ObjectID)
+	if !assertOK {
+		err = errors.New("error asserting InsertedID from InsertResult to ObjectID")
+		return objectid.NilObjectID, err
+	}
+	return insertedID, nil
+}
+
+// UpdateMany sets the fields in update on all Devices matching filter.
+func (m *MongoStorage) UpdateMany(
+	filter map[string]interface{},
+	update map[string]interface{},
+) (int64, int64, error) {
+	opts := []updateopt.Update{}
+	if m.session != nil {
+		opts = append(opts, m.session)
+	}
+
+	if len(m.constraints) > 0 {
+		err := m.checkUpdateUnique(filter, update)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	updateStats, err := m.collection.UpdateMany(filter, update, opts...)
+	if err != nil {
+		return 0, 0, m.uniqueIndexError(err)
+	}
+	return updateStats.MatchedCount, updateStats.ModifiedCount, nil
+}
+
+// DeleteMany deletes all Devices matching filter.
+func (m *MongoStorage) DeleteMany(filter map[string]interface{}) (int64, error) {
+	opts := []deleteopt.Delete{}
+	if m.session != nil {
+		opts = append(opts, m.session)
+	}
+
+	deleteStats, err := m.collection.DeleteMany(filter, opts...)
+	if err != nil {
+		return 0, err
+	}
+	return deleteStats.DeletedCount, nil
+}
+
+// Each calls fn with each Device matching filter, ordered by _id. Devices are
+// streamed from MongoDB, so all Devices can be read without loading them together.
+// Iteration stops at the first error returned by fn.
+func (m *MongoStorage) Each(
+	filter map[string]interface{}, fn func(device *Device) error,
+) error {
+	ctx := context.Background()
+	cursor, err := m.driverCollection().Find(
+		ctx, filter, findopt.Sort(map[string]interface{}{"_id": 1}),
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Error finding Devices")
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		doc, err := cursor.DecodeBytes()
+		if err != nil {
+			err = errors.Wrap(err, "Error reading Device from cursor")
+			return err
+		}
+		device := &Device{}
+		err = device.UnmarshalBSON(doc)
+		if err != nil {
+			return err
+		}
+		err = fn(device)
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// Restore stores the Devices with their _ids, replacing any Device with the same
+// _id, so restoring the same Devices again has no further effect.
+// Unique constraints are only enforced by their unique-indexes.
+func (m *MongoStorage) Restore(devices []*Device) error {
+	for _, device := range devices {
+		if device.ID == objectid.NilObjectID {
+			return errors.Errorf("device %s has no _id", device.DeviceID)
+		}
+		ctx, cancel := m.timeoutContext()
+		_, err := m.driverCollection().ReplaceOne(
+			ctx,
+			map[string]interface{}{"_id": device.ID},
+			device,
+			replaceopt.Upsert(true),
+		)
+		cancel()
+		if err != nil {
+			err = errors.Wrapf(err, "Error restoring Device %s", device.DeviceID)
+			return m.uniqueIndexError(err)
+		}
+	}
+	return nil
+}
+
+// InsertAssignment records an Assignment in the Device's assignment-history.
+func (m *MongoStorage) InsertAssignment(assignment *Assignment) error {
+	opts := []insertopt.One{}
+	if m.session != nil {
+		opts = append(opts, m.session)
+	}
+
+	_, err := m.assignmentCollection.InsertOne(assignment, opts...)
+	return err
+}
+
+// Transaction runs fn inside a MongoDB transaction, which is committed if fn
+// returns no error, and aborted otherwise. If transactions are disabled, or
+// this Storage is already part of a transaction, fn is run using this Storage.
+func (m *MongoStorage) Transaction(fn func(tx Storage) error) error {
+	if !m.transactions || m.session != nil {
+		return fn(m)
+	}
+
+	session, err := m.driverClient().StartSession()
+	if err != nil {
+		err = errors.Wrap(err, "Error starting session")
+		return err
+	}
+	defer func() {
+		ctx, cancel := m.timeoutContext()
+		session.EndSession(ctx)
+		cancel()
+	}()
+
+	err = session.StartTransaction()
+	if err != nil {
+		err = errors.Wrap(err, "Error starting transaction")
+		return err
+	}
+
+	err = fn(&MongoStorage{
+		collection:           m.collection,
+		assignmentCollection: m.assignmentCollection,
+		constraints:          m.constraints,
+		transactions:         true,
+		session:              session,
+	})
+	ctx, cancel := m.timeoutContext()
+	defer cancel()
+	if err != nil {
+		abortErr := session.AbortTransaction(ctx)
+		if abortErr != nil {
+			abortErr = errors.Wrap(abortErr, "Error aborting transaction")
+			log.Println(abortErr)
+		}
+		return err
+	}
+
+	err = session.CommitTransaction(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "Error committing transaction")
+		return err
+	}
+	return nil
+}
+
+// checkUpdateUnique checks that Devices matching filter would not violate
+// any UniqueConstraint once update is applied.
+func (m *MongoStorage) checkUpdateUnique(
+	filter map[string]interface{},
+	update map[string]interface{},
+) error {
+	matched, err := m.Find(filter)
+	if err != nil {
+		err = errors.Wrap(err, "Error finding Devices to update")
+		return err
+	}
+	updated := make([]*Device, len(matched))
+	for i, d := range matched {
+		updated[i], err = d.applyUpdate(update)
+		if err != nil {
+			return err
+		}
+	}
+	return m.CheckUnique(updated, update)
+}
+
+// CheckUnique returns a *UniqueConflictError if the Devices, as they would
+// be stored, violate a UniqueConstraint. If update is set, only constraints
+// affected by the update are checked.
+func (m *MongoStorage) CheckUnique(
+	devices []*Device, update map[string]interface{},
+) error {
+	return checkUnique(m.constraints, devices, update, m.findClashes)
+}
+
+// findClashes finds a Device matching filter, other than excludeIDs.
+func (m *MongoStorage) findClashes(
+	constraint *UniqueConstraint,
+	filter map[string]interface{},
+	excludeIDs []string,
+) ([]*Device, error) {
+	filter["deviceID"] = map[string]interface{}{
+		"$nin": excludeIDs,
+	}
+	opts := []findopt.Find{findopt.Limit(1)}
+	if constraint.CaseInsensitive {
+		opts = append(opts, findopt.Collation(CaseInsensitiveCollation))
+	}
+	if m.session != nil {
+		opts = append(opts, m.session)
+	}
+	return m.find(filter, opts...)
+}
+
+// uniqueIndexError converts duplicate-key errors, from writes that passed
+// the UniqueConstraint checks but violated a unique-index, to
+// UniqueConflictError. This can happen on concurrent writes.
+func (m *MongoStorage) uniqueIndexError(err error) error {
+	writeErrs, isWriteErr := errors.Cause(err).(mgo.WriteErrors)
+	if !isWriteErr {
+		return err
+	}
+	for _, writeErr := range writeErrs {
+		if writeErr.Code != duplicateKey {
+			continue
+		}
+		for _, constraint := range m.constraints {
+			if strings.Contains(writeErr.Message, constraint.Name) {
+				return &UniqueConflictError{Constraint: constraint.Name}
+			}
+		}
+	}
+	return err
+}
+
+func (m *MongoStorage) driverClient() *mgo.Client {
+	return m.collection.Connection.Client.DriverClient()
+}
+
+func (m *MongoStorage) driverCollection() *mgo.Collection {
+	return m.driverClient().
+		Database(m.collection.Database).
+		Collection(m.collection.Name)
+}
+
+func (m *MongoStorage) timeoutContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(
+		context.Background(),
+		time.Duration(m.collection.Connection.Timeout)*time.Millisecond,
+	)
+}
@@ -0,0 +1,232 @@
+package device
+
+import (
+	"encoding/json"
+	"regexp"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/pkg/errors"
+)
+
+// tenantIDPattern restricts TenantIDs, which can be used in
+// collection and database names.
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,48}$`)
+
+// TenantResolver resolves the tenant an event belongs to.
+type TenantResolver interface {
+	Tenant(event *model.Event) (string, error)
+}
+
+// DataTenant resolves the tenant from "tenantID" in Event-data,
+// or uses Default if that is not set.
+type DataTenant struct {
+	Default string
+}
+
+// Tenant returns the tenant the event belongs to.
+func (t DataTenant) Tenant(event *model.Event) (string, error) {
+	data := struct {
+		TenantID *string `json:"tenantID"`
+	}{}
+	err := json.Unmarshal(event.Data, &data)
+	if err != nil {
+		err = errors.Wrap(err, "Error while unmarshalling Event-data")
+		return "", err
+	}
+
+	tenantID := t.Default
+	if data.TenantID != nil {
+		tenantID = *data.TenantID
+	}
+	if tenantID == "" {
+		return "", errors.New("event has no tenantID")
+	}
+	err = ValidateTenantID(tenantID)
+	if err != nil {
+		return "", err
+	}
+	return tenantID, nil
+}
+
+// ValidateTenantID checks that the TenantID can be used in
+// collection and database names.
+func ValidateTenantID(tenantID string) error {
+	if !tenantIDPattern.MatchString(tenantID) {
+		return errors.Errorf(
+			"tenantID %q must have 1 to 48 letters, digits, '_' or '-'", tenantID,
+		)
+	}
+	return nil
+}
+
+// TenantRouter returns the Storage for a tenant's Devices, such as
+// when tenants are stored in separate collections.
+type TenantRouter func(tenantID string) (Storage, error)
+
+// Tenancy scopes handlers to the tenant of the event, as per resolver. If router
+// is set, the tenant's Storage is used, otherwise the store passed to handlers.
+// Either way, the Storage is wrapped in TenantStorage.
+func Tenancy(resolver TenantResolver, router TenantRouter) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(store Storage, event *model.Event) *model.KafkaResponse {
+			tenantID, err := resolver.Tenant(event)
+			if err != nil {
+				err = errors.Wrap(err, "Tenancy")
+				return errorResponse(event, err, UserError)
+			}
+			if router != nil {
+				store, err = router(tenantID)
+				if err != nil {
+					err = errors.Wrapf(err, "Tenancy: Error routing tenant %s", tenantID)
+					return errorResponse(event, err, DatabaseError)
+				}
+			}
+			return next(NewTenantStorage(store, tenantID), event)
+		}
+	}
+}
+
+// TenantStorage scopes a Storage to a tenant. The tenantID is injected into
+// all filters, and set on inserted Devices and Assignments, so Devices of
+// other tenants are never read or changed.
+type TenantStorage struct {
+	Storage
+	tenantID string
+}
+
+// NewTenantStorage scopes store to the tenant.
+func NewTenantStorage(store Storage, tenantID string) *TenantStorage {
+	return &TenantStorage{
+		Storage:  store,
+		tenantID: tenantID,
+	}
+}
+
+// TenantID returns the tenant the Storage is scoped to.
+func (t *TenantStorage) TenantID() string {
+	return t.tenantID
+}
+
+// scope returns a copy of filter that only matches the tenant's Devices.
+func (t *TenantStorage) scope(filter map[string]interface{}) (
+	map[string]interface{}, error,
+) {
+	scoped := map[string]interface{}{}
+	for k, v := range filter {
+		scoped[k] = v
+	}
+	tenantID, exists := scoped["tenantID"]
+	if exists && tenantID != t.tenantID {
+		err := errors.Errorf("filter tenantID does not match tenant %s", t.tenantID)
+		return nil, NewError(UserError, err)
+	}
+	scoped["tenantID"] = t.tenantID
+	return scoped, nil
+}
+
+// checkTenant sets the tenantID on device, or returns an error if
+// the device belongs to another tenant.
+func (t *TenantStorage) checkTenant(device *Device) error {
+	if device.TenantID == "" {
+		device.TenantID = t.tenantID
+	}
+	if device.TenantID != t.tenantID {
+		err := errors.Errorf("device tenantID does not match tenant %s", t.tenantID)
+		return NewError(UserError, err)
+	}
+	return nil
+}
+
+// checkUpdate returns an error if update changes the tenantID.
+func (t *TenantStorage) checkUpdate(update map[string]interface{}) error {
+	tenantID, exists := update["tenantID"]
+	if exists && tenantID != t.tenantID {
+		err := errors.New("tenantID cannot be updated")
+		return NewError(UserError, err)
+	}
+	return nil
+}
+
+// Find finds the tenant's Devices matching filter.
+func (t *TenantStorage) Find(filter map[string]interface{}) ([]*Device, error) {
+	scoped, err := t.scope(filter)
+	if err != nil {
+		return nil, err
+	}
+	return t.Storage.Find(scoped)
+}
+
+// Count counts the tenant's Devices matching filter.
+func (t *TenantStorage) Count(filter map[string]interface{}) (int64, error) {
+	scoped, err := t.scope(filter)
+	if err != nil {
+		return 0, err
+	}
+	return t.Storage.Count(scoped)
+}
+
+// InsertOne inserts the Device for the tenant.
+func (t *TenantStorage) InsertOne(device *Device) (objectid.ObjectID, error) {
+	err := t.checkTenant(device)
+	if err != nil {
+		return objectid.NilObjectID, err
+	}
+	return t.Storage.InsertOne(device)
+}
+
+// UpdateMany applies update to the tenant's Devices matching filter.
+func (t *TenantStorage) UpdateMany(
+	filter map[string]interface{},
+	update map[string]interface{},
+) (int64, int64, error) {
+	err := t.checkUpdate(update)
+	if err != nil {
+		return 0, 0, err
+	}
+	scoped, err := t.scope(filter)
+	if err != nil {
+		return 0, 0, err
+	}
+	return t.Storage.UpdateMany(scoped, update)
+}
+
+// DeleteMany deletes the tenant's Devices matching filter.
+func (t *TenantStorage) DeleteMany(filter map[string]interface{}) (int64, error) {
+	scoped, err := t.scope(filter)
+	if err != nil {
+		return 0, err
+	}
+	return t.Storage.DeleteMany(scoped)
+}
+
+// CheckUnique checks unique constraints for the tenant's devices.
+func (t *TenantStorage) CheckUnique(
+	devices []*Device,
+	update map[string]interface{},
+) error {
+	err := t.checkUpdate(update)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		err = t.checkTenant(device)
+		if err != nil {
+			return err
+		}
+	}
+	return t.Storage.CheckUnique(devices, update)
+}
+
+// InsertAssignment records the assignment for the tenant.
+func (t *TenantStorage) InsertAssignment(assignment *Assignment) error {
+	assignment.TenantID = t.tenantID
+	return t.Storage.InsertAssignment(assignment)
+}
+
+// Transaction runs fn in a transaction, scoped to the tenant.
+func (t *TenantStorage) Transaction(fn func(tx Storage) error) error {
+	return t.Storage.Transaction(func(tx Storage) error {
+		return fn(NewTenantStorage(tx, t.tenantID))
+	})
+}
@@ -0,0 +1,158 @@
+package device
+
+import (
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// filterStorage records the filters, Devices and Assignments it receives.
+type filterStorage struct {
+	Storage
+	filters     []map[string]interface{}
+	inserted    []*Device
+	assignments []*Assignment
+}
+
+func (s *filterStorage) Find(filter map[string]interface{}) ([]*Device, error) {
+	s.filters = append(s.filters, filter)
+	return nil, nil
+}
+
+func (s *filterStorage) DeleteMany(filter map[string]interface{}) (int64, error) {
+	s.filters = append(s.filters, filter)
+	return 0, nil
+}
+
+func (s *filterStorage) UpdateMany(
+	filter map[string]interface{},
+	update map[string]interface{},
+) (int64, int64, error) {
+	s.filters = append(s.filters, filter)
+	return 0, 0, nil
+}
+
+func (s *filterStorage) InsertOne(device *Device) (objectid.ObjectID, error) {
+	s.inserted = append(s.inserted, device)
+	return objectid.New(), nil
+}
+
+func (s *filterStorage) InsertAssignment(assignment *Assignment) error {
+	s.assignments = append(s.assignments, assignment)
+	return nil
+}
+
+func (s *filterStorage) Transaction(fn func(tx Storage) error) error {
+	return fn(s)
+}
+
+var _ = Describe("Tenancy", func() {
+	var (
+		base  *filterStorage
+		store *TenantStorage
+	)
+
+	BeforeEach(func() {
+		base = &filterStorage{}
+		store = NewTenantStorage(base, "acme")
+	})
+
+	It("should inject tenantID into filters", func() {
+		filter := map[string]interface{}{"lot": "a"}
+		_, err := store.Find(filter)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = store.DeleteMany(filter)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(base.filters).To(HaveLen(2))
+		for _, f := range base.filters {
+			Expect(f).To(Equal(map[string]interface{}{"lot": "a", "tenantID": "acme"}))
+		}
+		// Original filter is not changed
+		Expect(filter).ToNot(HaveKey("tenantID"))
+	})
+
+	It("should reject filters for other tenants", func() {
+		_, err := store.DeleteMany(map[string]interface{}{"tenantID": "other"})
+		Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+		Expect(base.filters).To(BeEmpty())
+	})
+
+	It("should reject updates to tenantID", func() {
+		_, _, err := store.UpdateMany(
+			map[string]interface{}{"lot": "a"},
+			map[string]interface{}{"tenantID": "other"},
+		)
+		Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+	})
+
+	It("should set tenantID on inserted Devices and Assignments", func() {
+		_, err := store.InsertOne(&Device{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(base.inserted[0].TenantID).To(Equal("acme"))
+
+		_, err = store.InsertOne(&Device{TenantID: "other"})
+		Expect(errorCode(err, 0)).To(Equal(int16(UserError)))
+
+		err = store.Transaction(func(tx Storage) error {
+			return tx.InsertAssignment(&Assignment{})
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(base.assignments[0].TenantID).To(Equal("acme"))
+	})
+
+	It("should resolve tenant from Event-data or default", func() {
+		tenantID, err := DataTenant{}.Tenant(&model.Event{
+			Data: []byte(`{"tenantID":"acme"}`),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tenantID).To(Equal("acme"))
+
+		tenantID, err = DataTenant{Default: "main"}.Tenant(&model.Event{
+			Data: []byte(`{}`),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tenantID).To(Equal("main"))
+
+		_, err = DataTenant{}.Tenant(&model.Event{Data: []byte(`{}`)})
+		Expect(err).To(HaveOccurred())
+		_, err = DataTenant{}.Tenant(&model.Event{
+			Data: []byte(`{"tenantID":"../admin"}`),
+		})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should route handlers to the tenant's Storage", func() {
+		routed := &filterStorage{}
+		var routedTenant string
+		router := func(tenantID string) (Storage, error) {
+			routedTenant = tenantID
+			return routed, nil
+		}
+
+		var handledStore Storage
+		kr := Tenancy(DataTenant{}, router)(
+			func(store Storage, event *model.Event) *model.KafkaResponse {
+				handledStore = store
+				return nil
+			},
+		)(base, &model.Event{Data: []byte(`{"tenantID":"acme"}`)})
+		Expect(kr).To(BeNil())
+		Expect(routedTenant).To(Equal("acme"))
+
+		tenantStore, isTenantStorage := handledStore.(*TenantStorage)
+		Expect(isTenantStorage).To(BeTrue())
+		Expect(tenantStore.TenantID()).To(Equal("acme"))
+		Expect(tenantStore.Storage).To(Equal(routed))
+	})
+
+	It("should reject events without tenant", func() {
+		kr := Tenancy(DataTenant{}, nil)(
+			func(store Storage, event *model.Event) *model.KafkaResponse {
+				return nil
+			},
+		)(base, &model.Event{Data: []byte(`{}`)})
+		Expect(kr.ErrorCode).To(Equal(int16(UserError)))
+	})
+})
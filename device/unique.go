@@ -0,0 +1,181 @@
+package device
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// UniqueConstraint requires Devices to have distinct values for the
+// combination of Fields, such as "name" within a "lot".
+type UniqueConstraint struct {
+	Name   string
+	Fields []string
+	// Scope limits the constraint to Devices having these field-values,
+	// such as only Devices with "status" "active".
+	Scope map[string]interface{}
+	// CaseInsensitive compares string-values ignoring their case.
+	CaseInsensitive bool
+}
+
+// UniqueConflictError is returned when a Device would violate a UniqueConstraint.
+type UniqueConflictError struct {
+	Constraint string
+	// DeviceID is the existing Device the conflicting Device clashes with.
+	// This is blank if the clash was only detected by a unique-index.
+	DeviceID uuuid.UUID
+}
+
+func (e *UniqueConflictError) Error() string {
+	if e.DeviceID == (uuuid.UUID{}) {
+		return fmt.Sprintf("device violates unique constraint %s", e.Constraint)
+	}
+	return fmt.Sprintf(
+		"device conflicts with device %s on unique constraint %s",
+		e.DeviceID, e.Constraint,
+	)
+}
+
+// inScope checks if the Device is subject to the constraint.
+func (c *UniqueConstraint) inScope(fields map[string]interface{}) bool {
+	for k, v := range c.Scope {
+		if fmt.Sprint(fields[k]) != fmt.Sprint(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasBlank checks if any constrained field is blank, in which case the
+// Device is not subject to the constraint, so Devices can leave them unset.
+func (c *UniqueConstraint) hasBlank(fields map[string]interface{}) bool {
+	for _, field := range c.Fields {
+		if fields[field] == nil || fields[field] == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// PartialFilter returns the partial-filter-expression for the unique-index
+// backing this constraint, so the index, like the constraint, only applies to
+// Devices within Scope, and without blank constrained fields.
+func (c *UniqueConstraint) PartialFilter() map[string]interface{} {
+	filter := map[string]interface{}{}
+	for k, v := range c.Scope {
+		filter[k] = v
+	}
+	// Only string-fields can be blank, and "$gt" does not match other types
+	stringFields := (&Device{TenantID: "tenant"}).fieldMap()
+	for _, field := range c.Fields {
+		if _, isString := stringFields[field].(string); isString {
+			filter[field] = map[string]interface{}{"$gt": ""}
+		}
+	}
+	return filter
+}
+
+// filter returns the filter matching Devices that clash with the provided
+// Device-fields on this constraint.
+func (c *UniqueConstraint) filter(fields map[string]interface{}) map[string]interface{} {
+	filter := map[string]interface{}{}
+	for k, v := range c.Scope {
+		filter[k] = v
+	}
+	for _, field := range c.Fields {
+		filter[field] = fields[field]
+	}
+	return filter
+}
+
+// key identifies the constraint's field-values, so Devices can be compared.
+func (c *UniqueConstraint) key(fields map[string]interface{}) string {
+	values := make([]string, len(c.Fields))
+	for i, field := range c.Fields {
+		values[i] = fmt.Sprint(fields[field])
+		if c.CaseInsensitive {
+			values[i] = strings.ToLower(values[i])
+		}
+	}
+	return strings.Join(values, "\x00")
+}
+
+// affectedBy checks if an update to the fields can change whether
+// Devices clash on this constraint.
+func (c *UniqueConstraint) affectedBy(update map[string]interface{}) bool {
+	for _, field := range c.Fields {
+		if _, exists := update[field]; exists {
+			return true
+		}
+	}
+	for field := range c.Scope {
+		if _, exists := update[field]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueFinder finds Devices clashing on a UniqueConstraint,
+// excluding the Devices in excludeIDs.
+type uniqueFinder func(
+	constraint *UniqueConstraint,
+	filter map[string]interface{},
+	excludeIDs []string,
+) ([]*Device, error)
+
+// checkUnique checks the Devices against each other, and against other
+// existing Devices found using find. Only constraints affected by update are
+// checked, or all constraints if update is nil.
+func checkUnique(
+	constraints []UniqueConstraint,
+	devices []*Device,
+	update map[string]interface{},
+	find uniqueFinder,
+) error {
+	excludeIDs := []string{}
+	for _, d := range devices {
+		excludeIDs = append(excludeIDs, d.DeviceID.String())
+	}
+	sort.Strings(excludeIDs)
+
+	for i := range constraints {
+		constraint := &constraints[i]
+		if update != nil && !constraint.affectedBy(update) {
+			continue
+		}
+
+		keys := map[string]uuuid.UUID{}
+		for _, d := range devices {
+			fields := d.fieldMap()
+			if !constraint.inScope(fields) || constraint.hasBlank(fields) {
+				continue
+			}
+
+			key := constraint.key(fields)
+			if clashID, exists := keys[key]; exists {
+				return &UniqueConflictError{
+					Constraint: constraint.Name,
+					DeviceID:   clashID,
+				}
+			}
+			keys[key] = d.DeviceID
+
+			clashes, err := find(constraint, constraint.filter(fields), excludeIDs)
+			if err != nil {
+				err = errors.Wrapf(err, "Error checking unique constraint %s", constraint.Name)
+				return err
+			}
+			if len(clashes) > 0 {
+				return &UniqueConflictError{
+					Constraint: constraint.Name,
+					DeviceID:   clashes[0].DeviceID,
+				}
+			}
+		}
+	}
+	return nil
+}
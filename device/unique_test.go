@@ -0,0 +1,113 @@
+package device
+
+import (
+	"github.com/TerrexTech/uuuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UniqueConstraint", func() {
+	var (
+		constraints []UniqueConstraint
+		existing    *Device
+		findCalls   int
+	)
+
+	// findExisting returns the existing Device if it matches filter
+	findExisting := func(
+		c *UniqueConstraint,
+		filter map[string]interface{},
+		excludeIDs []string,
+	) ([]*Device, error) {
+		findCalls++
+		fields := existing.fieldMap()
+		for _, id := range excludeIDs {
+			if id == existing.DeviceID.String() {
+				return nil, nil
+			}
+		}
+		if c.key(filter) != c.key(fields) || !c.inScope(fields) {
+			return nil, nil
+		}
+		return []*Device{existing}, nil
+	}
+
+	newDevice := func(lot string, name string, status string) *Device {
+		deviceID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		return &Device{
+			DeviceID: deviceID,
+			Lot:      lot,
+			Name:     name,
+			Status:   status,
+		}
+	}
+
+	BeforeEach(func() {
+		findCalls = 0
+		constraints = []UniqueConstraint{
+			UniqueConstraint{
+				Name:            "lot_name_unique",
+				Fields:          []string{"lot", "name"},
+				Scope:           map[string]interface{}{"status": "active"},
+				CaseInsensitive: true,
+			},
+		}
+		existing = newDevice("lot-1", "Sensor", "active")
+	})
+
+	It("should return conflict naming the existing Device", func() {
+		d := newDevice("lot-1", "sensor", "active")
+		err := checkUnique(constraints, []*Device{d}, nil, findExisting)
+		Expect(err).To(HaveOccurred())
+
+		conflict, isConflict := err.(*UniqueConflictError)
+		Expect(isConflict).To(BeTrue())
+		Expect(conflict.Constraint).To(Equal("lot_name_unique"))
+		Expect(conflict.DeviceID).To(Equal(existing.DeviceID))
+		Expect(errorCode(err, DatabaseError)).To(Equal(int16(ConflictError)))
+	})
+
+	It("should return conflict if updated Devices clash with each other", func() {
+		d1 := newDevice("lot-2", "Probe", "active")
+		d2 := newDevice("lot-2", "PROBE", "active")
+		err := checkUnique(constraints, []*Device{d1, d2}, nil, findExisting)
+
+		conflict, isConflict := err.(*UniqueConflictError)
+		Expect(isConflict).To(BeTrue())
+		Expect(conflict.DeviceID).To(Equal(d1.DeviceID))
+	})
+
+	It("should ignore Devices outside constraint-scope", func() {
+		d := newDevice("lot-1", "Sensor", "retired")
+		err := checkUnique(constraints, []*Device{d}, nil, findExisting)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should ignore Devices with blank constrained fields", func() {
+		existing = newDevice("", "Sensor", "active")
+		d1 := newDevice("", "Sensor", "active")
+		d2 := newDevice("", "sensor", "active")
+		err := checkUnique(constraints, []*Device{d1, d2}, nil, findExisting)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(findCalls).To(Equal(0))
+
+		Expect(constraints[0].PartialFilter()).To(Equal(map[string]interface{}{
+			"status": "active",
+			"lot":    map[string]interface{}{"$gt": ""},
+			"name":   map[string]interface{}{"$gt": ""},
+		}))
+		numeric := UniqueConstraint{Fields: []string{"dateInstalled", "tenantID"}}
+		Expect(numeric.PartialFilter()).To(Equal(map[string]interface{}{
+			"tenantID": map[string]interface{}{"$gt": ""},
+		}))
+	})
+
+	It("should skip constraints not affected by update", func() {
+		d := newDevice("lot-1", "Sensor", "active")
+		update := map[string]interface{}{"sku": "sku-1"}
+		err := checkUnique(constraints, []*Device{d}, update, findExisting)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(findCalls).To(Equal(0))
+	})
+})
@@ -2,15 +2,14 @@ package device
 
 import (
 	"encoding/json"
-	"log"
 
 	"github.com/TerrexTech/go-eventstore-models/model"
-	"github.com/TerrexTech/go-mongoutils/mongo"
 	"github.com/TerrexTech/uuuid"
 	"github.com/pkg/errors"
 )
 
 type deviceUpdate struct {
+	filterOptions
 	Filter map[string]interface{} `json:"filter"`
 	Update map[string]interface{} `json:"update"`
 }
@@ -20,108 +19,87 @@ type updateResult struct {
 	ModifiedCount int64 `json:"modifiedCount,omitempty"`
 }
 
-// Update handles "update" events.
-func Update(collection *mongo.Collection, event *model.Event) *model.KafkaResponse {
-	deviceUpdate := &deviceUpdate{}
+// Update returns the command for "update" events.
+// The number of Devices the update's filter can match is restricted by limits.
+func Update(limits FilterLimits) CommandFunc {
+	return func(store Storage, event *model.Event) (interface{}, error) {
+		deviceUpdate, err := parseUpdate(event)
+		if err != nil {
+			return nil, err
+		}
+
+		dryRun := isDryRun(event, deviceUpdate.DryRun)
+		result := &updateResult{}
+		var preview *dryRunResult
+		// Transaction ensures either all or none of the matched Devices are updated
+		err = store.Transaction(func(tx Storage) error {
+			err := checkFilter(tx, deviceUpdate.Filter, limits, deviceUpdate.filterOptions)
+			if dryRun {
+				preview, err = dryRunUpdate(tx, deviceUpdate, event, err)
+				return err
+			}
+			if err != nil {
+				return err
+			}
+
+			// Devices are updated as Apply updates them, so filters match
+			// the same Devices when handling and when replaying the event
+			matched, _, err := applyMatching(tx, deviceUpdate.Filter, event)
+			if err != nil || len(matched) == 0 {
+				return err
+			}
+			result.MatchedCount, result.ModifiedCount, err = tx.UpdateMany(
+				idsFilter(matched), deviceUpdate.Update,
+			)
+			return err
+		})
+		if err != nil {
+			err = errors.Wrap(err, "Update: Error in UpdateMany")
+			return nil, NewError(errorCode(err, DatabaseError), err)
+		}
 
+		if dryRun {
+			return preview, preview.rejection
+		}
+		return result, nil
+	}
+}
+
+// parseUpdate returns the filter and update of the "update" event.
+func parseUpdate(event *model.Event) (*deviceUpdate, error) {
+	deviceUpdate := &deviceUpdate{}
 	err := json.Unmarshal(event.Data, deviceUpdate)
 	if err != nil {
 		err = errors.Wrap(err, "Update: Error while unmarshalling Event-data")
-		log.Println(err)
-		return &model.KafkaResponse{
-			AggregateID:   event.AggregateID,
-			CorrelationID: event.CorrelationID,
-			Error:         err.Error(),
-			ErrorCode:     InternalError,
-			EventAction:   event.EventAction,
-			ServiceAction: event.ServiceAction,
-			UUID:          event.UUID,
-		}
+		return nil, NewError(InternalError, err)
 	}
 
 	if len(deviceUpdate.Filter) == 0 {
 		err = errors.New("blank filter provided")
 		err = errors.Wrap(err, "Update")
-		log.Println(err)
-		return &model.KafkaResponse{
-			AggregateID:   event.AggregateID,
-			CorrelationID: event.CorrelationID,
-			Error:         err.Error(),
-			ErrorCode:     InternalError,
-			EventAction:   event.EventAction,
-			ServiceAction: event.ServiceAction,
-			UUID:          event.UUID,
-		}
+		return nil, NewError(InternalError, err)
+	}
+
+	// ItemID is only changed by assign and unassign, so assignment-history
+	// is recorded. A blank ItemID is ignored, since that is how Devices
+	// without an Item are marshalled.
+	itemID, hasItemID := deviceUpdate.Update["itemID"]
+	if hasItemID && itemID != (uuuid.UUID{}).String() {
+		err = errors.New("itemID can only be changed using assign and unassign")
+		err = errors.Wrap(err, "Update")
+		return nil, NewError(UserError, err)
 	}
+	delete(deviceUpdate.Update, "itemID")
+
 	if len(deviceUpdate.Update) == 0 {
 		err = errors.New("blank update provided")
 		err = errors.Wrap(err, "Update")
-		log.Println(err)
-		return &model.KafkaResponse{
-			AggregateID:   event.AggregateID,
-			CorrelationID: event.CorrelationID,
-			Error:         err.Error(),
-			ErrorCode:     InternalError,
-			EventAction:   event.EventAction,
-			ServiceAction: event.ServiceAction,
-			UUID:          event.UUID,
-		}
+		return nil, NewError(InternalError, err)
 	}
 	if deviceUpdate.Update["deviceID"] == (uuuid.UUID{}).String() {
 		err = errors.New("found blank deviceID in update")
 		err = errors.Wrap(err, "Update")
-		log.Println(err)
-		return &model.KafkaResponse{
-			AggregateID:   event.AggregateID,
-			CorrelationID: event.CorrelationID,
-			Error:         err.Error(),
-			ErrorCode:     InternalError,
-			EventAction:   event.EventAction,
-			ServiceAction: event.ServiceAction,
-			UUID:          event.UUID,
-		}
-	}
-
-	updateStats, err := collection.UpdateMany(deviceUpdate.Filter, deviceUpdate.Update)
-	if err != nil {
-		err = errors.Wrap(err, "Update: Error in UpdateMany")
-		log.Println(err)
-		return &model.KafkaResponse{
-			AggregateID:   event.AggregateID,
-			CorrelationID: event.CorrelationID,
-			Error:         err.Error(),
-			ErrorCode:     DatabaseError,
-			EventAction:   event.EventAction,
-			ServiceAction: event.ServiceAction,
-			UUID:          event.UUID,
-		}
-	}
-
-	result := &updateResult{
-		MatchedCount:  updateStats.MatchedCount,
-		ModifiedCount: updateStats.ModifiedCount,
-	}
-	resultMarshal, err := json.Marshal(result)
-	if err != nil {
-		err = errors.Wrap(err, "Update: Error marshalling Device Update-result")
-		log.Println(err)
-		return &model.KafkaResponse{
-			AggregateID:   event.AggregateID,
-			CorrelationID: event.CorrelationID,
-			Error:         err.Error(),
-			ErrorCode:     InternalError,
-			EventAction:   event.EventAction,
-			ServiceAction: event.ServiceAction,
-			UUID:          event.UUID,
-		}
-	}
-
-	return &model.KafkaResponse{
-		AggregateID:   event.AggregateID,
-		CorrelationID: event.CorrelationID,
-		Result:        resultMarshal,
-		EventAction:   event.EventAction,
-		ServiceAction: event.ServiceAction,
-		UUID:          event.UUID,
+		return nil, NewError(InternalError, err)
 	}
+	return deviceUpdate, nil
 }
@@ -0,0 +1,30 @@
+package device
+
+import (
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/pkg/errors"
+)
+
+// ValidateCommand checks if the command-event would be accepted once
+// persisted, by handling it as a dry-run against current Devices, so all
+// validation and business-rules apply without changing any Device.
+// The rejection is returned, with the command's UUID and CorrelationID and
+// the dry-run result, or nil if the command would be accepted.
+func ValidateCommand(
+	registry *Registry, store Storage, event *model.Event,
+) *model.KafkaResponse {
+	dryRun, err := DryRunEvent(event)
+	if err != nil {
+		err = errors.Wrap(err, "Error validating command")
+		return errorResponse(event, err, UserError)
+	}
+	kr := registry.Handle(store, dryRun)
+	if kr == nil || kr.Error == "" {
+		return nil
+	}
+
+	rejection := *kr
+	rejection.UUID = event.UUID
+	rejection.CorrelationID = event.CorrelationID
+	return &rejection
+}
@@ -0,0 +1,79 @@
+package device
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	bolt "go.etcd.io/bbolt"
+)
+
+var _ = Describe("ValidateCommand", func() {
+	var (
+		dbFile   string
+		db       *bolt.DB
+		store    *BoltStorage
+		registry *Registry
+	)
+
+	newCommand := func(eventAction string, data string) *model.Event {
+		eventUUID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		correlationID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		return &model.Event{
+			AggregateID:   AggregateID,
+			EventAction:   eventAction,
+			CorrelationID: correlationID,
+			Data:          []byte(data),
+			UUID:          eventUUID,
+		}
+	}
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "agg_device_validation")
+		Expect(err).ToNot(HaveOccurred())
+		dbFile = f.Name()
+		f.Close()
+		db, err = bolt.Open(dbFile, 0600, nil)
+		Expect(err).ToNot(HaveOccurred())
+		store, err = NewBoltStorage(BoltStorageConfig{DB: db})
+		Expect(err).ToNot(HaveOccurred())
+
+		registry = NewRegistry()
+		err = RegisterCommands(registry, CommandsConfig{})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.Remove(dbFile)
+	})
+
+	It("should accept valid commands without changing Devices", func() {
+		deviceID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		event := newCommand("insert", `{"deviceID":"`+deviceID.String()+`"}`)
+		Expect(ValidateCommand(registry, store, event)).To(BeNil())
+
+		count, err := store.Count(map[string]interface{}{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(BeZero())
+	})
+
+	It("should reject invalid commands with their UUID and CorrelationID", func() {
+		event := newCommand("delete", `{}`)
+		kr := ValidateCommand(registry, store, event)
+		Expect(kr).ToNot(BeNil())
+		Expect(kr.Error).To(ContainSubstring("blank filter"))
+		Expect(kr.UUID).To(Equal(event.UUID))
+		Expect(kr.CorrelationID).To(Equal(event.CorrelationID))
+
+		kr = ValidateCommand(registry, store, newCommand("insert", `not-json`))
+		Expect(kr).ToNot(BeNil())
+		Expect(kr.ErrorCode).To(Equal(int16(UserError)))
+	})
+})
@@ -0,0 +1,169 @@
+package device
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// DriftReport describes how stored Devices differ from the Devices rebuilt by
+// replaying all events.
+type DriftReport struct {
+	// FirstVersion and Version are the Versions of the first and the last
+	// replayed event. History is incomplete unless FirstVersion is 1.
+	FirstVersion int64 `json:"firstVersion"`
+	Version      int64 `json:"version"`
+	// Checked is the number of stored Devices.
+	Checked int `json:"checked"`
+	// Missing are rebuilt Devices that are not stored.
+	Missing []*Device `json:"missing"`
+	// Extra are stored Devices that are not rebuilt, including stored
+	// duplicates of a rebuilt Device.
+	Extra []*Device `json:"extra"`
+	// Mismatched are stored Devices whose fields differ from the rebuilt ones.
+	Mismatched []DeviceDrift `json:"mismatched"`
+}
+
+// DeviceDrift lists the fields of a stored Device that differ from
+// the rebuilt Device.
+type DeviceDrift struct {
+	Device *Device               `json:"device"`
+	Fields map[string]FieldDrift `json:"fields"`
+}
+
+// FieldDrift is the stored and the rebuilt value of a field.
+// A value is nil if the field is not set.
+type FieldDrift struct {
+	Stored   interface{} `json:"stored"`
+	Expected interface{} `json:"expected"`
+}
+
+// HasDrift checks if any stored Device differs from the rebuilt Devices.
+func (r *DriftReport) HasDrift() bool {
+	return len(r.Missing) > 0 || len(r.Extra) > 0 || len(r.Mismatched) > 0
+}
+
+// Verify compares the stored Devices with the Devices rebuilt by replaying
+// all events. Snapshots are not used, so they cannot hide any drift.
+func Verify(stored []*Device, fetcher EventFetcher) (*DriftReport, error) {
+	events, err := fetcher.Events(0)
+	if err != nil {
+		err = errors.Wrap(err, "Error fetching events")
+		return nil, err
+	}
+	report := NewDriftReport(Replay(nil, events), stored)
+	if len(events) > 0 {
+		// Events are sorted by Version
+		report.FirstVersion = events[0].Version
+		report.Version = events[len(events)-1].Version
+	}
+	return report, nil
+}
+
+// IsComplete checks if the replayed events start at the first Version,
+// so Devices can be repaired to match the rebuilt Devices.
+func (r *DriftReport) IsComplete() bool {
+	return r.FirstVersion == 1
+}
+
+// NewDriftReport compares the stored Devices with the expected Devices,
+// pairing them by DeviceID. The Devices' _ids are not compared.
+func NewDriftReport(expected []*Device, stored []*Device) *DriftReport {
+	report := &DriftReport{
+		Checked:    len(stored),
+		Missing:    []*Device{},
+		Extra:      []*Device{},
+		Mismatched: []DeviceDrift{},
+	}
+
+	expectedByID := map[string]*Device{}
+	for _, d := range expected {
+		expectedByID[d.DeviceID.String()] = d
+	}
+	found := map[string]bool{}
+	for _, d := range stored {
+		deviceID := d.DeviceID.String()
+		e, isExpected := expectedByID[deviceID]
+		if !isExpected || found[deviceID] {
+			report.Extra = append(report.Extra, d)
+			continue
+		}
+		found[deviceID] = true
+
+		fields := diffFields(d.fieldMap(), e.fieldMap())
+		if len(fields) > 0 {
+			report.Mismatched = append(report.Mismatched, DeviceDrift{
+				Device: d,
+				Fields: fields,
+			})
+		}
+	}
+	for _, d := range expected {
+		if !found[d.DeviceID.String()] {
+			report.Missing = append(report.Missing, d)
+		}
+	}
+	return report
+}
+
+// diffFields returns the fields whose stored and expected values differ.
+func diffFields(
+	stored map[string]interface{}, expected map[string]interface{},
+) map[string]FieldDrift {
+	fields := map[string]FieldDrift{}
+	for field, value := range stored {
+		expectedValue, isSet := expected[field]
+		if !isSet || fmt.Sprint(value) != fmt.Sprint(expectedValue) {
+			fields[field] = FieldDrift{Stored: value, Expected: expectedValue}
+		}
+	}
+	for field, value := range expected {
+		if _, isSet := stored[field]; !isSet {
+			fields[field] = FieldDrift{Expected: value}
+		}
+	}
+	return fields
+}
+
+// Repair changes the stored Devices to match the rebuilt Devices, by deleting
+// extra Devices, updating mismatched fields and inserting missing Devices.
+// Devices are matched by their _ids, so duplicates are repaired separately.
+func Repair(store Storage, report *DriftReport) error {
+	for _, d := range report.Extra {
+		_, err := store.DeleteMany(map[string]interface{}{"_id": d.ID})
+		if err != nil {
+			err = errors.Wrapf(err, "Error deleting extra Device %s", d.DeviceID)
+			return err
+		}
+	}
+
+	for _, drift := range report.Mismatched {
+		update := map[string]interface{}{}
+		for field, values := range drift.Fields {
+			update[field] = values.Expected
+			// Only tenantID can be unset, and an empty tenantID is treated as unset
+			if values.Expected == nil {
+				update[field] = ""
+			}
+		}
+		_, _, err := store.UpdateMany(
+			map[string]interface{}{"_id": drift.Device.ID},
+			update,
+		)
+		if err != nil {
+			err = errors.Wrapf(
+				err, "Error updating mismatched Device %s", drift.Device.DeviceID,
+			)
+			return err
+		}
+	}
+
+	for _, d := range report.Missing {
+		_, err := store.InsertOne(d)
+		if err != nil {
+			err = errors.Wrapf(err, "Error inserting missing Device %s", d.DeviceID)
+			return err
+		}
+	}
+	return nil
+}
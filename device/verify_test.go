@@ -0,0 +1,125 @@
+package device
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	bolt "go.etcd.io/bbolt"
+)
+
+var _ = Describe("Verify", func() {
+	var expected []*Device
+
+	newDevice := func(status string) *Device {
+		deviceID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		return &Device{DeviceID: deviceID, Status: status}
+	}
+
+	// stored returns a copy of the Device, as it would be stored
+	stored := func(d *Device) *Device {
+		copied := *d
+		copied.ID = objectid.New()
+		return &copied
+	}
+
+	BeforeEach(func() {
+		expected = []*Device{newDevice("active"), newDevice("active"), newDevice("new")}
+	})
+
+	It("should report missing, extra and mismatched Devices", func() {
+		mismatched := stored(expected[1])
+		mismatched.Status = "broken"
+		mismatched.TenantID = "acme"
+		extra := newDevice("active")
+		duplicate := stored(expected[0])
+
+		report := NewDriftReport(expected, []*Device{
+			stored(expected[0]), mismatched, extra, duplicate,
+		})
+		Expect(report.HasDrift()).To(BeTrue())
+		Expect(report.Checked).To(Equal(4))
+		Expect(report.Missing).To(Equal([]*Device{expected[2]}))
+		Expect(report.Extra).To(Equal([]*Device{extra, duplicate}))
+		Expect(report.Mismatched).To(Equal([]DeviceDrift{
+			DeviceDrift{
+				Device: mismatched,
+				Fields: map[string]FieldDrift{
+					"status":   FieldDrift{Stored: "broken", Expected: "active"},
+					"tenantID": FieldDrift{Stored: "acme"},
+				},
+			},
+		}))
+
+		report = NewDriftReport(expected, []*Device{
+			stored(expected[2]), stored(expected[1]), stored(expected[0]),
+		})
+		Expect(report.HasDrift()).To(BeFalse())
+	})
+
+	It("should report if the replayed history is complete", func() {
+		events := []model.Event{}
+		for version := int64(2); version <= 3; version++ {
+			data, err := json.Marshal(map[string]interface{}{
+				"deviceID": expected[version-2].DeviceID.String(),
+				"status":   "active",
+			})
+			Expect(err).ToNot(HaveOccurred())
+			events = append(events, model.Event{
+				EventAction: "insert",
+				Data:        data,
+				Version:     version,
+			})
+		}
+		fetcher := fetcherFunc(func(fromVersion int64) ([]model.Event, error) {
+			return events, nil
+		})
+
+		report, err := Verify([]*Device{}, fetcher)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Missing).To(HaveLen(2))
+		Expect(report.FirstVersion).To(Equal(int64(2)))
+		Expect(report.Version).To(Equal(int64(3)))
+		Expect(report.IsComplete()).To(BeFalse())
+
+		events[0].Version = 1
+		report, err = Verify([]*Device{}, fetcher)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.IsComplete()).To(BeTrue())
+	})
+
+	It("should repair drift", func() {
+		f, err := ioutil.TempFile("", "agg_device_verify")
+		Expect(err).ToNot(HaveOccurred())
+		dbFile := f.Name()
+		f.Close()
+		defer os.Remove(dbFile)
+		db, err := bolt.Open(dbFile, 0600, nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer db.Close()
+		store, err := NewBoltStorage(BoltStorageConfig{DB: db})
+		Expect(err).ToNot(HaveOccurred())
+
+		mismatched := stored(expected[1])
+		mismatched.Status = "broken"
+		devices := []*Device{stored(expected[0]), mismatched, stored(newDevice("active"))}
+		for _, d := range devices {
+			_, err = store.InsertOne(d)
+			Expect(err).ToNot(HaveOccurred())
+		}
+		report := NewDriftReport(expected, devices)
+		Expect(report.HasDrift()).To(BeTrue())
+
+		err = Repair(store, report)
+		Expect(err).ToNot(HaveOccurred())
+		repaired, err := store.Find(map[string]interface{}{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(NewDriftReport(expected, repaired).HasDrift()).To(BeFalse())
+	})
+})
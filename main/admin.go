@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/pkg/errors"
+)
+
+func validateAdmin(cfg *AdminConfig) configErrors {
+	errs := configErrors{}
+	if cfg.Addr != "" {
+		errs.required(cfg.Token != "", "admin.token")
+		if cfg.ConsumerGroup != "" && cfg.TimeoutMS == 0 {
+			errs = append(errs, "admin.timeoutMS must be greater than 0")
+		}
+	}
+	return errs
+}
+
+// serveAdmin serves the read-only admin API for Devices in store.
+// Past Device states are served if admin.consumerGroup is set.
+func serveAdmin(cfg *Config, store device.Storage) {
+	reader, isReader := store.(device.PageReader)
+	if !isReader {
+		log.Println("Error serving admin-API: Storage does not support paging")
+		return
+	}
+	var fetcher device.EventFetcher
+	if cfg.Admin.ConsumerGroup != "" {
+		query, err := newESQuery(
+			&cfg.Kafka,
+			cfg.Admin.ConsumerGroup,
+			device.AggregateID,
+			time.Duration(cfg.Admin.TimeoutMS)*time.Millisecond,
+		)
+		if err != nil {
+			err = errors.Wrap(err, "Error creating Device EventStore-query")
+			log.Println(err)
+			return
+		}
+		// Past states replay all events, which are cached between requests
+		fetcher, err = device.NewEventCache(query)
+		if err != nil {
+			err = errors.Wrap(err, "Error creating EventCache")
+			log.Println(err)
+			return
+		}
+	}
+	handler, err := device.NewAdminHandler(reader, fetcher, cfg.Admin.Token)
+	if err != nil {
+		err = errors.Wrap(err, "Error creating admin-API")
+		log.Println(err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/devices", handler)
+	mux.Handle("/devices/", handler)
+	log.Printf("Serving admin-API on %s/devices", cfg.Admin.Addr)
+	err = http.ListenAndServe(cfg.Admin.Addr, mux)
+	if err != nil {
+		err = errors.Wrap(err, "Error serving admin-API")
+		log.Println(err)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// archiveManifest describes an exported archive, and is written
+// next to it as "<file>.manifest.json".
+type archiveManifest struct {
+	Format     string                 `json:"format"`
+	Count      int64                  `json:"count"`
+	SHA256     string                 `json:"sha256"`
+	Filter     map[string]interface{} `json:"filter,omitempty"`
+	ExportedAt string                 `json:"exportedAt"`
+}
+
+// importProgress records how much of an archive was imported, and is written
+// next to it as "<file>.progress.json", so interrupted imports can be resumed.
+type importProgress struct {
+	SHA256   string `json:"sha256"`
+	Offset   int64  `json:"offset"`
+	Imported int64  `json:"imported"`
+}
+
+// archiveFilter restricts exported and imported Devices by status and lot.
+type archiveFilter struct {
+	statuses []string
+	lots     []string
+}
+
+// register registers the filter's flags on fs.
+func (f *archiveFilter) register(fs *flag.FlagSet) {
+	fs.Var(&listValue{&f.statuses}, "status", "Comma-separated Device statuses to include")
+	fs.Var(&listValue{&f.lots}, "lot", "Comma-separated Device lots to include")
+}
+
+// query returns the MongoDB filter matching the filter's Devices.
+func (f *archiveFilter) query() map[string]interface{} {
+	query := map[string]interface{}{}
+	if len(f.statuses) > 0 {
+		query["status"] = map[string]interface{}{"$in": f.statuses}
+	}
+	if len(f.lots) > 0 {
+		query["lot"] = map[string]interface{}{"$in": f.lots}
+	}
+	return query
+}
+
+// matches checks if the Device is included by the filter.
+func (f *archiveFilter) matches(d *device.Device) bool {
+	return (len(f.statuses) == 0 || containsString(f.statuses, d.Status)) &&
+		(len(f.lots) == 0 || containsString(f.lots, d.Lot))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveStorage is the Device Storage that Devices are exported from,
+// imported to, and verified against.
+type archiveStorage interface {
+	device.Storage
+	Each(filter map[string]interface{}, fn func(*device.Device) error) error
+	Restore(devices []*device.Device) error
+}
+
+// newArchiveStorage creates the BoltStorage in db for the "bolt" storage backend.
+// Otherwise it creates the MongoStorage for the Aggregate collection,
+// creating the collection and its indexes if required.
+func newArchiveStorage(cfg *Config, db *bolt.DB) (archiveStorage, error) {
+	if db != nil {
+		return device.NewBoltStorage(device.BoltStorageConfig{
+			DB:                db,
+			UniqueConstraints: uniqueConstraints(cfg.Mongo.Unique),
+		})
+	}
+	return newMongoArchiveStorage(&cfg.Mongo)
+}
+
+func newMongoArchiveStorage(cfg *MongoConfig) (*device.MongoStorage, error) {
+	conn, err := newMongoConnection(cfg)
+	if err != nil {
+		return nil, err
+	}
+	aggCollection, err := createMongoCollection(
+		conn, cfg.Database, cfg.AggCollection, aggIndexConfigs(cfg),
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = createUniqueIndexes(conn, cfg.Database, cfg.AggCollection, cfg.Unique)
+	if err != nil {
+		return nil, err
+	}
+	return device.NewMongoStorage(device.MongoStorageConfig{
+		AggCollection:     aggCollection,
+		UniqueConstraints: uniqueConstraints(cfg.Unique),
+	})
+}
+
+// setupExport streams the Aggregate collection to an archive-file,
+// and writes its manifest with the archive's checksum.
+func setupExport(fs *flag.FlagSet) func(*Config) error {
+	file := fs.String("file", "", "Archive-file to export Devices to")
+	format := fs.String("format", device.NDJSONArchive, `Archive format, "ndjson" or "bson"`)
+	filter := &archiveFilter{}
+	filter.register(fs)
+
+	return func(cfg *Config) error {
+		if *file == "" {
+			return errors.New("-file is required")
+		}
+		db, err := openBolt(&cfg.Storage)
+		if err != nil {
+			return err
+		}
+		defer closeBolt(db)
+		store, err := newArchiveStorage(cfg, db)
+		if err != nil {
+			return err
+		}
+
+		// Archive is written to a temporary file, so an incomplete export
+		// never replaces a previous archive
+		tmpFile := *file + ".tmp"
+		out, err := os.Create(tmpFile)
+		if err != nil {
+			err = errors.Wrap(err, "Error creating archive-file")
+			return err
+		}
+		defer out.Close()
+		archive, err := device.NewArchiveWriter(out, *format)
+		if err != nil {
+			return err
+		}
+
+		query := filter.query()
+		err = store.Each(query, archive.Write)
+		if err != nil {
+			err = errors.Wrap(err, "Error exporting Devices")
+			return err
+		}
+		err = out.Close()
+		if err != nil {
+			err = errors.Wrap(err, "Error closing archive-file")
+			return err
+		}
+		err = os.Rename(tmpFile, *file)
+		if err != nil {
+			err = errors.Wrap(err, "Error renaming archive-file")
+			return err
+		}
+
+		manifest := &archiveManifest{
+			Format:     *format,
+			Count:      archive.Count(),
+			SHA256:     archive.Checksum(),
+			Filter:     query,
+			ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		}
+		err = writeJSONFile(*file+".manifest.json", manifest)
+		if err != nil {
+			return err
+		}
+		log.Printf("Exported %d Devices to %s", manifest.Count, *file)
+		return nil
+	}
+}
+
+// setupImport restores Devices from an archive-file, after verifying its
+// checksum against its manifest. Progress is recorded after each batch,
+// so an interrupted import can be resumed.
+func setupImport(fs *flag.FlagSet) func(*Config) error {
+	file := fs.String("file", "", "Archive-file to import Devices from")
+	format := fs.String(
+		"format", "", `Archive format, "ndjson" or "bson" (default: as per manifest)`,
+	)
+	skipVerify := fs.Bool("skip-verify", false, "Import without verifying checksum")
+	resume := fs.Bool("resume", false, "Resume the previous import of the archive-file")
+	batchSize := fs.Int("batch-size", 100, "Devices imported between recording progress")
+	filter := &archiveFilter{}
+	filter.register(fs)
+
+	return func(cfg *Config) error {
+		if *file == "" {
+			return errors.New("-file is required")
+		}
+		if *batchSize < 1 {
+			return errors.New("-batch-size must be greater than 0")
+		}
+
+		checksum, err := verifyArchive(*file, format, *skipVerify)
+		if err != nil {
+			return err
+		}
+
+		progressFile := *file + ".progress.json"
+		progress := &importProgress{SHA256: checksum}
+		if *resume {
+			progress, err = readImportProgress(progressFile, checksum)
+			if err != nil {
+				return err
+			}
+			log.Printf(
+				"Resuming import after %d Devices, at offset %d",
+				progress.Imported, progress.Offset,
+			)
+		}
+
+		db, err := openBolt(&cfg.Storage)
+		if err != nil {
+			return err
+		}
+		defer closeBolt(db)
+		store, err := newArchiveStorage(cfg, db)
+		if err != nil {
+			return err
+		}
+		in, err := os.Open(*file)
+		if err != nil {
+			err = errors.Wrap(err, "Error opening archive-file")
+			return err
+		}
+		defer in.Close()
+		_, err = in.Seek(progress.Offset, io.SeekStart)
+		if err != nil {
+			err = errors.Wrap(err, "Error seeking archive-file")
+			return err
+		}
+		archive, err := device.NewArchiveReader(in, *format, progress.Offset)
+		if err != nil {
+			return err
+		}
+
+		batch := []*device.Device{}
+		for {
+			d, err := archive.Read()
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if err == nil && filter.matches(d) {
+				batch = append(batch, d)
+			}
+			if len(batch) < *batchSize && err == nil {
+				continue
+			}
+
+			restoreErr := store.Restore(batch)
+			if restoreErr != nil {
+				restoreErr = errors.Wrap(restoreErr, "Error importing Devices")
+				return restoreErr
+			}
+			progress.Imported += int64(len(batch))
+			batch = batch[:0]
+			// Offset is only recorded once all Devices before it are imported
+			progress.Offset = archive.Offset()
+			writeErr := writeJSONFile(progressFile, progress)
+			if writeErr != nil {
+				return writeErr
+			}
+			if err == io.EOF {
+				break
+			}
+		}
+
+		err = os.Remove(progressFile)
+		if err != nil {
+			err = errors.Wrap(err, "Error removing import-progress file")
+			log.Println(err)
+		}
+		log.Printf("Imported %d Devices from %s", progress.Imported, *file)
+		return nil
+	}
+}
+
+// verifyArchive checks the archive's checksum against its manifest, and sets
+// format from the manifest if it is blank. The archive's checksum is returned.
+func verifyArchive(file string, format *string, skipVerify bool) (string, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		err = errors.Wrap(err, "Error opening archive-file")
+		return "", err
+	}
+	defer in.Close()
+	checksum, err := device.ArchiveChecksum(in)
+	if err != nil {
+		return "", err
+	}
+
+	manifest := &archiveManifest{}
+	err = readJSONFile(file+".manifest.json", manifest)
+	if err != nil {
+		if !skipVerify || *format == "" {
+			err = errors.Wrap(err, "Error reading archive manifest")
+			return "", err
+		}
+		return checksum, nil
+	}
+	if *format == "" {
+		*format = manifest.Format
+	}
+	if !skipVerify && manifest.SHA256 != checksum {
+		return "", errors.Errorf(
+			"archive checksum %s does not match manifest checksum %s",
+			checksum, manifest.SHA256,
+		)
+	}
+	return checksum, nil
+}
+
+// readImportProgress reads the progress of a previous import of the archive
+// with checksum.
+func readImportProgress(file string, checksum string) (*importProgress, error) {
+	progress := &importProgress{}
+	err := readJSONFile(file, progress)
+	if err != nil {
+		err = errors.Wrap(err, "Error reading import-progress")
+		return nil, err
+	}
+	if progress.SHA256 != checksum {
+		return nil, errors.New("import-progress is for a different archive")
+	}
+	return progress, nil
+}
+
+func writeJSONFile(file string, v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		err = errors.Wrapf(err, "Error marshalling %s", file)
+		return err
+	}
+	err = ioutil.WriteFile(file, out, 0644)
+	if err != nil {
+		err = errors.Wrapf(err, "Error writing %s", file)
+		return err
+	}
+	return nil
+}
+
+func readJSONFile(file string, v interface{}) error {
+	in, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(in, v)
+}
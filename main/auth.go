@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	mongoRoles = "mongo"
+	fileRoles  = "file"
+)
+
+// validateAuth checks the AuthConfig, which is only used if auth is enabled.
+func validateAuth(cfg *AuthConfig) configErrors {
+	errs := configErrors{}
+	switch cfg.Roles {
+	case mongoRoles:
+		errs.required(cfg.MongoCollection != "", "auth.mongoCollection")
+	case fileRoles:
+		errs.required(cfg.File != "", "auth.file")
+	default:
+		errs = append(errs, fmt.Sprintf(
+			"auth.roles must be %q or %q", mongoRoles, fileRoles,
+		))
+	}
+	errs.required(len(cfg.Policies) > 0, "auth.policies")
+	roles := map[string]bool{}
+	for i, policy := range cfg.Policies {
+		if policy.Role == "" {
+			errs = append(errs, fmt.Sprintf("auth.policies[%d].role is required", i))
+		} else if roles[policy.Role] {
+			errs = append(errs, fmt.Sprintf(
+				"auth.policies[%d].role %q is duplicate", i, policy.Role,
+			))
+		}
+		roles[policy.Role] = true
+		if len(policy.Actions) == 0 {
+			errs = append(errs, fmt.Sprintf("auth.policies[%d].actions is required", i))
+		}
+	}
+	return errs
+}
+
+// newAuthorizer creates the Authorizer for events, or nil if auth is disabled.
+func newAuthorizer(
+	cfg *AuthConfig, conn *mongo.ConnectionConfig, db string,
+) (device.Authorizer, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	var roles device.RoleLookup
+	var err error
+	switch cfg.Roles {
+	case mongoRoles:
+		roles, err = newMongoRoleLookup(conn, db, cfg.MongoCollection)
+	case fileRoles:
+		roles, err = readRolesFile(cfg.File)
+	default:
+		err = errors.Errorf("unknown user-roles lookup %q", cfg.Roles)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	policies := map[string]device.Policy{}
+	for _, policy := range cfg.Policies {
+		policies[policy.Role] = device.Policy{
+			Actions: policy.Actions,
+			Fields:  policy.Fields,
+		}
+	}
+	return device.NewRoleAuthorizer(roles, policies)
+}
+
+// newMongoRoleLookup creates the RoleLookup for user-roles stored in collection.
+func newMongoRoleLookup(
+	conn *mongo.ConnectionConfig, db string, collection string,
+) (device.RoleLookup, error) {
+	c := &mongo.Collection{
+		Connection:   conn,
+		Database:     db,
+		Name:         collection,
+		SchemaStruct: &device.UserRoles{},
+		Indexes: []mongo.IndexConfig{
+			mongo.IndexConfig{
+				ColumnConfig: []mongo.IndexColumnConfig{
+					mongo.IndexColumnConfig{Name: "userUUID"},
+				},
+				IsUnique: true,
+				Name:     "userUUID_index",
+			},
+		},
+	}
+	rolesCollection, err := mongo.EnsureCollection(c)
+	if err != nil {
+		err = errors.Wrap(err, "Error creating UserRoles MongoCollection")
+		return nil, err
+	}
+	return device.NewMongoRoleLookup(rolesCollection)
+}
+
+// readRolesFile reads user-roles from a YAML file, which maps
+// each UserUUID to a list of roles.
+func readRolesFile(path string) (device.StaticRoles, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = errors.Wrap(err, "Error reading user-roles file")
+		return nil, err
+	}
+	fileRoles := map[string][]string{}
+	err = yaml.UnmarshalStrict(data, &fileRoles)
+	if err != nil {
+		err = errors.Wrapf(err, "Error parsing user-roles file %s", path)
+		return nil, err
+	}
+
+	roles := device.StaticRoles{}
+	for userUUID, userRoles := range fileRoles {
+		id, err := uuuid.FromString(userUUID)
+		if err != nil {
+			err = errors.Wrapf(err, "Invalid UserUUID %q in user-roles file", userUUID)
+			return nil, err
+		}
+		roles[id] = userRoles
+	}
+	return roles, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-eventspoll/poll"
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/go-kafkautils/kafka"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltPollTimeout is the timeout for fetching new events for the "bolt"
+// storage backend.
+const boltPollTimeout = 30 * time.Second
+
+// boltEventPoll is the poll.EventPoll for the "bolt" storage backend, which
+// records the version of the last polled event in the BoltDB file, instead of
+// the MongoDB meta-collection used by poll.Init. Each message on the event-topic
+// triggers fetching the events newer than that version.
+type boltEventPoll struct {
+	fetcher  device.EventFetcher
+	versions device.VersionStore
+	read     poll.ReadConfig
+
+	// pollLock lets a single poll run at a time,
+	// so events are passed on in order and only once.
+	pollLock sync.Mutex
+
+	insert  chan *poll.EventResponse
+	update  chan *poll.EventResponse
+	delete  chan *poll.EventResponse
+	query   chan *poll.EventResponse
+	results chan *model.KafkaResponse
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	closers []func()
+}
+
+// newBoltEventPoll creates the boltEventPoll, consuming the event-topic and
+// esquery-responses, and producing results, as configured for poll.Init.
+func newBoltEventPoll(
+	cfg *Config, kc *poll.KafkaConfig, read poll.ReadConfig, db *bolt.DB,
+) (*boltEventPoll, error) {
+	versions, err := device.NewBoltPollVersionStore(db)
+	if err != nil {
+		err = errors.Wrap(err, "Error creating poll VersionStore")
+		return nil, err
+	}
+	query, err := newESQuery(
+		&cfg.Kafka,
+		cfg.Kafka.ConsumerEventQueryGroup,
+		device.AggregateID,
+		boltPollTimeout,
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Error creating Device EventStore-query")
+		return nil, err
+	}
+	p := newEventPoll(query, versions, read)
+	p.closers = append(p.closers, query.Close)
+
+	producer, err := kafka.NewProducer(kc.SvcResponseProd)
+	if err != nil {
+		p.Close()
+		err = errors.Wrap(err, "Error creating response Producer")
+		return nil, err
+	}
+	p.closers = append(p.closers, func() {
+		err := producer.Close()
+		if err != nil {
+			err = errors.Wrap(err, "Error closing response Producer")
+			log.Println(err)
+		}
+	})
+	consumer, err := kafka.NewConsumer(kc.EventCons)
+	if err != nil {
+		p.Close()
+		err = errors.Wrap(err, "Error creating event Consumer")
+		return nil, err
+	}
+	p.closers = append(p.closers, func() {
+		err := consumer.Close()
+		if err != nil {
+			err = errors.Wrap(err, "Error closing event Consumer")
+			log.Println(err)
+		}
+	})
+
+	go func() {
+		for err := range producer.Errors() {
+			err := errors.Wrap(err, "Error producing response")
+			log.Println(err)
+		}
+	}()
+	go func() {
+		for kr := range p.results {
+			msg, err := json.Marshal(kr)
+			if err != nil {
+				err = errors.Wrap(err, "Error marshalling response")
+				log.Println(err)
+				continue
+			}
+			producer.Input() <- kafka.CreateMessage(kc.SvcResponseTopic, msg)
+		}
+	}()
+	go func() {
+		err := consumer.Consume(p.ctx, &boltPollHandler{p})
+		if err != nil {
+			err = errors.Wrap(err, "Error consuming events")
+			log.Println(err)
+		}
+		p.cancel()
+	}()
+	// Events persisted while the service was stopped are polled on start
+	go p.pollLogged()
+	return p, nil
+}
+
+// newEventPoll creates a boltEventPoll fetching events using fetcher.
+func newEventPoll(
+	fetcher device.EventFetcher, versions device.VersionStore, read poll.ReadConfig,
+) *boltEventPoll {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &boltEventPoll{
+		fetcher:  fetcher,
+		versions: versions,
+		read:     read,
+
+		insert:  make(chan *poll.EventResponse),
+		update:  make(chan *poll.EventResponse),
+		delete:  make(chan *poll.EventResponse),
+		query:   make(chan *poll.EventResponse),
+		results: make(chan *model.KafkaResponse),
+
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// poll passes on the events newer than the last polled event, recording
+// the version of each event after it is passed on.
+func (p *boltEventPoll) poll() error {
+	p.pollLock.Lock()
+	defer p.pollLock.Unlock()
+
+	version, err := p.versions.AppliedVersion()
+	if err != nil {
+		err = errors.Wrap(err, "Error reading polled version")
+		return err
+	}
+	events, err := p.fetcher.Events(version)
+	if err != nil {
+		err = errors.Wrap(err, "Error fetching events")
+		return err
+	}
+	for i := range events {
+		event := events[i]
+		if event.Version <= version {
+			continue
+		}
+		eventChan := p.eventChan(event.EventAction)
+		if eventChan != nil {
+			select {
+			case <-p.ctx.Done():
+				return errors.New("event-poll closed")
+			case eventChan <- &poll.EventResponse{Event: event}:
+			}
+		}
+		err = p.versions.SetAppliedVersion(event.Version)
+		if err != nil {
+			err = errors.Wrap(err, "Error recording polled version")
+			return err
+		}
+		version = event.Version
+	}
+	return nil
+}
+
+func (p *boltEventPoll) pollLogged() {
+	err := p.poll()
+	if err != nil {
+		err = errors.Wrap(err, "Error polling events")
+		log.Println(err)
+	}
+}
+
+// eventChan returns the channel for events with the EventAction,
+// or nil if these are not read.
+func (p *boltEventPoll) eventChan(eventAction string) chan *poll.EventResponse {
+	switch {
+	case eventAction == "insert" && p.read.EnableInsert:
+		return p.insert
+	case eventAction == "update" && p.read.EnableUpdate:
+		return p.update
+	case eventAction == "delete" && p.read.EnableDelete:
+		return p.delete
+	}
+	return nil
+}
+
+func (p *boltEventPoll) Delete() <-chan *poll.EventResponse { return p.delete }
+func (p *boltEventPoll) Insert() <-chan *poll.EventResponse { return p.insert }
+func (p *boltEventPoll) Query() <-chan *poll.EventResponse  { return p.query }
+func (p *boltEventPoll) Update() <-chan *poll.EventResponse { return p.update }
+
+func (p *boltEventPoll) ProduceResult() chan<- *model.KafkaResponse {
+	return p.results
+}
+
+func (p *boltEventPoll) RoutinesCtx() context.Context {
+	return p.ctx
+}
+
+// Close stops polling, and closes the Kafka Consumers and Producers.
+func (p *boltEventPoll) Close() {
+	p.cancel()
+	for _, closer := range p.closers {
+		closer()
+	}
+}
+
+// boltPollHandler polls events for each message on the event-topic.
+type boltPollHandler struct {
+	poll *boltEventPoll
+}
+
+func (*boltPollHandler) Setup(sarama.ConsumerGroupSession) error {
+	log.Println("Initializing event Consumer")
+	return nil
+}
+
+func (*boltPollHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	log.Println("Closing event Consumer")
+	return nil
+}
+
+func (h *boltPollHandler) ConsumeClaim(
+	session sarama.ConsumerGroupSession,
+	claim sarama.ConsumerGroupClaim,
+) error {
+	for msg := range claim.Messages() {
+		session.MarkMessage(msg, "")
+		h.poll.pollLogged()
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/TerrexTech/go-eventspoll/poll"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// pollVersion is a device.VersionStore in memory.
+type pollVersion struct {
+	version int64
+}
+
+func (v *pollVersion) AppliedVersion() (int64, error) {
+	return v.version, nil
+}
+
+func (v *pollVersion) SetAppliedVersion(version int64) error {
+	v.version = version
+	return nil
+}
+
+var _ = Describe("boltEventPoll", func() {
+	var (
+		events    *eventLog
+		versions  *pollVersion
+		eventPoll *boltEventPoll
+	)
+
+	// polled collects the versions of the polled events
+	polled := func() []int64 {
+		done := make(chan error)
+		go func() {
+			done <- eventPoll.poll()
+		}()
+		received := []int64{}
+		for {
+			select {
+			case err := <-done:
+				Expect(err).ToNot(HaveOccurred())
+				return received
+			case r := <-eventPoll.Insert():
+				received = append(received, r.Event.Version)
+			case r := <-eventPoll.Update():
+				received = append(received, r.Event.Version)
+			case r := <-eventPoll.Delete():
+				received = append(received, r.Event.Version)
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		events = &eventLog{}
+		versions = &pollVersion{}
+		eventPoll = newEventPoll(events, versions, poll.ReadConfig{
+			EnableInsert: true,
+			EnableDelete: true,
+		})
+	})
+
+	AfterEach(func() {
+		eventPoll.Close()
+	})
+
+	It("should pass on the events newer than the last polled event", func() {
+		events.append("insert", map[string]interface{}{"name": "a"})
+		events.append("update", map[string]interface{}{"name": "b"})
+		events.append("delete", map[string]interface{}{"name": "a"})
+		Expect(polled()).To(Equal([]int64{1, 3}))
+		Expect(versions.version).To(Equal(int64(3)))
+
+		events.append("insert", map[string]interface{}{"name": "c"})
+		Expect(polled()).To(Equal([]int64{4}))
+		Expect(polled()).To(BeEmpty())
+		Expect(events.fromVersions).To(Equal([]int64{0, 3, 4}))
+	})
+
+	It("should stop polling once closed", func() {
+		events.append("insert", map[string]interface{}{"name": "a"})
+		eventPoll.Close()
+		Expect(eventPoll.poll()).To(HaveOccurred())
+		Expect(versions.version).To(Equal(int64(0)))
+	})
+})
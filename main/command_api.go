@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/go-kafkautils/kafka"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+func validateCommandAPI(cfg *Config) configErrors {
+	errs := configErrors{}
+	if cfg.CommandAPI.Addr == "" {
+		return errs
+	}
+	errs.required(len(cfg.CommandAPI.Tokens) > 0, "commandAPI.tokens")
+	for token, userUUID := range cfg.CommandAPI.Tokens {
+		if token == "" {
+			errs = append(errs, "commandAPI.tokens cannot contain blank tokens")
+		}
+		_, err := uuuid.FromString(userUUID)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf(
+				"commandAPI.tokens must map to valid userUUIDs, not %q", userUUID,
+			))
+		}
+	}
+	errs.required(cfg.CommandAPI.ConsumerGroup != "", "commandAPI.consumerGroup")
+	errs.required(cfg.Kafka.ProducerEventTopic != "", "kafka.producerEventTopic")
+	if cfg.CommandAPI.TimeoutMS == 0 {
+		errs = append(errs, "commandAPI.timeoutMS must be greater than 0")
+	}
+	return errs
+}
+
+// serveCommandAPI serves the command API, which validates commands using
+// registry and store, and publishes them to the EventStore.
+func serveCommandAPI(cfg *Config, registry *device.Registry, store device.Storage) {
+	publisher, err := newEventPublisher(
+		&cfg.Kafka,
+		cfg.CommandAPI.ConsumerGroup,
+		time.Duration(cfg.CommandAPI.TimeoutMS)*time.Millisecond,
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Error creating command-API")
+		log.Println(err)
+		return
+	}
+	defer publisher.Close()
+
+	tokens := map[string]uuuid.UUID{}
+	for token, userUUID := range cfg.CommandAPI.Tokens {
+		// userUUIDs are checked when validating Config
+		tokens[token], _ = uuuid.FromString(userUUID)
+	}
+	handler, err := device.NewCommandHandler(device.CommandAPIConfig{
+		Registry:  registry,
+		Storage:   store,
+		Publisher: publisher,
+		Tokens:    tokens,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error creating command-API")
+		log.Println(err)
+		return
+	}
+
+	log.Printf("Serving command-API on %s/commands", cfg.CommandAPI.Addr)
+	err = http.ListenAndServe(cfg.CommandAPI.Addr, handler)
+	if err != nil {
+		err = errors.Wrap(err, "Error serving command-API")
+		log.Println(err)
+	}
+}
+
+// eventPublisher produces events on the EventStore's event-topic, and waits
+// for their responses on the service's response-topic.
+type eventPublisher struct {
+	eventTopic string
+	timeout    time.Duration
+
+	producer *kafka.Producer
+	consumer *kafka.Consumer
+
+	waitersLock sync.Mutex
+	waiters     map[uuuid.UUID]chan *model.KafkaResponse
+}
+
+// newEventPublisher creates an eventPublisher. Responses are consumed using
+// the provided consumer-group, which must not be shared with other consumers,
+// since each eventPublisher needs all responses.
+func newEventPublisher(
+	cfg *KafkaConfig, group string, timeout time.Duration,
+) (*eventPublisher, error) {
+	producer, err := kafka.NewProducer(&kafka.ProducerConfig{
+		KafkaBrokers: cfg.Brokers,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error creating event Producer")
+		return nil, err
+	}
+	consumer, err := kafka.NewConsumer(&kafka.ConsumerConfig{
+		KafkaBrokers: cfg.Brokers,
+		GroupName:    group,
+		Topics:       []string{cfg.ProducerResponseTopic},
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error creating event-response Consumer")
+		return nil, err
+	}
+
+	p := &eventPublisher{
+		eventTopic: cfg.ProducerEventTopic,
+		timeout:    timeout,
+
+		producer: producer,
+		consumer: consumer,
+		waiters:  map[uuuid.UUID]chan *model.KafkaResponse{},
+	}
+	go func() {
+		for err := range producer.Errors() {
+			err := errors.Wrap(err, "Error producing event")
+			log.Println(err)
+		}
+	}()
+	go func() {
+		err := consumer.Consume(context.Background(), &eventResponseHandler{p})
+		if err != nil {
+			err = errors.Wrap(err, "Error consuming event-responses")
+			log.Println(err)
+		}
+	}()
+	return p, nil
+}
+
+// Publish produces the event, and returns the response to it.
+// device.ErrResponseTimeout is returned if no response is received in time.
+func (p *eventPublisher) Publish(event *model.Event) (*model.KafkaResponse, error) {
+	eventMsg, err := json.Marshal(event)
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling event")
+		return nil, err
+	}
+
+	respChan := make(chan *model.KafkaResponse, 1)
+	p.waitersLock.Lock()
+	p.waiters[event.UUID] = respChan
+	p.waitersLock.Unlock()
+	defer func() {
+		p.waitersLock.Lock()
+		delete(p.waiters, event.UUID)
+		p.waitersLock.Unlock()
+	}()
+
+	p.producer.Input() <- kafka.CreateMessage(p.eventTopic, eventMsg)
+
+	select {
+	case <-time.After(p.timeout):
+		return nil, device.ErrResponseTimeout
+	case kr := <-respChan:
+		return kr, nil
+	}
+}
+
+// Close closes the event Producer and response Consumer.
+func (p *eventPublisher) Close() {
+	err := p.consumer.Close()
+	if err != nil {
+		err = errors.Wrap(err, "Error closing event-response Consumer")
+		log.Println(err)
+	}
+	err = p.producer.Close()
+	if err != nil {
+		err = errors.Wrap(err, "Error closing event Producer")
+		log.Println(err)
+	}
+}
+
+// eventResponseHandler routes service-responses to their waiting publishers.
+type eventResponseHandler struct {
+	publisher *eventPublisher
+}
+
+func (*eventResponseHandler) Setup(sarama.ConsumerGroupSession) error {
+	log.Println("Initializing event-response Consumer")
+	return nil
+}
+
+func (*eventResponseHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	log.Println("Closing event-response Consumer")
+	return nil
+}
+
+func (h *eventResponseHandler) ConsumeClaim(
+	session sarama.ConsumerGroupSession,
+	claim sarama.ConsumerGroupClaim,
+) error {
+	for msg := range claim.Messages() {
+		session.MarkMessage(msg, "")
+
+		kr := &model.KafkaResponse{}
+		err := json.Unmarshal(msg.Value, kr)
+		if err != nil {
+			err = errors.Wrap(err, "Error unmarshalling event-response")
+			log.Println(err)
+			continue
+		}
+
+		h.publisher.waitersLock.Lock()
+		respChan, isWaiting := h.publisher.waiters[kr.UUID]
+		h.publisher.waitersLock.Unlock()
+		if isWaiting {
+			respChan <- kr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("commandAPI.tokens", func() {
+	var cfg *Config
+
+	BeforeEach(func() {
+		cfg = defaultConfig()
+		cfg.CommandAPI.Addr = ":8082"
+		cfg.Kafka.ProducerEventTopic = "events"
+	})
+
+	It("should parse token=userUUID pairs", func() {
+		v := &mapValue{&cfg.CommandAPI.Tokens}
+		err := v.Set("secret=b4b4e5c2-1a4f-4b4e-9f8e-4b4e5c21a4f4, other=x=y")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cfg.CommandAPI.Tokens).To(Equal(map[string]string{
+			"secret": "b4b4e5c2-1a4f-4b4e-9f8e-4b4e5c21a4f4",
+			"other":  "x=y",
+		}))
+		Expect(v.Set("secret")).To(HaveOccurred())
+	})
+
+	It("should require tokens mapped to valid userUUIDs", func() {
+		Expect(validateCommandAPI(cfg)).To(ContainElement(ContainSubstring("tokens")))
+
+		cfg.CommandAPI.Tokens = map[string]string{"secret": "not-a-uuid"}
+		Expect(validateCommandAPI(cfg)).To(ContainElement(ContainSubstring("not-a-uuid")))
+
+		cfg.CommandAPI.Tokens = map[string]string{
+			"secret": "b4b4e5c2-1a4f-4b4e-9f8e-4b4e5c21a4f4",
+		}
+		Expect(validateCommandAPI(cfg)).To(BeEmpty())
+	})
+
+	It("should mask tokens, keeping their userUUIDs", func() {
+		cfg.CommandAPI.Tokens = map[string]string{
+			"secret": "b4b4e5c2-1a4f-4b4e-9f8e-4b4e5c21a4f4",
+		}
+		masked := cfg.Masked()
+		Expect(masked.CommandAPI.Tokens).To(Equal(map[string]string{
+			secretMask + "1": "b4b4e5c2-1a4f-4b4e-9f8e-4b4e5c21a4f4",
+		}))
+		Expect(cfg.CommandAPI.Tokens).To(HaveKey("secret"))
+	})
+})
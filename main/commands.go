@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// command is a CLI subcommand of the service.
+type command struct {
+	usage string
+	// setup registers any command-specific flags on fs, and returns the
+	// function to run once flags and Config are loaded.
+	setup func(fs *flag.FlagSet) func(cfg *Config) error
+	// anyConfig runs the command even if the Config is not valid,
+	// and its problems are reported after running it.
+	anyConfig bool
+}
+
+// commands maps subcommand-names to their commands.
+// The unnamed command runs the service.
+var commands = map[string]command{
+	"": command{
+		usage: "Run the Device Aggregate command-service",
+		setup: func(*flag.FlagSet) func(*Config) error {
+			return runService
+		},
+	},
+	"config print": command{
+		usage: "Print the effective configuration, with secrets masked",
+		setup: func(*flag.FlagSet) func(*Config) error {
+			return printConfig
+		},
+		// Invalid configurations are printed too, for finding their problems
+		anyConfig: true,
+	},
+	"indexes": command{
+		usage: "Reconcile Aggregate-collection indexes with configuration",
+		setup: setupIndexes,
+	},
+	"export": command{
+		usage: "Export Devices to an NDJSON or BSON archive-file",
+		setup: setupExport,
+	},
+	"import": command{
+		usage: "Import Devices from an exported archive-file",
+		setup: setupImport,
+	},
+	"migrate": command{
+		usage: "Migrate Devices to a schema-version",
+		setup: setupMigrate,
+	},
+	"verify": command{
+		usage: "Report and repair drift of Devices from the EventStore",
+		setup: setupVerify,
+	},
+	"state": command{
+		usage: "Print a Device as of an event-version or time",
+		setup: setupState,
+	},
+}
+
+// parseCommand splits args into the subcommand-name and its remaining args.
+// The subcommand-name is formed by all leading args that are not flags.
+func parseCommand(args []string) (string, []string, error) {
+	words := []string{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			break
+		}
+		words = append(words, arg)
+	}
+
+	name := strings.Join(words, " ")
+	if _, ok := commands[name]; !ok {
+		return "", nil, errors.Errorf("unknown command %q\n%s", name, commandsUsage())
+	}
+	return name, args[len(words):], nil
+}
+
+// commandsUsage lists available subcommands.
+func commandsUsage() string {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	usage := "Available commands:"
+	for _, name := range names {
+		displayName := name
+		if displayName == "" {
+			displayName = "(none)"
+		}
+		usage += fmt.Sprintf("\n  %-14s %s", displayName, commands[name].usage)
+	}
+	return usage
+}
+
+// printConfig writes the effective Config as YAML to stdout.
+func printConfig(cfg *Config) error {
+	out, err := yaml.Marshal(cfg.Masked())
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling Config")
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// setupIndexes creates missing and changed indexes, and prints
+// a report comparing indexes in MongoDB with configuration.
+func setupIndexes(fs *flag.FlagSet) func(*Config) error {
+	dryRun := fs.Bool("dry-run", false, "Only report, without changing any index")
+
+	return func(cfg *Config) error {
+		conn, err := newMongoConnection(&cfg.Mongo)
+		if err != nil {
+			return err
+		}
+
+		indexConfigs := aggIndexConfigs(&cfg.Mongo)
+		var report *indexReport
+		if *dryRun {
+			report, err = diffIndexes(conn, cfg.Mongo.Database, cfg.Mongo.AggCollection,
+				indexConfigs, cfg.Mongo.Unique)
+		} else {
+			report, err = reconcileIndexes(conn, cfg.Mongo.Database,
+				cfg.Mongo.AggCollection, indexConfigs, cfg.Mongo.Unique,
+				cfg.Mongo.DropUnknownIndexes)
+			if err == nil {
+				_, err = createMongoCollection(conn, cfg.Mongo.Database,
+					cfg.Mongo.AggCollection, indexConfigs)
+			}
+			if err == nil {
+				err = createUniqueIndexes(conn, cfg.Mongo.Database,
+					cfg.Mongo.AggCollection, cfg.Mongo.Unique)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		out, err := yaml.Marshal(report)
+		if err != nil {
+			err = errors.Wrap(err, "Error marshalling index-report")
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+}
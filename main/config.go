@@ -0,0 +1,831 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-commonutils/commonutil"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// secretMask replaces secret values when printing Config.
+const secretMask = "******"
+
+// Config is the effective configuration for the service.
+// Values are layered in order: defaults, config-file, env-vars, and flags,
+// with later layers overriding earlier ones.
+type Config struct {
+	ServiceName string `yaml:"serviceName"`
+	// MetricsAddr is the address to serve metrics on.
+	// Metrics are not served if this is blank.
+	MetricsAddr string `yaml:"metricsAddr"`
+	// Admin serves the read-only admin-API, if its Addr is set.
+	Admin AdminConfig `yaml:"admin"`
+	// CommandAPI serves the command-API, if its Addr is set.
+	CommandAPI CommandAPIConfig `yaml:"commandAPI"`
+	// Validation validates command-requests before they are persisted, if Enabled.
+	Validation ValidationConfig `yaml:"validation"`
+	// Sequencing applies events in order of their Version, if Enabled.
+	Sequencing SequencingConfig `yaml:"sequencing"`
+	// Snapshots takes periodic Snapshots of Devices, if Enabled.
+	Snapshots SnapshotsConfig `yaml:"snapshots"`
+
+	Kafka   KafkaConfig   `yaml:"kafka"`
+	Mongo   MongoConfig   `yaml:"mongo"`
+	Storage StorageConfig `yaml:"storage"`
+	Items   ItemsConfig   `yaml:"items"`
+	Limits  LimitsConfig  `yaml:"limits"`
+	Auth    AuthConfig    `yaml:"auth"`
+	Tenancy TenancyConfig `yaml:"tenancy"`
+}
+
+// KafkaConfig defines the Kafka brokers, groups and topics used by the service.
+type KafkaConfig struct {
+	Brokers []string `yaml:"brokers"`
+
+	ConsumerEventGroup      string `yaml:"consumerEventGroup"`
+	ConsumerEventQueryGroup string `yaml:"consumerEventQueryGroup"`
+
+	ConsumerEventTopic      string `yaml:"consumerEventTopic"`
+	ConsumerEventQueryTopic string `yaml:"consumerEventQueryTopic"`
+	ProducerEventQueryTopic string `yaml:"producerEventQueryTopic"`
+	ProducerResponseTopic   string `yaml:"producerResponseTopic"`
+	// EventQueryFirstYear is the year-bucket of the first persisted events.
+	// Events are fetched from each year-bucket since, up to the current year.
+	EventQueryFirstYear uint32 `yaml:"eventQueryFirstYear"`
+	// ProducerEventTopic is the EventStore's event-topic, which the command-API
+	// and validation publish commands on.
+	ProducerEventTopic string `yaml:"producerEventTopic"`
+	// EmitRejections produces a "deviceCommandRejected" event on
+	// ProducerEventTopic for each persisted event that is rejected.
+	EmitRejections bool `yaml:"emitRejections"`
+	// QuarantineTopic receives events that caused a panic while being handled.
+	// Leave blank to disable.
+	QuarantineTopic string `yaml:"quarantineTopic"`
+}
+
+// MongoConfig defines the MongoDB connection and collections used by the service.
+type MongoConfig struct {
+	Hosts    []string `yaml:"hosts"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+
+	Database             string `yaml:"database"`
+	AggCollection        string `yaml:"aggCollection"`
+	MetaCollection       string `yaml:"metaCollection"`
+	AssignmentCollection string `yaml:"assignmentCollection"`
+	ProcessedCollection  string `yaml:"processedCollection"`
+	SnapshotCollection   string `yaml:"snapshotCollection"`
+
+	ConnectionTimeoutMS uint32 `yaml:"connectionTimeoutMS"`
+	ResourceTimeoutMS   uint32 `yaml:"resourceTimeoutMS"`
+
+	// Indexes are created on the Aggregate collection in addition to
+	// the unique "deviceID_index".
+	Indexes []IndexConfig `yaml:"indexes"`
+	// Unique constraints are checked by insert and update commands,
+	// and backed by unique-indexes on the Aggregate collection.
+	Unique []UniqueConfig `yaml:"unique"`
+	// MigrateOnStart migrates Devices to the latest schema-version on startup.
+	MigrateOnStart bool `yaml:"migrateOnStart"`
+	// DropUnknownIndexes drops indexes that exist on the Aggregate collection
+	// but are not configured.
+	DropUnknownIndexes bool `yaml:"dropUnknownIndexes"`
+	// Transactions runs multi-document writes in MongoDB transactions.
+	// This requires a replica-set, and is disabled on standalone servers.
+	Transactions bool `yaml:"transactions"`
+
+	// tenantScoped is set by applyTenancy, scoping DeviceIDs to tenants.
+	tenantScoped bool
+}
+
+// AdminConfig defines the read-only admin-API for inspecting Devices.
+type AdminConfig struct {
+	// Addr is the address to serve the admin-API on.
+	// The admin-API is not served if this is blank.
+	Addr string `yaml:"addr"`
+	// Token is the bearer-token required by admin-API requests.
+	Token string `yaml:"token"`
+	// ConsumerGroup consumes esquery-responses for reconstructing past Device
+	// states. It must not be shared with other consumers. Past states are not
+	// served if this is blank.
+	ConsumerGroup string `yaml:"consumerGroup"`
+	// TimeoutMS is how long to wait for events when reconstructing past states.
+	TimeoutMS uint32 `yaml:"timeoutMS"`
+}
+
+// CommandAPIConfig defines the HTTP-API for running commands synchronously.
+type CommandAPIConfig struct {
+	// Addr is the address to serve the command-API on.
+	// The command-API is not served if this is blank.
+	Addr string `yaml:"addr"`
+	// Tokens maps the bearer-tokens accepted by command-API requests to the
+	// UserUUID of their user, which published commands are attributed to.
+	Tokens map[string]string `yaml:"tokens"`
+	// ConsumerGroup consumes service-responses for published commands.
+	// It must not be shared with other consumers.
+	ConsumerGroup string `yaml:"consumerGroup"`
+	// TimeoutMS is how long to wait for the response to a published command.
+	TimeoutMS uint32 `yaml:"timeoutMS"`
+}
+
+// ValidationConfig defines validating command-requests before they are
+// persisted to the EventStore.
+type ValidationConfig struct {
+	// Enabled consumes command-requests from CommandTopic. Commands accepted
+	// against current Devices are forwarded to kafka.producerEventTopic, and
+	// rejected commands are answered on kafka.producerResponseTopic.
+	Enabled       bool   `yaml:"enabled"`
+	ConsumerGroup string `yaml:"consumerGroup"`
+	CommandTopic  string `yaml:"commandTopic"`
+}
+
+// SequencingConfig defines applying events in order of their Version.
+type SequencingConfig struct {
+	// Enabled records the Version of the last applied event, and fetches
+	// missing events from the EventStore before applying newer events.
+	Enabled bool `yaml:"enabled"`
+	// ConsumerGroup consumes responses to EventStore-queries for missing events.
+	// It must not be shared with other consumers.
+	ConsumerGroup string `yaml:"consumerGroup"`
+	TimeoutMS     uint32 `yaml:"timeoutMS"`
+}
+
+// SnapshotsConfig defines periodic Snapshots of Devices, rebuilt from events.
+type SnapshotsConfig struct {
+	// Enabled takes a Snapshot every EveryEvents handled events, or when an
+	// event is handled IntervalMS after the last Snapshot. Zero disables either.
+	Enabled     bool   `yaml:"enabled"`
+	EveryEvents uint32 `yaml:"everyEvents"`
+	IntervalMS  uint32 `yaml:"intervalMS"`
+	// ConsumerGroup consumes responses to EventStore-queries for events
+	// after the latest Snapshot. It must not be shared with other consumers.
+	ConsumerGroup string `yaml:"consumerGroup"`
+	TimeoutMS     uint32 `yaml:"timeoutMS"`
+}
+
+// StorageConfig defines where Devices are stored.
+type StorageConfig struct {
+	// Backend is "mongo" to store Devices in the Aggregate collection, or "bolt"
+	// to store them, with their assignment-history and processed events,
+	// in the embedded BoltDB file at BoltPath.
+	Backend  string `yaml:"backend"`
+	BoltPath string `yaml:"boltPath"`
+}
+
+// ItemsConfig defines how Inventory Items are looked up when assigning Devices.
+type ItemsConfig struct {
+	// Lookup is either "mongo", to look up Items in MongoCollection, or "esquery",
+	// to fold Inventory events fetched from the EventStore.
+	Lookup          string `yaml:"lookup"`
+	MongoCollection string `yaml:"mongoCollection"`
+	// AggregateID, ConsumerGroup and TimeoutMS are only used for "esquery" lookup.
+	AggregateID   int8   `yaml:"aggregateID"`
+	ConsumerGroup string `yaml:"consumerGroup"`
+	TimeoutMS     uint32 `yaml:"timeoutMS"`
+}
+
+// LimitsConfig restricts the Devices affected by "update" and "delete" events.
+type LimitsConfig struct {
+	// MaxAffected is the maximum number of Devices a single event can affect.
+	// Zero means no limit.
+	MaxAffected uint32 `yaml:"maxAffected"`
+}
+
+// TenancyConfig defines how Devices are isolated by tenant.
+type TenancyConfig struct {
+	// Enabled scopes all commands to the tenant of their event, as per
+	// "tenantID" in Event-data.
+	Enabled bool `yaml:"enabled"`
+	// DefaultTenant is used for events without "tenantID".
+	// Leave blank to reject such events.
+	DefaultTenant string `yaml:"defaultTenant"`
+	// Routing is "none" to store all tenants in the Aggregate collection,
+	// "collection" to store each tenant in "<aggCollection>_<tenantID>",
+	// or "database" to store each tenant in database "<database>_<tenantID>".
+	Routing string `yaml:"routing"`
+}
+
+// AuthConfig defines how events are authorized by the roles of their UserUUID.
+type AuthConfig struct {
+	// Enabled rejects events whose user is not allowed to run the command.
+	Enabled bool `yaml:"enabled"`
+	// Roles is either "mongo", to look up user-roles in MongoCollection,
+	// or "file", to read them from File.
+	Roles           string `yaml:"roles"`
+	MongoCollection string `yaml:"mongoCollection"`
+	File            string `yaml:"file"`
+	// Policies define what each role is allowed to do.
+	Policies []PolicyConfig `yaml:"policies"`
+}
+
+// PolicyConfig defines the commands a role is allowed to run.
+type PolicyConfig struct {
+	Role string `yaml:"role"`
+	// Actions are "<eventAction>" or "<eventAction>.<serviceAction>",
+	// "dryRun" for dry-runs, or "*" for all commands.
+	Actions []string `yaml:"actions"`
+	// Fields are the Device fields the role can set, or "*" for all fields.
+	Fields []string `yaml:"fields,omitempty"`
+}
+
+// defaultConfig returns the Config used as base before any other layer is applied.
+func defaultConfig() *Config {
+	return &Config{
+		ServiceName: "agg-device-cmd",
+		Admin: AdminConfig{
+			ConsumerGroup: "agg.device.cmd.admin.1",
+			TimeoutMS:     30000,
+		},
+		CommandAPI: CommandAPIConfig{
+			ConsumerGroup: "agg.device.cmd.api.1",
+			TimeoutMS:     10000,
+		},
+		Validation: ValidationConfig{
+			ConsumerGroup: "agg.device.cmd.validation.1",
+			CommandTopic:  "agg.device.command",
+		},
+		Sequencing: SequencingConfig{
+			ConsumerGroup: "agg.device.cmd.sequencing.1",
+			TimeoutMS:     10000,
+		},
+		Snapshots: SnapshotsConfig{
+			EveryEvents:   1000,
+			ConsumerGroup: "agg.device.cmd.snapshots.1",
+			TimeoutMS:     30000,
+		},
+		Kafka: KafkaConfig{
+			EventQueryFirstYear: 2018,
+		},
+		Mongo: MongoConfig{
+			AssignmentCollection: "agg_device_assignment",
+			ProcessedCollection:  "agg_device_processed",
+			SnapshotCollection:   "agg_device_snapshot",
+			ConnectionTimeoutMS:  3000,
+			ResourceTimeoutMS:    5000,
+			Transactions:         true,
+			MigrateOnStart:       true,
+			Indexes: []IndexConfig{
+				IndexConfig{Name: "itemID_index", Keys: []string{"itemID"}},
+				IndexConfig{Name: "sku_index", Keys: []string{"sku"}},
+				IndexConfig{Name: "lot_index", Keys: []string{"lot"}},
+				IndexConfig{Name: "status_index", Keys: []string{"status"}},
+				IndexConfig{Name: "sku_lot_index", Keys: []string{"sku", "lot"}},
+			},
+		},
+		Storage: StorageConfig{
+			Backend:  mongoStorage,
+			BoltPath: "agg_device.db",
+		},
+		Items: ItemsConfig{
+			Lookup:          mongoItemLookup,
+			MongoCollection: "agg_inventory",
+			AggregateID:     2,
+			TimeoutMS:       5000,
+		},
+		Limits: LimitsConfig{
+			MaxAffected: 100,
+		},
+		Tenancy: TenancyConfig{
+			Routing: noTenantRouting,
+		},
+		Auth: AuthConfig{
+			Roles:           mongoRoles,
+			MongoCollection: "agg_device_roles",
+			Policies: []PolicyConfig{
+				PolicyConfig{
+					Role:    device.ViewerRole,
+					Actions: []string{device.DryRunServiceAction},
+				},
+				PolicyConfig{
+					Role:    device.TechnicianRole,
+					Actions: []string{"update", device.DryRunServiceAction},
+					Fields:  []string{"itemID", "lastMaintenance", "status"},
+				},
+				PolicyConfig{
+					Role:    device.AdminRole,
+					Actions: []string{device.AllowAll},
+					Fields:  []string{device.AllowAll},
+				},
+			},
+		},
+	}
+}
+
+// configVar is a Config-value settable from an env-var and a command-line flag.
+type configVar struct {
+	env   string
+	flag  string
+	usage string
+	value flag.Value
+}
+
+// vars lists all Config-values that can be overridden by env-vars and flags.
+func (c *Config) vars() []configVar {
+	return []configVar{
+		{"SERVICE_NAME", "service-name", "Name of this service",
+			&stringValue{&c.ServiceName}},
+		{"METRICS_ADDR", "metrics-addr", "Address to serve metrics on, such as :8080",
+			&stringValue{&c.MetricsAddr}},
+		{"ADMIN_ADDR", "admin-addr", "Address to serve the admin-API on, such as :8081",
+			&stringValue{&c.Admin.Addr}},
+		{"ADMIN_TOKEN", "admin-token", "Bearer-token required by admin-API requests",
+			&stringValue{&c.Admin.Token}},
+		{"ADMIN_CONSUMER_GROUP", "admin-consumer-group",
+			"Consumer-group for events fetched by the admin-API, blank to disable",
+			&stringValue{&c.Admin.ConsumerGroup}},
+		{"ADMIN_TIMEOUT_MS", "admin-timeout-ms",
+			"Timeout in milliseconds for events fetched by the admin-API",
+			&uint32Value{&c.Admin.TimeoutMS}},
+		{"COMMAND_API_ADDR", "command-api-addr",
+			"Address to serve the command-API on, such as :8082",
+			&stringValue{&c.CommandAPI.Addr}},
+		{"COMMAND_API_TOKENS", "command-api-tokens",
+			"Comma-separated token=userUUID bearer-tokens accepted by the command-API",
+			&mapValue{&c.CommandAPI.Tokens}},
+		{"COMMAND_API_CONSUMER_GROUP", "command-api-consumer-group",
+			"Consumer-group for responses to commands published by the command-API",
+			&stringValue{&c.CommandAPI.ConsumerGroup}},
+		{"COMMAND_API_TIMEOUT_MS", "command-api-timeout-ms",
+			"Timeout in milliseconds for responses to published commands",
+			&uint32Value{&c.CommandAPI.TimeoutMS}},
+		{"VALIDATION_ENABLED", "validation-enabled",
+			"Validate command-requests, forwarding only accepted commands to the EventStore",
+			&boolValue{&c.Validation.Enabled}},
+		{"VALIDATION_CONSUMER_GROUP", "validation-consumer-group",
+			"Consumer-group for command-requests",
+			&stringValue{&c.Validation.ConsumerGroup}},
+		{"VALIDATION_COMMAND_TOPIC", "validation-command-topic",
+			"Topic to consume command-requests from",
+			&stringValue{&c.Validation.CommandTopic}},
+		{"SEQUENCING_ENABLED", "sequencing-enabled",
+			"Apply events in order of their Version, fetching missing events",
+			&boolValue{&c.Sequencing.Enabled}},
+		{"SEQUENCING_CONSUMER_GROUP", "sequencing-consumer-group",
+			"Consumer-group for EventStore-query responses with missing events",
+			&stringValue{&c.Sequencing.ConsumerGroup}},
+		{"SEQUENCING_TIMEOUT_MS", "sequencing-timeout-ms",
+			"Timeout in milliseconds for fetching missing events",
+			&uint32Value{&c.Sequencing.TimeoutMS}},
+		{"SNAPSHOTS_ENABLED", "snapshots-enabled",
+			"Take periodic Snapshots of Devices rebuilt from events",
+			&boolValue{&c.Snapshots.Enabled}},
+		{"SNAPSHOTS_EVERY_EVENTS", "snapshots-every-events",
+			"Take a Snapshot after this many events, 0 to disable",
+			&uint32Value{&c.Snapshots.EveryEvents}},
+		{"SNAPSHOTS_INTERVAL_MS", "snapshots-interval-ms",
+			"Take a Snapshot this many milliseconds after the last, 0 to disable",
+			&uint32Value{&c.Snapshots.IntervalMS}},
+		{"SNAPSHOTS_CONSUMER_GROUP", "snapshots-consumer-group",
+			"Consumer-group for EventStore-query responses with events to snapshot",
+			&stringValue{&c.Snapshots.ConsumerGroup}},
+		{"SNAPSHOTS_TIMEOUT_MS", "snapshots-timeout-ms",
+			"Timeout in milliseconds for fetching events to snapshot",
+			&uint32Value{&c.Snapshots.TimeoutMS}},
+
+		{"KAFKA_BROKERS", "kafka-brokers", "Comma-separated Kafka brokers",
+			&listValue{&c.Kafka.Brokers}},
+		{"KAFKA_CONSUMER_EVENT_GROUP", "kafka-consumer-event-group",
+			"Consumer-group for Event-topic", &stringValue{&c.Kafka.ConsumerEventGroup}},
+		{"KAFKA_CONSUMER_EVENT_QUERY_GROUP", "kafka-consumer-event-query-group",
+			"Consumer-group for EventStore-query responses",
+			&stringValue{&c.Kafka.ConsumerEventQueryGroup}},
+		{"KAFKA_CONSUMER_EVENT_TOPIC", "kafka-consumer-event-topic",
+			"Topic to consume Events from", &stringValue{&c.Kafka.ConsumerEventTopic}},
+		{"KAFKA_CONSUMER_EVENT_QUERY_TOPIC", "kafka-consumer-event-query-topic",
+			"Topic to consume EventStore-query responses from",
+			&stringValue{&c.Kafka.ConsumerEventQueryTopic}},
+		{"KAFKA_PRODUCER_EVENT_QUERY_TOPIC", "kafka-producer-event-query-topic",
+			"Topic to produce EventStore-queries on",
+			&stringValue{&c.Kafka.ProducerEventQueryTopic}},
+		{"KAFKA_PRODUCER_RESPONSE_TOPIC", "kafka-producer-response-topic",
+			"Topic to produce service-responses on",
+			&stringValue{&c.Kafka.ProducerResponseTopic}},
+		{"KAFKA_PRODUCER_EVENT_TOPIC", "kafka-producer-event-topic",
+			"EventStore topic to publish command-API commands on",
+			&stringValue{&c.Kafka.ProducerEventTopic}},
+		{"KAFKA_EMIT_REJECTIONS", "kafka-emit-rejections",
+			"Produce deviceCommandRejected events for rejected persisted events",
+			&boolValue{&c.Kafka.EmitRejections}},
+		{"KAFKA_EVENT_QUERY_FIRST_YEAR", "kafka-event-query-first-year",
+			"Year-bucket of the first persisted events, fetched by EventStore-queries",
+			&uint32Value{&c.Kafka.EventQueryFirstYear}},
+		{"KAFKA_QUARANTINE_TOPIC", "kafka-quarantine-topic",
+			"Topic to produce events that caused a panic on",
+			&stringValue{&c.Kafka.QuarantineTopic}},
+
+		{"MONGO_HOSTS", "mongo-hosts", "Comma-separated MongoDB hosts",
+			&listValue{&c.Mongo.Hosts}},
+		{"MONGO_USERNAME", "mongo-username", "MongoDB username",
+			&stringValue{&c.Mongo.Username}},
+		{"MONGO_PASSWORD", "mongo-password", "MongoDB password",
+			&stringValue{&c.Mongo.Password}},
+		{"MONGO_DATABASE", "mongo-database", "MongoDB database",
+			&stringValue{&c.Mongo.Database}},
+		{"MONGO_AGG_COLLECTION", "mongo-agg-collection", "Aggregate collection",
+			&stringValue{&c.Mongo.AggCollection}},
+		{"MONGO_META_COLLECTION", "mongo-meta-collection", "Aggregate-meta collection",
+			&stringValue{&c.Mongo.MetaCollection}},
+		{"MONGO_CONNECTION_TIMEOUT_MS", "mongo-connection-timeout-ms",
+			"MongoDB connection timeout in milliseconds",
+			&uint32Value{&c.Mongo.ConnectionTimeoutMS}},
+		{"MONGO_RESOURCE_TIMEOUT_MS", "mongo-resource-timeout-ms",
+			"MongoDB resource (query) timeout in milliseconds",
+			&uint32Value{&c.Mongo.ResourceTimeoutMS}},
+		{"MONGO_DROP_UNKNOWN_INDEXES", "mongo-drop-unknown-indexes",
+			"Drop indexes on Aggregate collection that are not configured",
+			&boolValue{&c.Mongo.DropUnknownIndexes}},
+		{"MONGO_TRANSACTIONS", "mongo-transactions",
+			"Use transactions for multi-document writes (requires replica-set)",
+			&boolValue{&c.Mongo.Transactions}},
+		{"MONGO_MIGRATE_ON_START", "mongo-migrate-on-start",
+			"Migrate Devices to the latest schema-version on startup",
+			&boolValue{&c.Mongo.MigrateOnStart}},
+		{"MONGO_ASSIGNMENT_COLLECTION", "mongo-assignment-collection",
+			"Device-to-Item assignment-history collection",
+			&stringValue{&c.Mongo.AssignmentCollection}},
+		{"MONGO_PROCESSED_COLLECTION", "mongo-processed-collection",
+			"Collection of processed events, for idempotent event-handling",
+			&stringValue{&c.Mongo.ProcessedCollection}},
+		{"MONGO_SNAPSHOT_COLLECTION", "mongo-snapshot-collection",
+			"Collection of Device Snapshots",
+			&stringValue{&c.Mongo.SnapshotCollection}},
+
+		{"STORAGE_BACKEND", "storage-backend",
+			`Device storage backend, "mongo" or "bolt"`,
+			&stringValue{&c.Storage.Backend}},
+		{"STORAGE_BOLT_PATH", "storage-bolt-path",
+			"BoltDB file for bolt storage backend",
+			&stringValue{&c.Storage.BoltPath}},
+
+		{"ITEMS_LOOKUP", "items-lookup",
+			`Item lookup for assignments, "mongo" or "esquery"`,
+			&stringValue{&c.Items.Lookup}},
+		{"ITEMS_MONGO_COLLECTION", "items-mongo-collection",
+			"Inventory collection for mongo Item lookup",
+			&stringValue{&c.Items.MongoCollection}},
+		{"ITEMS_AGGREGATE_ID", "items-aggregate-id",
+			"Inventory AggregateID for esquery Item lookup",
+			&int8Value{&c.Items.AggregateID}},
+		{"ITEMS_CONSUMER_GROUP", "items-consumer-group",
+			"Consumer-group for esquery Item lookup responses",
+			&stringValue{&c.Items.ConsumerGroup}},
+		{"ITEMS_TIMEOUT_MS", "items-timeout-ms",
+			"Timeout in milliseconds for esquery Item lookup",
+			&uint32Value{&c.Items.TimeoutMS}},
+
+		{"LIMITS_MAX_AFFECTED", "limits-max-affected",
+			"Maximum Devices affected by a single update or delete event (0 for no limit)",
+			&uint32Value{&c.Limits.MaxAffected}},
+
+		{"AUTH_ENABLED", "auth-enabled",
+			"Reject events whose user is not allowed to run the command",
+			&boolValue{&c.Auth.Enabled}},
+		{"AUTH_ROLES", "auth-roles",
+			`User-roles lookup, "mongo" or "file"`,
+			&stringValue{&c.Auth.Roles}},
+		{"AUTH_MONGO_COLLECTION", "auth-mongo-collection",
+			"User-roles collection for mongo lookup",
+			&stringValue{&c.Auth.MongoCollection}},
+		{"AUTH_FILE", "auth-file",
+			"User-roles YAML file for file lookup",
+			&stringValue{&c.Auth.File}},
+
+		{"TENANCY_ENABLED", "tenancy-enabled",
+			"Scope commands to the tenant of their event",
+			&boolValue{&c.Tenancy.Enabled}},
+		{"TENANCY_DEFAULT_TENANT", "tenancy-default-tenant",
+			"Tenant for events without tenantID (blank to reject such events)",
+			&stringValue{&c.Tenancy.DefaultTenant}},
+		{"TENANCY_ROUTING", "tenancy-routing",
+			`Tenant storage routing, "none", "collection" or "database"`,
+			&stringValue{&c.Tenancy.Routing}},
+	}
+}
+
+// Validate checks the Config and reports all problems together.
+func (c *Config) Validate() error {
+	errs := c.validate()
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *Config) validate() configErrors {
+	errs := configErrors{}
+
+	errs.required(len(c.Kafka.Brokers) > 0, "kafka.brokers")
+	errs.required(c.Kafka.ConsumerEventGroup != "", "kafka.consumerEventGroup")
+	errs.required(c.Kafka.ConsumerEventQueryGroup != "", "kafka.consumerEventQueryGroup")
+	errs.required(c.Kafka.ConsumerEventTopic != "", "kafka.consumerEventTopic")
+	errs.required(c.Kafka.ConsumerEventQueryTopic != "", "kafka.consumerEventQueryTopic")
+	errs.required(c.Kafka.ProducerEventQueryTopic != "", "kafka.producerEventQueryTopic")
+	errs.required(c.Kafka.ProducerResponseTopic != "", "kafka.producerResponseTopic")
+	firstYear := c.Kafka.EventQueryFirstYear
+	if firstYear == 0 || firstYear > uint32(time.Now().Year()) {
+		errs = append(errs, "kafka.eventQueryFirstYear must be a year up to the current year")
+	}
+	if c.Kafka.EmitRejections {
+		errs.required(c.Kafka.ProducerEventTopic != "", "kafka.producerEventTopic")
+	}
+
+	errs = append(errs, validateAdmin(&c.Admin)...)
+	errs = append(errs, validateCommandAPI(c)...)
+	errs = append(errs, validateValidation(c)...)
+	errs = append(errs, validateSequencing(&c.Sequencing)...)
+	errs = append(errs, validateSnapshots(c)...)
+
+	if c.requiresMongo() {
+		errs.required(len(c.Mongo.Hosts) > 0, "mongo.hosts")
+		errs.required(c.Mongo.Database != "", "mongo.database")
+		if c.Mongo.ConnectionTimeoutMS == 0 {
+			errs = append(errs, "mongo.connectionTimeoutMS must be greater than 0")
+		}
+		if c.Mongo.ResourceTimeoutMS == 0 {
+			errs = append(errs, "mongo.resourceTimeoutMS must be greater than 0")
+		}
+	}
+	if c.Storage.Backend == mongoStorage {
+		errs.required(c.Mongo.AggCollection != "", "mongo.aggCollection")
+		errs.required(c.Mongo.MetaCollection != "", "mongo.metaCollection")
+		errs.required(c.Mongo.AssignmentCollection != "", "mongo.assignmentCollection")
+		errs.required(c.Mongo.ProcessedCollection != "", "mongo.processedCollection")
+	}
+	errs = append(errs, validateIndexes(c.Mongo.Indexes)...)
+	errs = append(errs, validateUniques(c.Mongo.Unique, c.Mongo.Indexes)...)
+	errs = append(errs, validateStorage(c)...)
+
+	switch c.Items.Lookup {
+	case mongoItemLookup:
+		errs.required(c.Items.MongoCollection != "", "items.mongoCollection")
+	case esQueryItemLookup:
+		errs.required(c.Items.AggregateID > 0, "items.aggregateID")
+		errs.required(c.Items.ConsumerGroup != "", "items.consumerGroup")
+		if c.Items.TimeoutMS == 0 {
+			errs = append(errs, "items.timeoutMS must be greater than 0")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf(
+			"items.lookup must be %q or %q", mongoItemLookup, esQueryItemLookup,
+		))
+	}
+
+	if c.Auth.Enabled {
+		errs = append(errs, validateAuth(&c.Auth)...)
+	}
+	if c.Tenancy.Enabled {
+		errs = append(errs, validateTenancy(&c.Tenancy, c.Admin.Addr)...)
+	}
+	return errs
+}
+
+// Masked returns a copy of Config with secrets replaced, safe for printing.
+func (c Config) Masked() Config {
+	if c.Mongo.Password != "" {
+		c.Mongo.Password = secretMask
+	}
+	if c.Admin.Token != "" {
+		c.Admin.Token = secretMask
+	}
+	if len(c.CommandAPI.Tokens) > 0 {
+		userUUIDs := []string{}
+		for _, userUUID := range c.CommandAPI.Tokens {
+			userUUIDs = append(userUUIDs, userUUID)
+		}
+		sort.Strings(userUUIDs)
+		c.CommandAPI.Tokens = map[string]string{}
+		for i, userUUID := range userUUIDs {
+			c.CommandAPI.Tokens[fmt.Sprintf("%s%d", secretMask, i+1)] = userUUID
+		}
+	}
+	return c
+}
+
+// loadConfig builds the Config by layering defaults, config-file, env-vars,
+// and the flags in args. The config-file is read from the "-config" flag,
+// or from the CONFIG_FILE env-var.
+// Config-flags are registered on fs, which may contain other flags too.
+// If the Config is not valid, it is returned along with the configErrors,
+// so it can still be printed.
+func loadConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := defaultConfig()
+	vars := cfg.vars()
+	for _, v := range vars {
+		fs.Var(v.value, v.flag, fmt.Sprintf("%s (env: %s)", v.usage, v.env))
+	}
+	configFile := fs.String(
+		"config", os.Getenv("CONFIG_FILE"), "Path to YAML config-file (env: CONFIG_FILE)",
+	)
+
+	// Flags are parsed once to find the config-file, and again after
+	// the file and env-vars are applied, so flags take precedence.
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if *configFile != "" {
+		err = cfg.readFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	errs := configErrors{}
+	for _, v := range vars {
+		envVal, isSet := os.LookupEnv(v.env)
+		if !isSet || envVal == "" {
+			continue
+		}
+		err = v.value.Set(envVal)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("env-var %s: %s", v.env, err))
+		}
+	}
+
+	err = fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	errs = append(errs, cfg.validate()...)
+	if cfg.Tenancy.Enabled {
+		applyTenancy(&cfg.Mongo)
+	}
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// readFile applies the YAML config-file at path over Config.
+func (c *Config) readFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = errors.Wrap(err, "Error reading config-file")
+		return err
+	}
+	err = yaml.UnmarshalStrict(data, c)
+	if err != nil {
+		err = errors.Wrapf(err, "Error parsing config-file %s", path)
+		return err
+	}
+	return nil
+}
+
+// configErrors collects all Config problems so they can be reported together.
+type configErrors []string
+
+func (e *configErrors) required(isSet bool, name string) {
+	if !isSet {
+		*e = append(*e, name+" is required")
+	}
+}
+
+func (e configErrors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// stringValue is a flag.Value for string Config-values.
+type stringValue struct {
+	p *string
+}
+
+func (v *stringValue) Set(s string) error {
+	*v.p = s
+	return nil
+}
+
+func (v *stringValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
+}
+
+// listValue is a flag.Value for comma-separated Config-values, such as hosts.
+type listValue struct {
+	p *[]string
+}
+
+func (v *listValue) Set(s string) error {
+	*v.p = *commonutil.ParseHosts(s)
+	return nil
+}
+
+func (v *listValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strings.Join(*v.p, ",")
+}
+
+// mapValue is a flag.Value for comma-separated key=value Config-values.
+type mapValue struct {
+	p *map[string]string
+}
+
+func (v *mapValue) Set(s string) error {
+	m := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return errors.Errorf("%q is not a valid key=value pair", pair)
+		}
+		m[kv[0]] = kv[1]
+	}
+	*v.p = m
+	return nil
+}
+
+func (v *mapValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	pairs := []string{}
+	for k, val := range *v.p {
+		pairs = append(pairs, k+"="+val)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// uint32Value is a flag.Value for unsigned-integer Config-values.
+type uint32Value struct {
+	p *uint32
+}
+
+func (v *uint32Value) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return errors.Errorf("%q is not a valid unsigned integer", s)
+	}
+	*v.p = uint32(n)
+	return nil
+}
+
+func (v *uint32Value) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatUint(uint64(*v.p), 10)
+}
+
+// int8Value is a flag.Value for small integer Config-values, such as AggregateIDs.
+type int8Value struct {
+	p *int8
+}
+
+func (v *int8Value) Set(s string) error {
+	n, err := strconv.ParseInt(s, 10, 8)
+	if err != nil {
+		return errors.Errorf("%q is not a valid 8-bit integer", s)
+	}
+	*v.p = int8(n)
+	return nil
+}
+
+func (v *int8Value) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatInt(int64(*v.p), 10)
+}
+
+// boolValue is a flag.Value for boolean Config-values.
+type boolValue struct {
+	p *bool
+}
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return errors.Errorf("%q is not a valid boolean", s)
+	}
+	*v.p = b
+	return nil
+}
+
+func (v *boolValue) String() string {
+	if v.p == nil {
+		return "false"
+	}
+	return strconv.FormatBool(*v.p)
+}
+
+// IsBoolFlag allows using the flag without a value.
+func (v *boolValue) IsBoolFlag() bool {
+	return true
+}
@@ -1,68 +1,39 @@
 package main
 
 import (
-	"log"
-	"os"
-	"strconv"
-
 	"github.com/TerrexTech/agg-device-cmd/device"
 
-	"github.com/TerrexTech/go-commonutils/commonutil"
 	"github.com/TerrexTech/go-eventspoll/poll"
 	"github.com/TerrexTech/go-mongoutils/mongo"
 	"github.com/pkg/errors"
 )
 
-func loadMongoConfig() (*poll.MongoConfig, error) {
-	hosts := *commonutil.ParseHosts(
-		os.Getenv("MONGO_HOSTS"),
-	)
-
-	database := os.Getenv("MONGO_DATABASE")
-	aggCollection := os.Getenv("MONGO_AGG_COLLECTION")
-	metaCollection := os.Getenv("MONGO_META_COLLECTION")
-
-	username := os.Getenv("MONGO_USERNAME")
-	password := os.Getenv("MONGO_PASSWORD")
-	connTimeoutStr := os.Getenv("MONGO_CONNECTION_TIMEOUT_MS")
-	connTimeout, err := strconv.Atoi(connTimeoutStr)
+func loadMongoConfig(cfg *MongoConfig) (*poll.MongoConfig, error) {
+	conn, err := newMongoConnection(cfg)
 	if err != nil {
-		err = errors.Wrap(err, "Error converting MONGO_CONNECTION_TIMEOUT_MS to integer")
-		log.Println(err)
-		log.Println("A defalt value of 3000 will be used for MONGO_CONNECTION_TIMEOUT_MS")
-		connTimeout = 3000
-	}
-
-	mongoConfig := mongo.ClientConfig{
-		Hosts:               hosts,
-		Username:            username,
-		Password:            password,
-		TimeoutMilliseconds: uint32(connTimeout),
+		return nil, err
 	}
 
-	// MongoDB Client
-	client, err := mongo.NewClient(mongoConfig)
+	indexConfigs := aggIndexConfigs(cfg)
+	report, err := reconcileIndexes(
+		conn, cfg.Database, cfg.AggCollection, indexConfigs, cfg.Unique,
+		cfg.DropUnknownIndexes,
+	)
 	if err != nil {
-		err = errors.Wrap(err, "Error creating MongoClient")
-		log.Fatalln(err)
+		err = errors.Wrap(err, "Error reconciling indexes")
+		return nil, err
 	}
+	logIndexReport(report)
 
-	resTimeoutStr := os.Getenv("MONGO_CONNECTION_TIMEOUT_MS")
-	resTimeout, err := strconv.Atoi(resTimeoutStr)
+	aggMongoCollection, err := createMongoCollection(
+		conn, cfg.Database, cfg.AggCollection, indexConfigs,
+	)
 	if err != nil {
-		err = errors.Wrap(err, "Error converting MONGO_RESOURCE_TIMEOUT_MS to integer")
-		log.Println(err)
-		log.Println("A defalt value of 5000 will be used for MONGO_RESOURCE_TIMEOUT_MS")
-		connTimeout = 5000
-	}
-	conn := &mongo.ConnectionConfig{
-		Client:  client,
-		Timeout: uint32(resTimeout),
+		err = errors.Wrap(err, "Error creating MongoCollection")
+		return nil, err
 	}
-
-	aggMongoCollection, err := createMongoCollection(conn, database, aggCollection)
+	err = createUniqueIndexes(conn, cfg.Database, cfg.AggCollection, cfg.Unique)
 	if err != nil {
-		err = errors.Wrap(err, "Error creating MongoCollection")
 		return nil, err
 	}
 
@@ -70,27 +41,17 @@ func loadMongoConfig() (*poll.MongoConfig, error) {
 		AggregateID:        device.AggregateID,
 		AggCollection:      aggMongoCollection,
 		Connection:         conn,
-		MetaDatabaseName:   database,
-		MetaCollectionName: metaCollection,
+		MetaDatabaseName:   cfg.Database,
+		MetaCollectionName: cfg.MetaCollection,
 	}, nil
 }
 
 func createMongoCollection(
-	conn *mongo.ConnectionConfig, db string, coll string,
+	conn *mongo.ConnectionConfig,
+	db string,
+	coll string,
+	indexConfigs []mongo.IndexConfig,
 ) (*mongo.Collection, error) {
-	// Index Configuration
-	indexConfigs := []mongo.IndexConfig{
-		mongo.IndexConfig{
-			ColumnConfig: []mongo.IndexColumnConfig{
-				mongo.IndexColumnConfig{
-					Name: "deviceID",
-				},
-			},
-			IsUnique: true,
-			Name:     "deviceID_index",
-		},
-	}
-
 	// Create New Collection
 	c := &mongo.Collection{
 		Connection:   conn,
@@ -106,3 +67,52 @@ func createMongoCollection(
 	}
 	return collection, nil
 }
+
+// newMongoConnection creates the MongoDB connection as per the Config.
+func newMongoConnection(cfg *MongoConfig) (*mongo.ConnectionConfig, error) {
+	mongoConfig := mongo.ClientConfig{
+		Hosts:               cfg.Hosts,
+		Username:            cfg.Username,
+		Password:            cfg.Password,
+		TimeoutMilliseconds: cfg.ConnectionTimeoutMS,
+	}
+
+	// MongoDB Client
+	client, err := mongo.NewClient(mongoConfig)
+	if err != nil {
+		err = errors.Wrap(err, "Error creating MongoClient")
+		return nil, err
+	}
+
+	return &mongo.ConnectionConfig{
+		Client:  client,
+		Timeout: cfg.ResourceTimeoutMS,
+	}, nil
+}
+
+// createAssignmentCollection creates the Device-to-Item assignment-history
+// collection, indexed by deviceID for looking up a Device's history.
+func createAssignmentCollection(
+	conn *mongo.ConnectionConfig, cfg *MongoConfig,
+) (*mongo.Collection, error) {
+	c := &mongo.Collection{
+		Connection:   conn,
+		Database:     cfg.Database,
+		Name:         cfg.AssignmentCollection,
+		SchemaStruct: &device.Assignment{},
+		Indexes: []mongo.IndexConfig{
+			mongo.IndexConfig{
+				ColumnConfig: []mongo.IndexColumnConfig{
+					mongo.IndexColumnConfig{Name: "deviceID"},
+				},
+				Name: "deviceID_index",
+			},
+		},
+	}
+	collection, err := mongo.EnsureCollection(c)
+	if err != nil {
+		err = errors.Wrap(err, "Error creating Assignment MongoCollection")
+		return nil, err
+	}
+	return collection, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("loadConfig", func() {
+	var configFile string
+
+	// load loads the Config with env-vars set, and flags in args
+	load := func(env map[string]string, args ...string) (*Config, error) {
+		for k, v := range env {
+			os.Setenv(k, v)
+		}
+		defer func() {
+			for k := range env {
+				os.Unsetenv(k)
+			}
+		}()
+		return loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), args)
+	}
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "agg_device_config")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.WriteString("serviceName: file\nadmin:\n  token: file-token\n")
+		Expect(err).ToNot(HaveOccurred())
+		configFile = f.Name()
+		f.Close()
+	})
+
+	AfterEach(func() {
+		os.Remove(configFile)
+	})
+
+	It("should layer defaults, config-file, env-vars and flags", func() {
+		for _, layers := range []struct {
+			file     bool
+			env      string
+			flag     string
+			expected string
+		}{
+			{expected: "agg-device-cmd"},
+			{file: true, expected: "file"},
+			{env: "env", expected: "env"},
+			{file: true, env: "env", expected: "env"},
+			{flag: "flag", expected: "flag"},
+			{file: true, flag: "flag", expected: "flag"},
+			{file: true, env: "env", flag: "flag", expected: "flag"},
+		} {
+			env := map[string]string{}
+			args := []string{}
+			if layers.file {
+				env["CONFIG_FILE"] = configFile
+			}
+			if layers.env != "" {
+				env["SERVICE_NAME"] = layers.env
+			}
+			if layers.flag != "" {
+				args = append(args, "-service-name", layers.flag)
+			}
+
+			cfg, _ := load(env, args...)
+			Expect(cfg).ToNot(BeNil())
+			Expect(cfg.ServiceName).To(Equal(layers.expected), "layers %+v", layers)
+		}
+	})
+
+	It("should read the config-file from the flag over the env-var", func() {
+		cfg, _ := load(
+			map[string]string{"CONFIG_FILE": "missing.yaml"}, "-config", configFile,
+		)
+		Expect(cfg).ToNot(BeNil())
+		Expect(cfg.Admin.Token).To(Equal("file-token"))
+	})
+
+	It("should return invalid Configs along with their problems", func() {
+		cfg, err := load(map[string]string{"KAFKA_BROKERS": ""})
+		Expect(err).To(BeAssignableToTypeOf(configErrors{}))
+		Expect(err.(configErrors)).To(ContainElement(ContainSubstring("kafka.brokers")))
+		Expect(cfg).ToNot(BeNil())
+
+		cfg, err = load(map[string]string{"ADMIN_TIMEOUT_MS": "x"})
+		Expect(err.(configErrors)).To(ContainElement(ContainSubstring("ADMIN_TIMEOUT_MS")))
+		Expect(cfg.Admin.TimeoutMS).To(Equal(uint32(30000)))
+
+		cfg, err = load(nil, "-config", "missing.yaml")
+		Expect(err).To(HaveOccurred())
+		Expect(cfg).To(BeNil())
+	})
+
+	It("should load the example config-file as a valid Config", func() {
+		cfg, err := load(nil, "-config", "../config.example.yaml")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cfg.Validate()).To(Succeed())
+	})
+})
+
+var _ = Describe("Config.Masked", func() {
+	It("should mask set secrets only, without changing the Config", func() {
+		for _, secrets := range []struct {
+			password string
+			token    string
+		}{
+			{},
+			{password: "pass"},
+			{token: "token"},
+			{password: "pass", token: "token"},
+		} {
+			cfg := defaultConfig()
+			cfg.Mongo.Password = secrets.password
+			cfg.Admin.Token = secrets.token
+
+			masked := cfg.Masked()
+			for _, v := range []struct {
+				value  string
+				masked string
+			}{
+				{secrets.password, masked.Mongo.Password},
+				{secrets.token, masked.Admin.Token},
+			} {
+				if v.value == "" {
+					Expect(v.masked).To(BeEmpty())
+				} else {
+					Expect(v.masked).To(Equal(secretMask))
+				}
+			}
+			Expect(cfg.Mongo.Password).To(Equal(secrets.password))
+			Expect(cfg.Admin.Token).To(Equal(secrets.token))
+			Expect(masked.ServiceName).To(Equal(cfg.ServiceName))
+		}
+	})
+})
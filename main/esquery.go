@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/go-kafkautils/kafka"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// esQuery fetches Aggregate events from the EventStore using
+// the esquery request and response topics.
+type esQuery struct {
+	aggregateID  int8
+	requestTopic string
+	timeout      time.Duration
+	years        *yearBuckets
+
+	producer *kafka.Producer
+	consumer *kafka.Consumer
+
+	waitersLock sync.Mutex
+	waiters     map[uuuid.UUID]chan *model.KafkaResponse
+}
+
+// newESQuery creates an esQuery for events of specified Aggregate.
+// Responses are consumed using the provided consumer-group, which must not be
+// shared with other consumers, since each esQuery needs all responses.
+func newESQuery(
+	cfg *KafkaConfig, group string, aggregateID int8, timeout time.Duration,
+) (*esQuery, error) {
+	producer, err := kafka.NewProducer(&kafka.ProducerConfig{
+		KafkaBrokers: cfg.Brokers,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error creating esquery-request Producer")
+		return nil, err
+	}
+
+	responseTopic := fmt.Sprintf("%s.%d", cfg.ConsumerEventQueryTopic, aggregateID)
+	consumer, err := kafka.NewConsumer(&kafka.ConsumerConfig{
+		KafkaBrokers: cfg.Brokers,
+		GroupName:    group,
+		Topics:       []string{responseTopic},
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error creating esquery-response Consumer")
+		return nil, err
+	}
+
+	q := &esQuery{
+		aggregateID:  aggregateID,
+		requestTopic: cfg.ProducerEventQueryTopic,
+		timeout:      timeout,
+		years:        newYearBuckets(int16(cfg.EventQueryFirstYear)),
+
+		producer: producer,
+		consumer: consumer,
+		waiters:  map[uuuid.UUID]chan *model.KafkaResponse{},
+	}
+	go func() {
+		for err := range producer.Errors() {
+			err := errors.Wrap(err, "Error producing esquery-request")
+			log.Println(err)
+		}
+	}()
+	go func() {
+		err := consumer.Consume(context.Background(), &esQueryHandler{q})
+		if err != nil {
+			err = errors.Wrap(err, "Error consuming esquery-responses")
+			log.Println(err)
+		}
+	}()
+	return q, nil
+}
+
+// Events returns the Aggregate's events with version greater than fromVersion,
+// sorted by version. Each year-bucket that can have these events is queried.
+func (q *esQuery) Events(fromVersion int64) ([]model.Event, error) {
+	events := []model.Event{}
+	for _, year := range q.years.since(fromVersion, time.Now()) {
+		yearEvents, err := q.yearEvents(year, fromVersion)
+		if err != nil {
+			err = errors.Wrapf(err, "Error fetching events of year-bucket %d", year)
+			return nil, err
+		}
+		events = append(events, yearEvents...)
+	}
+	sortEvents(events)
+	q.years.record(events)
+	return events, nil
+}
+
+// yearEvents returns the Aggregate's events in the year-bucket with version
+// greater than fromVersion.
+func (q *esQuery) yearEvents(year int16, fromVersion int64) ([]model.Event, error) {
+	queryUUID, err := uuuid.NewV4()
+	if err != nil {
+		err = errors.Wrap(err, "Error generating UUID for esquery-request")
+		return nil, err
+	}
+	query := &model.EventStoreQuery{
+		AggregateID:      q.aggregateID,
+		AggregateVersion: fromVersion,
+		CorrelationID:    queryUUID,
+		UUID:             queryUUID,
+		YearBucket:       year,
+	}
+	queryMsg, err := json.Marshal(query)
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling esquery-request")
+		return nil, err
+	}
+
+	respChan := make(chan *model.KafkaResponse, 1)
+	q.waitersLock.Lock()
+	q.waiters[queryUUID] = respChan
+	q.waitersLock.Unlock()
+	defer func() {
+		q.waitersLock.Lock()
+		delete(q.waiters, queryUUID)
+		q.waitersLock.Unlock()
+	}()
+
+	q.producer.Input() <- kafka.CreateMessage(q.requestTopic, queryMsg)
+
+	select {
+	case <-time.After(q.timeout):
+		return nil, errors.New("timed out waiting for esquery-response")
+	case kr := <-respChan:
+		if kr.Error != "" {
+			err = errors.Errorf("esquery-response error: %s", kr.Error)
+			return nil, err
+		}
+		events := []model.Event{}
+		err = json.Unmarshal(kr.Result, &events)
+		if err != nil {
+			err = errors.Wrap(err, "Error unmarshalling esquery-response events")
+			return nil, err
+		}
+		return events, nil
+	}
+}
+
+// yearBuckets tracks the year-buckets of fetched events, so only year-buckets
+// that can have events newer than a version are queried.
+type yearBuckets struct {
+	firstYear int16
+
+	lock sync.Mutex
+	// versions has a version of an event in each year-bucket
+	versions map[int16]int64
+}
+
+func newYearBuckets(firstYear int16) *yearBuckets {
+	return &yearBuckets{
+		firstYear: firstYear,
+		versions:  map[int16]int64{},
+	}
+}
+
+// since returns the year-buckets up to now that can have events with version
+// greater than fromVersion. These are all year-buckets since the first year,
+// unless a year-bucket is known to have an event up to fromVersion, in which
+// case newer events are in that or later year-buckets. The year before it is
+// included too, for events persisted around the turn of the year.
+func (b *yearBuckets) since(fromVersion int64, now time.Time) []int16 {
+	b.lock.Lock()
+	start := b.firstYear
+	for year, version := range b.versions {
+		if version <= fromVersion && year-1 > start {
+			start = year - 1
+		}
+	}
+	b.lock.Unlock()
+
+	years := []int16{}
+	for year := start; year <= int16(now.Year()); year++ {
+		years = append(years, year)
+	}
+	return years
+}
+
+// record records the year-buckets of the events.
+func (b *yearBuckets) record(events []model.Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, event := range events {
+		version, isKnown := b.versions[event.YearBucket]
+		if !isKnown || event.Version < version {
+			b.versions[event.YearBucket] = event.Version
+		}
+	}
+}
+
+// Close closes the esquery Producer and Consumer.
+func (q *esQuery) Close() {
+	err := q.consumer.Close()
+	if err != nil {
+		err = errors.Wrap(err, "Error closing esquery-response Consumer")
+		log.Println(err)
+	}
+	err = q.producer.Close()
+	if err != nil {
+		err = errors.Wrap(err, "Error closing esquery-request Producer")
+		log.Println(err)
+	}
+}
+
+// sortEvents sorts events by their version.
+func sortEvents(events []model.Event) {
+	for i := 1; i < len(events); i++ {
+		for j := i; j > 0 && events[j].Version < events[j-1].Version; j-- {
+			events[j], events[j-1] = events[j-1], events[j]
+		}
+	}
+}
+
+// esQueryHandler routes esquery-responses to their waiting requests.
+type esQueryHandler struct {
+	query *esQuery
+}
+
+func (*esQueryHandler) Setup(sarama.ConsumerGroupSession) error {
+	log.Println("Initializing esquery-response Consumer")
+	return nil
+}
+
+func (*esQueryHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	log.Println("Closing esquery-response Consumer")
+	return nil
+}
+
+func (h *esQueryHandler) ConsumeClaim(
+	session sarama.ConsumerGroupSession,
+	claim sarama.ConsumerGroupClaim,
+) error {
+	for msg := range claim.Messages() {
+		session.MarkMessage(msg, "")
+
+		kr := &model.KafkaResponse{}
+		err := json.Unmarshal(msg.Value, kr)
+		if err != nil {
+			err = errors.Wrap(err, "Error unmarshalling esquery-response")
+			log.Println(err)
+			continue
+		}
+
+		h.query.respond(kr)
+	}
+	return nil
+}
+
+// respond passes the esquery-response to the request waiting for it, if any.
+// Requests are matched by CorrelationID, or by UUID if it was not set.
+func (q *esQuery) respond(kr *model.KafkaResponse) {
+	q.waitersLock.Lock()
+	respChan, isWaiting := q.waiters[kr.CorrelationID]
+	if !isWaiting {
+		respChan, isWaiting = q.waiters[kr.UUID]
+	}
+	q.waitersLock.Unlock()
+	if isWaiting {
+		respChan <- kr
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"time"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("esQuery", func() {
+	It("should sort events by version", func() {
+		events := []model.Event{
+			model.Event{Version: 3},
+			model.Event{Version: 1},
+			model.Event{Version: 2},
+		}
+		sortEvents(events)
+		Expect(events).To(Equal([]model.Event{
+			model.Event{Version: 1},
+			model.Event{Version: 2},
+			model.Event{Version: 3},
+		}))
+	})
+
+	It("should query the year-buckets that can have newer events", func() {
+		now := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+		years := newYearBuckets(2018)
+		Expect(years.since(0, now)).To(Equal([]int16{2018, 2019, 2020, 2021}))
+
+		years.record([]model.Event{
+			model.Event{Version: 1, YearBucket: 2018},
+			model.Event{Version: 2, YearBucket: 2020},
+			model.Event{Version: 3, YearBucket: 2021},
+		})
+		Expect(years.since(0, now)).To(Equal([]int16{2018, 2019, 2020, 2021}))
+		Expect(years.since(2, now)).To(Equal([]int16{2019, 2020, 2021}))
+		Expect(years.since(5, now)).To(Equal([]int16{2020, 2021}))
+	})
+
+	It("should pass responses to the requests waiting for them", func() {
+		requestUUID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		otherUUID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+
+		respChan := make(chan *model.KafkaResponse, 1)
+		q := &esQuery{
+			waiters: map[uuuid.UUID]chan *model.KafkaResponse{
+				requestUUID: respChan,
+			},
+		}
+
+		// Responses for other requests are dropped
+		q.respond(&model.KafkaResponse{CorrelationID: otherUUID, UUID: otherUUID})
+		Expect(respChan).ToNot(Receive())
+
+		kr := &model.KafkaResponse{CorrelationID: requestUUID}
+		q.respond(kr)
+		Expect(respChan).To(Receive(Equal(kr)))
+
+		kr = &model.KafkaResponse{UUID: requestUUID}
+		q.respond(kr)
+		Expect(respChan).To(Receive(Equal(kr)))
+	})
+})
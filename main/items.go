@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// Item-lookup types for ItemsConfig.Lookup.
+const (
+	mongoItemLookup   = "mongo"
+	esQueryItemLookup = "esquery"
+)
+
+// esQueryItems looks up Items by folding Inventory events fetched from the
+// EventStore. Only events newer than the last fetched event are requested on
+// each lookup, so the known Items are kept current incrementally.
+type esQueryItems struct {
+	query device.EventFetcher
+
+	lock sync.Mutex
+	// items are the fields of the known Items by their itemID, so the
+	// Items deleted by any filter can be found
+	items       map[string]map[string]interface{}
+	lastVersion int64
+}
+
+// inventoryUpdate is the data of Inventory update-events.
+type inventoryUpdate struct {
+	Filter map[string]interface{} `json:"filter"`
+	Update map[string]interface{} `json:"update"`
+}
+
+// ItemExists checks if the Item exists, as per the Inventory events so far.
+func (l *esQueryItems) ItemExists(itemID uuuid.UUID) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	events, err := l.query.Events(l.lastVersion)
+	if err != nil {
+		err = errors.Wrap(err, "Error fetching Inventory events")
+		return false, err
+	}
+	for _, event := range events {
+		if event.Version > l.lastVersion {
+			l.lastVersion = event.Version
+		}
+
+		switch event.EventAction {
+		case "insert":
+			fields := map[string]interface{}{}
+			err = json.Unmarshal(event.Data, &fields)
+			if itemID, isString := fields["itemID"].(string); err == nil && isString {
+				l.items[itemID] = fields
+			}
+		case "update":
+			update := &inventoryUpdate{}
+			err = json.Unmarshal(event.Data, update)
+			if err != nil || len(update.Filter) == 0 {
+				continue
+			}
+			for _, fields := range l.matching(update.Filter) {
+				for k, v := range update.Update {
+					// The itemID is the key of the Item
+					if k != "itemID" {
+						fields[k] = v
+					}
+				}
+			}
+		case "delete":
+			filter := map[string]interface{}{}
+			err = json.Unmarshal(event.Data, &filter)
+			if err != nil || len(filter) == 0 {
+				continue
+			}
+			for itemID := range l.matching(filter) {
+				delete(l.items, itemID)
+			}
+		}
+	}
+	_, exists := l.items[itemID.String()]
+	return exists, nil
+}
+
+// matching returns the fields of the known Items matching filter, by itemID.
+func (l *esQueryItems) matching(
+	filter map[string]interface{},
+) map[string]map[string]interface{} {
+	matched := map[string]map[string]interface{}{}
+	for itemID, fields := range l.items {
+		matches, err := device.MatchFilter(fields, filter)
+		if err != nil {
+			err = errors.Wrap(err, "Error matching Inventory event-filter")
+			log.Println(err)
+			return matched
+		}
+		if matches {
+			matched[itemID] = fields
+		}
+	}
+	return matched
+}
+
+// newItemLookup creates the device.ItemLookup as per ItemsConfig.
+func newItemLookup(
+	cfg *Config, conn *mongo.ConnectionConfig,
+) (device.ItemLookup, error) {
+	if cfg.Items.Lookup == esQueryItemLookup {
+		query, err := newESQuery(
+			&cfg.Kafka,
+			cfg.Items.ConsumerGroup,
+			cfg.Items.AggregateID,
+			time.Duration(cfg.Items.TimeoutMS)*time.Millisecond,
+		)
+		if err != nil {
+			err = errors.Wrap(err, "Error creating Inventory EventStore-query")
+			return nil, err
+		}
+		log.Println("Looking up Items from Inventory events")
+		return &esQueryItems{
+			query: query,
+			items: map[string]map[string]interface{}{},
+		}, nil
+	}
+
+	c := &mongo.Collection{
+		Connection:   conn,
+		Database:     cfg.Mongo.Database,
+		Name:         cfg.Items.MongoCollection,
+		SchemaStruct: &device.InventoryItem{},
+	}
+	collection, err := mongo.EnsureCollection(c)
+	if err != nil {
+		err = errors.Wrap(err, "Error creating Inventory MongoCollection")
+		return nil, err
+	}
+	log.Printf("Looking up Items from collection %s", cfg.Items.MongoCollection)
+	return device.NewMongoItemLookup(collection)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+)
+
+// eventLog is a device.EventFetcher of the events appended to it,
+// recording the versions events were fetched from.
+type eventLog struct {
+	events       []model.Event
+	fromVersions []int64
+	err          error
+}
+
+func (l *eventLog) Events(fromVersion int64) ([]model.Event, error) {
+	l.fromVersions = append(l.fromVersions, fromVersion)
+	events := []model.Event{}
+	for _, event := range l.events {
+		if event.Version > fromVersion {
+			events = append(events, event)
+		}
+	}
+	return events, l.err
+}
+
+func (l *eventLog) append(eventAction string, data interface{}) {
+	marshalled, err := json.Marshal(data)
+	Expect(err).ToNot(HaveOccurred())
+	l.events = append(l.events, model.Event{
+		EventAction: eventAction,
+		Data:        marshalled,
+		Version:     int64(len(l.events) + 1),
+	})
+}
+
+var _ = Describe("esQueryItems", func() {
+	var (
+		inventory *eventLog
+		items     *esQueryItems
+	)
+
+	newItemID := func() uuuid.UUID {
+		itemID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		return itemID
+	}
+
+	BeforeEach(func() {
+		inventory = &eventLog{}
+		items = &esQueryItems{
+			query: inventory,
+			items: map[string]map[string]interface{}{},
+		}
+	})
+
+	It("should fold inserted and deleted Items incrementally", func() {
+		itemID := newItemID()
+		otherItemID := newItemID()
+		inventory.append("insert", map[string]interface{}{"itemID": itemID})
+		inventory.append("insert", map[string]interface{}{"itemID": otherItemID})
+		inventory.append("update", map[string]interface{}{"itemID": newItemID()})
+
+		exists, err := items.ItemExists(itemID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(exists).To(BeTrue())
+
+		inventory.append("delete", map[string]interface{}{"itemID": itemID})
+		exists, err = items.ItemExists(itemID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(exists).To(BeFalse())
+
+		exists, err = items.ItemExists(otherItemID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(exists).To(BeTrue())
+		Expect(inventory.fromVersions).To(Equal([]int64{0, 3, 4}))
+	})
+
+	It("should delete the Items matching delete-filters", func() {
+		itemIDs := []uuuid.UUID{newItemID(), newItemID(), newItemID()}
+		for i, sku := range []string{"sku-a", "sku-b", "sku-b"} {
+			inventory.append("insert", map[string]interface{}{
+				"itemID": itemIDs[i],
+				"sku":    sku,
+			})
+		}
+		inventory.append("update", map[string]interface{}{
+			"filter": map[string]interface{}{"itemID": itemIDs[2].String()},
+			"update": map[string]interface{}{"sku": "sku-c"},
+		})
+		inventory.append("delete", map[string]interface{}{"sku": "sku-b"})
+
+		for i, expected := range []bool{true, false, true} {
+			exists, err := items.ItemExists(itemIDs[i])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(Equal(expected))
+		}
+
+		inventory.append("delete", map[string]interface{}{
+			"sku": map[string]interface{}{"$in": []string{"sku-a", "sku-c"}},
+		})
+		for _, itemID := range itemIDs {
+			exists, err := items.ItemExists(itemID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(exists).To(BeFalse())
+		}
+	})
+
+	It("should skip events without an itemID", func() {
+		inventory.append("insert", map[string]interface{}{"name": "item"})
+		inventory.events = append(inventory.events, model.Event{
+			EventAction: "insert",
+			Data:        []byte("not-json"),
+			Version:     2,
+		})
+
+		exists, err := items.ItemExists(newItemID())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(exists).To(BeFalse())
+		Expect(items.lastVersion).To(Equal(int64(2)))
+	})
+
+	It("should return errors fetching events", func() {
+		inventory.err = errors.New("timed out")
+		_, err := items.ItemExists(newItemID())
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -1,43 +1,18 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/TerrexTech/agg-device-cmd/device"
-	"github.com/TerrexTech/go-commonutils/commonutil"
 	"github.com/TerrexTech/go-eventspoll/poll"
+	"github.com/TerrexTech/go-mongoutils/mongo"
 	"github.com/joho/godotenv"
 	"github.com/pkg/errors"
 )
 
-func validateEnv() error {
-	missingVar, err := commonutil.ValidateEnv(
-		"KAFKA_BROKERS",
-
-		"KAFKA_CONSUMER_EVENT_GROUP",
-		"KAFKA_CONSUMER_EVENT_QUERY_GROUP",
-
-		"KAFKA_CONSUMER_EVENT_TOPIC",
-		"KAFKA_CONSUMER_EVENT_QUERY_TOPIC",
-		"KAFKA_PRODUCER_EVENT_QUERY_TOPIC",
-		"KAFKA_PRODUCER_RESPONSE_TOPIC",
-
-		"MONGO_HOSTS",
-		"MONGO_DATABASE",
-		"MONGO_AGG_COLLECTION",
-		"MONGO_META_COLLECTION",
-
-		"MONGO_CONNECTION_TIMEOUT_MS",
-		"MONGO_RESOURCE_TIMEOUT_MS",
-	)
-
-	if err != nil {
-		err = errors.Wrapf(err, "Env-var %s is required for testing, but is not set", missingVar)
-		return err
-	}
-	return nil
-}
-
 func main() {
 	log.Println("Reading environment file")
 	err := godotenv.Load("./.env")
@@ -48,84 +23,154 @@ func main() {
 		log.Println(err)
 	}
 
-	err = validateEnv()
+	name, args, err := parseCommand(os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fs := flag.NewFlagSet(strings.TrimSpace(os.Args[0]+" "+name), flag.ExitOnError)
+	run := commands[name].setup(fs)
+
+	cfg, cfgErr := loadConfig(fs, args)
+	if cfgErr != nil {
+		cfgErr = errors.Wrap(cfgErr, "Error loading Config")
+		if cfg == nil || !commands[name].anyConfig {
+			log.Fatalln(cfgErr)
+		}
+	}
+	err = run(cfg)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if cfgErr != nil {
+		log.Fatalln(cfgErr)
+	}
+}
 
-	kc, err := loadKafkaConfig()
+// runService consumes Device events and produces their results.
+func runService(cfg *Config) error {
+	kc, err := loadKafkaConfig(&cfg.Kafka)
 	if err != nil {
 		err = errors.Wrap(err, "Error in KafkaConfig")
-		log.Fatalln(err)
+		return err
 	}
-	mc, err := loadMongoConfig()
+	db, err := openBolt(&cfg.Storage)
 	if err != nil {
-		err = errors.Wrap(err, "Error in MongoConfig")
-		log.Fatalln(err)
+		return err
 	}
-	ioConfig := poll.IOConfig{
-		ReadConfig: poll.ReadConfig{
-			EnableInsert: true,
-			EnableUpdate: true,
-			EnableDelete: true,
-		},
-		KafkaConfig: *kc,
-		MongoConfig: *mc,
+	defer closeBolt(db)
+
+	// The "bolt" storage backend only connects to MongoDB
+	// if Items or user-roles are looked up there
+	var mc *poll.MongoConfig
+	var conn *mongo.ConnectionConfig
+	var aggCollection *mongo.Collection
+	if db == nil {
+		mc, err = loadMongoConfig(&cfg.Mongo)
+		if err != nil {
+			err = errors.Wrap(err, "Error in MongoConfig")
+			return err
+		}
+		conn = mc.Connection
+		aggCollection = mc.AggCollection
+	} else if cfg.requiresMongo() {
+		conn, err = newMongoConnection(&cfg.Mongo)
+		if err != nil {
+			return err
+		}
 	}
 
-	eventPoll, err := poll.Init(ioConfig)
+	if cfg.Mongo.MigrateOnStart {
+		err = migrateOnStart(cfg, aggCollection, db)
+		if err != nil {
+			return err
+		}
+	}
+	store, processed, err := newStorage(cfg, conn, aggCollection, db)
+	if err != nil {
+		return err
+	}
+	versions, err := newVersionStore(cfg, aggCollection, db)
+	if err != nil {
+		return err
+	}
+	snapshots, err := newSnapshotStore(cfg, conn, db)
+	if err != nil {
+		return err
+	}
+	registry, err := newRegistry(cfg, conn, processed, versions, snapshots)
+	if err != nil {
+		err = errors.Wrap(err, "Error creating command Registry")
+		return err
+	}
+	if cfg.MetricsAddr != "" {
+		go serveMetrics(cfg.MetricsAddr)
+	}
+	if cfg.Admin.Addr != "" {
+		go serveAdmin(cfg, store)
+	}
+	if cfg.CommandAPI.Addr != "" {
+		go serveCommandAPI(cfg, registry, store)
+	}
+	if cfg.Validation.Enabled {
+		go runValidation(cfg, registry, store)
+	}
+
+	readConfig := poll.ReadConfig{
+		EnableInsert: registry.Handles("insert"),
+		EnableUpdate: registry.Handles("update"),
+		EnableDelete: registry.Handles("delete"),
+	}
+	var eventPoll poll.EventPoll
+	if db != nil {
+		eventPoll, err = newBoltEventPoll(cfg, kc, readConfig, db)
+	} else {
+		eventPoll, err = poll.Init(poll.IOConfig{
+			ReadConfig:  readConfig,
+			KafkaConfig: *kc,
+			MongoConfig: *mc,
+		})
+	}
 	if err != nil {
 		err = errors.Wrap(err, "Error creating EventPoll service")
-		log.Fatalln(err)
+		return err
 	}
 
 	for {
+		var eventResp *poll.EventResponse
 		select {
 		case <-eventPoll.RoutinesCtx().Done():
 			err = errors.New("service-context closed")
-			log.Fatalln(err)
-
-		case eventResp := <-eventPoll.Delete():
-			go func(eventResp *poll.EventResponse) {
-				err := eventResp.Error
-				if err != nil {
-					err = errors.Wrap(err, "Error in Delete-EventResponse")
-					log.Println(err)
-					return
-				}
-				kafkaResp := device.Delete(mc.AggCollection, &eventResp.Event)
-				if kafkaResp != nil {
-					eventPoll.ProduceResult() <- kafkaResp
-				}
-			}(eventResp)
-
-		case eventResp := <-eventPoll.Insert():
-			go func(eventResp *poll.EventResponse) {
-				err := eventResp.Error
-				if err != nil {
-					err = errors.Wrap(eventResp.Error, "Error in Insert-EventResponse")
-					log.Println(err)
-					return
-				}
-				kafkaResp := device.Insert(mc.AggCollection, &eventResp.Event)
-				if kafkaResp != nil {
-					eventPoll.ProduceResult() <- kafkaResp
-				}
-			}(eventResp)
+			return err
+		case eventResp = <-eventPoll.Delete():
+		case eventResp = <-eventPoll.Insert():
+		case eventResp = <-eventPoll.Update():
+		}
 
-		case eventResp := <-eventPoll.Update():
-			go func(eventResp *poll.EventResponse) {
-				err := eventResp.Error
-				if err != nil {
-					err = errors.Wrap(err, "Error in Update-EventResponse")
-					log.Println(err)
-					return
-				}
-				kafkaResp := device.Update(mc.AggCollection, &eventResp.Event)
-				if kafkaResp != nil {
-					eventPoll.ProduceResult() <- kafkaResp
-				}
-			}(eventResp)
+		// With sequencing, events are handled in the order they are polled,
+		// since concurrently handled events would be mistaken for gaps
+		if versions != nil {
+			handleEvent(registry, store, eventPoll, eventResp)
+		} else {
+			go handleEvent(registry, store, eventPoll, eventResp)
 		}
 	}
 }
+
+// handleEvent handles the polled event, and produces its response.
+func handleEvent(
+	registry *device.Registry,
+	store device.Storage,
+	eventPoll poll.EventPoll,
+	eventResp *poll.EventResponse,
+) {
+	err := eventResp.Error
+	if err != nil {
+		err = errors.Wrap(err, "Error in EventResponse")
+		log.Println(err)
+		return
+	}
+	kafkaResp := registry.Handle(store, &eventResp.Event)
+	if kafkaResp != nil {
+		eventPoll.ProduceResult() <- kafkaResp
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// newMigrator creates the Migrator for Devices in db for the "bolt" storage
+// backend, or in aggCollection otherwise.
+func newMigrator(
+	cfg *Config, aggCollection *mongo.Collection, db *bolt.DB,
+) (*device.Migrator, error) {
+	var store device.MigrationStore
+	var err error
+	if db != nil {
+		store, err = device.NewBoltMigrationStore(db)
+	} else {
+		store, err = device.NewMongoMigrationStore(aggCollection, cfg.Mongo.MetaCollection)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "Error creating MigrationStore")
+		return nil, err
+	}
+	return device.NewMigrator(store, device.Migrations)
+}
+
+// migrateOnStart migrates Devices to the latest schema-version
+// before the service handles any event.
+func migrateOnStart(cfg *Config, aggCollection *mongo.Collection, db *bolt.DB) error {
+	migrator, err := newMigrator(cfg, aggCollection, db)
+	if err != nil {
+		return err
+	}
+	report, err := migrator.Migrate(migrator.Latest(), false)
+	if err != nil {
+		err = errors.Wrap(err, "Error migrating Devices")
+		return err
+	}
+	for _, step := range report.Steps {
+		log.Printf(
+			"Migrated %d Devices %s to schema-version %d: %s",
+			step.Documents, step.Direction, step.Version, step.Description,
+		)
+	}
+	return nil
+}
+
+// setupMigrate migrates Devices up or down to a schema-version,
+// and prints a report of the migrations run.
+func setupMigrate(fs *flag.FlagSet) func(*Config) error {
+	to := fs.Int64(
+		"to", device.SchemaVersion, "Schema-version to migrate to, 0 to undo all",
+	)
+	dryRun := fs.Bool(
+		"dry-run", false, "Only report the documents each migration would change",
+	)
+
+	return func(cfg *Config) error {
+		db, err := openBolt(&cfg.Storage)
+		if err != nil {
+			return err
+		}
+		defer closeBolt(db)
+
+		var aggCollection *mongo.Collection
+		if db == nil {
+			conn, err := newMongoConnection(&cfg.Mongo)
+			if err != nil {
+				return err
+			}
+			aggCollection, err = createMongoCollection(
+				conn, cfg.Mongo.Database, cfg.Mongo.AggCollection,
+				aggIndexConfigs(&cfg.Mongo),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		migrator, err := newMigrator(cfg, aggCollection, db)
+		if err != nil {
+			return err
+		}
+
+		report, migrateErr := migrator.Migrate(*to, *dryRun)
+		if report != nil {
+			out, err := yaml.Marshal(report)
+			if err != nil {
+				err = errors.Wrap(err, "Error marshalling migration-report")
+				return err
+			}
+			_, err = os.Stdout.Write(out)
+			if err != nil {
+				return err
+			}
+		}
+		return migrateErr
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-commonutils/commonutil"
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/mongodb/mongo-go-driver/bson"
+	mgocmd "github.com/mongodb/mongo-go-driver/core/command"
+	mgo "github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/pkg/errors"
+)
+
+// namespaceNotFound is the MongoDB error-code returned when listing
+// indexes of a collection that does not exist yet.
+const namespaceNotFound = 26
+
+// deviceIDIndex is always created, since it guarantees DeviceID uniqueness.
+// This is replaced by tenantDeviceIDIndex if tenancy is enabled.
+var deviceIDIndex = mongo.IndexConfig{
+	ColumnConfig: []mongo.IndexColumnConfig{
+		mongo.IndexColumnConfig{
+			Name: "deviceID",
+		},
+	},
+	IsUnique: true,
+	Name:     "deviceID_index",
+}
+
+// IndexConfig declares an index on the Aggregate collection.
+// Keys prefixed with "-" are indexed in descending order.
+type IndexConfig struct {
+	Name   string   `yaml:"name"`
+	Keys   []string `yaml:"keys"`
+	Unique bool     `yaml:"unique"`
+}
+
+// UniqueConfig declares a uniqueness constraint on Devices, which is checked
+// by insert and update commands, and backed by a unique-index of same name.
+type UniqueConfig struct {
+	Name   string   `yaml:"name"`
+	Fields []string `yaml:"fields"`
+	// Scope limits the constraint to Devices having these field-values.
+	Scope           map[string]interface{} `yaml:"scope,omitempty"`
+	CaseInsensitive bool                   `yaml:"caseInsensitive"`
+}
+
+// indexReport describes how the indexes in MongoDB compare with configured indexes.
+type indexReport struct {
+	// Missing are configured indexes that did not exist in MongoDB.
+	Missing []string `yaml:"missing"`
+	// Changed are indexes whose MongoDB definition differed from configuration.
+	Changed []string `yaml:"changed"`
+	// Unknown are indexes that exist in MongoDB but not in configuration.
+	Unknown []string `yaml:"unknown"`
+	// Dropped are the indexes dropped while reconciling.
+	Dropped []string `yaml:"dropped"`
+}
+
+// aggIndexConfigs returns the indexes to be created on the Aggregate collection.
+func aggIndexConfigs(cfg *MongoConfig) []mongo.IndexConfig {
+	indexConfigs := []mongo.IndexConfig{deviceIDIndex}
+	if cfg.tenantScoped {
+		indexConfigs[0] = tenantDeviceIDIndex
+	}
+	for _, ic := range cfg.Indexes {
+		columns := []mongo.IndexColumnConfig{}
+		for _, key := range ic.Keys {
+			columns = append(columns, mongo.IndexColumnConfig{
+				Name:         strings.TrimPrefix(key, "-"),
+				IsDescending: strings.HasPrefix(key, "-"),
+			})
+		}
+		indexConfigs = append(indexConfigs, mongo.IndexConfig{
+			ColumnConfig: columns,
+			IsUnique:     ic.Unique,
+			Name:         ic.Name,
+		})
+	}
+	return indexConfigs
+}
+
+// validateIndexes checks the configured indexes for problems.
+func validateIndexes(indexes []IndexConfig) []string {
+	errs := []string{}
+	names := map[string]bool{
+		"_id_":             true,
+		deviceIDIndex.Name: true,
+	}
+	for i, ic := range indexes {
+		if ic.Name == "" {
+			errs = append(errs, fmt.Sprintf("mongo.indexes[%d].name is required", i))
+		} else if names[ic.Name] {
+			errs = append(errs, fmt.Sprintf(
+				"mongo.indexes[%d].name %q is reserved or duplicated", i, ic.Name,
+			))
+		}
+		names[ic.Name] = true
+
+		if len(ic.Keys) == 0 {
+			errs = append(errs, fmt.Sprintf("mongo.indexes[%d].keys is required", i))
+		}
+		for _, key := range ic.Keys {
+			if strings.TrimPrefix(key, "-") == "" {
+				errs = append(errs, fmt.Sprintf("mongo.indexes[%d] has a blank key", i))
+			}
+		}
+	}
+	return errs
+}
+
+// diffIndexes compares the indexes existing in MongoDB with indexConfigs.
+func diffIndexes(
+	conn *mongo.ConnectionConfig,
+	db string,
+	coll string,
+	indexConfigs []mongo.IndexConfig,
+	uniques []UniqueConfig,
+) (*indexReport, error) {
+	existing, err := listIndexes(conn, db, coll)
+	if err != nil {
+		err = errors.Wrap(err, "Error listing indexes")
+		return nil, err
+	}
+
+	specs := map[string]string{}
+	names := []string{}
+	for _, ic := range indexConfigs {
+		specs[ic.Name] = indexSpec(ic)
+		names = append(names, ic.Name)
+	}
+	for _, uc := range uniques {
+		specs[uc.Name] = uniqueIndexSpec(uc)
+		names = append(names, uc.Name)
+	}
+
+	report := &indexReport{}
+	configured := map[string]bool{"_id_": true}
+	for _, name := range names {
+		configured[name] = true
+
+		existingIndex, exists := existing[name]
+		if !exists {
+			report.Missing = append(report.Missing, name)
+			continue
+		}
+		if existingIndex != specs[name] {
+			report.Changed = append(report.Changed, name)
+		}
+	}
+	for name := range existing {
+		if !configured[name] {
+			report.Unknown = append(report.Unknown, name)
+		}
+	}
+	sort.Strings(report.Unknown)
+	return report, nil
+}
+
+// reconcileIndexes compares the indexes existing in MongoDB with indexConfigs.
+// Changed indexes are dropped so they can be recreated with their configured
+// definition, and unknown indexes are only dropped if dropUnknown is true.
+// Missing indexes are not created here, that is done by mongo.EnsureCollection,
+// and by createUniqueIndexes for indexes backing unique constraints.
+func reconcileIndexes(
+	conn *mongo.ConnectionConfig,
+	db string,
+	coll string,
+	indexConfigs []mongo.IndexConfig,
+	uniques []UniqueConfig,
+	dropUnknown bool,
+) (*indexReport, error) {
+	report, err := diffIndexes(conn, db, coll, indexConfigs, uniques)
+	if err != nil {
+		return nil, err
+	}
+
+	toDrop := append([]string{}, report.Changed...)
+	if dropUnknown {
+		toDrop = append(toDrop, report.Unknown...)
+	}
+
+	indexView := conn.Client.DriverClient().Database(db).Collection(coll).Indexes()
+	for _, name := range toDrop {
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			time.Duration(conn.Timeout)*time.Millisecond,
+		)
+		_, err = indexView.DropOne(ctx, name)
+		cancel()
+		if err != nil {
+			err = errors.Wrapf(err, "Error dropping index %s", name)
+			return report, err
+		}
+		report.Dropped = append(report.Dropped, name)
+	}
+	return report, nil
+}
+
+// listIndexes returns the specs of indexes in MongoDB, keyed by index-name.
+// Specs are formatted as by indexSpec.
+func listIndexes(
+	conn *mongo.ConnectionConfig, db string, coll string,
+) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		time.Duration(conn.Timeout)*time.Millisecond,
+	)
+	defer cancel()
+
+	indexView := conn.Client.DriverClient().Database(db).Collection(coll).Indexes()
+	cur, err := indexView.List(ctx)
+	if err != nil {
+		cmdErr, isCmdErr := err.(mgocmd.Error)
+		if isCmdErr && cmdErr.Code == namespaceNotFound {
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	indexes := map[string]string{}
+	for cur.Next(ctx) {
+		index := &struct {
+			Name      string         `bson:"name"`
+			Key       *bson.Document `bson:"key"`
+			Unique    bool           `bson:"unique"`
+			Partial   *bson.Document `bson:"partialFilterExpression"`
+			Collation *bson.Document `bson:"collation"`
+		}{}
+		err = cur.Decode(index)
+		if err != nil {
+			err = errors.Wrap(err, "Error decoding index")
+			return nil, err
+		}
+
+		keys := []string{}
+		iter := index.Key.Iterator()
+		for iter.Next() {
+			elem := iter.Element()
+			keyType := fmt.Sprint(elem.Value().Interface())
+			// Key-type is either a sort-order, or a special type such as "text"
+			order, err := commonutil.AssertInt64(elem.Value().Interface())
+			if err == nil {
+				keyType = "1"
+				if order < 0 {
+					keyType = "-1"
+				}
+			}
+			keys = append(keys, elem.Key()+":"+keyType)
+		}
+		spec := fmt.Sprintf("%s unique=%t", strings.Join(keys, ","), index.Unique)
+		if index.Partial != nil {
+			spec += " partial=" + scopeSpec(documentMap(index.Partial))
+		}
+		if index.Collation != nil {
+			strength, err := index.Collation.LookupErr("strength")
+			if err == nil && fmt.Sprint(strength.Interface()) == "2" {
+				spec += " caseInsensitive"
+			}
+		}
+		indexes[index.Name] = spec
+	}
+	return indexes, cur.Err()
+}
+
+// indexSpec formats an index definition so it can be compared with others.
+func indexSpec(ic mongo.IndexConfig) string {
+	keys := []string{}
+	for _, col := range ic.ColumnConfig {
+		order := "1"
+		if col.IsDescending {
+			order = "-1"
+		}
+		keys = append(keys, col.Name+":"+order)
+	}
+	return fmt.Sprintf("%s unique=%t", strings.Join(keys, ","), ic.IsUnique)
+}
+
+// uniqueIndexSpec formats the unique-index definition of a UniqueConfig,
+// like indexSpec.
+func uniqueIndexSpec(uc UniqueConfig) string {
+	keys := []string{}
+	for _, field := range uc.Fields {
+		keys = append(keys, field+":1")
+	}
+	spec := fmt.Sprintf("%s unique=true", strings.Join(keys, ","))
+	if partial := uniquePartialFilter(uc); len(partial) > 0 {
+		spec += " partial=" + scopeSpec(partial)
+	}
+	if uc.CaseInsensitive {
+		spec += " caseInsensitive"
+	}
+	return spec
+}
+
+// uniquePartialFilter returns the partial-filter of the unique-index backing
+// the UniqueConfig, which excludes Devices the constraint does not apply to.
+func uniquePartialFilter(uc UniqueConfig) map[string]interface{} {
+	return uniqueConstraints([]UniqueConfig{uc})[0].PartialFilter()
+}
+
+// documentMap converts a BSON-document, and its sub-documents, to a map.
+func documentMap(doc *bson.Document) map[string]interface{} {
+	m := map[string]interface{}{}
+	iter := doc.Iterator()
+	for iter.Next() {
+		value := iter.Element().Value()
+		if subDoc, isDoc := value.MutableDocumentOK(); isDoc {
+			m[iter.Element().Key()] = documentMap(subDoc)
+			continue
+		}
+		m[iter.Element().Key()] = value.Interface()
+	}
+	return m
+}
+
+// filterDocument converts a filter, and its nested filters, to a BSON-document.
+func filterDocument(filter map[string]interface{}) *bson.Document {
+	doc := bson.NewDocument()
+	for k, v := range filter {
+		if nested, isMap := v.(map[string]interface{}); isMap {
+			doc.Append(bson.EC.SubDocument(k, filterDocument(nested)))
+			continue
+		}
+		doc.Append(bson.EC.Interface(k, v))
+	}
+	return doc
+}
+
+// scopeSpec formats a partial-filter so it can be compared with others.
+func scopeSpec(scope map[string]interface{}) string {
+	fields := []string{}
+	for k, v := range scope {
+		fields = append(fields, fmt.Sprintf("%s:%v", k, v))
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, ",")
+}
+
+// uniqueConstraints converts UniqueConfigs to Device UniqueConstraints.
+func uniqueConstraints(uniques []UniqueConfig) []device.UniqueConstraint {
+	constraints := []device.UniqueConstraint{}
+	for _, uc := range uniques {
+		constraints = append(constraints, device.UniqueConstraint{
+			Name:            uc.Name,
+			Fields:          uc.Fields,
+			Scope:           uc.Scope,
+			CaseInsensitive: uc.CaseInsensitive,
+		})
+	}
+	return constraints
+}
+
+// validateUniques checks the configured unique constraints for problems.
+// Constraint-names are also index-names, so they must not clash with indexes.
+func validateUniques(uniques []UniqueConfig, indexes []IndexConfig) []string {
+	errs := []string{}
+	names := map[string]bool{
+		"_id_":             true,
+		deviceIDIndex.Name: true,
+	}
+	for _, ic := range indexes {
+		names[ic.Name] = true
+	}
+	for i, uc := range uniques {
+		if uc.Name == "" {
+			errs = append(errs, fmt.Sprintf("mongo.unique[%d].name is required", i))
+		} else if names[uc.Name] {
+			errs = append(errs, fmt.Sprintf(
+				"mongo.unique[%d].name %q is reserved or used by another index", i, uc.Name,
+			))
+		}
+		names[uc.Name] = true
+
+		if len(uc.Fields) == 0 {
+			errs = append(errs, fmt.Sprintf("mongo.unique[%d].fields is required", i))
+		}
+		for _, field := range uc.Fields {
+			if field == "" {
+				errs = append(errs, fmt.Sprintf("mongo.unique[%d] has a blank field", i))
+			}
+		}
+		for field, value := range uc.Scope {
+			switch value.(type) {
+			case string, bool, int, int64, float64:
+			default:
+				errs = append(errs, fmt.Sprintf(
+					"mongo.unique[%d].scope.%s must be a string, number or boolean",
+					i, field,
+				))
+			}
+		}
+	}
+	return errs
+}
+
+// createUniqueIndexes creates the unique-indexes backing unique constraints.
+// Indexes that already exist with the same definition are left unchanged.
+func createUniqueIndexes(
+	conn *mongo.ConnectionConfig, db string, coll string, uniques []UniqueConfig,
+) error {
+	if len(uniques) == 0 {
+		return nil
+	}
+
+	models := []mgo.IndexModel{}
+	for _, uc := range uniques {
+		keys := bson.NewDocument()
+		for _, field := range uc.Fields {
+			keys.Append(bson.EC.Int32(field, 1))
+		}
+		opts := mgo.NewIndexOptionsBuilder().Name(uc.Name).Unique(true)
+		if partial := uniquePartialFilter(uc); len(partial) > 0 {
+			opts = opts.PartialFilterExpression(filterDocument(partial))
+		}
+		if uc.CaseInsensitive {
+			opts = opts.Collation(bson.NewDocument(
+				bson.EC.String("locale", device.CaseInsensitiveCollation.Locale),
+				bson.EC.Int32("strength", int32(device.CaseInsensitiveCollation.Strength)),
+			))
+		}
+		models = append(models, mgo.IndexModel{
+			Keys:    keys,
+			Options: opts.Build(),
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		time.Duration(conn.Timeout)*time.Millisecond,
+	)
+	defer cancel()
+	indexView := conn.Client.DriverClient().Database(db).Collection(coll).Indexes()
+	_, err := indexView.CreateMany(ctx, models)
+	if err != nil {
+		err = errors.Wrap(
+			err, "Error creating unique-indexes, existing Devices might violate them",
+		)
+		return err
+	}
+	return nil
+}
+
+// logIndexReport logs the result of reconciling indexes.
+func logIndexReport(report *indexReport) {
+	if len(report.Missing) > 0 {
+		log.Printf("Creating missing indexes: %v", report.Missing)
+	}
+	if len(report.Changed) > 0 {
+		log.Printf("Recreating changed indexes: %v", report.Changed)
+	}
+	if len(report.Unknown) > 0 {
+		log.Printf(
+			"Found indexes in MongoDB not present in configuration: %v "+
+				"(set mongo.dropUnknownIndexes to drop them)",
+			report.Unknown,
+		)
+	}
+	if len(report.Dropped) > 0 {
+		log.Printf("Dropped indexes: %v", report.Dropped)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Unique-indexes", func() {
+	It("should exclude Devices with blank constrained fields", func() {
+		uc := UniqueConfig{
+			Name:   "lot_name_unique",
+			Fields: []string{"lot", "dateInstalled"},
+			Scope:  map[string]interface{}{"status": "active"},
+		}
+		partial := uniquePartialFilter(uc)
+		Expect(partial).To(Equal(map[string]interface{}{
+			"status": "active",
+			"lot":    map[string]interface{}{"$gt": ""},
+		}))
+
+		// Partial-filters read from MongoDB are formatted like configured ones
+		listed := documentMap(filterDocument(partial))
+		Expect(scopeSpec(listed)).To(Equal(scopeSpec(partial)))
+		Expect(uniqueIndexSpec(uc)).To(Equal(
+			"lot:1,dateInstalled:1 unique=true partial=" + scopeSpec(partial),
+		))
+	})
+})
+
+var _ = Describe("deviceID_index", func() {
+	It("should scope DeviceIDs to tenants if tenancy is enabled", func() {
+		cfg := &MongoConfig{}
+		Expect(aggIndexConfigs(cfg)[0]).To(Equal(deviceIDIndex))
+
+		applyTenancy(cfg)
+		indexConfigs := aggIndexConfigs(cfg)
+		Expect(indexConfigs[0]).To(Equal(tenantDeviceIDIndex))
+		Expect(indexSpec(indexConfigs[0])).To(Equal("tenantID:1,deviceID:1 unique=true"))
+	})
+})
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-kafkautils/kafka"
+	"github.com/pkg/errors"
+)
+
+// kafkaQuarantine produces quarantined events on a Kafka topic.
+type kafkaQuarantine struct {
+	topic    string
+	producer *kafka.Producer
+}
+
+// newQuarantine creates the Quarantine for events that caused a panic.
+// Nil is returned if no quarantine-topic is configured.
+func newQuarantine(cfg *KafkaConfig) (device.Quarantine, error) {
+	if cfg.QuarantineTopic == "" {
+		return nil, nil
+	}
+	producer, err := kafka.NewProducer(&kafka.ProducerConfig{
+		KafkaBrokers: cfg.Brokers,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error creating quarantine Producer")
+		return nil, err
+	}
+	go func() {
+		for err := range producer.Errors() {
+			err := errors.Wrap(err, "Error producing quarantined event")
+			log.Println(err)
+		}
+	}()
+	return &kafkaQuarantine{
+		topic:    cfg.QuarantineTopic,
+		producer: producer,
+	}, nil
+}
+
+// Quarantine produces the JSON-marshalled event on the quarantine-topic.
+func (q *kafkaQuarantine) Quarantine(event *device.QuarantinedEvent) error {
+	msg, err := json.Marshal(event)
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling quarantined event")
+		return err
+	}
+	q.producer.Input() <- kafka.CreateMessage(q.topic, msg)
+	log.Printf("Quarantined event %s on topic %s", event.Event.UUID, q.topic)
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/pkg/errors"
+)
+
+// commandMetrics are the Device command metrics, served with other expvars.
+var commandMetrics = expvar.NewMap("deviceCommands")
+
+// newRegistry creates the Registry with all Device commands and middleware.
+// Handled events are recorded in processed, events are sequenced using
+// versions, and Snapshots are taken in snapshots, unless these are nil.
+func newRegistry(
+	cfg *Config,
+	conn *mongo.ConnectionConfig,
+	processed device.ProcessedEvents,
+	versions device.VersionStore,
+	snapshots device.SnapshotStore,
+) (*device.Registry, error) {
+	items, err := newItemLookup(cfg, conn)
+	if err != nil {
+		err = errors.Wrap(err, "Error creating Item lookup")
+		return nil, err
+	}
+	quarantine, err := newQuarantine(&cfg.Kafka)
+	if err != nil {
+		return nil, err
+	}
+	rejections, err := newRejectionEmitter(&cfg.Kafka)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := newAuthorizer(&cfg.Auth, conn, cfg.Mongo.Database)
+	if err != nil {
+		err = errors.Wrap(err, "Error creating Authorizer")
+		return nil, err
+	}
+
+	deps := &registryDeps{
+		items:      items,
+		quarantine: quarantine,
+		rejections: rejections,
+		processed:  processed,
+	}
+	if versions != nil {
+		query, err := newESQuery(
+			&cfg.Kafka,
+			cfg.Sequencing.ConsumerGroup,
+			device.AggregateID,
+			time.Duration(cfg.Sequencing.TimeoutMS)*time.Millisecond,
+		)
+		if err != nil {
+			err = errors.Wrap(err, "Error creating Device EventStore-query")
+			return nil, err
+		}
+		deps.versions = versions
+		deps.versionEvents = query
+	}
+	if snapshots != nil {
+		query, err := newESQuery(
+			&cfg.Kafka,
+			cfg.Snapshots.ConsumerGroup,
+			device.AggregateID,
+			time.Duration(cfg.Snapshots.TimeoutMS)*time.Millisecond,
+		)
+		if err != nil {
+			err = errors.Wrap(err, "Error creating Device EventStore-query")
+			return nil, err
+		}
+		deps.snapshotting = device.Snapshotting(
+			snapshots, query, snapshotPolicy(&cfg.Snapshots),
+		)
+	}
+	if auth != nil {
+		deps.authorization = device.Authorization(auth)
+	}
+	if cfg.Tenancy.Enabled {
+		deps.tenancy = device.Tenancy(
+			device.DataTenant{Default: cfg.Tenancy.DefaultTenant},
+			newTenantRouter(cfg, conn),
+		)
+	}
+	return buildRegistry(cfg, deps)
+}
+
+// registryDeps are the dependencies of the Registry. Optional dependencies
+// and middleware are nil if disabled.
+type registryDeps struct {
+	items      device.ItemLookup
+	quarantine device.Quarantine
+	rejections device.EventEmitter
+	processed  device.ProcessedEvents
+	// versions and versionEvents sequence events
+	versions      device.VersionStore
+	versionEvents device.EventFetcher
+
+	snapshotting  device.Middleware
+	authorization device.Middleware
+	tenancy       device.Middleware
+}
+
+// buildRegistry creates the Registry with all Device commands, and
+// middleware in the order they handle events.
+func buildRegistry(cfg *Config, deps *registryDeps) (*device.Registry, error) {
+	registry := device.NewRegistry()
+	registry.Use(
+		device.Recovery(commandMetrics, deps.quarantine),
+		device.Logging(),
+		// Redelivered events reuse their response before reaching
+		// Compensation, so they are not compensated twice
+		device.Idempotency(deps.processed),
+	)
+	// Compensation wraps all middleware that can reject events
+	if deps.rejections != nil {
+		registry.Use(device.Compensation(deps.rejections))
+	}
+	registry.Use(
+		device.Metrics(commandMetrics),
+		device.Timing(commandMetrics),
+		device.Validation(),
+	)
+	if deps.versions != nil {
+		registry.Use(device.Sequencing(deps.versions, deps.versionEvents, registry.Handle))
+	}
+	for _, middleware := range []device.Middleware{
+		deps.snapshotting,
+		deps.authorization,
+		deps.tenancy,
+	} {
+		if middleware != nil {
+			registry.Use(middleware)
+		}
+	}
+	err := device.RegisterCommands(registry, device.CommandsConfig{
+		Limits: device.FilterLimits{
+			MaxAffected: int64(cfg.Limits.MaxAffected),
+		},
+		Items: deps.items,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// newProcessedEvents creates the ProcessedEvents for idempotent event-handling.
+func newProcessedEvents(
+	conn *mongo.ConnectionConfig, cfg *MongoConfig,
+) (device.ProcessedEvents, error) {
+	c := &mongo.Collection{
+		Connection:   conn,
+		Database:     cfg.Database,
+		Name:         cfg.ProcessedCollection,
+		SchemaStruct: &device.ProcessedEvent{},
+		Indexes: []mongo.IndexConfig{
+			mongo.IndexConfig{
+				ColumnConfig: []mongo.IndexColumnConfig{
+					mongo.IndexColumnConfig{Name: "eventUUID"},
+				},
+				IsUnique: true,
+				Name:     "eventUUID_index",
+			},
+		},
+	}
+	collection, err := mongo.EnsureCollection(c)
+	if err != nil {
+		err = errors.Wrap(err, "Error creating ProcessedEvent MongoCollection")
+		return nil, err
+	}
+	return device.NewMongoProcessedEvents(collection)
+}
+
+// serveMetrics serves expvar metrics, including command metrics,
+// on "/debug/vars".
+func serveMetrics(addr string) {
+	log.Printf("Serving metrics on %s/debug/vars", addr)
+	err := http.ListenAndServe(addr, nil)
+	if err != nil {
+		err = errors.Wrap(err, "Error serving metrics")
+		log.Println(err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/uuuid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// emitted is a device.EventEmitter collecting emitted events.
+type emitted struct {
+	events []*model.Event
+}
+
+func (e *emitted) Emit(event *model.Event) error {
+	e.events = append(e.events, event)
+	return nil
+}
+
+var _ = Describe("Registry", func() {
+	var (
+		dbFile     string
+		db         *bolt.DB
+		store      device.Storage
+		processed  device.ProcessedEvents
+		rejections *emitted
+		registry   *device.Registry
+		authErr    error
+	)
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "agg_device_registry")
+		Expect(err).ToNot(HaveOccurred())
+		dbFile = f.Name()
+		f.Close()
+		db, err = bolt.Open(dbFile, 0600, nil)
+		Expect(err).ToNot(HaveOccurred())
+		store, err = device.NewBoltStorage(device.BoltStorageConfig{DB: db})
+		Expect(err).ToNot(HaveOccurred())
+		processed, err = device.NewBoltProcessedEvents(db)
+		Expect(err).ToNot(HaveOccurred())
+
+		rejections = &emitted{}
+		authErr = device.NewError(device.UnauthorizedError, errors.New("not allowed"))
+		registry, err = buildRegistry(defaultConfig(), &registryDeps{
+			rejections: rejections,
+			processed:  processed,
+			authorization: device.Authorization(device.AuthorizerFunc(
+				func(event *model.Event) error {
+					return authErr
+				},
+			)),
+		})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.Remove(dbFile)
+	})
+
+	// newEvent returns an insert-event for a new Device
+	newEvent := func() *model.Event {
+		deviceID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		data, err := json.Marshal(map[string]interface{}{
+			"deviceID": deviceID.String(),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		eventUUID, err := uuuid.NewV4()
+		Expect(err).ToNot(HaveOccurred())
+		return &model.Event{
+			AggregateID: device.AggregateID,
+			EventAction: "insert",
+			Data:        data,
+			UUID:        eventUUID,
+		}
+	}
+
+	It("should compensate rejections of middleware once", func() {
+		event := newEvent()
+		kr := registry.Handle(store, event)
+		Expect(kr.ErrorCode).To(Equal(int16(device.UnauthorizedError)))
+		Expect(rejections.events).To(HaveLen(1))
+		rejected := &device.RejectedCommand{}
+		err := json.Unmarshal(rejections.events[0].Data, rejected)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rejected.EventUUID).To(Equal(event.UUID))
+		Expect(rejected.ErrorCode).To(Equal(int16(device.UnauthorizedError)))
+
+		// Redelivered events reuse their response
+		Expect(registry.Handle(store, event)).To(Equal(kr))
+		Expect(rejections.events).To(HaveLen(1))
+	})
+
+	It("should compensate retried events at most once", func() {
+		event := newEvent()
+		authErr = device.NewError(device.DatabaseError, errors.New("lookup failed"))
+		kr := registry.Handle(store, event)
+		Expect(kr.ErrorCode).To(Equal(int16(device.DatabaseError)))
+		kr = registry.Handle(store, event)
+		Expect(kr.ErrorCode).To(Equal(int16(device.DatabaseError)))
+		Expect(rejections.events).To(BeEmpty())
+
+		authErr = device.NewError(device.InternalError, errors.New("failed"))
+		kr = registry.Handle(store, event)
+		Expect(kr.ErrorCode).To(Equal(int16(device.InternalError)))
+		Expect(rejections.events).To(HaveLen(1))
+
+		authErr = nil
+		Expect(registry.Handle(store, event)).To(Equal(kr))
+		Expect(rejections.events).To(HaveLen(1))
+	})
+
+	It("should handle dry-runs again without recording them", func() {
+		event := newEvent()
+		dryRun, err := device.DryRunEvent(event)
+		Expect(err).ToNot(HaveOccurred())
+		dryRun.UUID = event.UUID
+
+		kr := registry.Handle(store, dryRun)
+		Expect(kr.ErrorCode).To(Equal(int16(device.UnauthorizedError)))
+		authErr = nil
+		kr = registry.Handle(store, dryRun)
+		Expect(kr.Error).To(BeEmpty())
+		recorded, err := processed.Response(event.UUID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(recorded).To(BeNil())
+		Expect(rejections.events).To(BeEmpty())
+
+		// The command is handled once persisted, with the same UUID
+		kr = registry.Handle(store, event)
+		Expect(kr.Error).To(BeEmpty())
+		count, err := store.Count(map[string]interface{}{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(int64(1)))
+		Expect(registry.Handle(store, event)).To(Equal(kr))
+	})
+})
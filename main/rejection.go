@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/go-kafkautils/kafka"
+	"github.com/pkg/errors"
+)
+
+// kafkaEmitter produces events on the EventStore's event-topic.
+type kafkaEmitter struct {
+	topic    string
+	producer *kafka.Producer
+}
+
+// newRejectionEmitter creates the EventEmitter for rejection-events.
+// Nil is returned if emitting rejection-events is disabled.
+func newRejectionEmitter(cfg *KafkaConfig) (device.EventEmitter, error) {
+	if !cfg.EmitRejections {
+		return nil, nil
+	}
+	producer, err := kafka.NewProducer(&kafka.ProducerConfig{
+		KafkaBrokers: cfg.Brokers,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error creating rejection-event Producer")
+		return nil, err
+	}
+	go func() {
+		for err := range producer.Errors() {
+			err := errors.Wrap(err, "Error producing rejection-event")
+			log.Println(err)
+		}
+	}()
+	return &kafkaEmitter{
+		topic:    cfg.ProducerEventTopic,
+		producer: producer,
+	}, nil
+}
+
+// Emit produces the JSON-marshalled event on the event-topic.
+func (e *kafkaEmitter) Emit(event *model.Event) error {
+	msg, err := json.Marshal(event)
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling event")
+		return err
+	}
+	e.producer.Input() <- kafka.CreateMessage(e.topic, msg)
+	return nil
+}
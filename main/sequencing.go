@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+func validateSequencing(cfg *SequencingConfig) configErrors {
+	errs := configErrors{}
+	if !cfg.Enabled {
+		return errs
+	}
+	errs.required(cfg.ConsumerGroup != "", "sequencing.consumerGroup")
+	if cfg.TimeoutMS == 0 {
+		errs = append(errs, "sequencing.timeoutMS must be greater than 0")
+	}
+	return errs
+}
+
+// newVersionStore creates the VersionStore recording the applied event-version
+// in db for the "bolt" storage backend, or in the Aggregate-meta collection
+// otherwise. Nil is returned if sequencing is disabled.
+func newVersionStore(
+	cfg *Config, aggCollection *mongo.Collection, db *bolt.DB,
+) (device.VersionStore, error) {
+	if !cfg.Sequencing.Enabled {
+		return nil, nil
+	}
+	var versions device.VersionStore
+	var err error
+	if db != nil {
+		versions, err = device.NewBoltVersionStore(db)
+	} else {
+		versions, err = device.NewMongoVersionStore(aggCollection, cfg.Mongo.MetaCollection)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "Error creating VersionStore")
+		return nil, err
+	}
+	return versions, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"time"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+func validateSnapshots(cfg *Config) configErrors {
+	errs := configErrors{}
+	if !cfg.Snapshots.Enabled {
+		return errs
+	}
+	if cfg.Snapshots.EveryEvents == 0 && cfg.Snapshots.IntervalMS == 0 {
+		errs = append(errs, "snapshots.everyEvents or snapshots.intervalMS is required")
+	}
+	errs.required(cfg.Snapshots.ConsumerGroup != "", "snapshots.consumerGroup")
+	if cfg.Snapshots.TimeoutMS == 0 {
+		errs = append(errs, "snapshots.timeoutMS must be greater than 0")
+	}
+	if cfg.Storage.Backend == mongoStorage {
+		errs.required(cfg.Mongo.SnapshotCollection != "", "mongo.snapshotCollection")
+	}
+	return errs
+}
+
+// snapshotPolicy returns the SnapshotPolicy as per SnapshotsConfig.
+func snapshotPolicy(cfg *SnapshotsConfig) device.SnapshotPolicy {
+	return device.SnapshotPolicy{
+		EveryEvents: int64(cfg.EveryEvents),
+		Interval:    time.Duration(cfg.IntervalMS) * time.Millisecond,
+	}
+}
+
+// newSnapshotStore creates the SnapshotStore in db for the "bolt" storage
+// backend, or in the snapshot collection otherwise.
+// Nil is returned if snapshots are disabled.
+func newSnapshotStore(
+	cfg *Config, conn *mongo.ConnectionConfig, db *bolt.DB,
+) (device.SnapshotStore, error) {
+	if !cfg.Snapshots.Enabled {
+		return nil, nil
+	}
+	if db != nil {
+		return device.NewBoltSnapshotStore(db)
+	}
+
+	c := &mongo.Collection{
+		Connection:   conn,
+		Database:     cfg.Mongo.Database,
+		Name:         cfg.Mongo.SnapshotCollection,
+		SchemaStruct: &device.SnapshotChunk{},
+		Indexes: []mongo.IndexConfig{
+			mongo.IndexConfig{
+				ColumnConfig: []mongo.IndexColumnConfig{
+					mongo.IndexColumnConfig{Name: "version", IsDescending: true},
+					mongo.IndexColumnConfig{Name: "chunk"},
+				},
+				IsUnique: true,
+				Name:     "version_chunk_index",
+			},
+		},
+	}
+	collection, err := mongo.EnsureCollection(c)
+	if err != nil {
+		err = errors.Wrap(err, "Error creating Snapshot MongoCollection")
+		return nil, err
+	}
+	return device.NewMongoSnapshotStore(collection)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// setupState prints the JSON DeviceState of a Device as of an event-version
+// and/or a time, reconstructed by replaying events.
+func setupState(fs *flag.FlagSet) func(*Config) error {
+	id := fs.String("device-id", "", "DeviceID of the Device to reconstruct")
+	version := fs.String("version", "", "Event-version to reconstruct the Device as of")
+	at := fs.String("at", "", "RFC3339 time to reconstruct the Device as of")
+	group := fs.String(
+		"consumer-group", "agg.device.cmd.state.1",
+		"Consumer-group for esquery-responses",
+	)
+	timeoutMS := fs.Int("timeout-ms", 30000, "Timeout for fetching events, in ms")
+
+	return func(cfg *Config) error {
+		err := requireSharedTenancy(cfg, "reconstruct Devices")
+		if err != nil {
+			return err
+		}
+		deviceID, err := uuuid.FromString(*id)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing -device-id")
+			return err
+		}
+		pointInTime, err := device.ParsePointInTime(*version, *at)
+		if err != nil {
+			return err
+		}
+		query, err := newESQuery(
+			&cfg.Kafka, *group, device.AggregateID,
+			time.Duration(*timeoutMS)*time.Millisecond,
+		)
+		if err != nil {
+			err = errors.Wrap(err, "Error creating Device EventStore-query")
+			return err
+		}
+
+		state, err := device.StateAt(query, deviceID, pointInTime)
+		if err != nil {
+			err = errors.Wrap(err, "Error reconstructing Device")
+			return err
+		}
+		if state == nil {
+			return errors.Errorf("device %s not found", deviceID)
+		}
+		out, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			err = errors.Wrap(err, "Error marshalling DeviceState")
+			return err
+		}
+		_, err = os.Stdout.Write(append(out, '\n'))
+		return err
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Storage backends for Devices.
+const (
+	// mongoStorage stores Devices in the MongoDB Aggregate collection.
+	mongoStorage = "mongo"
+	// boltStorage stores Devices in an embedded BoltDB file.
+	boltStorage = "bolt"
+)
+
+// boltOpenTimeout is how long to wait for the lock on the BoltDB file,
+// which is held while any other process has the file open.
+const boltOpenTimeout = 5 * time.Second
+
+func validateStorage(cfg *Config) configErrors {
+	errs := configErrors{}
+	switch cfg.Storage.Backend {
+	case mongoStorage:
+	case boltStorage:
+		errs.required(cfg.Storage.BoltPath != "", "storage.boltPath")
+		if cfg.Tenancy.Enabled && cfg.Tenancy.Routing != noTenantRouting {
+			errs = append(errs, fmt.Sprintf(
+				"tenancy.routing must be %q for %q storage", noTenantRouting, boltStorage,
+			))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf(
+			"storage.backend must be %q or %q", mongoStorage, boltStorage,
+		))
+	}
+	return errs
+}
+
+// requiresMongo checks if MongoDB is used, which is always the case for the
+// "mongo" storage backend, and otherwise only if Items or user-roles are
+// looked up in MongoDB.
+func (c *Config) requiresMongo() bool {
+	return c.Storage.Backend != boltStorage ||
+		c.Items.Lookup == mongoItemLookup ||
+		(c.Auth.Enabled && c.Auth.Roles == mongoRoles)
+}
+
+// openBolt opens the BoltDB file of the "bolt" storage backend,
+// or returns nil for other backends.
+func openBolt(cfg *StorageConfig) (*bolt.DB, error) {
+	if cfg.Backend != boltStorage {
+		return nil, nil
+	}
+	db, err := bolt.Open(cfg.BoltPath, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		err = errors.Wrapf(err, "Error opening BoltDB file %s", cfg.BoltPath)
+		return nil, err
+	}
+	return db, nil
+}
+
+// closeBolt closes db, if the "bolt" storage backend is used.
+func closeBolt(db *bolt.DB) {
+	if db == nil {
+		return
+	}
+	err := db.Close()
+	if err != nil {
+		err = errors.Wrap(err, "Error closing BoltDB file")
+		log.Println(err)
+	}
+}
+
+// newStorage creates the Device Storage, and the ProcessedEvents for idempotent
+// event-handling. These are stored in db for the "bolt" storage backend,
+// and in MongoDB collections otherwise.
+func newStorage(
+	cfg *Config,
+	conn *mongo.ConnectionConfig,
+	aggCollection *mongo.Collection,
+	db *bolt.DB,
+) (device.Storage, device.ProcessedEvents, error) {
+	if db != nil {
+		store, err := device.NewBoltStorage(device.BoltStorageConfig{
+			DB:                db,
+			UniqueConstraints: uniqueConstraints(cfg.Mongo.Unique),
+		})
+		if err != nil {
+			err = errors.Wrap(err, "Error creating Device Storage")
+			return nil, nil, err
+		}
+		processed, err := device.NewBoltProcessedEvents(db)
+		if err != nil {
+			err = errors.Wrap(err, "Error creating ProcessedEvents")
+			return nil, nil, err
+		}
+		return store, processed, nil
+	}
+
+	assignmentCollection, err := createAssignmentCollection(conn, &cfg.Mongo)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := device.NewMongoStorage(device.MongoStorageConfig{
+		AggCollection:        aggCollection,
+		AssignmentCollection: assignmentCollection,
+		UniqueConstraints:    uniqueConstraints(cfg.Mongo.Unique),
+		EnableTransactions:   cfg.Mongo.Transactions,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error creating Device Storage")
+		return nil, nil, err
+	}
+	processed, err := newProcessedEvents(conn, &cfg.Mongo)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, processed, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-mongoutils/mongo"
+	"github.com/pkg/errors"
+)
+
+const (
+	noTenantRouting         = "none"
+	collectionTenantRouting = "collection"
+	databaseTenantRouting   = "database"
+)
+
+// tenantIndex indexes Devices by tenant, since all filters include tenantID.
+var tenantIndex = IndexConfig{Name: "tenantID_index", Keys: []string{"tenantID"}}
+
+// tenantDeviceIDIndex replaces deviceIDIndex when tenancy is enabled, so DeviceIDs
+// are unique per tenant, rather than leaking across tenants in shared collections.
+var tenantDeviceIDIndex = mongo.IndexConfig{
+	ColumnConfig: []mongo.IndexColumnConfig{
+		mongo.IndexColumnConfig{
+			Name: "tenantID",
+		},
+		mongo.IndexColumnConfig{
+			Name: "deviceID",
+		},
+	},
+	IsUnique: true,
+	Name:     deviceIDIndex.Name,
+}
+
+// validateTenancy checks the TenancyConfig, which is only used if tenancy is enabled.
+// The admin-API only reads the Aggregate collection, so it is not served
+// if tenants are routed to other collections.
+func validateTenancy(cfg *TenancyConfig, adminAddr string) configErrors {
+	errs := configErrors{}
+	switch cfg.Routing {
+	case noTenantRouting, collectionTenantRouting, databaseTenantRouting:
+	default:
+		errs = append(errs, fmt.Sprintf(
+			"tenancy.routing must be %q, %q or %q",
+			noTenantRouting, collectionTenantRouting, databaseTenantRouting,
+		))
+	}
+	if cfg.Routing != noTenantRouting && adminAddr != "" {
+		errs = append(errs, fmt.Sprintf(
+			"admin.addr cannot be set unless tenancy.routing is %q", noTenantRouting,
+		))
+	}
+	if cfg.DefaultTenant != "" {
+		err := device.ValidateTenantID(cfg.DefaultTenant)
+		if err != nil {
+			errs = append(errs, "tenancy.defaultTenant: "+err.Error())
+		}
+	}
+	return errs
+}
+
+// applyTenancy scopes unique constraints and DeviceIDs to tenants, by prefixing
+// their fields with tenantID, and indexes Devices by tenantID.
+func applyTenancy(cfg *MongoConfig) {
+	cfg.tenantScoped = true
+	uniques := []UniqueConfig{}
+	for _, uc := range cfg.Unique {
+		if len(uc.Fields) == 0 || uc.Fields[0] != "tenantID" {
+			uc.Fields = append([]string{"tenantID"}, uc.Fields...)
+		}
+		uniques = append(uniques, uc)
+	}
+	cfg.Unique = uniques
+
+	for _, ic := range cfg.Indexes {
+		if ic.Name == tenantIndex.Name {
+			return
+		}
+	}
+	cfg.Indexes = append(cfg.Indexes, tenantIndex)
+}
+
+// requireSharedTenancy returns an error if tenants are routed to other
+// collections or databases, for commands that only read the Aggregate collection
+// or replay events of all tenants together.
+func requireSharedTenancy(cfg *Config, command string) error {
+	if cfg.Tenancy.Enabled && cfg.Tenancy.Routing != noTenantRouting {
+		return errors.Errorf("tenancy.routing must be %q to %s", noTenantRouting, command)
+	}
+	return nil
+}
+
+// tenantStores creates and caches the Storage of each tenant,
+// for tenants stored in separate collections or databases.
+type tenantStores struct {
+	cfg  *MongoConfig
+	conn *mongo.ConnectionConfig
+	// routing is either collectionTenantRouting or databaseTenantRouting.
+	routing string
+
+	lock   sync.Mutex
+	stores map[string]device.Storage
+}
+
+// newTenantRouter creates the TenantRouter for the routing in cfg,
+// or nil if all tenants share the Aggregate collection.
+func newTenantRouter(cfg *Config, conn *mongo.ConnectionConfig) device.TenantRouter {
+	if cfg.Tenancy.Routing == noTenantRouting {
+		return nil
+	}
+	t := &tenantStores{
+		cfg:     &cfg.Mongo,
+		conn:    conn,
+		routing: cfg.Tenancy.Routing,
+		stores:  map[string]device.Storage{},
+	}
+	return t.route
+}
+
+// route returns the tenant's Storage, creating its collections
+// and indexes when the tenant is first seen.
+func (t *tenantStores) route(tenantID string) (device.Storage, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if store, exists := t.stores[tenantID]; exists {
+		return store, nil
+	}
+
+	tc := *t.cfg
+	if t.routing == databaseTenantRouting {
+		tc.Database += "_" + tenantID
+	} else {
+		tc.AggCollection += "_" + tenantID
+		tc.AssignmentCollection += "_" + tenantID
+	}
+
+	aggCollection, err := createMongoCollection(
+		t.conn, tc.Database, tc.AggCollection, aggIndexConfigs(&tc),
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = createUniqueIndexes(t.conn, tc.Database, tc.AggCollection, tc.Unique)
+	if err != nil {
+		return nil, err
+	}
+	assignmentCollection, err := createAssignmentCollection(t.conn, &tc)
+	if err != nil {
+		return nil, err
+	}
+	store, err := device.NewMongoStorage(device.MongoStorageConfig{
+		AggCollection:        aggCollection,
+		AssignmentCollection: assignmentCollection,
+		UniqueConstraints:    uniqueConstraints(tc.Unique),
+		EnableTransactions:   tc.Transactions,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error creating tenant Storage")
+		return nil, err
+	}
+	t.stores[tenantID] = store
+	return store, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/Shopify/sarama"
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/TerrexTech/go-eventstore-models/model"
+	"github.com/TerrexTech/go-kafkautils/kafka"
+	"github.com/pkg/errors"
+)
+
+func validateValidation(cfg *Config) configErrors {
+	errs := configErrors{}
+	if !cfg.Validation.Enabled {
+		return errs
+	}
+	errs.required(cfg.Validation.ConsumerGroup != "", "validation.consumerGroup")
+	errs.required(cfg.Validation.CommandTopic != "", "validation.commandTopic")
+	errs.required(cfg.Kafka.ProducerEventTopic != "", "kafka.producerEventTopic")
+	return errs
+}
+
+// runValidation consumes command-requests, and validates them using registry
+// and store. Accepted commands are forwarded to the EventStore, and rejected
+// commands are answered with their rejection on the response-topic.
+func runValidation(cfg *Config, registry *device.Registry, store device.Storage) {
+	producer, err := kafka.NewProducer(&kafka.ProducerConfig{
+		KafkaBrokers: cfg.Kafka.Brokers,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error creating command-validation Producer")
+		log.Println(err)
+		return
+	}
+	defer producer.Close()
+	go func() {
+		for err := range producer.Errors() {
+			err := errors.Wrap(err, "Error producing validated command")
+			log.Println(err)
+		}
+	}()
+
+	consumer, err := kafka.NewConsumer(&kafka.ConsumerConfig{
+		KafkaBrokers: cfg.Kafka.Brokers,
+		GroupName:    cfg.Validation.ConsumerGroup,
+		Topics:       []string{cfg.Validation.CommandTopic},
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error creating command-request Consumer")
+		log.Println(err)
+		return
+	}
+	defer consumer.Close()
+
+	log.Printf("Validating commands from topic %s", cfg.Validation.CommandTopic)
+	err = consumer.Consume(context.Background(), &commandValidator{
+		registry:      registry,
+		store:         store,
+		producer:      producer,
+		eventTopic:    cfg.Kafka.ProducerEventTopic,
+		responseTopic: cfg.Kafka.ProducerResponseTopic,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error consuming command-requests")
+		log.Println(err)
+	}
+}
+
+// commandValidator handles command-requests, forwarding accepted commands
+// to the EventStore's event-topic.
+type commandValidator struct {
+	registry *device.Registry
+	store    device.Storage
+	producer *kafka.Producer
+
+	eventTopic    string
+	responseTopic string
+}
+
+func (*commandValidator) Setup(sarama.ConsumerGroupSession) error {
+	log.Println("Initializing command-request Consumer")
+	return nil
+}
+
+func (*commandValidator) Cleanup(sarama.ConsumerGroupSession) error {
+	log.Println("Closing command-request Consumer")
+	return nil
+}
+
+func (v *commandValidator) ConsumeClaim(
+	session sarama.ConsumerGroupSession,
+	claim sarama.ConsumerGroupClaim,
+) error {
+	for msg := range claim.Messages() {
+		err := v.validate(msg.Value)
+		if err != nil {
+			log.Println(err)
+		}
+		session.MarkMessage(msg, "")
+	}
+	return nil
+}
+
+// validate forwards the command if accepted, or produces its rejection.
+func (v *commandValidator) validate(msg []byte) error {
+	event := &model.Event{}
+	err := json.Unmarshal(msg, event)
+	if err != nil {
+		err = errors.Wrap(err, "Error unmarshalling command-request")
+		return err
+	}
+	if event.AggregateID != device.AggregateID {
+		return errors.Errorf(
+			"Ignored command %s for AggregateID %d", event.UUID, event.AggregateID,
+		)
+	}
+
+	rejection := device.ValidateCommand(v.registry, v.store, event)
+	if rejection == nil {
+		v.producer.Input() <- kafka.CreateMessage(v.eventTopic, msg)
+		return nil
+	}
+
+	resp, err := json.Marshal(rejection)
+	if err != nil {
+		err = errors.Wrap(err, "Error marshalling command-rejection")
+		return err
+	}
+	v.producer.Input() <- kafka.CreateMessage(v.responseTopic, resp)
+	log.Printf("Rejected command %s: %s", event.UUID, rejection.Error)
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/TerrexTech/agg-device-cmd/device"
+	"github.com/pkg/errors"
+)
+
+// setupVerify compares the Aggregate collection with the Devices rebuilt from
+// all events, and prints a JSON drift-report. Drift is an error, unless it is
+// repaired.
+func setupVerify(fs *flag.FlagSet) func(*Config) error {
+	repair := fs.Bool("repair", false, "Change stored Devices to match the rebuilt Devices")
+	group := fs.String(
+		"consumer-group", "agg.device.cmd.verify.1",
+		"Consumer-group for esquery-responses",
+	)
+	timeoutMS := fs.Int("timeout-ms", 30000, "Timeout for fetching events, in ms")
+
+	return func(cfg *Config) error {
+		err := requireSharedTenancy(cfg, "verify Devices")
+		if err != nil {
+			return err
+		}
+		db, err := openBolt(&cfg.Storage)
+		if err != nil {
+			return err
+		}
+		defer closeBolt(db)
+		store, err := newArchiveStorage(cfg, db)
+		if err != nil {
+			return err
+		}
+		query, err := newESQuery(
+			&cfg.Kafka, *group, device.AggregateID,
+			time.Duration(*timeoutMS)*time.Millisecond,
+		)
+		if err != nil {
+			err = errors.Wrap(err, "Error creating Device EventStore-query")
+			return err
+		}
+
+		stored := []*device.Device{}
+		err = store.Each(map[string]interface{}{}, func(d *device.Device) error {
+			stored = append(stored, d)
+			return nil
+		})
+		if err != nil {
+			err = errors.Wrap(err, "Error reading stored Devices")
+			return err
+		}
+		report, err := device.Verify(stored, query)
+		if err != nil {
+			err = errors.Wrap(err, "Error verifying Devices")
+			return err
+		}
+
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			err = errors.Wrap(err, "Error marshalling drift-report")
+			return err
+		}
+		_, err = os.Stdout.Write(append(out, '\n'))
+		if err != nil {
+			return err
+		}
+
+		if !report.HasDrift() {
+			return nil
+		}
+		if !*repair {
+			return errors.Errorf(
+				"found %d missing, %d extra and %d mismatched Devices",
+				len(report.Missing), len(report.Extra), len(report.Mismatched),
+			)
+		}
+		// Incomplete history, such as from missing year-buckets,
+		// would delete or revert Devices changed by the missing events
+		if !report.IsComplete() {
+			return errors.Errorf(
+				"refusing to repair Devices: fetched events start at version %d, not 1",
+				report.FirstVersion,
+			)
+		}
+		err = device.Repair(store, report)
+		if err != nil {
+			err = errors.Wrap(err, "Error repairing Devices")
+			return err
+		}
+		log.Printf(
+			"Repaired %d missing, %d extra and %d mismatched Devices",
+			len(report.Missing), len(report.Extra), len(report.Mismatched),
+		)
+		return nil
+	}
+}